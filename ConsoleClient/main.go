@@ -58,6 +58,9 @@ func main() {
 	var interfaceName string
 	flag.StringVar(&interfaceName, "listenInterface", "", "bind local proxies to specified interface")
 
+	var dataStoreCommand string
+	flag.StringVar(&dataStoreCommand, "datastore", "", "run datastore command -- check, compact, or export -- and exit")
+
 	var versionDetails bool
 	flag.BoolVar(&versionDetails, "version", false, "print build information and exit")
 	flag.BoolVar(&versionDetails, "v", false, "print build information and exit")
@@ -228,6 +231,18 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	// Handle optional datastore command parameter. Datastore commands operate
+	// on the datastore file and must run before the datastore is opened.
+
+	if dataStoreCommand != "" {
+		err := runDataStoreCommand(config, dataStoreCommand)
+		if err != nil {
+			psiphon.NoticeError("error running datastore command: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize data store
 
 	err = psiphon.OpenDataStore(config)
@@ -360,3 +375,39 @@ func (p *tunProvider) GetPrimaryDnsServer() string {
 func (p *tunProvider) GetSecondaryDnsServer() string {
 	return p.secondaryDNS
 }
+
+// runDataStoreCommand runs the specified datastore maintenance command. The
+// check command runs consistency checks, without recovering a corrupt
+// datastore; the compact command rewrites the datastore file to reclaim
+// unused space; and the export command writes the datastore contents, as
+// JSON, to stdout.
+func runDataStoreCommand(config *psiphon.Config, command string) error {
+
+	switch command {
+
+	case "check":
+		err := psiphon.CheckDataStore(config)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("datastore check passed\n")
+
+	case "compact":
+		originalSize, compactedSize, err := psiphon.CompactDataStore(config)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("datastore compacted from %d to %d bytes\n", originalSize, compactedSize)
+
+	case "export":
+		err := psiphon.ExportDataStore(config, os.Stdout)
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown datastore command: %s", command)
+	}
+
+	return nil
+}
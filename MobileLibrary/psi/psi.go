@@ -213,6 +213,22 @@ func SetDynamicConfig(newSponsorID, newAuthorizationsList string) {
 	}
 }
 
+// SetEgressRegion changes the egress region set in the config passed to
+// Start, without stopping the Controller. Active tunnels are closed and
+// tunnels are established in the new region. SetEgressRegion has no effect
+// if no Controller is started.
+func SetEgressRegion(newEgressRegion string) error {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		return controller.SetEgressRegion(newEgressRegion)
+	}
+
+	return nil
+}
+
 // Encrypt and upload feedback.
 func SendFeedback(configJson, diagnosticsJson, b64EncodedPublicKey, uploadServer, uploadPath, uploadServerHeaders string) error {
 	return psiphon.SendFeedback(configJson, diagnosticsJson, b64EncodedPublicKey, uploadServer, uploadPath, uploadServerHeaders)
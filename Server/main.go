@@ -44,6 +44,7 @@ func main() {
 
 	var configFilename string
 	var generateServerIPaddress string
+	var generateServerIPv6address string
 	var generateServerNetworkInterface string
 	var generateProtocolPorts stringListFlag
 	var generateWebServerPort int
@@ -65,11 +66,17 @@ func main() {
 		server.DEFAULT_SERVER_IP_ADDRESS,
 		"generate with this server `IP address`")
 
+	flag.StringVar(
+		&generateServerIPv6address,
+		"ipv6address",
+		"",
+		"generate with this additional server `IPv6 address`")
+
 	flag.StringVar(
 		&generateServerNetworkInterface,
 		"interface",
 		"",
-		"generate with server IP address from this `network-interface`")
+		"generate with server IP addresses from this `network-interface`")
 
 	flag.Var(
 		&generateProtocolPorts,
@@ -131,18 +138,35 @@ func main() {
 	} else if args[0] == "generate" {
 
 		serverIPaddress := generateServerIPaddress
+		serverIPv6address := generateServerIPv6address
 
 		if generateServerNetworkInterface != "" {
-			// TODO: IPv6 support
-			serverIPv4Address, _, err := common.GetInterfaceIPAddresses(generateServerNetworkInterface)
-			if err == nil && serverIPv4Address == nil {
-				err = fmt.Errorf("no IPv4 address for interface %s", generateServerNetworkInterface)
+
+			// When the interface has both IPv4 and IPv6 addresses, the IPv4
+			// address is the primary server IP address and the IPv6 address
+			// is the additional server IPv6 address. When the interface has
+			// only an IPv6 address, it's used as the primary address. A
+			// link-local IPv6 address is not usable as a server address.
+
+			serverIPv4Address, serverIPv6Address, err := common.GetInterfaceIPAddresses(generateServerNetworkInterface)
+			if serverIPv6Address != nil && !serverIPv6Address.IsGlobalUnicast() {
+				serverIPv6Address = nil
+			}
+			if err == nil && serverIPv4Address == nil && serverIPv6Address == nil {
+				err = fmt.Errorf("no IP address for interface %s", generateServerNetworkInterface)
 			}
 			if err != nil {
 				fmt.Printf("generate failed: %s\n", err)
 				os.Exit(1)
 			}
-			serverIPaddress = serverIPv4Address.String()
+			if serverIPv4Address != nil {
+				serverIPaddress = serverIPv4Address.String()
+				if serverIPv6Address != nil {
+					serverIPv6address = serverIPv6Address.String()
+				}
+			} else {
+				serverIPaddress = serverIPv6Address.String()
+			}
 		}
 
 		tunnelProtocolPorts := make(map[string]int)
@@ -171,6 +195,7 @@ func main() {
 				&server.GenerateConfigParams{
 					LogFilename:                generateLogFilename,
 					ServerIPAddress:            serverIPaddress,
+					ServerIPv6Address:          serverIPv6address,
 					EnableSSHAPIRequests:       true,
 					WebServerPort:              generateWebServerPort,
 					TunnelProtocolPorts:        tunnelProtocolPorts,
@@ -224,33 +249,40 @@ func main() {
 
 		loadedConfigJSON = configJSON
 
-		// The initial call to panicwrap.Wrap will spawn a child process
-		// running the same program.
+		// Unhandled panic wrapper. Each call to panicwrap.Wrap spawns a
+		// child process running the same program, waits for the child to
+		// terminate, and panicHandler logs any panics from the child.
 		//
-		// The parent process waits for the child to terminate and
-		// panicHandler logs any panics from the child.
+		// The parent process runs the listener hand-off supervisor, which
+		// calls panicwrap.Wrap for the initial child and for each new
+		// child started by a listener hand-off, so that each child is
+		// wrapped and receives forwarded signals.
 		//
-		// The child will return immediately from Wrap without spawning
-		// and fall through to server.RunServices.
-
-		// Unhandled panic wrapper. Logs it, then re-executes the current executable
-		exitStatus, err := panicwrap.Wrap(&panicwrap.WrapConfig{
-			Handler:        panicHandler,
-			ForwardSignals: []os.Signal{os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTSTP, syscall.SIGCONT},
-		})
-		if err != nil {
-			fmt.Printf("failed to set up the panic wrapper: %s\n", err)
-			os.Exit(1)
-		}
-
 		// Note: panicwrap.Wrap documentation states that exitStatus == -1
 		// should be used to determine whether the process is the child.
 		// However, we have found that this exitStatus is returned even when
 		// the process is the parent. Likely due to panicwrap returning
 		// syscall.WaitStatus.ExitStatus() as the exitStatus, which _can_ be
-		// -1. Checking panicwrap.Wrapped(nil) is more reliable.
+		// -1. Checking panicwrap.Wrapped is more reliable.
+
+		newWrapConfig := func() *panicwrap.WrapConfig {
+			return &panicwrap.WrapConfig{
+				Handler:        panicHandler,
+				ForwardSignals: []os.Signal{os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGTSTP, syscall.SIGCONT},
+			}
+		}
+
+		if !panicwrap.Wrapped(newWrapConfig()) {
+
+			exitStatus, err := server.RunListenerHandoffSupervisor(
+				func() (int, error) {
+					return panicwrap.Wrap(newWrapConfig())
+				})
+			if err != nil {
+				fmt.Printf("failed to set up the panic wrapper: %s\n", err)
+				os.Exit(1)
+			}
 
-		if !panicwrap.Wrapped(nil) {
 			os.Exit(exitStatus)
 		}
 		// Else, this is the child process.
@@ -274,12 +306,15 @@ func (list *stringListFlag) Set(flagValue string) error {
 	return nil
 }
 
+// panicHandler logs a panic in a child process. panicHandler doesn't exit
+// the parent process, which may be supervising other child processes; the
+// parent exits with the exit status of the child.
 func panicHandler(output string) {
 	if len(loadedConfigJSON) > 0 {
 		config, err := server.LoadConfig([]byte(loadedConfigJSON))
 		if err != nil {
 			fmt.Printf("error parsing configuration file: %s\n%s\n", err, output)
-			os.Exit(1)
+			return
 		}
 
 		logEvent := make(map[string]string)
@@ -295,7 +330,7 @@ func panicHandler(output string) {
 			panicLog, err := rotate.NewRotatableFileWriter(config.LogFilename, 0666)
 			if err != nil {
 				fmt.Printf("unable to set panic log output: %s\n%s\n", err, output)
-				os.Exit(1)
+				return
 			}
 			defer panicLog.Close()
 
@@ -308,12 +343,9 @@ func panicHandler(output string) {
 		err = enc.Encode(logEvent)
 		if err != nil {
 			fmt.Printf("unable to serialize panic message to JSON: %s\n%s\n", err, output)
-			os.Exit(1)
+			return
 		}
 	} else {
 		fmt.Printf("no configuration JSON was loaded, cannot continue\n%s\n", output)
-		os.Exit(1)
 	}
-
-	os.Exit(1)
 }
@@ -62,3 +62,36 @@ func newUDPConn(domain int, config *DialConfig) (net.PacketConn, error) {
 
 	return conn, nil
 }
+
+// hasIPRoute returns true when the host has a route to the public internet
+// for the specified IP version. The check connects a UDP socket, which
+// performs a route lookup but sends no packets. When deviceBinder is not
+// nil, the socket is first bound with it, so that, with an active VPN, the
+// result reflects the routes available to tunnel dials.
+func hasIPRoute(IPv6 bool, deviceBinder DeviceBinder) bool {
+
+	domain := syscall.AF_INET
+	var sockAddr syscall.Sockaddr = &syscall.SockaddrInet4{
+		Port: 53, Addr: [4]byte{8, 8, 8, 8}}
+	if IPv6 {
+		domain = syscall.AF_INET6
+		sockAddrInet6 := &syscall.SockaddrInet6{Port: 53}
+		copy(sockAddrInet6.Addr[:], net.ParseIP("2001:4860:4860::8888"))
+		sockAddr = sockAddrInet6
+	}
+
+	socketFD, err := syscall.Socket(domain, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(socketFD)
+
+	if deviceBinder != nil {
+		err := bindToDeviceCallWrapper(deviceBinder, socketFD)
+		if err != nil {
+			return false
+		}
+	}
+
+	return syscall.Connect(socketFD, sockAddr) == nil
+}
@@ -43,3 +43,22 @@ func newUDPConn(domain int, config *DialConfig) (net.PacketConn, error) {
 
 	return net.ListenUDP(network, nil)
 }
+
+// hasIPRoute returns true when the host has a route to the public internet
+// for the specified IP version. The check connects a UDP socket, which
+// performs a route lookup but sends no packets. DeviceBinder is not
+// supported on this platform, so deviceBinder is ignored.
+func hasIPRoute(IPv6 bool, _ DeviceBinder) bool {
+	network := "udp4"
+	address := "8.8.8.8:53"
+	if IPv6 {
+		network = "udp6"
+		address = "[2001:4860:4860::8888]:53"
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
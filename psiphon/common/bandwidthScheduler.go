@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"container/heap"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+const (
+	BANDWIDTH_SCHEDULER_BURST_PERIOD = 100 * time.Millisecond
+)
+
+// BandwidthScheduler enforces a total bandwidth budget, in bytes per
+// second, shared by many flows. When the budget is exceeded, flows wait
+// and are served in weighted fair order: over time, each active flow
+// receives a share of the budget proportional to its weight. Bandwidth
+// not used by idle flows is shared among active flows.
+//
+// The scheduler implements self-clocked fair queueing. Each flow
+// transfer is assigned a virtual finish tag, the flow's previous finish
+// tag, or the current virtual time if later, plus the transfer size
+// divided by the flow weight. Waiting transfers are served in finish tag
+// order as the token bucket refills.
+//
+// Each direction of data transfer requires a distinct BandwidthScheduler.
+type BandwidthScheduler struct {
+	mutex           sync.Mutex
+	bytesPerSecond  float64
+	burstBytes      float64
+	tokens          float64
+	lastRefillTime  monotime.Time
+	virtualTime     float64
+	waiters         bandwidthWaiters
+	nextSequence    uint64
+	dispatchPending bool
+}
+
+// BandwidthFlow is a flow, such as a client connection, that shares a
+// BandwidthScheduler budget.
+type BandwidthFlow struct {
+	scheduler  *BandwidthScheduler
+	weight     float64
+	lastFinish float64
+}
+
+type bandwidthWaiter struct {
+	finish   float64
+	sequence uint64
+	bytes    float64
+	granted  chan struct{}
+}
+
+// NewBandwidthScheduler creates a new BandwidthScheduler with the
+// specified budget, which must be > 0.
+func NewBandwidthScheduler(bytesPerSecond int64) *BandwidthScheduler {
+
+	burstBytes := float64(bytesPerSecond) * BANDWIDTH_SCHEDULER_BURST_PERIOD.Seconds()
+
+	return &BandwidthScheduler{
+		bytesPerSecond: float64(bytesPerSecond),
+		burstBytes:     burstBytes,
+		tokens:         burstBytes,
+		lastRefillTime: monotime.Now(),
+	}
+}
+
+// NewFlow creates a new BandwidthFlow with the specified weight. Weights
+// less than 1 are treated as 1.
+func (scheduler *BandwidthScheduler) NewFlow(weight int) *BandwidthFlow {
+	flow := &BandwidthFlow{scheduler: scheduler}
+	flow.SetWeight(weight)
+	return flow
+}
+
+// SetWeight modifies the flow weight. The new weight applies to
+// subsequent transfers.
+func (flow *BandwidthFlow) SetWeight(weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	flow.scheduler.mutex.Lock()
+	flow.weight = float64(weight)
+	flow.scheduler.mutex.Unlock()
+}
+
+// Wait blocks until the flow may transfer the specified number of bytes
+// within the scheduler budget. Transfers larger than the burst size are
+// permitted, and the excess is deducted from subsequent transfers.
+func (flow *BandwidthFlow) Wait(bytes int) {
+
+	if bytes <= 0 {
+		return
+	}
+
+	scheduler := flow.scheduler
+
+	scheduler.mutex.Lock()
+
+	scheduler.refill()
+
+	start := flow.lastFinish
+	if start < scheduler.virtualTime {
+		start = scheduler.virtualTime
+	}
+	finish := start + float64(bytes)/flow.weight
+	flow.lastFinish = finish
+
+	// Fast path: no transfers are waiting and the budget is not exhausted.
+	if len(scheduler.waiters) == 0 && scheduler.tokens > 0 {
+		scheduler.tokens -= float64(bytes)
+		scheduler.virtualTime = finish
+		scheduler.mutex.Unlock()
+		return
+	}
+
+	waiter := &bandwidthWaiter{
+		finish:   finish,
+		sequence: scheduler.nextSequence,
+		bytes:    float64(bytes),
+		granted:  make(chan struct{}),
+	}
+	scheduler.nextSequence++
+
+	heap.Push(&scheduler.waiters, waiter)
+
+	if !scheduler.dispatchPending {
+		scheduler.dispatchPending = true
+		time.AfterFunc(scheduler.refillDelay(), scheduler.dispatch)
+	}
+
+	scheduler.mutex.Unlock()
+
+	<-waiter.granted
+}
+
+// refill adds tokens for the time elapsed since the previous refill. The
+// caller must hold the scheduler mutex.
+func (scheduler *BandwidthScheduler) refill() {
+	now := monotime.Now()
+	scheduler.tokens += now.Sub(scheduler.lastRefillTime).Seconds() * scheduler.bytesPerSecond
+	if scheduler.tokens > scheduler.burstBytes {
+		scheduler.tokens = scheduler.burstBytes
+	}
+	scheduler.lastRefillTime = now
+}
+
+// refillDelay returns the time until the token bucket is no longer
+// exhausted. The caller must hold the scheduler mutex.
+func (scheduler *BandwidthScheduler) refillDelay() time.Duration {
+	if scheduler.tokens > 0 {
+		return 0
+	}
+	return time.Duration(
+		(1 - scheduler.tokens) / scheduler.bytesPerSecond * float64(time.Second))
+}
+
+// dispatch grants waiting transfers, in finish tag order, while the token
+// bucket is not exhausted, and reschedules itself while transfers remain
+// waiting.
+func (scheduler *BandwidthScheduler) dispatch() {
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.refill()
+
+	for len(scheduler.waiters) > 0 && scheduler.tokens > 0 {
+		waiter := heap.Pop(&scheduler.waiters).(*bandwidthWaiter)
+		scheduler.tokens -= waiter.bytes
+		scheduler.virtualTime = waiter.finish
+		close(waiter.granted)
+	}
+
+	if len(scheduler.waiters) > 0 {
+		time.AfterFunc(scheduler.refillDelay(), scheduler.dispatch)
+	} else {
+		scheduler.dispatchPending = false
+	}
+}
+
+// bandwidthWaiters implements heap.Interface, ordering waiters by finish
+// tag and then by arrival.
+type bandwidthWaiters []*bandwidthWaiter
+
+func (waiters bandwidthWaiters) Len() int {
+	return len(waiters)
+}
+
+func (waiters bandwidthWaiters) Less(i, j int) bool {
+	if waiters[i].finish == waiters[j].finish {
+		return waiters[i].sequence < waiters[j].sequence
+	}
+	return waiters[i].finish < waiters[j].finish
+}
+
+func (waiters bandwidthWaiters) Swap(i, j int) {
+	waiters[i], waiters[j] = waiters[j], waiters[i]
+}
+
+func (waiters *bandwidthWaiters) Push(x interface{}) {
+	*waiters = append(*waiters, x.(*bandwidthWaiter))
+}
+
+func (waiters *bandwidthWaiters) Pop() interface{} {
+	old := *waiters
+	n := len(old)
+	waiter := old[n-1]
+	old[n-1] = nil
+	*waiters = old[:n-1]
+	return waiter
+}
+
+// ScheduledConn wraps a net.Conn with BandwidthFlows that apply shared
+// BandwidthScheduler budgets to reads and writes. Either flow may be nil,
+// in which case that direction is not scheduled. As with ThrottledConn,
+// reads are scheduled after the underlying read completes, as the number
+// of bytes is not known in advance.
+type ScheduledConn struct {
+	net.Conn
+	readFlow  *BandwidthFlow
+	writeFlow *BandwidthFlow
+}
+
+// NewScheduledConn initializes a new ScheduledConn.
+func NewScheduledConn(
+	conn net.Conn, readFlow, writeFlow *BandwidthFlow) *ScheduledConn {
+
+	return &ScheduledConn{
+		Conn:      conn,
+		readFlow:  readFlow,
+		writeFlow: writeFlow,
+	}
+}
+
+func (conn *ScheduledConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 && conn.readFlow != nil {
+		conn.readFlow.Wait(n)
+	}
+	return n, err
+}
+
+func (conn *ScheduledConn) Write(buffer []byte) (int, error) {
+	if conn.writeFlow != nil {
+		conn.writeFlow.Wait(len(buffer))
+	}
+	return conn.Conn.Write(buffer)
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBandwidthScheduler(t *testing.T) {
+
+	bytesPerSecond := int64(1024 * 1024)
+	transferSize := 8192
+	testDuration := 2 * time.Second
+
+	scheduler := NewBandwidthScheduler(bytesPerSecond)
+
+	// Two flows with weight 1 and one flow with weight 2 transfer as fast as
+	// the scheduler permits. A fourth flow is idle and must not reduce the
+	// shares of the active flows.
+
+	weights := []int{1, 1, 2}
+	counts := make([]int64, len(weights))
+
+	_ = scheduler.NewFlow(1)
+
+	stopTime := time.Now().Add(testDuration)
+
+	waitGroup := new(sync.WaitGroup)
+	for i, weight := range weights {
+		waitGroup.Add(1)
+		go func(i int, flow *BandwidthFlow) {
+			defer waitGroup.Done()
+			for time.Now().Before(stopTime) {
+				flow.Wait(transferSize)
+				atomic.AddInt64(&counts[i], int64(transferSize))
+			}
+		}(i, scheduler.NewFlow(weight))
+	}
+	waitGroup.Wait()
+
+	total := counts[0] + counts[1] + counts[2]
+
+	expectedTotal := float64(bytesPerSecond) * testDuration.Seconds()
+
+	if float64(total) < 0.8*expectedTotal || float64(total) > 1.2*expectedTotal {
+		t.Fatalf("unexpected total bytes: %d", total)
+	}
+
+	checkShare := func(i int, expectedShare float64) {
+		share := float64(counts[i]) / float64(total)
+		if share < 0.8*expectedShare || share > 1.2*expectedShare {
+			t.Fatalf("unexpected share for flow %d: %f", i, share)
+		}
+	}
+
+	checkShare(0, 0.25)
+	checkShare(1, 0.25)
+	checkShare(2, 0.5)
+}
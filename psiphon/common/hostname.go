@@ -17,7 +17,7 @@
  *
  */
 
-package transferstats
+package common
 
 import (
 	"bufio"
@@ -25,19 +25,25 @@ import (
 	"net/http"
 )
 
-// getHostname attempts to determine the hostname of the server from the request data.
-func getHostname(buffer []byte) (hostname string, ok bool) {
+// ExtractHostnameFromTCPFlow attempts to determine the hostname of the
+// server from the first data sent by the client in a TCP flow: the Host
+// header of an HTTP request or the SNI of a TLS client hello. Returns ""
+// when no hostname is found.
+func ExtractHostnameFromTCPFlow(buffer []byte) string {
 	// Check if this is a HTTP request
 	bufferReader := bufio.NewReader(bytes.NewReader(buffer))
 	httpReq, httpErr := http.ReadRequest(bufferReader)
 	if httpErr == nil {
-		return httpReq.Host, true
+		return httpReq.Host
 	}
 
 	// Check if it's a TLS request
-	hostname, ok = getTLSHostname(buffer)
+	hostname, ok := getTLSHostname(buffer)
+	if !ok {
+		return ""
+	}
 
-	return
+	return hostname
 }
 
 /*
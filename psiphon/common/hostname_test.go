@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestExtractHostnameFromTCPFlow(t *testing.T) {
+
+	// Capture a TLS client hello with an SNI.
+
+	clientConn, serverConn := net.Pipe()
+
+	go func() {
+		tlsConn := tls.Client(clientConn, &tls.Config{ServerName: "example.org"})
+		tlsConn.Handshake()
+		clientConn.Close()
+	}()
+
+	clientHello := make([]byte, 16384)
+	n, err := serverConn.Read(clientHello)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	clientHello = clientHello[:n]
+	serverConn.Close()
+
+	testCases := []struct {
+		description      string
+		flow             []byte
+		expectedHostname string
+	}{
+		{"HTTP", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "example.com"},
+		{"TLS", clientHello, "example.org"},
+		{"truncated TLS", clientHello[:len(clientHello)/2], ""},
+		{"other", []byte("SSH-2.0-OpenSSH_7.4\r\n"), ""},
+		{"empty", []byte{}, ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			hostname := ExtractHostnameFromTCPFlow(testCase.flow)
+			if hostname != testCase.expectedHostname {
+				t.Fatalf("unexpected hostname: %s", hostname)
+			}
+		})
+	}
+}
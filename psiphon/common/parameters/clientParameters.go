@@ -90,6 +90,8 @@ const (
 	InitialLimitTunnelProtocolsCandidateCount  = "InitialLimitTunnelProtocolsCandidateCount"
 	LimitTunnelProtocolsProbability            = "LimitTunnelProtocolsProbability"
 	LimitTunnelProtocols                       = "LimitTunnelProtocols"
+	AdaptiveProtocolSelectionProbability       = "AdaptiveProtocolSelectionProbability"
+	AdaptiveProtocolSelectionDecay             = "AdaptiveProtocolSelectionDecay"
 	LimitTLSProfilesProbability                = "LimitTLSProfilesProbability"
 	LimitTLSProfiles                           = "LimitTLSProfiles"
 	FragmentorProbability                      = "FragmentorProbability"
@@ -100,11 +102,20 @@ const (
 	FragmentorMaxWriteBytes                    = "FragmentorMaxWriteBytes"
 	FragmentorMinDelay                         = "FragmentorMinDelay"
 	FragmentorMaxDelay                         = "FragmentorMaxDelay"
+	IPv6DialProbability                        = "IPv6DialProbability"
+	ReplayDialParametersTTL                    = "ReplayDialParametersTTL"
+	PruneServerEntryFailureThreshold           = "PruneServerEntryFailureThreshold"
+	PruneServerEntryDeadPeriod                 = "PruneServerEntryDeadPeriod"
+	PruneServerEntryStalePeriod                = "PruneServerEntryStalePeriod"
+	MaxServerEntryCount                        = "MaxServerEntryCount"
 	ObfuscatedSSHMinPadding                    = "ObfuscatedSSHMinPadding"
 	ObfuscatedSSHMaxPadding                    = "ObfuscatedSSHMaxPadding"
 	TunnelOperateShutdownTimeout               = "TunnelOperateShutdownTimeout"
 	TunnelPortForwardDialTimeout               = "TunnelPortForwardDialTimeout"
 	TunnelRateLimits                           = "TunnelRateLimits"
+	TunnelPoolDegradedFailureRate              = "TunnelPoolDegradedFailureRate"
+	TunnelPoolDegradedRTTMultiplier            = "TunnelPoolDegradedRTTMultiplier"
+	TunnelPoolFailureRateHalfLife              = "TunnelPoolFailureRateHalfLife"
 	AdditionalCustomHeaders                    = "AdditionalCustomHeaders"
 	SpeedTestPaddingMinBytes                   = "SpeedTestPaddingMinBytes"
 	SpeedTestPaddingMaxBytes                   = "SpeedTestPaddingMaxBytes"
@@ -120,6 +131,9 @@ const (
 	SSHKeepAliveProbeInactivePeriod            = "SSHKeepAliveProbeInactivePeriod"
 	HTTPProxyOriginServerTimeout               = "HTTPProxyOriginServerTimeout"
 	HTTPProxyMaxIdleConnectionsPerHost         = "HTTPProxyMaxIdleConnectionsPerHost"
+	DNSProxyRequestTimeout                     = "DNSProxyRequestTimeout"
+	DNSProxyCacheMaxEntries                    = "DNSProxyCacheMaxEntries"
+	DNSProxyCacheMaxTTL                        = "DNSProxyCacheMaxTTL"
 	FetchRemoteServerListTimeout               = "FetchRemoteServerListTimeout"
 	FetchRemoteServerListRetryPeriod           = "FetchRemoteServerListRetryPeriod"
 	FetchRemoteServerListStalePeriod           = "FetchRemoteServerListStalePeriod"
@@ -212,6 +226,18 @@ var defaultClientParameters = map[string]struct {
 	TunnelPortForwardDialTimeout:             {value: 10 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
 	TunnelRateLimits:                         {value: common.RateLimits{}},
 
+	// A tunnel in the tunnel pool is considered degraded, and new port
+	// forwards are directed to other tunnels, when its recent port forward
+	// failure rate exceeds TunnelPoolDegradedFailureRate or its SSH keep
+	// alive RTT exceeds the best RTT in the pool by a factor of
+	// TunnelPoolDegradedRTTMultiplier. The failure rate decays towards 0,
+	// halving every TunnelPoolFailureRateHalfLife, so that a degraded tunnel
+	// which receives no new port forwards recovers.
+
+	TunnelPoolDegradedFailureRate:   {value: 0.5, minimum: 0.0},
+	TunnelPoolDegradedRTTMultiplier: {value: 3.0, minimum: 1.0},
+	TunnelPoolFailureRateHalfLife:   {value: 30 * time.Second, minimum: 1 * time.Millisecond},
+
 	// PrioritizeTunnelProtocols parameters are obsoleted by InitialLimitTunnelProtocols.
 	// TODO: remove once no longer required for older clients.
 	PrioritizeTunnelProtocolsProbability:    {value: 1.0, minimum: 0.0},
@@ -225,6 +251,16 @@ var defaultClientParameters = map[string]struct {
 	LimitTunnelProtocolsProbability: {value: 1.0, minimum: 0.0},
 	LimitTunnelProtocols:            {value: protocol.TunnelProtocols{}},
 
+	// AdaptiveProtocolSelectionProbability is the probability that the
+	// best scoring tunnel protocol, based on past establishment outcomes on
+	// the current network, is selected instead of a random protocol. A
+	// value of 0 disables adaptive selection. AdaptiveProtocolSelectionDecay
+	// is the factor applied to past outcomes as each new outcome is recorded;
+	// values greater than 1.0 are treated as 1.0.
+
+	AdaptiveProtocolSelectionProbability: {value: 0.75, minimum: 0.0},
+	AdaptiveProtocolSelectionDecay:       {value: 0.9, minimum: 0.0},
+
 	LimitTLSProfilesProbability: {value: 1.0, minimum: 0.0},
 	LimitTLSProfiles:            {value: protocol.TLSProfiles{}},
 
@@ -237,6 +273,30 @@ var defaultClientParameters = map[string]struct {
 	FragmentorMinDelay:       {value: time.Duration(0), minimum: time.Duration(0)},
 	FragmentorMaxDelay:       {value: 10 * time.Millisecond, minimum: time.Duration(0)},
 
+	// IPv6DialProbability applies only when the server entry has an IPv6
+	// address and the network has both IPv4 and IPv6 routes. On IPv6-only
+	// networks, the IPv6 address is always dialed when available.
+
+	IPv6DialProbability: {value: 0.5, minimum: 0.0},
+
+	// ReplayDialParametersTTL is the time for which successful dial
+	// parameters are replayed for a server on a network. A value of 0
+	// disables replay.
+
+	ReplayDialParametersTTL: {value: 24 * time.Hour, minimum: time.Duration(0)},
+
+	// Server entries with at least PruneServerEntryFailureThreshold
+	// consecutive failures, and with no success or new source within
+	// PruneServerEntryDeadPeriod, are pruned as dead. Server entries with
+	// no success or new source within PruneServerEntryStalePeriod are
+	// pruned as stale. MaxServerEntryCount caps the number of stored server
+	// entries. For each, a value of 0 disables the corresponding pruning.
+
+	PruneServerEntryFailureThreshold: {value: 10, minimum: 0},
+	PruneServerEntryDeadPeriod:       {value: 7 * 24 * time.Hour, minimum: time.Duration(0)},
+	PruneServerEntryStalePeriod:      {value: 90 * 24 * time.Hour, minimum: time.Duration(0)},
+	MaxServerEntryCount:              {value: 5000, minimum: 0},
+
 	// The Psiphon server will reject obfuscated SSH seed messages with
 	// padding greater than OBFUSCATE_MAX_PADDING.
 	// obfuscator.NewClientObfuscator will ignore invalid min/max padding
@@ -274,6 +334,10 @@ var defaultClientParameters = map[string]struct {
 	HTTPProxyOriginServerTimeout:       {value: 15 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
 	HTTPProxyMaxIdleConnectionsPerHost: {value: 50, minimum: 0},
 
+	DNSProxyRequestTimeout:  {value: 10 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	DNSProxyCacheMaxEntries: {value: 1000, minimum: 0},
+	DNSProxyCacheMaxTTL:     {value: 1 * time.Hour, minimum: time.Duration(0)},
+
 	FetchRemoteServerListTimeout:       {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	FetchRemoteServerListRetryPeriod:   {value: 30 * time.Second, minimum: 1 * time.Millisecond},
 	FetchRemoteServerListStalePeriod:   {value: 6 * time.Hour, minimum: 1 * time.Hour},
@@ -335,6 +399,27 @@ var defaultClientParameters = map[string]struct {
 	PickUserAgentProbability:     {value: 0.5, minimum: 0.0},
 }
 
+// RegisterParameter adds a client parameter, with the specified default
+// and minimum values, to the set of dynamically configurable client
+// parameters. RegisterParameter is intended for use by registered tunnel
+// protocol transports which are not built in; see
+// protocol.RegisterTransport.
+//
+// RegisterParameter is not safe for concurrent use and must be called from
+// an init function. RegisterParameter panics if the parameter name is
+// already registered.
+func RegisterParameter(name string, defaultValue, minimum interface{}) {
+
+	if _, ok := defaultClientParameters[name]; ok {
+		panic(fmt.Sprintf("duplicate parameter: %s", name))
+	}
+
+	defaultParameter := defaultClientParameters[name]
+	defaultParameter.value = defaultValue
+	defaultParameter.minimum = minimum
+	defaultClientParameters[name] = defaultParameter
+}
+
 // ClientParameters is a set of client parameters. To use the parameters, call
 // Get. To apply new values to the parameters, call Set.
 type ClientParameters struct {
@@ -38,6 +38,8 @@ const (
 	TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH           = "QUIC-OSSH"
 	TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH     = "MARIONETTE-OSSH"
 	TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH       = "TAPDANCE-OSSH"
+	TUNNEL_PROTOCOL_FRONTED_WEBSOCKET             = "FRONTED-WEBSOCKET-OSSH"
+	TUNNEL_PROTOCOL_UNFRONTED_WEBSOCKET           = "UNFRONTED-WEBSOCKET-OSSH"
 
 	SERVER_ENTRY_SOURCE_EMBEDDED   = "EMBEDDED"
 	SERVER_ENTRY_SOURCE_REMOTE     = "REMOTE"
@@ -47,6 +49,7 @@ const (
 
 	CAPABILITY_SSH_API_REQUESTS            = "ssh-api-requests"
 	CAPABILITY_UNTUNNELED_WEB_API_REQUESTS = "handshake"
+	CAPABILITY_MULTI_HOP_RELAY             = "multihop-relay"
 
 	CLIENT_CAPABILITY_SERVER_REQUESTS = "server-requests"
 
@@ -54,6 +57,7 @@ const (
 	PSIPHON_API_CONNECTED_REQUEST_NAME = "psiphon-connected"
 	PSIPHON_API_STATUS_REQUEST_NAME    = "psiphon-status"
 	PSIPHON_API_OSL_REQUEST_NAME       = "psiphon-osl"
+	PSIPHON_API_DRAIN_REQUEST_NAME     = "psiphon-drain"
 
 	// PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME may still be used by older Android clients
 	PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME = "psiphon-client-verification"
@@ -89,22 +93,72 @@ func (t TunnelProtocols) PruneInvalid() TunnelProtocols {
 	return u
 }
 
-var SupportedTunnelProtocols = TunnelProtocols{
-	TUNNEL_PROTOCOL_SSH,
-	TUNNEL_PROTOCOL_OBFUSCATED_SSH,
-	TUNNEL_PROTOCOL_UNFRONTED_MEEK,
-	TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
-	TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET,
-	TUNNEL_PROTOCOL_FRONTED_MEEK,
-	TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP,
-	TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
-	TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH,
-	TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH,
-}
+// SupportedTunnelProtocols and DefaultDisabledTunnelProtocols are
+// populated by RegisterTransport.
+var SupportedTunnelProtocols TunnelProtocols
+
+var DefaultDisabledTunnelProtocols TunnelProtocols
+
+func init() {
+
+	RegisterTransport(Transport{
+		TunnelProtocol: TUNNEL_PROTOCOL_SSH,
+	})
+
+	RegisterTransport(Transport{
+		TunnelProtocol:    TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		UsesObfuscatedSSH: true,
+	})
 
-var DefaultDisabledTunnelProtocols = TunnelProtocols{
-	TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH,
-	TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH,
+	for _, tunnelProtocol := range []string{
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET,
+		TUNNEL_PROTOCOL_FRONTED_MEEK,
+		TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP} {
+
+		RegisterTransport(Transport{
+			TunnelProtocol:      tunnelProtocol,
+			UsesObfuscatedSSH:   true,
+			IsResourceIntensive: true,
+			SupportsTactics:     true,
+		})
+	}
+
+	for _, tunnelProtocol := range []string{
+		TUNNEL_PROTOCOL_FRONTED_WEBSOCKET,
+		TUNNEL_PROTOCOL_UNFRONTED_WEBSOCKET} {
+
+		RegisterTransport(Transport{
+			TunnelProtocol:      tunnelProtocol,
+			UsesObfuscatedSSH:   true,
+			IsResourceIntensive: true,
+		})
+	}
+
+	RegisterTransport(Transport{
+		TunnelProtocol:                  TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
+		UsesObfuscatedSSH:               true,
+		IsResourceIntensive:             true,
+		IsIncompatibleWithUpstreamProxy: true,
+	})
+
+	// TODO: Marionette UDP formats are incompatible with
+	// useUpstreamProxy, but not currently supported
+
+	RegisterTransport(Transport{
+		TunnelProtocol:      TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH,
+		UsesObfuscatedSSH:   true,
+		IsResourceIntensive: true,
+		IsDefaultDisabled:   true,
+	})
+
+	RegisterTransport(Transport{
+		TunnelProtocol:      TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH,
+		UsesObfuscatedSSH:   true,
+		IsResourceIntensive: true,
+		IsDefaultDisabled:   true,
+	})
 }
 
 var SupportedServerEntrySources = TunnelProtocols{
@@ -120,7 +174,8 @@ func TunnelProtocolUsesSSH(protocol string) bool {
 }
 
 func TunnelProtocolUsesObfuscatedSSH(protocol string) bool {
-	return protocol != TUNNEL_PROTOCOL_SSH
+	transport := GetTransport(protocol)
+	return transport != nil && transport.UsesObfuscatedSSH
 }
 
 func TunnelProtocolUsesMeek(protocol string) bool {
@@ -143,6 +198,11 @@ func TunnelProtocolUsesObfuscatedSessionTickets(protocol string) bool {
 	return protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET
 }
 
+func TunnelProtocolUsesWebSocket(protocol string) bool {
+	return protocol == TUNNEL_PROTOCOL_FRONTED_WEBSOCKET ||
+		protocol == TUNNEL_PROTOCOL_UNFRONTED_WEBSOCKET
+}
+
 func TunnelProtocolUsesQUIC(protocol string) bool {
 	return protocol == TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH
 }
@@ -156,10 +216,18 @@ func TunnelProtocolUsesTapdance(protocol string) bool {
 }
 
 func TunnelProtocolIsResourceIntensive(protocol string) bool {
-	return TunnelProtocolUsesMeek(protocol) ||
-		TunnelProtocolUsesQUIC(protocol) ||
-		TunnelProtocolUsesMarionette(protocol) ||
-		TunnelProtocolUsesTapdance(protocol)
+	transport := GetTransport(protocol)
+	return transport != nil && transport.IsResourceIntensive
+}
+
+func TunnelProtocolSupportsUpstreamProxy(protocol string) bool {
+	transport := GetTransport(protocol)
+	return transport != nil && !transport.IsIncompatibleWithUpstreamProxy
+}
+
+func TunnelProtocolSupportsTactics(protocol string) bool {
+	transport := GetTransport(protocol)
+	return transport != nil && transport.SupportsTactics
 }
 
 func UseClientTunnelProtocol(
@@ -234,6 +302,15 @@ type HandshakeResponse struct {
 	ServerTimestamp        string              `json:"server_timestamp"`
 	ActiveAuthorizationIDs []string            `json:"active_authorization_ids"`
 	TacticsPayload         json.RawMessage     `json:"tactics_payload"`
+	Quotas                 []QuotaStatus       `json:"quotas"`
+}
+
+// QuotaStatus reports the client's data transfer quota for a period and
+// the bytes remaining in the current period.
+type QuotaStatus struct {
+	Period         string `json:"period"`
+	Bytes          int64  `json:"bytes"`
+	RemainingBytes int64  `json:"remaining_bytes"`
 }
 
 type ConnectedResponse struct {
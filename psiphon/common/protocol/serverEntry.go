@@ -22,6 +22,8 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -31,6 +33,7 @@ import (
 	"strings"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ed25519"
 )
 
 // ServerEntry represents a Psiphon server. It contains information
@@ -39,6 +42,7 @@ import (
 // various sources.
 type ServerEntry struct {
 	IpAddress                     string   `json:"ipAddress"`
+	IpAddressV6                   string   `json:"ipAddressV6"`
 	WebServerPort                 string   `json:"webServerPort"` // not an int
 	WebServerSecret               string   `json:"webServerSecret"`
 	WebServerCertificate          string   `json:"webServerCertificate"`
@@ -63,8 +67,18 @@ type ServerEntry struct {
 	TacticsRequestPublicKey       string   `json:"tacticsRequestPublicKey"`
 	TacticsRequestObfuscatedKey   string   `json:"tacticsRequestObfuscatedKey"`
 	MarionetteFormat              string   `json:"marionetteFormat"`
+	WebSocketServerPort           int      `json:"webSocketServerPort"`
 	ConfigurationVersion          int      `json:"configurationVersion"`
 
+	// TransportParameters contains transport-specific fields for
+	// registered transports that are not built in, keyed by tunnel
+	// protocol. See GetServerEntryTransportParameters.
+	TransportParameters map[string]json.RawMessage `json:"transportParameters,omitempty"`
+
+	// Signature is an optional Ed25519 digital signature of the server
+	// entry. See ServerEntryFields.AddSignature.
+	Signature string `json:"signature,omitempty"`
+
 	// These local fields are not expected to be present in downloaded server
 	// entries. They are added by the client to record and report stats about
 	// how and when server entries are obtained.
@@ -96,6 +110,18 @@ func (fields ServerEntryFields) GetIPAddress() string {
 	return ipAddressStr
 }
 
+func (fields ServerEntryFields) GetIPv6Address() string {
+	ipAddressV6, ok := fields["ipAddressV6"]
+	if !ok {
+		return ""
+	}
+	ipAddressV6Str, ok := ipAddressV6.(string)
+	if !ok {
+		return ""
+	}
+	return ipAddressV6Str
+}
+
 func (fields ServerEntryFields) GetConfigurationVersion() int {
 	configurationVersion, ok := fields["configurationVersion"]
 	if !ok {
@@ -108,6 +134,18 @@ func (fields ServerEntryFields) GetConfigurationVersion() int {
 	return configurationVersionInt
 }
 
+func (fields ServerEntryFields) GetLocalSource() string {
+	localSource, ok := fields["localSource"]
+	if !ok {
+		return ""
+	}
+	localSourceStr, ok := localSource.(string)
+	if !ok {
+		return ""
+	}
+	return localSourceStr
+}
+
 func (fields ServerEntryFields) SetLocalSource(source string) {
 	fields["localSource"] = source
 }
@@ -116,6 +154,127 @@ func (fields ServerEntryFields) SetLocalTimestamp(timestamp string) {
 	fields["localTimestamp"] = timestamp
 }
 
+// NewServerEntrySignatureKeyPair generates a new Ed25519 key pair for
+// signing and verifying server entries. The keys are base64 encoded.
+func NewServerEntrySignatureKeyPair() (string, string, error) {
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", common.ContextError(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(publicKey),
+		base64.StdEncoding.EncodeToString(privateKey),
+		nil
+}
+
+// AddSignature signs the server entry fields with the specified private key
+// and adds the signature to the server entry. The public key is used to
+// check that the key pair is valid.
+//
+// The signature covers all fields, including any fields not recognized by
+// ServerEntry, except for the signature itself and the local fields added
+// by the client.
+func (fields ServerEntryFields) AddSignature(publicKey, privateKey string) error {
+
+	decodedPublicKey, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	decodedPrivateKey, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if len(decodedPrivateKey) != ed25519.PrivateKeySize ||
+		!bytes.Equal(
+			decodedPrivateKey[ed25519.PrivateKeySize-ed25519.PublicKeySize:],
+			decodedPublicKey) {
+
+		return common.ContextError(errors.New("invalid key pair"))
+	}
+
+	message, err := fields.getSignatureMessage()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	signature := ed25519.Sign(decodedPrivateKey, message)
+
+	fields["signature"] = base64.StdEncoding.EncodeToString(signature)
+
+	return nil
+}
+
+// VerifySignature checks that the server entry has a valid signature made
+// with the private key corresponding to the specified public key.
+func (fields ServerEntryFields) VerifySignature(publicKey string) error {
+
+	decodedPublicKey, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if len(decodedPublicKey) != ed25519.PublicKeySize {
+		return common.ContextError(errors.New("invalid public key"))
+	}
+
+	signatureField, ok := fields["signature"].(string)
+	if !ok || signatureField == "" {
+		return common.ContextError(errors.New("missing signature"))
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(signatureField)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	message, err := fields.getSignatureMessage()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if !ed25519.Verify(decodedPublicKey, message, signature) {
+		return common.ContextError(errors.New("invalid signature"))
+	}
+
+	return nil
+}
+
+// getSignatureMessage returns the canonical encoding of the signed server
+// entry fields. The fields are round tripped through JSON, so that the
+// encoding is the same whether the fields were constructed or decoded; and
+// encoding/json sorts map keys, so the field order is deterministic.
+func (fields ServerEntryFields) getSignatureMessage() ([]byte, error) {
+
+	signedFields := make(map[string]interface{})
+	for name, value := range fields {
+		if name == "signature" || name == "localSource" || name == "localTimestamp" {
+			continue
+		}
+		signedFields[name] = value
+	}
+
+	encodedFields, err := json.Marshal(signedFields)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var decodedFields map[string]interface{}
+	err = json.Unmarshal(encodedFields, &decodedFields)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	message, err := json.Marshal(decodedFields)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return message, nil
+}
+
 // GetCapability returns the server capability corresponding
 // to the tunnel protocol.
 func GetCapability(protocol string) string {
@@ -146,9 +305,7 @@ func (serverEntry *ServerEntry) GetSupportedProtocols(
 
 	for _, protocol := range SupportedTunnelProtocols {
 
-		// TODO: Marionette UDP formats are incompatible with
-		// useUpstreamProxy, but not currently supported
-		if useUpstreamProxy && TunnelProtocolUsesQUIC(protocol) {
+		if useUpstreamProxy && !TunnelProtocolSupportsUpstreamProxy(protocol) {
 			continue
 		}
 
@@ -183,7 +340,7 @@ func (serverEntry *ServerEntry) GetSupportedTacticsProtocols() []string {
 
 	for _, protocol := range SupportedTunnelProtocols {
 
-		if !TunnelProtocolUsesMeek(protocol) {
+		if !TunnelProtocolSupportsTactics(protocol) {
 			continue
 		}
 
@@ -204,6 +361,12 @@ func (serverEntry *ServerEntry) SupportsSSHAPIRequests() bool {
 	return common.Contains(serverEntry.Capabilities, CAPABILITY_SSH_API_REQUESTS)
 }
 
+// SupportsMultiHopRelay returns true when the server may be used as the
+// entry server of a multi-hop tunnel, relaying to an exit server.
+func (serverEntry *ServerEntry) SupportsMultiHopRelay() bool {
+	return common.Contains(serverEntry.Capabilities, CAPABILITY_MULTI_HOP_RELAY)
+}
+
 func (serverEntry *ServerEntry) GetUntunneledWebRequestPorts() []string {
 	ports := make([]string, 0)
 	if common.Contains(serverEntry.Capabilities, CAPABILITY_UNTUNNELED_WEB_API_REQUESTS) {
@@ -307,6 +470,7 @@ func decodeServerEntry(
 // ValidateServerEntryFields checks for malformed server entries.
 // Currently, it checks for a valid ipAddress. This is important since
 // the IP address is the key used to store/lookup the server entry.
+// The optional ipAddressV6, when present, must be a valid IPv6 address.
 // TODO: validate more fields?
 func ValidateServerEntryFields(serverEntryFields ServerEntryFields) error {
 	ipAddress := serverEntryFields.GetIPAddress()
@@ -314,6 +478,14 @@ func ValidateServerEntryFields(serverEntryFields ServerEntryFields) error {
 		return common.ContextError(
 			fmt.Errorf("server entry has invalid ipAddress: %s", ipAddress))
 	}
+	ipAddressV6 := serverEntryFields.GetIPv6Address()
+	if ipAddressV6 != "" {
+		IP := net.ParseIP(ipAddressV6)
+		if IP == nil || IP.To4() != nil {
+			return common.ContextError(
+				fmt.Errorf("server entry has invalid ipAddressV6: %s", ipAddressV6))
+		}
+	}
 	return nil
 }
 
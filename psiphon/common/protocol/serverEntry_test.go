@@ -22,6 +22,7 @@ package protocol
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"testing"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -33,6 +34,7 @@ const (
 	_VALID_FUTURE_SERVER_ENTRY                    = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.1","webServerPort":"80","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>","dummyFutureField":"dummyFutureField"}`
 	_INVALID_WINDOWS_REGISTRY_LEGACY_SERVER_ENTRY = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
 	_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY    = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.","webServerPort":"80","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
+	_INVALID_MALFORMED_IPV6_ADDRESS_SERVER_ENTRY  = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.1","ipAddressV6":"192.168.0.2","webServerPort":"80","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
 	_EXPECTED_IP_ADDRESS                          = `192.168.0.1`
 	_EXPECTED_DUMMY_FUTURE_FIELD                  = `dummyFutureField`
 )
@@ -122,7 +124,11 @@ func TestStreamingServerEntryDecoder(t *testing.T) {
 // Directly call DecodeServerEntryFields and ValidateServerEntry with invalid inputs
 func TestInvalidServerEntries(t *testing.T) {
 
-	testCases := [2]string{_INVALID_WINDOWS_REGISTRY_LEGACY_SERVER_ENTRY, _INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY}
+	testCases := [3]string{
+		_INVALID_WINDOWS_REGISTRY_LEGACY_SERVER_ENTRY,
+		_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY,
+		_INVALID_MALFORMED_IPV6_ADDRESS_SERVER_ENTRY,
+	}
 
 	for _, testCase := range testCases {
 		encodedServerEntry := hex.EncodeToString([]byte(testCase))
@@ -152,3 +158,75 @@ func TestDecodeServerEntryStruct(t *testing.T) {
 		t.Errorf("unexpected IP address in decoded server entry: %s", serverEntry.IpAddress)
 	}
 }
+
+func TestServerEntrySignature(t *testing.T) {
+
+	publicKey, privateKey, err := NewServerEntrySignatureKeyPair()
+	if err != nil {
+		t.Fatalf("NewServerEntrySignatureKeyPair failed: %s", err)
+	}
+
+	otherPublicKey, _, err := NewServerEntrySignatureKeyPair()
+	if err != nil {
+		t.Fatalf("NewServerEntrySignatureKeyPair failed: %s", err)
+	}
+
+	serverEntryFields, err := DecodeServerEntryFields(
+		hex.EncodeToString([]byte(_VALID_FUTURE_SERVER_ENTRY)),
+		common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_REMOTE)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+
+	err = serverEntryFields.VerifySignature(publicKey)
+	if err == nil {
+		t.Fatalf("unexpected verification of unsigned server entry")
+	}
+
+	err = serverEntryFields.AddSignature(otherPublicKey, privateKey)
+	if err == nil {
+		t.Fatalf("unexpected signing with mismatched key pair")
+	}
+
+	err = serverEntryFields.AddSignature(publicKey, privateKey)
+	if err != nil {
+		t.Fatalf("AddSignature failed: %s", err)
+	}
+
+	// The signature survives encoding and decoding, which sets new local
+	// fields.
+
+	jsonServerEntry, err := json.Marshal(serverEntryFields)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	encodedServerEntry := hex.EncodeToString(
+		append([]byte("192.168.0.1 80 <webServerSecret> <webServerCertificate> "), jsonServerEntry...))
+
+	decodedServerEntryFields, err := DecodeServerEntryFields(
+		encodedServerEntry, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_DISCOVERY)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+
+	err = decodedServerEntryFields.VerifySignature(publicKey)
+	if err != nil {
+		t.Fatalf("VerifySignature failed: %s", err)
+	}
+
+	err = decodedServerEntryFields.VerifySignature(otherPublicKey)
+	if err == nil {
+		t.Fatalf("unexpected verification with other public key")
+	}
+
+	// Modifying any field, including unrecognized fields, invalidates the
+	// signature.
+
+	decodedServerEntryFields[_EXPECTED_DUMMY_FUTURE_FIELD] = "modified"
+
+	err = decodedServerEntryFields.VerifySignature(publicKey)
+	if err == nil {
+		t.Fatalf("unexpected verification of modified server entry")
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// Transport describes the properties of a tunnel protocol transport that
+// are common to clients and servers. The client dialer and server listener
+// for a transport are registered separately, in the psiphon and
+// psiphon/server packages.
+//
+// The server capability for a transport is derived from its tunnel
+// protocol name; see GetCapability.
+type Transport struct {
+
+	// TunnelProtocol is the tunnel protocol name, such as "OSSH".
+	TunnelProtocol string
+
+	// UsesObfuscatedSSH indicates that the SSH layer is obfuscated.
+	UsesObfuscatedSSH bool
+
+	// IsResourceIntensive indicates that the transport dialer consumes
+	// significant memory or CPU; the number of concurrent resource
+	// intensive dials may be limited.
+	IsResourceIntensive bool
+
+	// IsDefaultDisabled indicates that the transport is not selected unless
+	// explicitly enabled with LimitTunnelProtocols.
+	IsDefaultDisabled bool
+
+	// IsIncompatibleWithUpstreamProxy indicates that the transport cannot
+	// be dialed through an upstream proxy.
+	IsIncompatibleWithUpstreamProxy bool
+
+	// SupportsTactics indicates that the transport may be used for
+	// untunneled tactics requests.
+	SupportsTactics bool
+}
+
+var transports = make(map[string]*Transport)
+
+// RegisterTransport adds a tunnel protocol transport to the list of
+// supported tunnel protocols. RegisterTransport is not safe for concurrent
+// use and must be called from an init function. Transports are selected in
+// order of registration where an order is required, as in
+// SupportedTunnelProtocols.
+//
+// RegisterTransport panics if the tunnel protocol is already registered.
+func RegisterTransport(transport Transport) {
+
+	if transport.TunnelProtocol == "" {
+		panic("missing tunnel protocol")
+	}
+	if _, ok := transports[transport.TunnelProtocol]; ok {
+		panic(fmt.Sprintf("duplicate tunnel protocol: %s", transport.TunnelProtocol))
+	}
+
+	transports[transport.TunnelProtocol] = &transport
+
+	SupportedTunnelProtocols = append(
+		SupportedTunnelProtocols, transport.TunnelProtocol)
+
+	if transport.IsDefaultDisabled {
+		DefaultDisabledTunnelProtocols = append(
+			DefaultDisabledTunnelProtocols, transport.TunnelProtocol)
+	}
+}
+
+// GetTransport returns the registered transport for the specified tunnel
+// protocol, or nil when the tunnel protocol is not registered.
+func GetTransport(tunnelProtocol string) *Transport {
+	return transports[tunnelProtocol]
+}
+
+// GetServerEntryTransportParameters unmarshals the transport-specific
+// server entry fields for the specified tunnel protocol into parameters.
+// Transports which are not built in, and so do not have dedicated
+// ServerEntry fields, use ServerEntry.TransportParameters.
+func GetServerEntryTransportParameters(
+	serverEntry *ServerEntry, tunnelProtocol string, parameters interface{}) error {
+
+	encodedParameters, ok := serverEntry.TransportParameters[tunnelProtocol]
+	if !ok {
+		return common.ContextError(
+			fmt.Errorf("missing transport parameters: %s", tunnelProtocol))
+	}
+
+	err := json.Unmarshal(encodedParameters, parameters)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestRegisterTransport(t *testing.T) {
+
+	testTunnelProtocol := "TEST-OSSH"
+
+	// Restore the registry for other tests.
+	savedSupportedTunnelProtocols := SupportedTunnelProtocols
+	savedDefaultDisabledTunnelProtocols := DefaultDisabledTunnelProtocols
+	defer func() {
+		SupportedTunnelProtocols = savedSupportedTunnelProtocols
+		DefaultDisabledTunnelProtocols = savedDefaultDisabledTunnelProtocols
+		delete(transports, testTunnelProtocol)
+	}()
+
+	RegisterTransport(Transport{
+		TunnelProtocol:                  testTunnelProtocol,
+		UsesObfuscatedSSH:               true,
+		IsResourceIntensive:             true,
+		IsDefaultDisabled:               true,
+		IsIncompatibleWithUpstreamProxy: true,
+	})
+
+	if !common.Contains(SupportedTunnelProtocols, testTunnelProtocol) ||
+		!common.Contains(DefaultDisabledTunnelProtocols, testTunnelProtocol) {
+		t.Fatalf("registered tunnel protocol not supported")
+	}
+
+	if !TunnelProtocolUsesObfuscatedSSH(testTunnelProtocol) ||
+		!TunnelProtocolIsResourceIntensive(testTunnelProtocol) ||
+		TunnelProtocolSupportsUpstreamProxy(testTunnelProtocol) ||
+		TunnelProtocolSupportsTactics(testTunnelProtocol) {
+		t.Fatalf("unexpected registered tunnel protocol properties")
+	}
+
+	err := TunnelProtocols{testTunnelProtocol}.Validate()
+	if err != nil {
+		t.Fatalf("Validate failed: %s", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("duplicate RegisterTransport did not panic")
+			}
+		}()
+		RegisterTransport(Transport{TunnelProtocol: testTunnelProtocol})
+	}()
+
+	serverEntry := &ServerEntry{
+		Capabilities: []string{GetCapability(testTunnelProtocol)},
+		TransportParameters: map[string]json.RawMessage{
+			testTunnelProtocol: json.RawMessage(`{"port":1234}`),
+		},
+	}
+
+	// The default disabled protocol is selected only when explicitly
+	// enabled, and not when using an upstream proxy.
+
+	limitTunnelProtocols := []string{testTunnelProtocol}
+
+	for _, testCase := range []struct {
+		useUpstreamProxy     bool
+		limitTunnelProtocols []string
+		expectSupported      bool
+	}{
+		{false, nil, false},
+		{false, limitTunnelProtocols, true},
+		{true, limitTunnelProtocols, false},
+	} {
+		supportedProtocols := serverEntry.GetSupportedProtocols(
+			testCase.useUpstreamProxy, testCase.limitTunnelProtocols, false)
+		if common.Contains(supportedProtocols, testTunnelProtocol) != testCase.expectSupported {
+			t.Fatalf("unexpected supported protocols: %+v", supportedProtocols)
+		}
+	}
+
+	var parameters struct {
+		Port int `json:"port"`
+	}
+	err = GetServerEntryTransportParameters(serverEntry, testTunnelProtocol, &parameters)
+	if err != nil {
+		t.Fatalf("GetServerEntryTransportParameters failed: %s", err)
+	}
+	if parameters.Port != 1234 {
+		t.Fatalf("unexpected transport parameters: %+v", parameters)
+	}
+
+	err = GetServerEntryTransportParameters(serverEntry, TUNNEL_PROTOCOL_OBFUSCATED_SSH, &parameters)
+	if err == nil {
+		t.Fatalf("unexpected GetServerEntryTransportParameters success")
+	}
+}
@@ -0,0 +1,1412 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	STACK_TIMER_PERIOD             = 100 * time.Millisecond
+	STACK_TCP_RECEIVE_BUFFER_SIZE  = 65535
+	STACK_TCP_SEND_BUFFER_SIZE     = 65535
+	STACK_TCP_READ_BUFFER_SIZE     = 16384
+	STACK_TCP_INITIAL_RTO          = 1 * time.Second
+	STACK_TCP_MAX_RTO              = 30 * time.Second
+	STACK_TCP_MAX_RETRANSMISSIONS  = 8
+	STACK_UDP_MAX_PENDING_PACKETS  = 16
+	STACK_UDP_READ_BUFFER_SIZE     = 65536
+	STACK_DEFAULT_TCP_IPV4_MSS     = 536
+	STACK_DEFAULT_TCP_IPV6_MSS     = 1220
+	STACK_IPV4_HEADER_LENGTH       = 20
+	STACK_IPV6_HEADER_LENGTH       = 40
+	STACK_TCP_HEADER_LENGTH        = 20
+	STACK_UDP_HEADER_LENGTH        = 8
+	STACK_TCP_FAST_RETRANSMIT_ACKS = 3
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	tcpOptionEnd = 0
+	tcpOptionNOP = 1
+	tcpOptionMSS = 2
+)
+
+// FlowDialer is a function which establishes an upstream connection for
+// a TCP or UDP flow terminated by the userspace network stack. network is
+// "tcp" or "udp". FlowDialer may block while dialing and must be safe for
+// concurrent calls.
+//
+// The returned conn is closed when the flow ends. FlowDialer is
+// responsible for enforcing any port forward limits and idle timeouts, and
+// for accounting for the bytes relayed through the conn. When the conn
+// implements CloseWrite, the stack calls CloseWrite when the client closes
+// its side of a TCP flow.
+type FlowDialer func(
+	network string, upstreamIPAddress net.IP, port int) (net.Conn, error)
+
+// stack is a minimal userspace network stack which terminates the TCP and
+// UDP flows in a session's upstream packets and relays each flow through
+// an upstream connection established by the session's FlowDialer. In
+// userspace stack mode, a stack takes the place of the tun device, NAT, and
+// host network stack.
+//
+// The stack receives upstream packets after processPacket has validated
+// and rewritten them, so traffic rules are already enforced, the source
+// address is the session's assigned address, and transparent DNS packets
+// are destined to a DNS resolver. Packets generated by the stack are
+// likewise passed through processPacket for downstream rewriting before
+// they're enqueued for the client.
+//
+// The TCP implementation is intentionally limited. The stack and client
+// are connected by a reliable, flow controlled channel, and packets are
+// lost only when the downstream packet queue overflows, so no congestion
+// control is implemented. Out-of-order segments are dropped and
+// retransmission is go-back-N. TCP options other than MSS are ignored:
+// there is no window scaling, SACK, or timestamps. There is no TIME-WAIT
+// state; segments arriving after a flow is closed are answered with RST.
+//
+// Flows persist while the client is disconnected, as NAT state does
+// when using a tun device. Downstream packets are dropped while no client
+// is connected, and TCP retransmission resumes delivery when the client
+// reconnects.
+//
+// ICMP echo is not relayed in userspace stack mode.
+type stack struct {
+	logger      common.Logger
+	session     *session
+	MTU         int
+	mutex       sync.Mutex
+	tcpFlows    map[flowID]*stackTCPFlow
+	udpFlows    map[flowID]*stackUDPFlow
+	sendMutex   sync.Mutex
+	workers     *sync.WaitGroup
+	runContext  context.Context
+	stopRunning context.CancelFunc
+}
+
+func newStack(logger common.Logger, session *session, MTU int) *stack {
+
+	runContext, stopRunning := context.WithCancel(context.Background())
+
+	stack := &stack{
+		logger:      logger,
+		session:     session,
+		MTU:         MTU,
+		tcpFlows:    make(map[flowID]*stackTCPFlow),
+		udpFlows:    make(map[flowID]*stackUDPFlow),
+		workers:     new(sync.WaitGroup),
+		runContext:  runContext,
+		stopRunning: stopRunning,
+	}
+
+	stack.workers.Add(1)
+	go stack.runTimer()
+
+	return stack
+}
+
+// close closes all flows and stops the stack. close must not be called
+// concurrently with handlePacket.
+func (stack *stack) close() {
+
+	stack.stopRunning()
+
+	stack.mutex.Lock()
+	TCPFlows := make([]*stackTCPFlow, 0, len(stack.tcpFlows))
+	for _, flow := range stack.tcpFlows {
+		TCPFlows = append(TCPFlows, flow)
+	}
+	UDPFlows := make([]*stackUDPFlow, 0, len(stack.udpFlows))
+	for _, flow := range stack.udpFlows {
+		UDPFlows = append(UDPFlows, flow)
+	}
+	stack.mutex.Unlock()
+
+	for _, flow := range TCPFlows {
+		flow.mutex.Lock()
+		flow.closeLocked()
+		flow.mutex.Unlock()
+	}
+
+	for _, flow := range UDPFlows {
+		flow.close()
+	}
+
+	stack.workers.Wait()
+}
+
+// handlePacket processes an upstream packet which has been accepted and
+// rewritten by processPacket. handlePacket doesn't retain the packet
+// buffer. Only the session's runClientUpstream goroutine calls
+// handlePacket.
+func (stack *stack) handlePacket(packet []byte) {
+
+	select {
+	case <-stack.runContext.Done():
+		return
+	default:
+	}
+
+	p, ok := parseStackPacket(packet)
+	if !ok {
+		return
+	}
+
+	var ID flowID
+	ID.set(
+		p.sourceIPAddress,
+		p.sourcePort,
+		p.destinationIPAddress,
+		p.destinationPort,
+		p.protocol)
+
+	if p.protocol == internetProtocolTCP {
+		stack.handleTCPPacket(ID, p)
+	} else if p.protocol == internetProtocolUDP {
+		stack.handleUDPPacket(ID, p)
+	}
+
+	// Else, the packet is ICMP, which is dropped.
+}
+
+// sendPacket performs downstream processing for a packet generated by the
+// stack and enqueues it for the client. sendPacket is safe for concurrent
+// calls.
+func (stack *stack) sendPacket(packet []byte) {
+
+	// PacketQueue.Enqueue is not safe for concurrent calls.
+	stack.sendMutex.Lock()
+	defer stack.sendMutex.Unlock()
+
+	downstreamPackets := stack.session.getDownstreamPackets()
+
+	if downstreamPackets == nil {
+		stack.session.metrics.rejectedPacket(
+			packetDirectionServerDownstream, packetRejectNoClient)
+		return
+	}
+
+	if !processPacket(
+		stack.session.metrics,
+		stack.session,
+		packetDirectionServerDownstream,
+		packet) {
+
+		// Packet is rejected and dropped. Reason will be counted in metrics.
+		return
+	}
+
+	downstreamPackets.Enqueue(packet)
+}
+
+func (stack *stack) runTimer() {
+
+	defer stack.workers.Done()
+
+	ticker := time.NewTicker(STACK_TIMER_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stack.runContext.Done():
+			return
+		}
+
+		stack.mutex.Lock()
+		flows := make([]*stackTCPFlow, 0, len(stack.tcpFlows))
+		for _, flow := range stack.tcpFlows {
+			flows = append(flows, flow)
+		}
+		stack.mutex.Unlock()
+
+		for _, flow := range flows {
+			flow.tick()
+		}
+	}
+}
+
+func (stack *stack) handleTCPPacket(ID flowID, p *stackPacket) {
+
+	stack.mutex.Lock()
+
+	flow, ok := stack.tcpFlows[ID]
+
+	if !ok {
+
+		stack.mutex.Unlock()
+
+		if p.flags&tcpFlagRST != 0 {
+			return
+		}
+
+		// Only a SYN may start a new flow. Any other segment is for a closed
+		// or unknown flow and is answered with a RST.
+
+		if p.flags&(tcpFlagSYN|tcpFlagACK) != tcpFlagSYN {
+			stack.sendTCPReset(p)
+			return
+		}
+
+		flow = newStackTCPFlow(stack, ID, p)
+
+		stack.mutex.Lock()
+		stack.tcpFlows[ID] = flow
+		stack.mutex.Unlock()
+
+		stack.workers.Add(1)
+		go flow.run()
+
+		return
+	}
+
+	stack.mutex.Unlock()
+
+	flow.mutex.Lock()
+	flow.handleSegment(p)
+	flow.mutex.Unlock()
+}
+
+func (stack *stack) removeTCPFlow(flow *stackTCPFlow) {
+	stack.mutex.Lock()
+	if stack.tcpFlows[flow.ID] == flow {
+		delete(stack.tcpFlows, flow.ID)
+	}
+	stack.mutex.Unlock()
+}
+
+func (stack *stack) sendTCPReset(p *stackPacket) {
+
+	// As in RFC 793, "Reset Generation": when the segment has an ACK, the
+	// RST takes its sequence number from the ACK; otherwise the RST
+	// acknowledges the segment.
+
+	var sequence, acknowledgement uint32
+	flags := byte(tcpFlagRST)
+
+	if p.flags&tcpFlagACK != 0 {
+		sequence = p.acknowledgement
+	} else {
+		acknowledgement = p.sequence + uint32(len(p.payload))
+		if p.flags&tcpFlagSYN != 0 {
+			acknowledgement += 1
+		}
+		if p.flags&tcpFlagFIN != 0 {
+			acknowledgement += 1
+		}
+		flags |= tcpFlagACK
+	}
+
+	stack.sendPacket(
+		makeTCPPacket(
+			p.destinationIPAddress,
+			p.sourceIPAddress,
+			p.destinationPort,
+			p.sourcePort,
+			sequence,
+			acknowledgement,
+			flags,
+			0,
+			nil,
+			nil))
+}
+
+func (stack *stack) handleUDPPacket(ID flowID, p *stackPacket) {
+
+	stack.mutex.Lock()
+
+	flow, ok := stack.udpFlows[ID]
+
+	if !ok {
+
+		flow = &stackUDPFlow{
+			stack:                stack,
+			ID:                   ID,
+			localIPAddress:       append(net.IP(nil), p.destinationIPAddress...),
+			localPort:            p.destinationPort,
+			remoteIPAddress:      append(net.IP(nil), p.sourceIPAddress...),
+			remotePort:           p.sourcePort,
+			maxDownstreamPayload: stack.MTU - getIPHeaderLength(p.version) - STACK_UDP_HEADER_LENGTH,
+		}
+		stack.udpFlows[ID] = flow
+
+		stack.workers.Add(1)
+		go flow.run()
+	}
+
+	stack.mutex.Unlock()
+
+	flow.relayUpstream(p.payload)
+}
+
+func (stack *stack) removeUDPFlow(flow *stackUDPFlow) {
+	stack.mutex.Lock()
+	if stack.udpFlows[flow.ID] == flow {
+		delete(stack.udpFlows, flow.ID)
+	}
+	stack.mutex.Unlock()
+}
+
+const (
+	stackTCPStateDialing = iota
+	stackTCPStateSynReceived
+	stackTCPStateEstablished
+)
+
+// stackTCPFlow is a TCP flow terminated by the stack. In the flow, "local"
+// is the upstream end, which the stack impersonates, and "remote" is the
+// client.
+//
+// All fields after mutex are synchronized by mutex. Each flow has two
+// relay goroutines: relayDownstream reads from the upstream conn into
+// sendBuffer; and relayUpstream writes receiveBuffer to the upstream conn.
+// Segments from the client are handled by handleSegment, and
+// retransmission timeouts by tick.
+type stackTCPFlow struct {
+	stack           *stack
+	ID              flowID
+	version         int
+	localIPAddress  net.IP
+	localPort       uint16
+	remoteIPAddress net.IP
+	remotePort      uint16
+	MSS             int
+
+	mutex                   sync.Mutex
+	cond                    *sync.Cond
+	state                   int
+	closed                  bool
+	conn                    net.Conn
+	initialSequence         uint32
+	sendUnacknowledged      uint32
+	sendNext                uint32
+	sendWindow              uint16
+	sendBuffer              []byte
+	upstreamEOF             bool
+	sentFIN                 bool
+	acknowledgedFIN         bool
+	duplicateACKs           int
+	retransmitDeadline      monotime.Time
+	retransmitTimeout       time.Duration
+	retransmissions         int
+	receiveNext             uint32
+	receiveBuffer           []byte
+	writeBuffer             []byte
+	receivedFIN             bool
+	upstreamWriteClosed     bool
+	advertisedWindow        int
+	lastSentAcknowledgement uint32
+}
+
+func newStackTCPFlow(stack *stack, ID flowID, p *stackPacket) *stackTCPFlow {
+
+	// The flow MSS is the lesser of the client's MSS and the largest segment
+	// that fits in the packet tunnel MTU.
+
+	MSS := stack.MTU - getIPHeaderLength(p.version) - STACK_TCP_HEADER_LENGTH
+	clientMSS := getTCPOptionMSS(p.options)
+	if clientMSS == 0 {
+		if p.version == 4 {
+			clientMSS = STACK_DEFAULT_TCP_IPV4_MSS
+		} else {
+			clientMSS = STACK_DEFAULT_TCP_IPV6_MSS
+		}
+	}
+	if clientMSS < MSS {
+		MSS = clientMSS
+	}
+
+	flow := &stackTCPFlow{
+		stack:             stack,
+		ID:                ID,
+		version:           p.version,
+		localIPAddress:    append(net.IP(nil), p.destinationIPAddress...),
+		localPort:         p.destinationPort,
+		remoteIPAddress:   append(net.IP(nil), p.sourceIPAddress...),
+		remotePort:        p.sourcePort,
+		MSS:               MSS,
+		state:             stackTCPStateDialing,
+		sendWindow:        p.window,
+		retransmitTimeout: STACK_TCP_INITIAL_RTO,
+		receiveNext:       p.sequence + 1,
+	}
+	flow.cond = sync.NewCond(&flow.mutex)
+
+	return flow
+}
+
+func (flow *stackTCPFlow) run() {
+
+	defer flow.stack.workers.Done()
+
+	var conn net.Conn
+	var err error
+
+	flowDialer := flow.stack.session.getFlowDialer()
+	if flowDialer == nil {
+		err = errors.New("no flow dialer")
+	} else {
+		conn, err = flowDialer("tcp", flow.localIPAddress, int(flow.localPort))
+	}
+
+	flow.mutex.Lock()
+
+	if err != nil || flow.closed {
+
+		if err != nil {
+			// Debug since dial failures occur during normal operation.
+			flow.stack.logger.WithContextFields(
+				common.LogFields{"error": err}).Debug("dial TCP flow failed")
+		}
+
+		if conn != nil {
+			conn.Close()
+		}
+
+		// Refuse the connection. The RST acknowledges the client's SYN.
+		if !flow.closed {
+			flow.sendSegment(tcpFlagRST|tcpFlagACK, 0, nil)
+			flow.closeLocked()
+		}
+
+		flow.mutex.Unlock()
+		return
+	}
+
+	initialSequence, err := common.MakeSecureRandomInt64(1 << 32)
+	if err != nil {
+		flow.stack.logger.WithContextFields(
+			common.LogFields{"error": err}).Warning("generate initial sequence failed")
+		conn.Close()
+		flow.sendSegment(tcpFlagRST|tcpFlagACK, 0, nil)
+		flow.closeLocked()
+		flow.mutex.Unlock()
+		return
+	}
+
+	flow.conn = conn
+	flow.state = stackTCPStateSynReceived
+	flow.initialSequence = uint32(initialSequence)
+	flow.sendUnacknowledged = flow.initialSequence
+	flow.sendNext = flow.initialSequence + 1
+
+	flow.sendSegment(tcpFlagSYN|tcpFlagACK, flow.initialSequence, nil)
+	flow.armRetransmit()
+
+	flow.mutex.Unlock()
+
+	flow.stack.workers.Add(1)
+	go flow.relayUpstream()
+
+	flow.relayDownstream()
+}
+
+// relayDownstream reads from the upstream conn and transmits the data to
+// the client. Reads are paused while the send buffer is full.
+func (flow *stackTCPFlow) relayDownstream() {
+
+	buffer := make([]byte, STACK_TCP_READ_BUFFER_SIZE)
+
+	for {
+
+		flow.mutex.Lock()
+		for !flow.closed && len(flow.sendBuffer) >= STACK_TCP_SEND_BUFFER_SIZE {
+			flow.cond.Wait()
+		}
+		closed := flow.closed
+		readSize := STACK_TCP_SEND_BUFFER_SIZE - len(flow.sendBuffer)
+		flow.mutex.Unlock()
+
+		if closed {
+			return
+		}
+
+		if readSize > len(buffer) {
+			readSize = len(buffer)
+		}
+
+		n, err := flow.conn.Read(buffer[:readSize])
+
+		flow.mutex.Lock()
+
+		if flow.closed {
+			flow.mutex.Unlock()
+			return
+		}
+
+		if n > 0 {
+			flow.sendBuffer = append(flow.sendBuffer, buffer[:n]...)
+			flow.transmit()
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				// The FIN is sent once all buffered data is sent.
+				flow.upstreamEOF = true
+				flow.transmit()
+				flow.checkDone()
+			} else {
+				// Debug since conn errors occur during normal operation.
+				flow.stack.logger.WithContextFields(
+					common.LogFields{"error": err}).Debug("downstream TCP flow relay failed")
+				flow.reset()
+			}
+			flow.mutex.Unlock()
+			return
+		}
+
+		flow.mutex.Unlock()
+	}
+}
+
+// relayUpstream writes data received from the client to the upstream
+// conn. Once the client has closed its side of the flow and all data is
+// written, the upstream conn write side is closed.
+func (flow *stackTCPFlow) relayUpstream() {
+
+	defer flow.stack.workers.Done()
+
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+
+	for {
+
+		for !flow.closed && len(flow.receiveBuffer) == 0 && !flow.receivedFIN {
+			flow.cond.Wait()
+		}
+
+		if flow.closed {
+			return
+		}
+
+		if len(flow.receiveBuffer) == 0 {
+
+			// The client sent a FIN and all received data is written.
+
+			flow.upstreamWriteClosed = true
+			conn := flow.conn
+
+			flow.mutex.Unlock()
+			if closeWriter, ok := conn.(interface {
+				CloseWrite() error
+			}); ok {
+				closeWriter.CloseWrite()
+			}
+			flow.mutex.Lock()
+
+			flow.checkDone()
+			return
+		}
+
+		// Swap buffers so segments may continue to be received while the
+		// write is in progress.
+
+		data := flow.receiveBuffer
+		flow.receiveBuffer = flow.writeBuffer[:0]
+		previousAdvertisedWindow := flow.advertisedWindow
+		conn := flow.conn
+
+		flow.mutex.Unlock()
+		_, err := conn.Write(data)
+		flow.mutex.Lock()
+
+		flow.writeBuffer = data[:0]
+
+		if flow.closed {
+			return
+		}
+
+		if err != nil {
+			// Debug since conn errors occur during normal operation.
+			flow.stack.logger.WithContextFields(
+				common.LogFields{"error": err}).Debug("upstream TCP flow relay failed")
+			flow.reset()
+			return
+		}
+
+		// Send a window update when the previously advertised window was
+		// too small for a full segment, as the client may be waiting for
+		// the window to open.
+
+		if previousAdvertisedWindow < flow.MSS {
+			flow.sendSegment(tcpFlagACK, flow.sendNext, nil)
+		}
+	}
+}
+
+// handleSegment processes a segment received from the client.
+func (flow *stackTCPFlow) handleSegment(p *stackPacket) {
+
+	if flow.closed {
+		return
+	}
+
+	if p.flags&tcpFlagRST != 0 {
+		flow.closeLocked()
+		return
+	}
+
+	if p.flags&tcpFlagSYN != 0 {
+
+		// The client retransmitted its SYN, as the SYN-ACK was lost or not
+		// yet sent.
+
+		if flow.state == stackTCPStateSynReceived {
+			flow.sendSegment(tcpFlagSYN|tcpFlagACK, flow.initialSequence, nil)
+		}
+		return
+	}
+
+	if flow.state == stackTCPStateDialing || p.flags&tcpFlagACK == 0 {
+		return
+	}
+
+	if flow.state == stackTCPStateSynReceived {
+
+		if p.acknowledgement != flow.initialSequence+1 {
+			return
+		}
+
+		flow.state = stackTCPStateEstablished
+		flow.sendUnacknowledged = p.acknowledgement
+		flow.retransmitDeadline = 0
+		flow.retransmissions = 0
+		flow.retransmitTimeout = STACK_TCP_INITIAL_RTO
+	}
+
+	flow.handleAcknowledgement(p)
+
+	// Receive data and FIN. Only the next in-order segment is accepted;
+	// anything else is answered with a duplicate ACK.
+
+	sendACK := false
+	outOfOrder := false
+
+	if len(p.payload) > 0 || p.flags&tcpFlagFIN != 0 {
+
+		sendACK = true
+		outOfOrder = true
+
+		if p.sequence == flow.receiveNext && !flow.receivedFIN {
+
+			accepted := STACK_TCP_RECEIVE_BUFFER_SIZE - len(flow.receiveBuffer)
+			if accepted > len(p.payload) {
+				accepted = len(p.payload)
+			}
+
+			flow.receiveBuffer = append(flow.receiveBuffer, p.payload[:accepted]...)
+			flow.receiveNext += uint32(accepted)
+			outOfOrder = (accepted < len(p.payload))
+
+			if p.flags&tcpFlagFIN != 0 && accepted == len(p.payload) {
+				flow.receivedFIN = true
+				flow.receiveNext += 1
+			}
+
+			flow.cond.Broadcast()
+		}
+	}
+
+	flow.transmit()
+
+	// Any data transmitted carries the ACK; otherwise send a pure ACK.
+	// Out-of-order, duplicate, and truncated segments always get a
+	// duplicate ACK.
+
+	if sendACK && (outOfOrder || flow.lastSentAcknowledgement != flow.receiveNext) {
+
+		flow.sendSegment(tcpFlagACK, flow.sendNext, nil)
+	}
+
+	flow.checkDone()
+}
+
+func (flow *stackTCPFlow) handleAcknowledgement(p *stackPacket) {
+
+	acknowledged := p.acknowledgement - flow.sendUnacknowledged
+	outstanding := flow.sendNext - flow.sendUnacknowledged
+
+	if acknowledged > outstanding {
+
+		// The ACK is for old or unsent data.
+
+	} else if acknowledged > 0 {
+
+		dataAcknowledged := int(acknowledged)
+		if flow.sentFIN && p.acknowledgement == flow.sendNext {
+			flow.acknowledgedFIN = true
+			dataAcknowledged -= 1
+		}
+
+		n := copy(flow.sendBuffer, flow.sendBuffer[dataAcknowledged:])
+		flow.sendBuffer = flow.sendBuffer[:n]
+
+		flow.sendUnacknowledged = p.acknowledgement
+		flow.duplicateACKs = 0
+		flow.retransmissions = 0
+		flow.retransmitTimeout = STACK_TCP_INITIAL_RTO
+		flow.retransmitDeadline = 0
+		if flow.sendNext != flow.sendUnacknowledged {
+			flow.armRetransmit()
+		}
+
+		// Signal relayDownstream that there is send buffer space.
+		flow.cond.Broadcast()
+
+	} else if outstanding > 0 &&
+		len(p.payload) == 0 &&
+		p.flags&tcpFlagFIN == 0 &&
+		p.window == flow.sendWindow {
+
+		// Fast retransmit.
+
+		flow.duplicateACKs += 1
+		if flow.duplicateACKs == STACK_TCP_FAST_RETRANSMIT_ACKS {
+			flow.retransmit()
+		}
+	}
+
+	flow.sendWindow = p.window
+}
+
+// transmit sends any unsent data permitted by the client's window, and
+// then a FIN once the upstream conn has reached EOF.
+func (flow *stackTCPFlow) transmit() {
+
+	if flow.state != stackTCPStateEstablished {
+		return
+	}
+
+	for !flow.sentFIN {
+
+		inFlight := int(flow.sendNext - flow.sendUnacknowledged)
+		unsent := len(flow.sendBuffer) - inFlight
+
+		if unsent > 0 {
+
+			size := int(flow.sendWindow) - inFlight
+			if size <= 0 {
+				break
+			}
+			if size > unsent {
+				size = unsent
+			}
+			if size > flow.MSS {
+				size = flow.MSS
+			}
+
+			flow.sendSegment(
+				tcpFlagACK|tcpFlagPSH,
+				flow.sendNext,
+				flow.sendBuffer[inFlight:inFlight+size])
+
+			flow.sendNext += uint32(size)
+			flow.armRetransmit()
+			continue
+		}
+
+		if flow.upstreamEOF {
+			flow.sendSegment(tcpFlagFIN|tcpFlagACK, flow.sendNext, nil)
+			flow.sendNext += 1
+			flow.sentFIN = true
+			flow.armRetransmit()
+		}
+
+		break
+	}
+}
+
+// retransmit resends the SYN-ACK or, go-back-N, all unacknowledged data.
+func (flow *stackTCPFlow) retransmit() {
+
+	if flow.state == stackTCPStateSynReceived {
+		flow.sendSegment(tcpFlagSYN|tcpFlagACK, flow.initialSequence, nil)
+		return
+	}
+
+	flow.sendNext = flow.sendUnacknowledged
+	flow.sentFIN = false
+	flow.transmit()
+
+	// When the client's window is closed, send a one byte window probe.
+
+	if flow.sendNext == flow.sendUnacknowledged && len(flow.sendBuffer) > 0 {
+		flow.sendSegment(tcpFlagACK, flow.sendNext, flow.sendBuffer[0:1])
+		flow.sendNext += 1
+	}
+}
+
+func (flow *stackTCPFlow) armRetransmit() {
+	if flow.retransmitDeadline == 0 {
+		flow.retransmitDeadline = monotime.Now().Add(flow.retransmitTimeout)
+	}
+}
+
+// tick handles retransmission timeouts. A flow is reset after
+// STACK_TCP_MAX_RETRANSMISSIONS consecutive timeouts, which includes
+// timeouts while the client's window remains closed.
+func (flow *stackTCPFlow) tick() {
+
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+
+	if flow.closed || flow.state == stackTCPStateDialing {
+		return
+	}
+
+	now := monotime.Now()
+
+	if flow.retransmitDeadline == 0 {
+
+		// Start the timer for a window probe when there is unsent data and
+		// the client's window is closed.
+
+		if flow.state == stackTCPStateEstablished &&
+			flow.sendWindow == 0 &&
+			len(flow.sendBuffer) > int(flow.sendNext-flow.sendUnacknowledged) {
+
+			flow.armRetransmit()
+		}
+		return
+	}
+
+	if now.Before(flow.retransmitDeadline) {
+		return
+	}
+
+	flow.retransmissions += 1
+	if flow.retransmissions > STACK_TCP_MAX_RETRANSMISSIONS {
+		flow.reset()
+		return
+	}
+
+	flow.retransmitTimeout *= 2
+	if flow.retransmitTimeout > STACK_TCP_MAX_RTO {
+		flow.retransmitTimeout = STACK_TCP_MAX_RTO
+	}
+	flow.retransmitDeadline = now.Add(flow.retransmitTimeout)
+
+	flow.retransmit()
+}
+
+// checkDone closes the flow once both sides have closed and all data has
+// been relayed.
+func (flow *stackTCPFlow) checkDone() {
+	if flow.acknowledgedFIN && flow.receivedFIN && flow.upstreamWriteClosed {
+		flow.closeLocked()
+	}
+}
+
+// reset sends a RST to the client and closes the flow.
+func (flow *stackTCPFlow) reset() {
+	flow.sendSegment(tcpFlagRST|tcpFlagACK, flow.sendNext, nil)
+	flow.closeLocked()
+}
+
+func (flow *stackTCPFlow) closeLocked() {
+
+	if flow.closed {
+		return
+	}
+
+	flow.closed = true
+	if flow.conn != nil {
+		flow.conn.Close()
+	}
+
+	// Interrupt the relay goroutines.
+	flow.cond.Broadcast()
+
+	flow.stack.removeTCPFlow(flow)
+}
+
+func (flow *stackTCPFlow) sendSegment(flags byte, sequence uint32, payload []byte) {
+
+	window := STACK_TCP_RECEIVE_BUFFER_SIZE - len(flow.receiveBuffer)
+
+	var options []byte
+	if flags&tcpFlagSYN != 0 {
+		options = make([]byte, 4)
+		options[0] = tcpOptionMSS
+		options[1] = 4
+		binary.BigEndian.PutUint16(options[2:4], uint16(flow.MSS))
+	}
+
+	var acknowledgement uint32
+	if flags&tcpFlagACK != 0 {
+		acknowledgement = flow.receiveNext
+		flow.lastSentAcknowledgement = flow.receiveNext
+	}
+
+	flow.advertisedWindow = window
+
+	flow.stack.sendPacket(
+		makeTCPPacket(
+			flow.localIPAddress,
+			flow.remoteIPAddress,
+			flow.localPort,
+			flow.remotePort,
+			sequence,
+			acknowledgement,
+			flags,
+			uint16(window),
+			options,
+			payload))
+}
+
+// stackUDPFlow is a UDP flow terminated by the stack. As in
+// stackTCPFlow, "local" is the upstream end and "remote" is the client.
+type stackUDPFlow struct {
+	stack                *stack
+	ID                   flowID
+	localIPAddress       net.IP
+	localPort            uint16
+	remoteIPAddress      net.IP
+	remotePort           uint16
+	maxDownstreamPayload int
+
+	mutex          sync.Mutex
+	closed         bool
+	conn           net.Conn
+	pendingPackets [][]byte
+}
+
+func (flow *stackUDPFlow) run() {
+
+	defer flow.stack.workers.Done()
+
+	var conn net.Conn
+	var err error
+
+	flowDialer := flow.stack.session.getFlowDialer()
+	if flowDialer == nil {
+		err = errors.New("no flow dialer")
+	} else {
+		conn, err = flowDialer("udp", flow.localIPAddress, int(flow.localPort))
+	}
+
+	flow.mutex.Lock()
+
+	if err != nil || flow.closed {
+
+		if err != nil {
+			// Debug since dial failures occur during normal operation.
+			flow.stack.logger.WithContextFields(
+				common.LogFields{"error": err}).Debug("dial UDP flow failed")
+		}
+
+		if conn != nil {
+			conn.Close()
+		}
+
+		flow.closeLocked()
+		flow.mutex.Unlock()
+		return
+	}
+
+	flow.conn = conn
+
+	// Relay packets received while dialing.
+	// Note: assumes UDP writes won't block.
+
+	for _, packet := range flow.pendingPackets {
+		_, err := conn.Write(packet)
+		if err != nil {
+			break
+		}
+	}
+	flow.pendingPackets = nil
+
+	flow.mutex.Unlock()
+
+	buffer := make([]byte, STACK_UDP_READ_BUFFER_SIZE)
+
+	for {
+
+		// UDP flows are closed when idle, as is done for flow tracking.
+
+		conn.SetReadDeadline(time.Now().Add(FLOW_IDLE_EXPIRY))
+
+		n, err := conn.Read(buffer)
+		if err != nil {
+			break
+		}
+
+		// IP fragmentation is not supported, so packets larger than the MTU
+		// are dropped.
+
+		if n > flow.maxDownstreamPayload {
+			continue
+		}
+
+		flow.stack.sendPacket(
+			makeUDPPacket(
+				flow.localIPAddress,
+				flow.remoteIPAddress,
+				flow.localPort,
+				flow.remotePort,
+				buffer[:n]))
+	}
+
+	flow.close()
+}
+
+func (flow *stackUDPFlow) relayUpstream(payload []byte) {
+
+	flow.mutex.Lock()
+
+	if flow.closed {
+		flow.mutex.Unlock()
+		return
+	}
+
+	if flow.conn == nil {
+		if len(flow.pendingPackets) < STACK_UDP_MAX_PENDING_PACKETS {
+			flow.pendingPackets = append(
+				flow.pendingPackets, append([]byte(nil), payload...))
+		}
+		flow.mutex.Unlock()
+		return
+	}
+
+	conn := flow.conn
+
+	flow.mutex.Unlock()
+
+	// Note: assumes UDP writes won't block.
+	_, err := conn.Write(payload)
+	if err != nil {
+		// Debug since conn errors occur during normal operation.
+		flow.stack.logger.WithContextFields(
+			common.LogFields{"error": err}).Debug("upstream UDP flow relay failed")
+		flow.close()
+	}
+}
+
+func (flow *stackUDPFlow) close() {
+	flow.mutex.Lock()
+	flow.closeLocked()
+	flow.mutex.Unlock()
+}
+
+func (flow *stackUDPFlow) closeLocked() {
+
+	if flow.closed {
+		return
+	}
+
+	flow.closed = true
+	if flow.conn != nil {
+		flow.conn.Close()
+	}
+
+	flow.stack.removeUDPFlow(flow)
+}
+
+// stackPacket is a parsed TCP or UDP packet. The address and payload
+// fields reference the parsed packet buffer.
+type stackPacket struct {
+	version              int
+	protocol             internetProtocol
+	sourceIPAddress      net.IP
+	destinationIPAddress net.IP
+	sourcePort           uint16
+	destinationPort      uint16
+	sequence             uint32
+	acknowledgement      uint32
+	flags                byte
+	window               uint16
+	options              []byte
+	payload              []byte
+}
+
+// parseStackPacket parses a TCP or UDP packet. The packet is assumed to
+// have been accepted by processPacket, and so has no IPv4 options or IPv6
+// extension headers. IPv4 fragments, which the stack cannot reassemble,
+// are rejected.
+func parseStackPacket(packet []byte) (*stackPacket, bool) {
+
+	if len(packet) < 1 {
+		return nil, false
+	}
+
+	p := &stackPacket{
+		version: int(packet[0] >> 4),
+	}
+
+	var transportPacket []byte
+
+	if p.version == 4 {
+
+		if len(packet) < STACK_IPV4_HEADER_LENGTH {
+			return nil, false
+		}
+
+		totalLength := int(binary.BigEndian.Uint16(packet[2:4]))
+		if totalLength < STACK_IPV4_HEADER_LENGTH || totalLength > len(packet) {
+			return nil, false
+		}
+
+		// More fragments flag or non-zero fragment offset.
+		if binary.BigEndian.Uint16(packet[6:8])&0x3FFF != 0 {
+			return nil, false
+		}
+
+		p.protocol = internetProtocol(packet[9])
+		p.sourceIPAddress = packet[12:16]
+		p.destinationIPAddress = packet[16:20]
+		transportPacket = packet[STACK_IPV4_HEADER_LENGTH:totalLength]
+
+	} else if p.version == 6 {
+
+		if len(packet) < STACK_IPV6_HEADER_LENGTH {
+			return nil, false
+		}
+
+		totalLength := STACK_IPV6_HEADER_LENGTH + int(binary.BigEndian.Uint16(packet[4:6]))
+		if totalLength > len(packet) {
+			return nil, false
+		}
+
+		p.protocol = internetProtocol(packet[6])
+		p.sourceIPAddress = packet[8:24]
+		p.destinationIPAddress = packet[24:40]
+		transportPacket = packet[STACK_IPV6_HEADER_LENGTH:totalLength]
+
+	} else {
+		return nil, false
+	}
+
+	if p.protocol == internetProtocolTCP {
+
+		if len(transportPacket) < STACK_TCP_HEADER_LENGTH {
+			return nil, false
+		}
+
+		dataOffset := 4 * int(transportPacket[12]>>4)
+		if dataOffset < STACK_TCP_HEADER_LENGTH || dataOffset > len(transportPacket) {
+			return nil, false
+		}
+
+		p.sourcePort = binary.BigEndian.Uint16(transportPacket[0:2])
+		p.destinationPort = binary.BigEndian.Uint16(transportPacket[2:4])
+		p.sequence = binary.BigEndian.Uint32(transportPacket[4:8])
+		p.acknowledgement = binary.BigEndian.Uint32(transportPacket[8:12])
+		p.flags = transportPacket[13]
+		p.window = binary.BigEndian.Uint16(transportPacket[14:16])
+		p.options = transportPacket[STACK_TCP_HEADER_LENGTH:dataOffset]
+		p.payload = transportPacket[dataOffset:]
+
+	} else if p.protocol == internetProtocolUDP {
+
+		if len(transportPacket) < STACK_UDP_HEADER_LENGTH {
+			return nil, false
+		}
+
+		length := int(binary.BigEndian.Uint16(transportPacket[4:6]))
+		if length < STACK_UDP_HEADER_LENGTH || length > len(transportPacket) {
+			return nil, false
+		}
+
+		p.sourcePort = binary.BigEndian.Uint16(transportPacket[0:2])
+		p.destinationPort = binary.BigEndian.Uint16(transportPacket[2:4])
+		p.payload = transportPacket[STACK_UDP_HEADER_LENGTH:length]
+
+	}
+
+	// Else, other protocols are returned with only the IP fields set.
+
+	return p, true
+}
+
+// getTCPOptionMSS returns the MSS option value, or 0 when there is no MSS
+// option.
+func getTCPOptionMSS(options []byte) int {
+	for i := 0; i < len(options); {
+		kind := options[i]
+		if kind == tcpOptionEnd {
+			break
+		}
+		if kind == tcpOptionNOP {
+			i += 1
+			continue
+		}
+		if i+1 >= len(options) {
+			break
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			break
+		}
+		if kind == tcpOptionMSS && length == 4 {
+			return int(binary.BigEndian.Uint16(options[i+2 : i+4]))
+		}
+		i += length
+	}
+	return 0
+}
+
+func getIPHeaderLength(version int) int {
+	if version == 4 {
+		return STACK_IPV4_HEADER_LENGTH
+	}
+	return STACK_IPV6_HEADER_LENGTH
+}
+
+// makeTCPPacket creates an IPv4 or IPv6 TCP packet with valid checksums.
+// The IP version is determined by the length of sourceIPAddress. options
+// must be padded to a multiple of 4 bytes.
+func makeTCPPacket(
+	sourceIPAddress, destinationIPAddress net.IP,
+	sourcePort, destinationPort uint16,
+	sequence, acknowledgement uint32,
+	flags byte,
+	window uint16,
+	options, payload []byte) []byte {
+
+	header := make([]byte, STACK_TCP_HEADER_LENGTH+len(options))
+	binary.BigEndian.PutUint16(header[0:2], sourcePort)
+	binary.BigEndian.PutUint16(header[2:4], destinationPort)
+	binary.BigEndian.PutUint32(header[4:8], sequence)
+	binary.BigEndian.PutUint32(header[8:12], acknowledgement)
+	header[12] = byte(len(header)/4) << 4
+	header[13] = flags
+	binary.BigEndian.PutUint16(header[14:16], window)
+	copy(header[STACK_TCP_HEADER_LENGTH:], options)
+
+	return makeIPPacket(
+		sourceIPAddress, destinationIPAddress, internetProtocolTCP, header, payload)
+}
+
+// makeUDPPacket creates an IPv4 or IPv6 UDP packet with valid checksums.
+// The IP version is determined by the length of sourceIPAddress.
+func makeUDPPacket(
+	sourceIPAddress, destinationIPAddress net.IP,
+	sourcePort, destinationPort uint16,
+	payload []byte) []byte {
+
+	header := make([]byte, STACK_UDP_HEADER_LENGTH)
+	binary.BigEndian.PutUint16(header[0:2], sourcePort)
+	binary.BigEndian.PutUint16(header[2:4], destinationPort)
+	binary.BigEndian.PutUint16(header[4:6], uint16(STACK_UDP_HEADER_LENGTH+len(payload)))
+
+	return makeIPPacket(
+		sourceIPAddress, destinationIPAddress, internetProtocolUDP, header, payload)
+}
+
+func makeIPPacket(
+	sourceIPAddress, destinationIPAddress net.IP,
+	protocol internetProtocol,
+	transportHeader, payload []byte) []byte {
+
+	transportLength := len(transportHeader) + len(payload)
+
+	var packet, transportPacket []byte
+
+	// The transport checksum covers a pseudo-header which consists of the
+	// IP addresses, protocol, and transport length.
+
+	var checksum uint32
+	checksum = checksumAdd(checksum, sourceIPAddress)
+	checksum = checksumAdd(checksum, destinationIPAddress)
+	checksum += uint32(protocol) + uint32(transportLength)
+
+	if len(sourceIPAddress) == net.IPv4len {
+
+		packet = make([]byte, STACK_IPV4_HEADER_LENGTH+transportLength)
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+		binary.BigEndian.PutUint16(packet[6:8], 0x4000) // Don't fragment
+		packet[8] = 64
+		packet[9] = byte(protocol)
+		copy(packet[12:16], sourceIPAddress)
+		copy(packet[16:20], destinationIPAddress)
+		binary.BigEndian.PutUint16(
+			packet[10:12], internetChecksum(packet[0:STACK_IPV4_HEADER_LENGTH]))
+
+		transportPacket = packet[STACK_IPV4_HEADER_LENGTH:]
+
+	} else {
+
+		packet = make([]byte, STACK_IPV6_HEADER_LENGTH+transportLength)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:6], uint16(transportLength))
+		packet[6] = byte(protocol)
+		packet[7] = 64
+		copy(packet[8:24], sourceIPAddress)
+		copy(packet[24:40], destinationIPAddress)
+
+		transportPacket = packet[STACK_IPV6_HEADER_LENGTH:]
+	}
+
+	copy(transportPacket, transportHeader)
+	copy(transportPacket[len(transportHeader):], payload)
+
+	checksumValue := ^checksumFold(checksumAdd(checksum, transportPacket))
+
+	if protocol == internetProtocolTCP {
+		binary.BigEndian.PutUint16(transportPacket[16:18], checksumValue)
+	} else { // UDP
+		// A computed UDP checksum of 0 is transmitted as all ones.
+		if checksumValue == 0 {
+			checksumValue = 0xFFFF
+		}
+		binary.BigEndian.PutUint16(transportPacket[6:8], checksumValue)
+	}
+
+	return packet
+}
+
+// internetChecksum computes the RFC 1071 checksum of data.
+func internetChecksum(data []byte) uint16 {
+	return ^checksumFold(checksumAdd(0, data))
+}
+
+func checksumAdd(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return uint16(sum)
+}
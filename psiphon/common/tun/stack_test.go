@@ -0,0 +1,935 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+)
+
+const (
+	STACK_TEST_TIMEOUT = 10 * time.Second
+)
+
+func TestUserspaceStack(t *testing.T) {
+	testUserspaceStack(t, false)
+	testUserspaceStack(t, true)
+}
+
+func testUserspaceStack(t *testing.T, useIPv6 bool) {
+
+	// This test runs a packet tunnel server in userspace stack mode, which
+	// requires no tun device or root privileges. The test acts as the
+	// packet tunnel client, sending and receiving raw packets through the
+	// client channel. The flow dialer relays flows to local echo servers.
+
+	var clientIPAddress, upstreamIPAddress net.IP
+	if !useIPv6 {
+		clientIPAddress = net.ParseIP("192.168.0.2").To4()
+		upstreamIPAddress = net.ParseIP("192.0.2.1").To4()
+	} else {
+		clientIPAddress = net.ParseIP("fd00::2")
+		upstreamIPAddress = net.ParseIP("2001:db8::1")
+	}
+
+	upstreamPort := 80
+	refusedUpstreamPort := 81
+
+	TCPListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer TCPListener.Close()
+
+	go func() {
+		for {
+			conn, err := TCPListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	UDPConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket failed: %s", err)
+	}
+	defer UDPConn.Close()
+
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, addr, err := UDPConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			UDPConn.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	flowDialer := func(
+		network string, IPAddress net.IP, port int) (net.Conn, error) {
+
+		if !IPAddress.Equal(upstreamIPAddress) || port != upstreamPort {
+			return nil, errors.New("unexpected upstream address")
+		}
+		if network == "tcp" {
+			return net.Dial("tcp", TCPListener.Addr().String())
+		}
+		return net.Dial("udp", UDPConn.LocalAddr().String())
+	}
+
+	server, err := NewServer(&ServerConfig{
+		Logger:                      newTestLogger(false),
+		GetDNSResolverIPv4Addresses: func() []net.IP { return nil },
+		GetDNSResolverIPv6Addresses: func() []net.IP { return nil },
+		UserspaceStack:              true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+	server.Start()
+	defer server.Stop()
+
+	clientConn, serverConn := net.Pipe()
+
+	checkAllowedPortFunc := func(net.IP, int) bool { return true }
+
+	err = server.ClientConnected(
+		"session",
+		serverConn,
+		checkAllowedPortFunc,
+		checkAllowedPortFunc,
+		nil,
+		nil,
+		nil,
+		flowDialer)
+	if err != nil {
+		t.Fatalf("ClientConnected failed: %s", err)
+	}
+
+	channel := NewChannel(clientConn, getMTU(0))
+
+	packets := make(chan *stackPacket, 1024)
+
+	go func() {
+		defer close(packets)
+		for {
+			packet, err := channel.ReadPacket()
+			if err != nil {
+				return
+			}
+			packet = append([]byte(nil), packet...)
+			if !verifyStackPacketChecksums(packet) {
+				return
+			}
+			p, ok := parseStackPacket(packet)
+			if !ok {
+				return
+			}
+			packets <- p
+		}
+	}()
+
+	writePacket := func(packet []byte) {
+		err := channel.WritePacket(packet)
+		if err != nil {
+			t.Fatalf("WritePacket failed: %s", err)
+		}
+	}
+
+	// readPacket returns the next downstream packet for the specified
+	// protocol, skipping any others.
+	readPacket := func(protocol internetProtocol) *stackPacket {
+		for {
+			select {
+			case p, ok := <-packets:
+				if !ok {
+					t.Fatalf("invalid downstream packet")
+				}
+				if !p.sourceIPAddress.Equal(upstreamIPAddress) ||
+					!p.destinationIPAddress.Equal(clientIPAddress) {
+					t.Fatalf("unexpected downstream packet addresses: %s, %s",
+						p.sourceIPAddress, p.destinationIPAddress)
+				}
+				if p.protocol == protocol {
+					return p
+				}
+			case <-time.After(STACK_TEST_TIMEOUT):
+				t.Fatalf("timeout waiting for downstream packet")
+			}
+		}
+	}
+
+	makeClientTCPPacket := func(
+		port int, sequence, acknowledgement uint32, flags byte, payload []byte) []byte {
+
+		return makeTCPPacket(
+			clientIPAddress,
+			upstreamIPAddress,
+			40000,
+			uint16(port),
+			sequence,
+			acknowledgement,
+			flags,
+			65535,
+			nil,
+			payload)
+	}
+
+	// A flow which the flow dialer can't establish is refused with a RST.
+
+	writePacket(makeClientTCPPacket(refusedUpstreamPort, 1000, 0, tcpFlagSYN, nil))
+
+	p := readPacket(internetProtocolTCP)
+	if p.flags&tcpFlagRST == 0 || p.acknowledgement != 1001 {
+		t.Fatalf("unexpected refused flow response: %x, %d", p.flags, p.acknowledgement)
+	}
+
+	// Establish a TCP flow.
+
+	clientSequence := uint32(2000)
+
+	writePacket(makeClientTCPPacket(upstreamPort, clientSequence, 0, tcpFlagSYN, nil))
+	clientSequence += 1
+
+	p = readPacket(internetProtocolTCP)
+	if p.flags != tcpFlagSYN|tcpFlagACK ||
+		p.acknowledgement != clientSequence ||
+		int(p.sourcePort) != upstreamPort ||
+		p.destinationPort != 40000 ||
+		getTCPOptionMSS(p.options) == 0 {
+		t.Fatalf("unexpected SYN-ACK: %x, %d", p.flags, p.acknowledgement)
+	}
+	serverSequence := p.sequence + 1
+
+	// Send data and receive the echo.
+
+	payload := []byte("hello, world")
+
+	writePacket(makeClientTCPPacket(
+		upstreamPort, clientSequence, serverSequence, tcpFlagACK|tcpFlagPSH, payload))
+	clientSequence += uint32(len(payload))
+
+	var received []byte
+	for len(received) < len(payload) {
+		p = readPacket(internetProtocolTCP)
+		if len(p.payload) == 0 {
+			continue
+		}
+		if p.sequence != serverSequence+uint32(len(received)) {
+			t.Fatalf("unexpected sequence: %d", p.sequence)
+		}
+		received = append(received, p.payload...)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("unexpected echo: %s", string(received))
+	}
+	serverSequence += uint32(len(received))
+
+	writePacket(makeClientTCPPacket(
+		upstreamPort, clientSequence, serverSequence, tcpFlagACK, nil))
+
+	// Close the flow. The client FIN is relayed to the echo server, which
+	// closes its conn, and the stack then sends a FIN.
+
+	writePacket(makeClientTCPPacket(
+		upstreamPort, clientSequence, serverSequence, tcpFlagFIN|tcpFlagACK, nil))
+	clientSequence += 1
+
+	for {
+		p = readPacket(internetProtocolTCP)
+		if p.flags&tcpFlagFIN != 0 {
+			break
+		}
+	}
+	if p.sequence != serverSequence || p.acknowledgement != clientSequence {
+		t.Fatalf("unexpected FIN: %d, %d", p.sequence, p.acknowledgement)
+	}
+	serverSequence += 1
+
+	writePacket(makeClientTCPPacket(
+		upstreamPort, clientSequence, serverSequence, tcpFlagACK, nil))
+
+	// Segments for the closed flow are answered with a RST.
+
+	writePacket(makeClientTCPPacket(
+		upstreamPort, clientSequence, serverSequence, tcpFlagACK|tcpFlagPSH, payload))
+
+	p = readPacket(internetProtocolTCP)
+	if p.flags&tcpFlagRST == 0 || p.sequence != serverSequence {
+		t.Fatalf("unexpected closed flow response: %x, %d", p.flags, p.sequence)
+	}
+
+	// Relay a UDP flow.
+
+	for i := 0; i < 3; i++ {
+
+		writePacket(makeUDPPacket(
+			clientIPAddress, upstreamIPAddress, 40001, uint16(upstreamPort), payload))
+
+		p = readPacket(internetProtocolUDP)
+		if int(p.sourcePort) != upstreamPort ||
+			p.destinationPort != 40001 ||
+			!bytes.Equal(p.payload, payload) {
+			t.Fatalf("unexpected UDP response: %d, %d", p.sourcePort, p.destinationPort)
+		}
+	}
+}
+
+func TestSessionConfiguration(t *testing.T) {
+
+	// This test uses a packet tunnel server in userspace stack mode, which
+	// requires no tun device or root privileges, to request a session
+	// configuration and then relay packets using the assigned addresses.
+
+	UDPConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket failed: %s", err)
+	}
+	defer UDPConn.Close()
+
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, addr, err := UDPConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			UDPConn.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	flowDialer := func(
+		network string, IPAddress net.IP, port int) (net.Conn, error) {
+
+		if network != "udp" {
+			return nil, errors.New("unexpected network")
+		}
+		return net.Dial("udp", UDPConn.LocalAddr().String())
+	}
+
+	MTU := 1400
+
+	server, err := NewServer(&ServerConfig{
+		Logger:                      newTestLogger(false),
+		GetDNSResolverIPv4Addresses: func() []net.IP { return nil },
+		GetDNSResolverIPv6Addresses: func() []net.IP { return nil },
+		MTU:                         MTU,
+		UserspaceStack:              true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+	server.Start()
+	defer server.Stop()
+
+	clientConn, serverConn := net.Pipe()
+
+	checkAllowedPortFunc := func(net.IP, int) bool { return true }
+
+	err = server.ClientConnected(
+		"session",
+		serverConn,
+		checkAllowedPortFunc,
+		checkAllowedPortFunc,
+		nil,
+		nil,
+		nil,
+		flowDialer)
+	if err != nil {
+		t.Fatalf("ClientConnected failed: %s", err)
+	}
+
+	// The client side of the exchange is exercised with a Client that has
+	// no device, as only its channel and control message handling are
+	// used.
+
+	handledSessionConfigurations := make(chan *SessionConfiguration, 1)
+
+	client := &Client{
+		config: &ClientConfig{
+			Logger: newTestLogger(false),
+			SessionConfigurationHandler: func(sessionConfiguration *SessionConfiguration) {
+				handledSessionConfigurations <- sessionConfiguration
+			},
+		},
+		channel: NewChannel(clientConn, channelMaxPacketSize),
+	}
+
+	err = client.RequestSessionConfiguration()
+	if err != nil {
+		t.Fatalf("RequestSessionConfiguration failed: %s", err)
+	}
+
+	responses := make(chan []byte, 1)
+
+	go func() {
+		packet, err := client.channel.ReadPacket()
+		if err != nil {
+			close(responses)
+			return
+		}
+		responses <- append([]byte(nil), packet...)
+	}()
+
+	select {
+	case response := <-responses:
+		if !isControlMessage(response) {
+			t.Fatalf("unexpected response")
+		}
+		client.handleControlMessage(response)
+	case <-time.After(STACK_TEST_TIMEOUT):
+		t.Fatalf("timeout waiting for session configuration response")
+	}
+
+	var sessionConfiguration *SessionConfiguration
+
+	select {
+	case sessionConfiguration = <-handledSessionConfigurations:
+	default:
+		t.Fatalf("session configuration not handled")
+	}
+
+	if client.GetSessionConfiguration() != sessionConfiguration {
+		t.Fatalf("unexpected GetSessionConfiguration")
+	}
+
+	IPv4Address, IPv4Subnet, err := net.ParseCIDR(sessionConfiguration.IPv4AddressCIDR)
+	if err != nil ||
+		IPv4Subnet.String() != privateSubnetIPv4.String() ||
+		IPv4Address.Equal(transparentDNSResolverIPv4Address) {
+		t.Fatalf("unexpected IPv4AddressCIDR: %s", sessionConfiguration.IPv4AddressCIDR)
+	}
+
+	IPv6Address, IPv6Subnet, err := net.ParseCIDR(sessionConfiguration.IPv6AddressCIDR)
+	if err != nil ||
+		IPv6Subnet.String() != privateSubnetIPv6.String() ||
+		IPv6Address.Equal(transparentDNSResolverIPv6Address) {
+		t.Fatalf("unexpected IPv6AddressCIDR: %s", sessionConfiguration.IPv6AddressCIDR)
+	}
+
+	if sessionConfiguration.MTU != MTU {
+		t.Fatalf("unexpected MTU: %d", sessionConfiguration.MTU)
+	}
+
+	if sessionConfiguration.DNSResolverIPv4Address !=
+		GetTransparentDNSResolverIPv4Address().String() ||
+		sessionConfiguration.DNSResolverIPv6Address !=
+			GetTransparentDNSResolverIPv6Address().String() {
+
+		t.Fatalf("unexpected DNS resolvers: %s, %s",
+			sessionConfiguration.DNSResolverIPv4Address,
+			sessionConfiguration.DNSResolverIPv6Address)
+	}
+
+	// Relay a UDP packet using the assigned address.
+
+	channel := NewChannel(clientConn, sessionConfiguration.MTU)
+
+	upstreamIPAddress := net.ParseIP("192.0.2.1").To4()
+	payload := []byte("hello, world")
+
+	err = channel.WritePacket(makeUDPPacket(
+		IPv4Address.To4(), upstreamIPAddress, 40000, 53, payload))
+	if err != nil {
+		t.Fatalf("WritePacket failed: %s", err)
+	}
+
+	packets := make(chan *stackPacket, 1)
+
+	go func() {
+		packet, err := channel.ReadPacket()
+		if err != nil {
+			close(packets)
+			return
+		}
+		p, _ := parseStackPacket(append([]byte(nil), packet...))
+		packets <- p
+	}()
+
+	select {
+	case p := <-packets:
+		if p == nil ||
+			p.protocol != internetProtocolUDP ||
+			!p.destinationIPAddress.Equal(IPv4Address) ||
+			!bytes.Equal(p.payload, payload) {
+			t.Fatalf("unexpected downstream packet")
+		}
+	case <-time.After(STACK_TEST_TIMEOUT):
+		t.Fatalf("timeout waiting for downstream packet")
+	}
+}
+
+func TestFlowHostnames(t *testing.T) {
+
+	// This test uses a packet tunnel server in userspace stack mode, which
+	// requires no tun device or root privileges, to check the hostnames
+	// passed to the FlowActivityUpdaterMaker: for TCP flows, from HTTP
+	// payloads or, otherwise, from relayed DNS responses.
+
+	clientIPAddress := net.ParseIP("192.168.0.2").To4()
+	upstreamIPAddress := net.ParseIP("192.0.2.1").To4()
+	DNSResolverIPAddress := net.ParseIP("127.0.0.1").To4()
+	resolvedHostname := "example.org"
+	HTTPHostname := "example.com"
+
+	DNSConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket failed: %s", err)
+	}
+	defer DNSConn.Close()
+
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, addr, err := DNSConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var request dns.Msg
+			if request.Unpack(buffer[:n]) != nil {
+				continue
+			}
+			response := new(dns.Msg)
+			response.SetReply(&request)
+			response.Answer = append(response.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   dns.Fqdn(resolvedHostname),
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    300,
+				},
+				A: upstreamIPAddress,
+			})
+			packet, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			DNSConn.WriteTo(packet, addr)
+		}
+	}()
+
+	TCPListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer TCPListener.Close()
+
+	go func() {
+		for {
+			conn, err := TCPListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	flowDialer := func(
+		network string, IPAddress net.IP, port int) (net.Conn, error) {
+
+		if network == "udp" && IPAddress.Equal(DNSResolverIPAddress) && port == 53 {
+			return net.Dial("udp", DNSConn.LocalAddr().String())
+		}
+		if network == "tcp" && IPAddress.Equal(upstreamIPAddress) {
+			return net.Dial("tcp", TCPListener.Addr().String())
+		}
+		return nil, errors.New("unexpected upstream address")
+	}
+
+	hostnames := make(chan string, 16)
+
+	flowActivityUpdaterMaker := func(
+		upstreamHostname string, IPAddress net.IP) []FlowActivityUpdater {
+
+		if IPAddress.Equal(upstreamIPAddress) {
+			hostnames <- upstreamHostname
+		}
+		return nil
+	}
+
+	server, err := NewServer(&ServerConfig{
+		Logger: newTestLogger(false),
+		GetDNSResolverIPv4Addresses: func() []net.IP {
+			return []net.IP{DNSResolverIPAddress}
+		},
+		GetDNSResolverIPv6Addresses: func() []net.IP { return nil },
+		UserspaceStack:              true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+	server.Start()
+	defer server.Stop()
+
+	clientConn, serverConn := net.Pipe()
+
+	checkAllowedPortFunc := func(net.IP, int) bool { return true }
+
+	err = server.ClientConnected(
+		"session",
+		serverConn,
+		checkAllowedPortFunc,
+		checkAllowedPortFunc,
+		nil,
+		flowActivityUpdaterMaker,
+		nil,
+		flowDialer)
+	if err != nil {
+		t.Fatalf("ClientConnected failed: %s", err)
+	}
+
+	channel := NewChannel(clientConn, getMTU(0))
+
+	packets := make(chan *stackPacket, 1024)
+
+	go func() {
+		defer close(packets)
+		for {
+			packet, err := channel.ReadPacket()
+			if err != nil {
+				return
+			}
+			p, ok := parseStackPacket(append([]byte(nil), packet...))
+			if !ok {
+				return
+			}
+			packets <- p
+		}
+	}()
+
+	writePacket := func(packet []byte) {
+		err := channel.WritePacket(packet)
+		if err != nil {
+			t.Fatalf("WritePacket failed: %s", err)
+		}
+	}
+
+	readPacket := func(protocol internetProtocol) *stackPacket {
+		for {
+			select {
+			case p, ok := <-packets:
+				if !ok {
+					t.Fatalf("invalid downstream packet")
+				}
+				if p.protocol == protocol {
+					return p
+				}
+			case <-time.After(STACK_TEST_TIMEOUT):
+				t.Fatalf("timeout waiting for downstream packet")
+			}
+		}
+	}
+
+	readHostname := func() string {
+		select {
+		case hostname := <-hostnames:
+			return hostname
+		case <-time.After(STACK_TEST_TIMEOUT):
+			t.Fatalf("timeout waiting for flow hostname")
+		}
+		return ""
+	}
+
+	// Resolve the upstream IP address using the transparent DNS resolver.
+
+	request := new(dns.Msg)
+	request.SetQuestion(dns.Fqdn(resolvedHostname), dns.TypeA)
+	requestPacket, err := request.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %s", err)
+	}
+
+	writePacket(makeUDPPacket(
+		clientIPAddress, GetTransparentDNSResolverIPv4Address(), 40000, 53, requestPacket))
+
+	p := readPacket(internetProtocolUDP)
+	if !p.sourceIPAddress.Equal(GetTransparentDNSResolverIPv4Address()) {
+		t.Fatalf("unexpected DNS response source: %s", p.sourceIPAddress)
+	}
+
+	// For each TCP flow, the hostname is determined once the flow has
+	// application data.
+
+	testCases := []struct {
+		port             int
+		payload          []byte
+		expectedHostname string
+	}{
+		{80, []byte("GET / HTTP/1.1\r\nHost: " + HTTPHostname + "\r\n\r\n"), HTTPHostname},
+		{443, []byte("not an HTTP request or TLS client hello"), resolvedHostname},
+	}
+
+	for i, testCase := range testCases {
+
+		clientPort := uint16(40001 + i)
+		clientSequence := uint32(1000)
+
+		writePacket(makeTCPPacket(
+			clientIPAddress, upstreamIPAddress, clientPort, uint16(testCase.port),
+			clientSequence, 0, tcpFlagSYN, 65535, nil, nil))
+		clientSequence += 1
+
+		for {
+			p = readPacket(internetProtocolTCP)
+			if p.destinationPort == clientPort {
+				break
+			}
+		}
+		if p.flags != tcpFlagSYN|tcpFlagACK {
+			t.Fatalf("unexpected SYN-ACK: %x", p.flags)
+		}
+
+		select {
+		case hostname := <-hostnames:
+			t.Fatalf("unexpected flow hostname before application data: %s", hostname)
+		default:
+		}
+
+		writePacket(makeTCPPacket(
+			clientIPAddress, upstreamIPAddress, clientPort, uint16(testCase.port),
+			clientSequence, p.sequence+1, tcpFlagACK|tcpFlagPSH, 65535, nil, testCase.payload))
+
+		hostname := readHostname()
+		if hostname != testCase.expectedHostname {
+			t.Fatalf("unexpected flow hostname: %s", hostname)
+		}
+	}
+}
+
+func TestDNSQueryFiltering(t *testing.T) {
+
+	// This test uses a packet tunnel server in userspace stack mode, which
+	// requires no tun device or root privileges, to check that DNS queries
+	// for blocked domains receive an NXDOMAIN response from the server and
+	// that other DNS queries are relayed.
+
+	clientIPv4Address := net.ParseIP("192.168.0.2").To4()
+	clientIPv6Address := net.ParseIP("fd00::2")
+	otherResolverIPAddress := net.ParseIP("192.0.2.53").To4()
+	allowedDomain := "example.org"
+	blockedDomain := "blocked.example.org"
+
+	DNSConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket failed: %s", err)
+	}
+	defer DNSConn.Close()
+
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, addr, err := DNSConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var request dns.Msg
+			if request.Unpack(buffer[:n]) != nil {
+				continue
+			}
+			response := new(dns.Msg)
+			response.SetReply(&request)
+			packet, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			DNSConn.WriteTo(packet, addr)
+		}
+	}()
+
+	flowDialer := func(
+		network string, IPAddress net.IP, port int) (net.Conn, error) {
+
+		if network == "udp" && port == 53 {
+			return net.Dial("udp", DNSConn.LocalAddr().String())
+		}
+		return nil, errors.New("unexpected upstream address")
+	}
+
+	checkedDomains := make(chan string, 16)
+
+	checkAllowedDomainFunc := func(domain string) bool {
+		checkedDomains <- domain
+		return domain != blockedDomain
+	}
+
+	server, err := NewServer(&ServerConfig{
+		Logger: newTestLogger(false),
+		GetDNSResolverIPv4Addresses: func() []net.IP {
+			return []net.IP{net.ParseIP("127.0.0.1").To4()}
+		},
+		GetDNSResolverIPv6Addresses: func() []net.IP {
+			return []net.IP{net.ParseIP("::1")}
+		},
+		UserspaceStack: true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+	server.Start()
+	defer server.Stop()
+
+	clientConn, serverConn := net.Pipe()
+
+	checkAllowedPortFunc := func(net.IP, int) bool { return true }
+
+	err = server.ClientConnected(
+		"session",
+		serverConn,
+		checkAllowedPortFunc,
+		checkAllowedPortFunc,
+		checkAllowedDomainFunc,
+		nil,
+		nil,
+		flowDialer)
+	if err != nil {
+		t.Fatalf("ClientConnected failed: %s", err)
+	}
+
+	channel := NewChannel(clientConn, getMTU(0))
+
+	testCases := []struct {
+		description          string
+		clientIPAddress      net.IP
+		resolverIPAddress    net.IP
+		domain               string
+		expectedResponseCode int
+	}{
+		{
+			"allowed IPv4",
+			clientIPv4Address, GetTransparentDNSResolverIPv4Address(),
+			allowedDomain, dns.RcodeSuccess,
+		},
+		{
+			"blocked IPv4",
+			clientIPv4Address, GetTransparentDNSResolverIPv4Address(),
+			blockedDomain, dns.RcodeNameError,
+		},
+		{
+			"blocked IPv6",
+			clientIPv6Address, GetTransparentDNSResolverIPv6Address(),
+			blockedDomain, dns.RcodeNameError,
+		},
+		{
+			"blocked other resolver",
+			clientIPv4Address, otherResolverIPAddress,
+			blockedDomain, dns.RcodeNameError,
+		},
+	}
+
+	for i, testCase := range testCases {
+
+		clientPort := uint16(40000 + i)
+
+		request := new(dns.Msg)
+		request.SetQuestion(dns.Fqdn(strings.ToUpper(testCase.domain)), dns.TypeA)
+		requestPacket, err := request.Pack()
+		if err != nil {
+			t.Fatalf("Pack failed: %s", err)
+		}
+
+		err = channel.WritePacket(makeUDPPacket(
+			testCase.clientIPAddress, testCase.resolverIPAddress,
+			clientPort, 53, requestPacket))
+		if err != nil {
+			t.Fatalf("WritePacket failed: %s", err)
+		}
+
+		select {
+		case domain := <-checkedDomains:
+			if domain != testCase.domain {
+				t.Fatalf("unexpected checked domain: %s", domain)
+			}
+		case <-time.After(STACK_TEST_TIMEOUT):
+			t.Fatalf("timeout waiting for domain check")
+		}
+
+		packet, err := channel.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %s", err)
+		}
+		packet = append([]byte(nil), packet...)
+
+		if !verifyStackPacketChecksums(packet) {
+			t.Fatalf("%s: invalid checksums", testCase.description)
+		}
+
+		p, ok := parseStackPacket(packet)
+		if !ok ||
+			p.protocol != internetProtocolUDP ||
+			!p.sourceIPAddress.Equal(testCase.resolverIPAddress) ||
+			!p.destinationIPAddress.Equal(testCase.clientIPAddress) ||
+			p.sourcePort != 53 ||
+			p.destinationPort != clientPort {
+			t.Fatalf("%s: unexpected DNS response packet", testCase.description)
+		}
+
+		var response dns.Msg
+		err = response.Unpack(p.payload)
+		if err != nil {
+			t.Fatalf("Unpack failed: %s", err)
+		}
+
+		if !response.Response ||
+			response.Id != request.Id ||
+			response.Rcode != testCase.expectedResponseCode ||
+			len(response.Question) != 1 ||
+			response.Question[0].Name != request.Question[0].Name {
+			t.Fatalf("%s: unexpected DNS response: %s", testCase.description, response.String())
+		}
+	}
+}
+
+func verifyStackPacketChecksums(packet []byte) bool {
+
+	var checksum uint32
+	var transportPacket []byte
+
+	if packet[0]>>4 == 4 {
+		if internetChecksum(packet[0:STACK_IPV4_HEADER_LENGTH]) != 0 {
+			return false
+		}
+		transportPacket = packet[STACK_IPV4_HEADER_LENGTH:]
+		checksum = checksumAdd(checksum, packet[12:20])
+		checksum += uint32(packet[9]) + uint32(len(transportPacket))
+	} else {
+		transportPacket = packet[STACK_IPV6_HEADER_LENGTH:]
+		checksum = checksumAdd(checksum, packet[8:40])
+		checksum += uint32(packet[6]) + uint32(len(transportPacket))
+	}
+
+	return checksumFold(checksumAdd(checksum, transportPacket)) == 0xFFFF
+}
@@ -91,6 +91,15 @@ to different servers without having to tear down or change their local
 network configuration. Clients may configure their local tun device with an
 arbitrary IP address and a static DNS resolver address.
 
+Optionally, a client may request its session configuration -- the assigned
+IP addresses, the server MTU, and the transparent DNS resolver addresses --
+from the server, using a control message sent through the channel. A client
+which adopts this configuration avoids MTU mismatches, and its packets don't
+require address rewriting on the server to which it is connected. As each
+server assigns its own configuration, the client requests the configuration
+again after reconnecting to a different server. Servers which don't support
+session configuration requests drop the request and don't respond.
+
 The server uses the 24-bit 10.0.0.0/8 IPv4 private address space to maximize
 the number of addresses available, due to Psiphon client churn and minimum
 address lease time constraints. For IPv6, a 24-bit unique local space is used.
@@ -110,13 +119,27 @@ Packet count and bytes transferred metrics are logged for each client session.
 
 The server integrates with and enforces Psiphon traffic rules and logging
 facilities. The server parses and validates packets. Client-to-client packets
-are not permitted. Only global unicast packets are permitted. Only TCP and UDP
-packets are permitted. The client also filters out, before sending, packets
-that the server won't route.
+are not permitted. Only global unicast packets are permitted. Only TCP, UDP,
+and ICMP echo packets are permitted. The client also filters out, before
+sending, packets that the server won't route.
+
+ICMP echo requests, as sent by ping, are relayed upstream and the
+corresponding echo replies are relayed downstream. In addition to the
+source address rewriting, the server rewrites the echo identifier of
+each client echo request to a random per-session value, and restores
+the original identifier in the echo reply. Only echo replies matching a
+recent echo request are relayed to the client, and echo requests are
+rate limited per session. Other ICMP messages, such as destination
+unreachable or time exceeded, are not relayed.
+
+The server may also filter client DNS queries by domain. Queries for domains
+that the traffic rules don't permit are not relayed; instead, the server
+responds to the client with NXDOMAIN.
 
 Certain aspects of packet tunneling are outside the scope of this package;
 e.g, the Psiphon client and server are responsible for establishing an SSH
-channel and negotiating the correct MTU and DNS settings. The Psiphon
+channel and, unless session configuration requests are used, negotiating the
+correct MTU and DNS settings. The Psiphon
 server will call Server.ClientConnected when a client connects and establishes
 a packet tunnel channel; and Server.ClientDisconnected when the client closes
 the channel and/or disconnects.
@@ -127,18 +150,22 @@ package tun
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/Psiphon-Labs/dns"
 	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/juju/ratelimit"
 )
 
 const (
@@ -148,6 +175,10 @@ const (
 	DEFAULT_IDLE_SESSION_EXPIRY_SECONDS  = 300
 	ORPHAN_METRICS_CHECKPOINTER_PERIOD   = 30 * time.Minute
 	FLOW_IDLE_EXPIRY                     = 60 * time.Second
+	ICMP_ECHO_IDLE_EXPIRY                = 30 * time.Second
+	DEFAULT_ICMP_ECHO_REQUEST_RATE       = 10
+	MAX_RESOLVED_HOSTNAMES               = 4096
+	MAX_RESOLVED_HOSTNAME_EXPIRY         = 1 * time.Hour
 )
 
 // ServerConfig specifies the configuration of a packet tunnel server.
@@ -237,6 +268,23 @@ type ServerConfig struct {
 	// SessionIdleExpirySeconds is also, effectively, the lease
 	// time for assigned IP addresses.
 	SessionIdleExpirySeconds int
+
+	// ICMPEchoRequestsPerSecond specifies the maximum rate of ICMP
+	// echo requests relayed for each client session. Echo requests
+	// exceeding the rate are dropped. A burst of up to one second's
+	// worth of echo requests is permitted.
+	// When ICMPEchoRequestsPerSecond is 0, a default value is used.
+	ICMPEchoRequestsPerSecond int
+
+	// UserspaceStack specifies whether to terminate client TCP and UDP
+	// flows in a userspace network stack instead of relaying packets
+	// through a tun device. In this mode, no tun device, NAT, or network
+	// configuration commands are used, and each client flow is relayed
+	// through a connection established by the FlowDialer passed to
+	// ClientConnected. SudoNetworkConfigCommands,
+	// AllowNoIPv6NetworkConfiguration, and EgressInterface are ignored.
+	// ICMP echo is not relayed in this mode.
+	UserspaceStack bool
 }
 
 // Server is a packet tunnel server. A packet tunnel server
@@ -245,6 +293,10 @@ type ServerConfig struct {
 // device. The server assigns IP addresses to clients, performs
 // IP address and transparent DNS rewriting, and enforces
 // traffic rules.
+//
+// In userspace stack mode, there is no tun device. Instead,
+// each session has a userspace network stack which terminates
+// the client's TCP and UDP flows; see ServerConfig.UserspaceStack.
 type Server struct {
 	config              *ServerConfig
 	device              *Device
@@ -255,18 +307,25 @@ type Server struct {
 	runContext          context.Context
 	stopRunning         context.CancelFunc
 	orphanMetrics       *packetMetrics
+	totalMetrics        *packetMetrics
 }
 
 // NewServer initializes a server.
 func NewServer(config *ServerConfig) (*Server, error) {
 
-	device, err := NewServerDevice(config)
-	if err != nil {
-		return nil, common.ContextError(err)
+	var device *Device
+	if !config.UserspaceStack {
+		var err error
+		device, err = NewServerDevice(config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
 	}
 
 	runContext, stopRunning := context.WithCancel(context.Background())
 
+	totalMetrics := new(packetMetrics)
+
 	return &Server{
 		config:              config,
 		device:              device,
@@ -274,7 +333,8 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		workers:             new(sync.WaitGroup),
 		runContext:          runContext,
 		stopRunning:         stopRunning,
-		orphanMetrics:       new(packetMetrics),
+		orphanMetrics:       &packetMetrics{parent: totalMetrics},
+		totalMetrics:        totalMetrics,
 	}, nil
 }
 
@@ -289,8 +349,18 @@ func (server *Server) Start() {
 	server.workers.Add(1)
 	go server.runOrphanMetricsCheckpointer()
 
-	server.workers.Add(1)
-	go server.runDeviceDownstream()
+	if server.device != nil {
+		server.workers.Add(1)
+		go server.runDeviceDownstream()
+	}
+}
+
+// GetMetrics returns cumulative packet metrics, for all sessions and for
+// orphan packets, since the server was initialized. The metric names are
+// the same as in "packet_metrics" logs. Unlike the logged metrics, which
+// are reset after each log, these counters are never reset.
+func (server *Server) GetMetrics() common.LogFields {
+	return server.totalMetrics.snapshot()
 }
 
 // Stop halts a running server.
@@ -301,7 +371,9 @@ func (server *Server) Stop() {
 	server.stopRunning()
 
 	// Interrupt blocked device read/writes.
-	server.device.Close()
+	if server.device != nil {
+		server.device.Close()
+	}
 
 	// Wait for any in-progress ClientConnected calls to complete.
 	server.connectedInProgress.Wait()
@@ -316,6 +388,9 @@ func (server *Server) Stop() {
 	server.indexToSession.Range(func(_, value interface{}) bool {
 		session := value.(*session)
 		server.interruptSession(session)
+		if session.stack != nil {
+			session.stack.close()
+		}
 		return true
 	})
 
@@ -329,6 +404,11 @@ func (server *Server) Stop() {
 // and/or port.
 type AllowedPortChecker func(upstreamIPAddress net.IP, port int) bool
 
+// AllowedDomainChecker is a function which returns true when it is
+// permitted to resolve the specified domain. The domain is lowercase
+// and has no trailing dot.
+type AllowedDomainChecker func(domain string) bool
+
 // FlowActivityUpdater defines an interface for receiving updates for
 // flow activity. Values passed to UpdateProgress are bytes transferred
 // and flow duration since the previous UpdateProgress.
@@ -362,6 +442,13 @@ type MetricsUpdater func(
 // permitted. These callbacks must be efficient and safe for concurrent
 // calls.
 //
+// checkAllowedDomainFunc, when not nil, is a callback used to filter
+// client DNS queries. For each UDP DNS query packet, the function is
+// called with the queried domain; when the domain is not permitted, the
+// query is not relayed and the server instead responds to the client
+// with an NXDOMAIN response. This callback must also be efficient and
+// safe for concurrent calls. DNS over TCP is not filtered.
+//
 // flowActivityUpdaterMaker is a callback invoked for each new packet
 // flow; it may create updaters to track flow activity.
 //
@@ -369,6 +456,12 @@ type MetricsUpdater func(
 // when the client disconnects) with a summary of application bytes
 // transferred.
 //
+// flowDialer is used only in userspace stack mode, where it is invoked
+// to establish an upstream connection for each new TCP or UDP flow; see
+// FlowDialer. Flows may outlive the client connection, as NAT state does,
+// so conns established by flowDialer may remain in use after the client
+// disconnects.
+//
 // It is safe to make concurrent calls to ClientConnected for distinct
 // session IDs. The caller is responsible for serializing calls with the
 // same session ID. Further, the caller must ensure, in the case of a client
@@ -381,8 +474,10 @@ func (server *Server) ClientConnected(
 	sessionID string,
 	transport io.ReadWriteCloser,
 	checkAllowedTCPPortFunc, checkAllowedUDPPortFunc AllowedPortChecker,
+	checkAllowedDomainFunc AllowedDomainChecker,
 	flowActivityUpdaterMaker FlowActivityUpdaterMaker,
-	metricsUpdater MetricsUpdater) error {
+	metricsUpdater MetricsUpdater,
+	flowDialer FlowDialer) error {
 
 	// It's unusual to call both sync.WaitGroup.Add() _and_ Done() in the same
 	// goroutine. There's no other place to call Add() since ClientConnected is
@@ -435,13 +530,20 @@ func (server *Server) ClientConnected(
 			DNSResolverIPv4Addresses[i] = resolver.To4()
 		}
 
+		ICMPEchoRequestsPerSecond := DEFAULT_ICMP_ECHO_REQUEST_RATE
+		if server.config.ICMPEchoRequestsPerSecond > 0 {
+			ICMPEchoRequestsPerSecond = server.config.ICMPEchoRequestsPerSecond
+		}
+
 		clientSession = &session{
 			lastActivity:             int64(monotime.Now()),
 			sessionID:                sessionID,
-			metrics:                  new(packetMetrics),
+			metrics:                  &packetMetrics{parent: server.totalMetrics},
 			DNSResolverIPv4Addresses: append([]net.IP(nil), DNSResolverIPv4Addresses...),
 			DNSResolverIPv6Addresses: append([]net.IP(nil), server.config.GetDNSResolverIPv6Addresses()...),
-			workers:                  new(sync.WaitGroup),
+			ICMPEchoRequestLimiter: ratelimit.NewBucketWithRate(
+				float64(ICMPEchoRequestsPerSecond), int64(ICMPEchoRequestsPerSecond)),
+			workers: new(sync.WaitGroup),
 		}
 
 		// allocateIndex initializes session.index, session.assignedIPv4Address,
@@ -452,6 +554,10 @@ func (server *Server) ClientConnected(
 		if err != nil {
 			return common.ContextError(err)
 		}
+
+		if server.config.UserspaceStack {
+			clientSession.stack = newStack(server.config.Logger, clientSession, MTU)
+		}
 	}
 
 	// Note: it's possible that a client disconnects (or reconnects before a
@@ -464,8 +570,10 @@ func (server *Server) ClientConnected(
 		NewChannel(transport, MTU),
 		checkAllowedTCPPortFunc,
 		checkAllowedUDPPortFunc,
+		checkAllowedDomainFunc,
 		flowActivityUpdaterMaker,
-		metricsUpdater)
+		metricsUpdater,
+		flowDialer)
 
 	return nil
 }
@@ -502,8 +610,10 @@ func (server *Server) resumeSession(
 	session *session,
 	channel *Channel,
 	checkAllowedTCPPortFunc, checkAllowedUDPPortFunc AllowedPortChecker,
+	checkAllowedDomainFunc AllowedDomainChecker,
 	flowActivityUpdaterMaker FlowActivityUpdaterMaker,
-	metricsUpdater MetricsUpdater) {
+	metricsUpdater MetricsUpdater,
+	flowDialer FlowDialer) {
 
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
@@ -539,10 +649,14 @@ func (server *Server) resumeSession(
 
 	session.setCheckAllowedUDPPortFunc(&checkAllowedUDPPortFunc)
 
+	session.setCheckAllowedDomainFunc(&checkAllowedDomainFunc)
+
 	session.setFlowActivityUpdaterMaker(&flowActivityUpdaterMaker)
 
 	session.setMetricsUpdater(&metricsUpdater)
 
+	session.setFlowDialer(&flowDialer)
+
 	session.channel = channel
 
 	// Parent context is not server.runContext so that session workers
@@ -615,9 +729,13 @@ func (server *Server) interruptSession(session *session) {
 
 	session.setCheckAllowedUDPPortFunc(nil)
 
+	session.setCheckAllowedDomainFunc(nil)
+
 	session.setFlowActivityUpdaterMaker(nil)
 
 	session.setMetricsUpdater(nil)
+
+	session.setFlowDialer(nil)
 }
 
 func (server *Server) runSessionReaper() {
@@ -668,6 +786,9 @@ func (server *Server) removeSession(session *session) {
 	server.sessionIDToIndex.Delete(session.sessionID)
 	server.indexToSession.Delete(session.index)
 	server.interruptSession(session)
+	if session.stack != nil {
+		session.stack.close()
+	}
 }
 
 func (server *Server) runOrphanMetricsCheckpointer() {
@@ -807,7 +928,8 @@ func (server *Server) runClientUpstream(session *session) {
 	defer session.workers.Done()
 
 	// Read incoming packets from the client channel, validate the packets,
-	// perform rewriting, and send them through to the tun device.
+	// perform rewriting, and send them through to the tun device or
+	// userspace stack.
 
 	for {
 		readPacket, err := session.channel.ReadPacket()
@@ -833,6 +955,11 @@ func (server *Server) runClientUpstream(session *session) {
 
 		session.touch()
 
+		if isControlMessage(readPacket) {
+			server.handleControlMessage(session, readPacket)
+			continue
+		}
+
 		// processPacket transparently rewrites the source address to the
 		// session's assigned address and rewrites the destination of any
 		// DNS packets destined to the target DNS resolver.
@@ -853,6 +980,11 @@ func (server *Server) runClientUpstream(session *session) {
 			continue
 		}
 
+		if session.stack != nil {
+			session.stack.handlePacket(readPacket)
+			continue
+		}
+
 		err = server.device.WritePacket(readPacket)
 
 		if err != nil {
@@ -865,6 +997,56 @@ func (server *Server) runClientUpstream(session *session) {
 	}
 }
 
+func (server *Server) handleControlMessage(session *session, message []byte) {
+
+	messageType, _, ok := parseControlMessage(message)
+	if !ok || messageType != controlMessageSessionConfigurationRequest {
+		server.config.Logger.WithContext().Debug("unexpected control message")
+		return
+	}
+
+	// The session configuration response is written directly to the
+	// channel, concurrent with runClientDownstream writes, rather than
+	// enqueued in the downstream packet queue, which supports only a
+	// single writer.
+
+	payload, err := json.Marshal(server.getSessionConfiguration(session))
+	if err != nil {
+		server.config.Logger.WithContextFields(
+			common.LogFields{"error": err}).Warning("marshal session configuration failed")
+		return
+	}
+
+	err = session.channel.WritePacket(
+		makeControlMessage(controlMessageSessionConfigurationResponse, payload))
+	if err != nil {
+		// Debug since channel I/O errors occur during normal operation.
+		// Any persistent channel failure will tear down the session in
+		// runClientUpstream or runClientDownstream.
+		server.config.Logger.WithContextFields(
+			common.LogFields{"error": err}).Debug("write session configuration failed")
+	}
+}
+
+func (server *Server) getSessionConfiguration(session *session) *SessionConfiguration {
+
+	// The assigned addresses are in the server's private subnets, and use
+	// the subnet netmask and prefix.
+
+	IPv4PrefixLength, _ := privateSubnetIPv4.Mask.Size()
+	IPv6PrefixLength, _ := privateSubnetIPv6.Mask.Size()
+
+	return &SessionConfiguration{
+		IPv4AddressCIDR: fmt.Sprintf(
+			"%s/%d", session.assignedIPv4Address, IPv4PrefixLength),
+		IPv6AddressCIDR: fmt.Sprintf(
+			"%s/%d", session.assignedIPv6Address, IPv6PrefixLength),
+		MTU:                    getMTU(server.config.MTU),
+		DNSResolverIPv4Address: transparentDNSResolverIPv4Address.String(),
+		DNSResolverIPv6Address: transparentDNSResolverIPv6Address.String(),
+	}
+}
+
 func (server *Server) runClientDownstream(session *session) {
 
 	defer session.workers.Done()
@@ -979,7 +1161,11 @@ func (server *Server) allocateIndex(newSession *session) error {
 		newSession.assignedIPv6Address = server.convertIndexToIPv6Address(index)
 		server.sessionIDToIndex.Store(newSession.sessionID, index)
 
-		server.resetRouting(newSession.assignedIPv4Address, newSession.assignedIPv6Address)
+		// In userspace stack mode, there are no NAT tables to reset; flow
+		// state is discarded with the session's stack.
+		if !server.config.UserspaceStack {
+			server.resetRouting(newSession.assignedIPv4Address, newSession.assignedIPv6Address)
+		}
 
 		return nil
 	}
@@ -1052,10 +1238,13 @@ type session struct {
 	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
 	lastActivity             int64
 	lastFlowReapIndex        int64
+	lastICMPEchoReapIndex    int64
 	checkAllowedTCPPortFunc  unsafe.Pointer
 	checkAllowedUDPPortFunc  unsafe.Pointer
+	checkAllowedDomainFunc   unsafe.Pointer
 	flowActivityUpdaterMaker unsafe.Pointer
 	metricsUpdater           unsafe.Pointer
+	flowDialer               unsafe.Pointer
 	downstreamPackets        unsafe.Pointer
 
 	metrics                  *packetMetrics
@@ -1070,6 +1259,12 @@ type session struct {
 	setOriginalIPv6Address   int32
 	originalIPv6Address      net.IP
 	flows                    sync.Map
+	ICMPEchoRequestLimiter   *ratelimit.Bucket
+	ICMPEchoUpstreamFlows    sync.Map
+	ICMPEchoDownstreamFlows  sync.Map
+	resolvedHostnamesMutex   sync.Mutex
+	resolvedHostnames        map[[net.IPv6len]byte]resolvedHostname
+	stack                    *stack
 	workers                  *sync.WaitGroup
 	mutex                    sync.Mutex
 	channel                  *Channel
@@ -1141,6 +1336,18 @@ func (session *session) getCheckAllowedUDPPortFunc() AllowedPortChecker {
 	return *p
 }
 
+func (session *session) setCheckAllowedDomainFunc(p *AllowedDomainChecker) {
+	atomic.StorePointer(&session.checkAllowedDomainFunc, unsafe.Pointer(p))
+}
+
+func (session *session) getCheckAllowedDomainFunc() AllowedDomainChecker {
+	p := (*AllowedDomainChecker)(atomic.LoadPointer(&session.checkAllowedDomainFunc))
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
 func (session *session) setFlowActivityUpdaterMaker(p *FlowActivityUpdaterMaker) {
 	atomic.StorePointer(&session.flowActivityUpdaterMaker, unsafe.Pointer(p))
 }
@@ -1165,6 +1372,18 @@ func (session *session) getMetricsUpdater() MetricsUpdater {
 	return *p
 }
 
+func (session *session) setFlowDialer(p *FlowDialer) {
+	atomic.StorePointer(&session.flowDialer, unsafe.Pointer(p))
+}
+
+func (session *session) getFlowDialer() FlowDialer {
+	p := (*FlowDialer)(atomic.LoadPointer(&session.flowDialer))
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
 func (session *session) setDownstreamPackets(p *PacketQueue) {
 	atomic.StorePointer(&session.downstreamPackets, unsafe.Pointer(p))
 }
@@ -1218,6 +1437,8 @@ type flowState struct {
 	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
 	lastUpstreamPacketTime   int64
 	lastDownstreamPacketTime int64
+	pendingActivityUpdaters  int32
+	activityUpdatersMutex    sync.Mutex
 	activityUpdaters         []FlowActivityUpdater
 }
 
@@ -1251,12 +1472,17 @@ func (session *session) isTrackingFlow(ID flowID) bool {
 // Flow tracking is used to implement:
 // - one-time permissions checks for a flow
 // - OSLs
-// - domain bytes transferred [TODO]
+// - domain bytes transferred
 //
-// The applicationData from the first packet in the flow is
-// inspected to determine any associated hostname, using HTTP or
-// TLS payload. The session's FlowActivityUpdaterMaker is invoked
-// to determine a list of updaters to track flow activity.
+// The session's FlowActivityUpdaterMaker is invoked to determine a
+// list of updaters to track flow activity. The maker is passed the
+// flow's upstream hostname, when known. For TCP flows, the hostname
+// is extracted from the first upstream application data in the flow,
+// using HTTP or TLS payload; as the first packet in a TCP flow, a
+// SYN, has no application data, the maker isn't invoked until the
+// first packet with application data. Otherwise, the hostname is the
+// name most recently resolved to the upstream IP address in a DNS
+// response relayed to the client; see recordDNSResponse.
 //
 // Updaters receive reports with the number of application data
 // bytes in each flow packet. This number, totalled for all packets
@@ -1282,25 +1508,16 @@ func (session *session) startTrackingFlow(
 	if reapIndex != previousReapIndex &&
 		atomic.CompareAndSwapInt64(&session.lastFlowReapIndex, previousReapIndex, reapIndex) {
 		session.reapFlows()
+		session.reapResolvedHostnames()
 	}
 
-	var hostname string
-	if ID.protocol == internetProtocolTCP {
-		// TODO: implement
-		// hostname = common.ExtractHostnameFromTCPFlow(applicationData)
-	}
-
-	var activityUpdaters []FlowActivityUpdater
+	flowState := &flowState{}
 
-	flowActivityUpdaterMaker := session.getFlowActivityUpdaterMaker()
-	if flowActivityUpdaterMaker != nil {
-		activityUpdaters = flowActivityUpdaterMaker(
-			hostname,
-			net.IP(ID.upstreamIPAddress[:]))
-	}
-
-	flowState := &flowState{
-		activityUpdaters: activityUpdaters,
+	if ID.protocol == internetProtocolTCP && len(applicationData) == 0 {
+		flowState.pendingActivityUpdaters = 1
+	} else {
+		flowState.activityUpdaters = session.makeFlowActivityUpdaters(
+			ID, direction, applicationData)
 	}
 
 	if direction == packetDirectionServerUpstream {
@@ -1315,6 +1532,29 @@ func (session *session) startTrackingFlow(
 	session.updateFlow(ID, direction, applicationData)
 }
 
+func (session *session) makeFlowActivityUpdaters(
+	ID flowID, direction packetDirection, applicationData []byte) []FlowActivityUpdater {
+
+	flowActivityUpdaterMaker := session.getFlowActivityUpdaterMaker()
+	if flowActivityUpdaterMaker == nil {
+		return nil
+	}
+
+	upstreamIPAddress := net.IP(ID.upstreamIPAddress[:])
+
+	var hostname string
+	if ID.protocol == internetProtocolTCP &&
+		direction == packetDirectionServerUpstream {
+
+		hostname = common.ExtractHostnameFromTCPFlow(applicationData)
+	}
+	if hostname == "" {
+		hostname = session.getResolvedHostname(upstreamIPAddress)
+	}
+
+	return flowActivityUpdaterMaker(hostname, upstreamIPAddress)
+}
+
 func (session *session) updateFlow(
 	ID flowID, direction packetDirection, applicationData []byte) {
 
@@ -1345,6 +1585,25 @@ func (session *session) updateFlow(
 		durationNanoseconds = now - atomic.SwapInt64(&flowState.lastDownstreamPacketTime, now)
 	}
 
+	// Make any pending updaters once the flow has application data. As
+	// the updaters don't yet exist, any activity before this point, which
+	// is only the duration of the TCP handshake, isn't reported.
+
+	if atomic.LoadInt32(&flowState.pendingActivityUpdaters) == 1 {
+
+		if len(applicationData) == 0 {
+			return
+		}
+
+		flowState.activityUpdatersMutex.Lock()
+		if atomic.LoadInt32(&flowState.pendingActivityUpdaters) == 1 {
+			flowState.activityUpdaters = session.makeFlowActivityUpdaters(
+				ID, direction, applicationData)
+			atomic.StoreInt32(&flowState.pendingActivityUpdaters, 0)
+		}
+		flowState.activityUpdatersMutex.Unlock()
+	}
+
 	for _, updater := range flowState.activityUpdaters {
 		updater.UpdateProgress(upstreamBytes, downstreamBytes, durationNanoseconds)
 	}
@@ -1361,6 +1620,250 @@ func (session *session) reapFlows() {
 	})
 }
 
+type resolvedHostname struct {
+	hostname string
+	expiry   monotime.Time
+}
+
+// recordDNSResponse records the IP addresses resolved in a DNS response
+// relayed to the client, mapping each address to the hostname in the DNS
+// question. This mapping is used to determine the upstream hostname for
+// flows which don't reveal the hostname in their application data.
+//
+// Mappings are retained for the DNS record TTL, with a minimum of
+// FLOW_IDLE_EXPIRY and a maximum of MAX_RESOLVED_HOSTNAME_EXPIRY. At most
+// MAX_RESOLVED_HOSTNAMES mappings are retained per session; new mappings
+// are dropped while this limit is reached.
+func (session *session) recordDNSResponse(message []byte) {
+
+	var response dns.Msg
+	err := response.Unpack(message)
+	if err != nil ||
+		!response.Response ||
+		response.Rcode != dns.RcodeSuccess ||
+		len(response.Question) != 1 {
+		return
+	}
+
+	hostname := strings.ToLower(
+		strings.TrimSuffix(response.Question[0].Name, "."))
+	if hostname == "" {
+		return
+	}
+
+	now := monotime.Now()
+
+	session.resolvedHostnamesMutex.Lock()
+	defer session.resolvedHostnamesMutex.Unlock()
+
+	if session.resolvedHostnames == nil {
+		session.resolvedHostnames = make(map[[net.IPv6len]byte]resolvedHostname)
+	}
+
+	for _, answer := range response.Answer {
+
+		var IPAddress net.IP
+		switch record := answer.(type) {
+		case *dns.A:
+			IPAddress = record.A
+		case *dns.AAAA:
+			IPAddress = record.AAAA
+		default:
+			continue
+		}
+
+		var key [net.IPv6len]byte
+		if copy(key[:], IPAddress.To16()) != net.IPv6len {
+			continue
+		}
+
+		_, ok := session.resolvedHostnames[key]
+		if !ok && len(session.resolvedHostnames) >= MAX_RESOLVED_HOSTNAMES {
+			continue
+		}
+
+		TTL := time.Duration(answer.Header().Ttl) * time.Second
+		if TTL < FLOW_IDLE_EXPIRY {
+			TTL = FLOW_IDLE_EXPIRY
+		} else if TTL > MAX_RESOLVED_HOSTNAME_EXPIRY {
+			TTL = MAX_RESOLVED_HOSTNAME_EXPIRY
+		}
+
+		session.resolvedHostnames[key] = resolvedHostname{
+			hostname: hostname,
+			expiry:   now.Add(TTL),
+		}
+	}
+}
+
+// getResolvedHostname returns the hostname most recently resolved to the
+// specified IP address, or "" when there is no unexpired mapping.
+func (session *session) getResolvedHostname(IPAddress net.IP) string {
+
+	var key [net.IPv6len]byte
+	if copy(key[:], IPAddress.To16()) != net.IPv6len {
+		return ""
+	}
+
+	session.resolvedHostnamesMutex.Lock()
+	defer session.resolvedHostnamesMutex.Unlock()
+
+	entry, ok := session.resolvedHostnames[key]
+	if !ok || monotime.Now().After(entry.expiry) {
+		return ""
+	}
+
+	return entry.hostname
+}
+
+// reapResolvedHostnames removes expired resolved hostname mappings.
+func (session *session) reapResolvedHostnames() {
+
+	now := monotime.Now()
+
+	session.resolvedHostnamesMutex.Lock()
+	defer session.resolvedHostnamesMutex.Unlock()
+
+	for key, entry := range session.resolvedHostnames {
+		if now.After(entry.expiry) {
+			delete(session.resolvedHostnames, key)
+		}
+	}
+}
+
+// icmpEchoID identifies an ICMP echo exchange between a client and an
+// upstream host. The identifier is the client's original echo identifier
+// when the icmpEchoID is a key for ICMPEchoUpstreamFlows, and the
+// rewritten identifier when the key is for ICMPEchoDownstreamFlows.
+type icmpEchoID struct {
+	upstreamIPAddress [net.IPv6len]byte
+	identifier        uint16
+}
+
+func (ID *icmpEchoID) set(upstreamIPAddress net.IP, identifier uint16) {
+	if len(upstreamIPAddress) == net.IPv4len {
+		copy(ID.upstreamIPAddress[:], v4InV6Prefix)
+		copy(ID.upstreamIPAddress[len(v4InV6Prefix):], upstreamIPAddress)
+	} else { // net.IPv6len
+		copy(ID.upstreamIPAddress[:], upstreamIPAddress)
+	}
+	ID.identifier = identifier
+}
+
+type icmpEchoFlowState struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	lastUpstreamPacketTime int64
+	originalIdentifier     uint16
+	rewrittenIdentifier    uint16
+}
+
+func (flowState *icmpEchoFlowState) expired(idleExpiry time.Duration) bool {
+	lastUpstreamPacketTime := monotime.Time(atomic.LoadInt64(&flowState.lastUpstreamPacketTime))
+	return monotime.Since(lastUpstreamPacketTime) > idleExpiry
+}
+
+// getICMPEchoRewrittenIdentifier returns the rewritten echo identifier to
+// use for an upstream echo request with the specified original identifier.
+// Each distinct original identifier, per upstream IP address, is mapped to
+// a random rewritten identifier that is not already in use. The mapping is
+// retained until no echo requests are sent for ICMP_ECHO_IDLE_EXPIRY.
+//
+// getICMPEchoRewrittenIdentifier is called only from the session's single
+// upstream packet relay goroutine, so allocating and storing a new mapping
+// does not race with another allocation.
+func (session *session) getICMPEchoRewrittenIdentifier(
+	upstreamIPAddress net.IP, originalIdentifier uint16) (uint16, bool) {
+
+	now := int64(monotime.Now())
+
+	// Once every period, iterate over flows and reap expired entries.
+	reapIndex := now / int64(monotime.Time(ICMP_ECHO_IDLE_EXPIRY/2))
+	previousReapIndex := atomic.LoadInt64(&session.lastICMPEchoReapIndex)
+	if reapIndex != previousReapIndex &&
+		atomic.CompareAndSwapInt64(&session.lastICMPEchoReapIndex, previousReapIndex, reapIndex) {
+		session.reapICMPEchoFlows()
+	}
+
+	var upstreamID icmpEchoID
+	upstreamID.set(upstreamIPAddress, originalIdentifier)
+
+	f, ok := session.ICMPEchoUpstreamFlows.Load(upstreamID)
+	if ok {
+		flowState := f.(*icmpEchoFlowState)
+		atomic.StoreInt64(&flowState.lastUpstreamPacketTime, now)
+		return flowState.rewrittenIdentifier, true
+	}
+
+	// Select a random, unused identifier. Give up after a number of
+	// attempts; this will only happen when the client is sending echo
+	// requests with a very large number of distinct identifiers.
+
+	downstreamID := upstreamID
+
+	for i := 0; i < 16; i++ {
+
+		downstreamID.identifier = uint16(rand.Intn(65536))
+
+		_, ok := session.ICMPEchoDownstreamFlows.Load(downstreamID)
+		if ok {
+			continue
+		}
+
+		flowState := &icmpEchoFlowState{
+			lastUpstreamPacketTime: now,
+			originalIdentifier:     originalIdentifier,
+			rewrittenIdentifier:    downstreamID.identifier,
+		}
+
+		session.ICMPEchoDownstreamFlows.Store(downstreamID, flowState)
+		session.ICMPEchoUpstreamFlows.Store(upstreamID, flowState)
+
+		return flowState.rewrittenIdentifier, true
+	}
+
+	return 0, false
+}
+
+// getICMPEchoOriginalIdentifier returns the client's original echo
+// identifier for a downstream echo reply with the specified rewritten
+// identifier. getICMPEchoOriginalIdentifier returns false when there is no
+// corresponding, unexpired echo request.
+func (session *session) getICMPEchoOriginalIdentifier(
+	upstreamIPAddress net.IP, rewrittenIdentifier uint16) (uint16, bool) {
+
+	var downstreamID icmpEchoID
+	downstreamID.set(upstreamIPAddress, rewrittenIdentifier)
+
+	f, ok := session.ICMPEchoDownstreamFlows.Load(downstreamID)
+	if !ok {
+		return 0, false
+	}
+	flowState := f.(*icmpEchoFlowState)
+
+	if flowState.expired(ICMP_ECHO_IDLE_EXPIRY) {
+		return 0, false
+	}
+
+	return flowState.originalIdentifier, true
+}
+
+// reapICMPEchoFlows removes expired ICMP echo identifier mappings.
+func (session *session) reapICMPEchoFlows() {
+	session.ICMPEchoUpstreamFlows.Range(func(key, value interface{}) bool {
+		flowState := value.(*icmpEchoFlowState)
+		if flowState.expired(ICMP_ECHO_IDLE_EXPIRY) {
+			upstreamID := key.(icmpEchoID)
+			downstreamID := upstreamID
+			downstreamID.identifier = flowState.rewrittenIdentifier
+			session.ICMPEchoDownstreamFlows.Delete(downstreamID)
+			session.ICMPEchoUpstreamFlows.Delete(key)
+		}
+		return true
+	})
+}
+
 type packetMetrics struct {
 	upstreamRejectReasons   [packetRejectReasonCount]int64
 	downstreamRejectReasons [packetRejectReasonCount]int64
@@ -1368,6 +1871,12 @@ type packetMetrics struct {
 	TCPIPv6                 relayedPacketMetrics
 	UDPIPv4                 relayedPacketMetrics
 	UDPIPv6                 relayedPacketMetrics
+	ICMPIPv4                relayedPacketMetrics
+	ICMPIPv6                relayedPacketMetrics
+
+	// parent, when set, is a packetMetrics to which all metrics
+	// are also added. Parent metrics are not reset by checkpoint.
+	parent *packetMetrics
 }
 
 type relayedPacketMetrics struct {
@@ -1393,6 +1902,10 @@ func (metrics *packetMetrics) rejectedPacket(
 		atomic.AddInt64(&metrics.downstreamRejectReasons[reason], 1)
 
 	}
+
+	if metrics.parent != nil {
+		metrics.parent.rejectedPacket(direction, reason)
+	}
 }
 
 func (metrics *packetMetrics) relayedPacket(
@@ -1401,67 +1914,53 @@ func (metrics *packetMetrics) relayedPacket(
 	protocol internetProtocol,
 	packetLength, applicationDataLength int) {
 
-	var packetsMetric, bytesMetric, applicationBytesMetric *int64
+	var relayedMetrics *relayedPacketMetrics
 
-	if direction == packetDirectionServerUpstream ||
-		direction == packetDirectionClientUpstream {
-
-		if version == 4 {
+	if version == 4 {
 
-			if protocol == internetProtocolTCP {
-				packetsMetric = &metrics.TCPIPv4.packetsUp
-				bytesMetric = &metrics.TCPIPv4.bytesUp
-				applicationBytesMetric = &metrics.TCPIPv4.applicationBytesUp
-			} else { // UDP
-				packetsMetric = &metrics.UDPIPv4.packetsUp
-				bytesMetric = &metrics.UDPIPv4.bytesUp
-				applicationBytesMetric = &metrics.UDPIPv4.applicationBytesUp
-			}
+		if protocol == internetProtocolTCP {
+			relayedMetrics = &metrics.TCPIPv4
+		} else if protocol == internetProtocolUDP {
+			relayedMetrics = &metrics.UDPIPv4
+		} else { // ICMPv4
+			relayedMetrics = &metrics.ICMPIPv4
+		}
 
-		} else { // IPv6
+	} else { // IPv6
 
-			if protocol == internetProtocolTCP {
-				packetsMetric = &metrics.TCPIPv6.packetsUp
-				bytesMetric = &metrics.TCPIPv6.bytesUp
-				applicationBytesMetric = &metrics.TCPIPv6.applicationBytesUp
-			} else { // UDP
-				packetsMetric = &metrics.UDPIPv6.packetsUp
-				bytesMetric = &metrics.UDPIPv6.bytesUp
-				applicationBytesMetric = &metrics.UDPIPv6.applicationBytesUp
-			}
+		if protocol == internetProtocolTCP {
+			relayedMetrics = &metrics.TCPIPv6
+		} else if protocol == internetProtocolUDP {
+			relayedMetrics = &metrics.UDPIPv6
+		} else { // ICMPv6
+			relayedMetrics = &metrics.ICMPIPv6
 		}
+	}
 
-	} else { // packetDirectionDownstream
+	var packetsMetric, bytesMetric, applicationBytesMetric *int64
 
-		if version == 4 {
+	if direction == packetDirectionServerUpstream ||
+		direction == packetDirectionClientUpstream {
 
-			if protocol == internetProtocolTCP {
-				packetsMetric = &metrics.TCPIPv4.packetsDown
-				bytesMetric = &metrics.TCPIPv4.bytesDown
-				applicationBytesMetric = &metrics.TCPIPv4.applicationBytesDown
-			} else { // UDP
-				packetsMetric = &metrics.UDPIPv4.packetsDown
-				bytesMetric = &metrics.UDPIPv4.bytesDown
-				applicationBytesMetric = &metrics.UDPIPv4.applicationBytesDown
-			}
+		packetsMetric = &relayedMetrics.packetsUp
+		bytesMetric = &relayedMetrics.bytesUp
+		applicationBytesMetric = &relayedMetrics.applicationBytesUp
 
-		} else { // IPv6
+	} else { // packetDirectionDownstream
 
-			if protocol == internetProtocolTCP {
-				packetsMetric = &metrics.TCPIPv6.packetsDown
-				bytesMetric = &metrics.TCPIPv6.bytesDown
-				applicationBytesMetric = &metrics.TCPIPv6.applicationBytesDown
-			} else { // UDP
-				packetsMetric = &metrics.UDPIPv6.packetsDown
-				bytesMetric = &metrics.UDPIPv6.bytesDown
-				applicationBytesMetric = &metrics.UDPIPv6.applicationBytesDown
-			}
-		}
+		packetsMetric = &relayedMetrics.packetsDown
+		bytesMetric = &relayedMetrics.bytesDown
+		applicationBytesMetric = &relayedMetrics.applicationBytesDown
 	}
 
 	atomic.AddInt64(packetsMetric, 1)
 	atomic.AddInt64(bytesMetric, int64(packetLength))
 	atomic.AddInt64(applicationBytesMetric, int64(applicationDataLength))
+
+	if metrics.parent != nil {
+		metrics.parent.relayedPacket(
+			direction, version, protocol, packetLength, applicationDataLength)
+	}
 }
 
 const (
@@ -1490,8 +1989,11 @@ func (metrics *packetMetrics) checkpoint(
 
 	if whichMetrics&packetMetricsRelayed != 0 {
 
+		// ICMP application bytes are not reported to the MetricsUpdater.
+
 		var TCPApplicationBytesUp, TCPApplicationBytesDown,
-			UDPApplicationBytesUp, UDPApplicationBytesDown int64
+			UDPApplicationBytesUp, UDPApplicationBytesDown,
+			ICMPApplicationBytesUp, ICMPApplicationBytesDown int64
 
 		relayedMetrics := []struct {
 			prefix           string
@@ -1503,6 +2005,8 @@ func (metrics *packetMetrics) checkpoint(
 			{"tcp_ipv6_", &metrics.TCPIPv6, &TCPApplicationBytesUp, &TCPApplicationBytesDown},
 			{"udp_ipv4_", &metrics.UDPIPv4, &UDPApplicationBytesUp, &UDPApplicationBytesDown},
 			{"udp_ipv6_", &metrics.UDPIPv6, &UDPApplicationBytesUp, &UDPApplicationBytesDown},
+			{"icmp_ipv4_", &metrics.ICMPIPv4, &ICMPApplicationBytesUp, &ICMPApplicationBytesDown},
+			{"icmp_ipv6_", &metrics.ICMPIPv6, &ICMPApplicationBytesUp, &ICMPApplicationBytesDown},
 		}
 
 		for _, r := range relayedMetrics {
@@ -1531,6 +2035,43 @@ func (metrics *packetMetrics) checkpoint(
 	logger.LogMetric(logName, logFields)
 }
 
+// snapshot returns the current value of all metric counters, using the same
+// names as checkpoint. The counters are not reset.
+func (metrics *packetMetrics) snapshot() common.LogFields {
+
+	logFields := make(common.LogFields)
+
+	for i := 0; i < packetRejectReasonCount; i++ {
+		logFields["upstream_packet_rejected_"+packetRejectReasonDescription(packetRejectReason(i))] =
+			atomic.LoadInt64(&metrics.upstreamRejectReasons[i])
+		logFields["downstream_packet_rejected_"+packetRejectReasonDescription(packetRejectReason(i))] =
+			atomic.LoadInt64(&metrics.downstreamRejectReasons[i])
+	}
+
+	relayedMetrics := []struct {
+		prefix  string
+		metrics *relayedPacketMetrics
+	}{
+		{"tcp_ipv4_", &metrics.TCPIPv4},
+		{"tcp_ipv6_", &metrics.TCPIPv6},
+		{"udp_ipv4_", &metrics.UDPIPv4},
+		{"udp_ipv6_", &metrics.UDPIPv6},
+		{"icmp_ipv4_", &metrics.ICMPIPv4},
+		{"icmp_ipv6_", &metrics.ICMPIPv6},
+	}
+
+	for _, r := range relayedMetrics {
+		logFields[r.prefix+"packets_up"] = atomic.LoadInt64(&r.metrics.packetsUp)
+		logFields[r.prefix+"packets_down"] = atomic.LoadInt64(&r.metrics.packetsDown)
+		logFields[r.prefix+"bytes_up"] = atomic.LoadInt64(&r.metrics.bytesUp)
+		logFields[r.prefix+"bytes_down"] = atomic.LoadInt64(&r.metrics.bytesDown)
+		logFields[r.prefix+"application_bytes_up"] = atomic.LoadInt64(&r.metrics.applicationBytesUp)
+		logFields[r.prefix+"application_bytes_down"] = atomic.LoadInt64(&r.metrics.applicationBytesDown)
+	}
+
+	return logFields
+}
+
 // PacketQueue is a fixed-size, preallocated queue of packets.
 // Enqueued packets are packed into a contiguous buffer with channel
 // framing, allowing the entire queue to be written to a channel
@@ -1698,20 +2239,58 @@ type ClientConfig struct {
 	// to be configured to be routed through a newly
 	// created tun device.
 	RouteDestinations []string
+
+	// SessionConfigurationHandler, when set, is called with each
+	// session configuration -- assigned IP addresses, MTU, and DNS
+	// resolvers -- received from the packet tunnel server in response
+	// to RequestSessionConfiguration. The handler is responsible for
+	// applying the configuration to the tun device, which is typically
+	// owned by the caller when TunFileDescriptor is specified. The
+	// handler is called from the packet relay goroutine and should not
+	// block.
+	SessionConfigurationHandler func(*SessionConfiguration)
+}
+
+// SessionConfiguration is the packet tunnel configuration assigned to
+// a client session by the packet tunnel server.
+//
+// Using the assigned addresses is optional, as the server continues to
+// transparently rewrite client packet addresses. When a client
+// reconnects to a different server, and is assigned different
+// addresses, it may continue to use its original tun device
+// configuration.
+type SessionConfiguration struct {
+
+	// IPv4AddressCIDR and IPv6AddressCIDR are the IPv4 and IPv6
+	// addresses assigned to the session, along with the server's
+	// private subnet netmask and prefix.
+	IPv4AddressCIDR string `json:"ipv4_address_cidr"`
+	IPv6AddressCIDR string `json:"ipv6_address_cidr"`
+
+	// MTU is the packet tunnel server's MTU. Clients configured with
+	// this MTU won't send packets the server can't relay.
+	MTU int `json:"mtu"`
+
+	// DNSResolverIPv4Address and DNSResolverIPv6Address are the
+	// transparent DNS resolver addresses the client should use.
+	DNSResolverIPv4Address string `json:"dns_resolver_ipv4_address"`
+	DNSResolverIPv6Address string `json:"dns_resolver_ipv6_address"`
 }
 
 // Client is a packet tunnel client. A packet tunnel client
 // relays packets between a local tun device and a packet
 // tunnel server via a transport channel.
 type Client struct {
-	config          *ClientConfig
-	device          *Device
-	channel         *Channel
-	upstreamPackets *PacketQueue
-	metrics         *packetMetrics
-	runContext      context.Context
-	stopRunning     context.CancelFunc
-	workers         *sync.WaitGroup
+	config                    *ClientConfig
+	device                    *Device
+	channel                   *Channel
+	upstreamPackets           *PacketQueue
+	metrics                   *packetMetrics
+	runContext                context.Context
+	stopRunning               context.CancelFunc
+	workers                   *sync.WaitGroup
+	sessionConfigurationMutex sync.Mutex
+	sessionConfiguration      *SessionConfiguration
 }
 
 // NewClient initializes a new Client. Unless using the
@@ -1751,6 +2330,81 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	}, nil
 }
 
+// RequestSessionConfiguration sends a session configuration request to
+// the packet tunnel server. The request is sent asynchronously with
+// respect to the response, which is received by the running client and
+// passed to SessionConfigurationHandler.
+//
+// Each server assigns its own session configuration, so the request
+// should be sent each time Transport is connected to a server, including
+// when Transport switches to a different server.
+func (client *Client) RequestSessionConfiguration() error {
+
+	err := client.channel.WritePacket(
+		makeControlMessage(controlMessageSessionConfigurationRequest, nil))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// GetSessionConfiguration returns the most recent session configuration
+// received from the packet tunnel server, or nil when none has been
+// received.
+func (client *Client) GetSessionConfiguration() *SessionConfiguration {
+	client.sessionConfigurationMutex.Lock()
+	defer client.sessionConfigurationMutex.Unlock()
+	return client.sessionConfiguration
+}
+
+func (client *Client) handleControlMessage(message []byte) {
+
+	messageType, payload, ok := parseControlMessage(message)
+	if !ok || messageType != controlMessageSessionConfigurationResponse {
+		client.config.Logger.WithContext().Debug("unexpected control message")
+		return
+	}
+
+	sessionConfiguration, err := unmarshalSessionConfiguration(payload)
+	if err != nil {
+		client.config.Logger.WithContextFields(
+			common.LogFields{"error": err}).Warning("invalid session configuration")
+		return
+	}
+
+	client.config.Logger.WithContextFields(
+		common.LogFields{
+			"IPv4AddressCIDR": sessionConfiguration.IPv4AddressCIDR,
+			"IPv6AddressCIDR": sessionConfiguration.IPv6AddressCIDR,
+			"MTU":             sessionConfiguration.MTU,
+		}).Info("received session configuration")
+
+	client.sessionConfigurationMutex.Lock()
+	client.sessionConfiguration = sessionConfiguration
+	client.sessionConfigurationMutex.Unlock()
+
+	if client.config.SessionConfigurationHandler != nil {
+		client.config.SessionConfigurationHandler(sessionConfiguration)
+	}
+}
+
+func unmarshalSessionConfiguration(payload []byte) (*SessionConfiguration, error) {
+
+	var sessionConfiguration SessionConfiguration
+	err := json.Unmarshal(payload, &sessionConfiguration)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if getMTU(sessionConfiguration.MTU) != sessionConfiguration.MTU {
+		return nil, common.ContextError(
+			fmt.Errorf("invalid MTU: %d", sessionConfiguration.MTU))
+	}
+
+	return &sessionConfiguration, nil
+}
+
 // Start starts a client and returns with it running.
 func (client *Client) Start() {
 
@@ -1846,6 +2500,11 @@ func (client *Client) Start() {
 				continue
 			}
 
+			if isControlMessage(readPacket) {
+				client.handleControlMessage(readPacket)
+				continue
+			}
+
 			if !processPacket(
 				client.metrics,
 				nil,
@@ -1968,6 +2627,21 @@ func (client *Client) Stop() {
                  |
                  |          data octets ...
                  +---------------- ...
+
+   ICMP echo: https://tools.ietf.org/html/rfc792, https://tools.ietf.org/html/rfc4443
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |     Type      |     Code      |          Checksum             |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |           Identifier          |        Sequence Number        |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |     Data ...
+   +-+-+-+-+-
+
+   The ICMPv6 checksum includes an IPv6 pseudo-header; the ICMPv4
+   checksum covers only the ICMP message.
 */
 
 const (
@@ -1976,8 +2650,15 @@ const (
 	packetDirectionClientUpstream   = 2
 	packetDirectionClientDownstream = 3
 
-	internetProtocolTCP = 6
-	internetProtocolUDP = 17
+	internetProtocolICMPv4 = 1
+	internetProtocolTCP    = 6
+	internetProtocolUDP    = 17
+	internetProtocolICMPv6 = 58
+
+	icmpv4TypeEchoReply   = 0
+	icmpv4TypeEchoRequest = 8
+	icmpv6TypeEchoRequest = 128
+	icmpv6TypeEchoReply   = 129
 
 	portNumberDNS = 53
 
@@ -1994,8 +2675,13 @@ const (
 	packetRejectNoOriginalAddress  = 10
 	packetRejectNoDNSResolvers     = 11
 	packetRejectNoClient           = 12
-	packetRejectReasonCount        = 13
-	packetOk                       = 13
+	packetRejectICMPProtocolLength = 13
+	packetRejectICMPType           = 14
+	packetRejectICMPRateLimit      = 15
+	packetRejectNoICMPEchoRequest  = 16
+	packetRejectBlockedDomain      = 17
+	packetRejectReasonCount        = 18
+	packetOk                       = 18
 )
 
 type packetDirection int
@@ -2034,6 +2720,16 @@ func packetRejectReasonDescription(reason packetRejectReason) string {
 		return "no_dns_resolvers"
 	case packetRejectNoClient:
 		return "no_client"
+	case packetRejectICMPProtocolLength:
+		return "invalid_icmp_packet_length"
+	case packetRejectICMPType:
+		return "disallowed_icmp_type"
+	case packetRejectICMPRateLimit:
+		return "icmp_rate_limit_exceeded"
+	case packetRejectNoICMPEchoRequest:
+		return "no_icmp_echo_request"
+	case packetRejectBlockedDomain:
+		return "blocked_dns_query_domain"
 	}
 
 	return "unknown_reason"
@@ -2116,7 +2812,9 @@ func processPacket(
 	var protocol internetProtocol
 	var sourceIPAddress, destinationIPAddress net.IP
 	var sourcePort, destinationPort uint16
-	var IPChecksum, TCPChecksum, UDPChecksum []byte
+	var IPChecksum, TCPChecksum, UDPChecksum, ICMPChecksum []byte
+	var ICMPType byte
+	var ICMPIdentifierSequence []byte
 	var applicationData []byte
 
 	if version == 4 {
@@ -2136,7 +2834,7 @@ func processPacket(
 			return false
 		}
 
-		// Protocol must be TCP or UDP.
+		// Protocol must be TCP, UDP, or ICMP.
 
 		protocol = internetProtocol(packet[9])
 		dataOffset := 0
@@ -2152,11 +2850,17 @@ func processPacket(
 				return false
 			}
 		} else if protocol == internetProtocolUDP {
-			dataOffset := 28
+			dataOffset = 28
 			if len(packet) < dataOffset {
 				metrics.rejectedPacket(direction, packetRejectUDPProtocolLength)
 				return false
 			}
+		} else if protocol == internetProtocolICMPv4 {
+			dataOffset = 28
+			if len(packet) < dataOffset {
+				metrics.rejectedPacket(direction, packetRejectICMPProtocolLength)
+				return false
+			}
 		} else {
 			metrics.rejectedPacket(direction, packetRejectProtocol)
 			return false
@@ -2170,15 +2874,24 @@ func processPacket(
 		destinationIPAddress = packet[16:20]
 		IPChecksum = packet[10:12]
 
-		// Port numbers have the same offset in TCP and UDP.
+		if protocol == internetProtocolICMPv4 {
 
-		sourcePort = binary.BigEndian.Uint16(packet[20:22])
-		destinationPort = binary.BigEndian.Uint16(packet[22:24])
+			ICMPType = packet[20]
+			ICMPChecksum = packet[22:24]
+			ICMPIdentifierSequence = packet[24:28]
 
-		if protocol == internetProtocolTCP {
-			TCPChecksum = packet[36:38]
-		} else { // UDP
-			UDPChecksum = packet[26:28]
+		} else {
+
+			// Port numbers have the same offset in TCP and UDP.
+
+			sourcePort = binary.BigEndian.Uint16(packet[20:22])
+			destinationPort = binary.BigEndian.Uint16(packet[22:24])
+
+			if protocol == internetProtocolTCP {
+				TCPChecksum = packet[36:38]
+			} else { // UDP
+				UDPChecksum = packet[26:28]
+			}
 		}
 
 	} else { // IPv6
@@ -2188,7 +2901,7 @@ func processPacket(
 			return false
 		}
 
-		// Next Header must be TCP or UDP.
+		// Next Header must be TCP, UDP, or ICMPv6.
 
 		nextHeader := packet[6]
 
@@ -2206,11 +2919,17 @@ func processPacket(
 				return false
 			}
 		} else if protocol == internetProtocolUDP {
-			dataOffset := 48
+			dataOffset = 48
 			if len(packet) < dataOffset {
 				metrics.rejectedPacket(direction, packetRejectUDPProtocolLength)
 				return false
 			}
+		} else if protocol == internetProtocolICMPv6 {
+			dataOffset = 48
+			if len(packet) < dataOffset {
+				metrics.rejectedPacket(direction, packetRejectICMPProtocolLength)
+				return false
+			}
 		} else {
 			metrics.rejectedPacket(direction, packetRejectProtocol)
 			return false
@@ -2223,15 +2942,24 @@ func processPacket(
 		sourceIPAddress = packet[8:24]
 		destinationIPAddress = packet[24:40]
 
-		// Port numbers have the same offset in TCP and UDP.
+		if protocol == internetProtocolICMPv6 {
 
-		sourcePort = binary.BigEndian.Uint16(packet[40:42])
-		destinationPort = binary.BigEndian.Uint16(packet[42:44])
+			ICMPType = packet[40]
+			ICMPChecksum = packet[42:44]
+			ICMPIdentifierSequence = packet[44:48]
 
-		if protocol == internetProtocolTCP {
-			TCPChecksum = packet[56:58]
-		} else { // UDP
-			UDPChecksum = packet[46:48]
+		} else {
+
+			// Port numbers have the same offset in TCP and UDP.
+
+			sourcePort = binary.BigEndian.Uint16(packet[40:42])
+			destinationPort = binary.BigEndian.Uint16(packet[42:44])
+
+			if protocol == internetProtocolTCP {
+				TCPChecksum = packet[56:58]
+			} else { // UDP
+				UDPChecksum = packet[46:48]
+			}
 		}
 	}
 
@@ -2244,6 +2972,9 @@ func processPacket(
 	isServer := (direction == packetDirectionServerUpstream ||
 		direction == packetDirectionServerDownstream)
 
+	isICMP := (protocol == internetProtocolICMPv4 ||
+		protocol == internetProtocolICMPv6)
+
 	// Check if the packet qualifies for transparent DNS rewriting
 	//
 	// - Both TCP and UDP DNS packets may qualify
@@ -2313,9 +3044,49 @@ func processPacket(
 		}
 	}
 
+	// Filter client DNS queries. A query for a domain that is not
+	// permitted is not relayed. Instead, the query packet is rewritten,
+	// in place, as an NXDOMAIN response and sent back to the client.
+	//
+	// Queries to both the transparent DNS resolver and other resolvers
+	// are filtered. DNS over TCP is not filtered.
+
+	if direction == packetDirectionServerUpstream &&
+		protocol == internetProtocolUDP &&
+		destinationPort == portNumberDNS {
+
+		checkAllowedDomainFunc := session.getCheckAllowedDomainFunc()
+		if checkAllowedDomainFunc != nil {
+
+			domain, ok := getDNSQueryDomain(applicationData)
+			if ok && !checkAllowedDomainFunc(domain) {
+
+				makeBlockedDNSQueryResponse(
+					packet,
+					version,
+					sourceIPAddress,
+					destinationIPAddress,
+					UDPChecksum,
+					applicationData)
+
+				// runClientUpstream, the caller in this direction, is
+				// running and so session.channel is set. Write errors are
+				// ignored here; a broken channel will also fail the
+				// runClientUpstream read and tear down the session.
+				_ = session.channel.WritePacket(packet)
+
+				metrics.rejectedPacket(direction, packetRejectBlockedDomain)
+				return false
+			}
+		}
+	}
+
 	// Check if flow is tracked before checking traffic permission
+	//
+	// ICMP echo exchanges are not tracked as flows; instead, echo
+	// identifiers are mapped, below.
 
-	doFlowTracking := !doTransparentDNS && isServer
+	doFlowTracking := !doTransparentDNS && isServer && !isICMP
 
 	// TODO: verify this struct is stack allocated
 	var ID flowID
@@ -2324,13 +3095,25 @@ func processPacket(
 
 	if doFlowTracking {
 
+		// The downstream address in the flow ID is the session's assigned
+		// address, which is the source address of upstream packets after
+		// rewriting and the destination address of downstream packets
+		// before rewriting. This ensures that packets in both directions
+		// map to the same flow.
+
 		if direction == packetDirectionServerUpstream {
+
+			assignedIPAddress := session.assignedIPv4Address
+			if version == 6 {
+				assignedIPAddress = session.assignedIPv6Address
+			}
+
 			ID.set(
-				destinationIPAddress, destinationPort, sourceIPAddress, sourcePort, protocol)
+				assignedIPAddress, sourcePort, destinationIPAddress, destinationPort, protocol)
 
 		} else if direction == packetDirectionServerDownstream {
 			ID.set(
-				sourceIPAddress, sourcePort, destinationIPAddress, destinationPort, protocol)
+				destinationIPAddress, destinationPort, sourceIPAddress, sourcePort, protocol)
 		}
 
 		isTrackingFlow = session.isTrackingFlow(ID)
@@ -2409,6 +3192,74 @@ func processPacket(
 		}
 	}
 
+	// Check ICMP packets. Only echo requests are relayed upstream, and
+	// only echo replies are relayed downstream.
+	//
+	// The server rewrites the echo identifier in each direction. Upstream,
+	// the client's original identifier is mapped to a rewritten
+	// identifier; and echo requests are subject to the session rate limit.
+	// Downstream, echo replies are relayed only when the rewritten
+	// identifier maps back to an original identifier.
+
+	rewriteICMPIdentifier := false
+	var ICMPIdentifier uint16
+
+	if isICMP {
+
+		isUpstream := (direction == packetDirectionServerUpstream ||
+			direction == packetDirectionClientUpstream)
+
+		var expectedICMPType byte
+		if protocol == internetProtocolICMPv4 {
+			if isUpstream {
+				expectedICMPType = icmpv4TypeEchoRequest
+			} else {
+				expectedICMPType = icmpv4TypeEchoReply
+			}
+		} else { // ICMPv6
+			if isUpstream {
+				expectedICMPType = icmpv6TypeEchoRequest
+			} else {
+				expectedICMPType = icmpv6TypeEchoReply
+			}
+		}
+
+		if ICMPType != expectedICMPType {
+			metrics.rejectedPacket(direction, packetRejectICMPType)
+			return false
+		}
+
+		identifier := binary.BigEndian.Uint16(ICMPIdentifierSequence[0:2])
+
+		if direction == packetDirectionServerUpstream {
+
+			if session.ICMPEchoRequestLimiter.TakeAvailable(1) != 1 {
+				metrics.rejectedPacket(direction, packetRejectICMPRateLimit)
+				return false
+			}
+
+			ICMPIdentifier, rewriteICMPIdentifier =
+				session.getICMPEchoRewrittenIdentifier(destinationIPAddress, identifier)
+
+			// No unused identifier could be allocated, which is also a
+			// consequence of excessive echo requests.
+			if !rewriteICMPIdentifier {
+				metrics.rejectedPacket(direction, packetRejectICMPRateLimit)
+				return false
+			}
+
+		} else if direction == packetDirectionServerDownstream {
+
+			ICMPIdentifier, rewriteICMPIdentifier =
+				session.getICMPEchoOriginalIdentifier(sourceIPAddress, identifier)
+
+			if !rewriteICMPIdentifier {
+				metrics.rejectedPacket(direction, packetRejectNoICMPEchoRequest)
+				return false
+			}
+		}
+	}
+
 	// Configure rewriting.
 
 	var checksumAccumulator int32
@@ -2469,7 +3320,7 @@ func processPacket(
 		}
 	}
 
-	// Apply rewrites. IP (v4 only) and TCP/UDP all have packet
+	// Apply rewrites. IP (v4 only), TCP/UDP, and ICMP all have packet
 	// checksums which are updated to relect the rewritten headers.
 
 	if rewriteSourceIPAddress != nil {
@@ -2493,11 +3344,41 @@ func processPacket(
 
 		if protocol == internetProtocolTCP {
 			checksumAdjust(TCPChecksum, checksumAccumulator)
-		} else { // UDP
+		} else if protocol == internetProtocolUDP {
 			checksumAdjust(UDPChecksum, checksumAccumulator)
 		}
 	}
 
+	if rewriteICMPIdentifier {
+
+		// The ICMPv6 checksum includes the rewritten IP addresses, via the
+		// pseudo-header; the ICMPv4 checksum does not. The identifier and
+		// sequence number are accumulated together as the checksum helpers
+		// operate on 4 byte words.
+
+		var ICMPChecksumAccumulator int32
+		if protocol == internetProtocolICMPv6 {
+			ICMPChecksumAccumulator = checksumAccumulator
+		}
+
+		checksumAccumulate(ICMPIdentifierSequence, false, &ICMPChecksumAccumulator)
+		binary.BigEndian.PutUint16(ICMPIdentifierSequence[0:2], ICMPIdentifier)
+		checksumAccumulate(ICMPIdentifierSequence, true, &ICMPChecksumAccumulator)
+
+		checksumAdjust(ICMPChecksum, ICMPChecksumAccumulator)
+	}
+
+	// Record hostnames resolved in DNS responses, for flow tracking. This
+	// includes both transparent DNS and DNS responses from other resolvers.
+
+	if direction == packetDirectionServerDownstream &&
+		protocol == internetProtocolUDP &&
+		sourcePort == 53 &&
+		session.getFlowActivityUpdaterMaker() != nil {
+
+		session.recordDNSResponse(applicationData)
+	}
+
 	// Start/update flow tracking, only once past all possible packet rejects
 
 	if doFlowTracking {
@@ -2513,6 +3394,68 @@ func processPacket(
 	return true
 }
 
+// getDNSQueryDomain returns the domain queried in a DNS query message.
+// The domain is lowercase and has no trailing dot. getDNSQueryDomain
+// returns false when the message is not a standard query with exactly
+// one question.
+func getDNSQueryDomain(message []byte) (string, bool) {
+
+	var query dns.Msg
+	err := query.Unpack(message)
+	if err != nil ||
+		query.Response ||
+		query.Opcode != dns.OpcodeQuery ||
+		len(query.Question) != 1 {
+		return "", false
+	}
+
+	return strings.TrimSuffix(strings.ToLower(query.Question[0].Name), "."), true
+}
+
+// makeBlockedDNSQueryResponse rewrites, in place, a UDP DNS query packet
+// as an NXDOMAIN response to the query. The source and destination
+// addresses and ports are swapped, and the DNS message header flags are
+// set to indicate a response with the NXDOMAIN response code. The
+// question, and any EDNS OPT record, remain in the message. The IP header
+// checksum is unaffected by the swap; the UDP checksum is adjusted for the
+// flags change.
+func makeBlockedDNSQueryResponse(
+	packet []byte,
+	version byte,
+	sourceIPAddress, destinationIPAddress net.IP,
+	UDPChecksum []byte,
+	DNSMessage []byte) {
+
+	var IPAddress [net.IPv6len]byte
+	n := copy(IPAddress[:], sourceIPAddress)
+	copy(sourceIPAddress, destinationIPAddress)
+	copy(destinationIPAddress, IPAddress[:n])
+
+	portsOffset := 20
+	if version == 6 {
+		portsOffset = 40
+	}
+	ports := packet[portsOffset : portsOffset+4]
+	sourcePort := binary.BigEndian.Uint16(ports[0:2])
+	copy(ports[0:2], ports[2:4])
+	binary.BigEndian.PutUint16(ports[2:4], sourcePort)
+
+	// Set QR, retain Opcode and RD, and clear AA and TC. Set RA and the
+	// NXDOMAIN RCODE, and clear Z, AD, and CD. The message ID and flags are
+	// accumulated together as the checksum helpers operate on 4 byte words.
+
+	var checksumAccumulator int32
+	checksumAccumulate(DNSMessage[0:4], false, &checksumAccumulator)
+	DNSMessage[2] = 0x80 | (DNSMessage[2] & 0x79)
+	DNSMessage[3] = 0x80 | byte(dns.RcodeNameError)
+	checksumAccumulate(DNSMessage[0:4], true, &checksumAccumulator)
+
+	// An IPv4 UDP checksum of 0 indicates no checksum.
+	if version == 6 || UDPChecksum[0] != 0 || UDPChecksum[1] != 0 {
+		checksumAdjust(UDPChecksum, checksumAccumulator)
+	}
+}
+
 // Checksum code based on https://github.com/OpenVPN/openvpn:
 /*
 OpenVPN (TM) -- An Open Source VPN daemon
@@ -2743,15 +3686,50 @@ func (device *Device) Close() error {
 type Channel struct {
 	transport      io.ReadWriteCloser
 	inboundBuffer  []byte
+	writeMutex     sync.Mutex
 	outboundBuffer []byte
 }
 
 // IP packets cannot be larger that 64K, so a 16-bit length
 // header is sufficient.
 const (
-	channelHeaderSize = 2
+	channelHeaderSize    = 2
+	channelMaxPacketSize = 0xFFFF
+)
+
+// Control messages are relayed through the channel along with IP
+// packets. A control message is distinguished from an IP packet by
+// its first byte, 0, as the IP version in the first 4 bits of an IP
+// packet is always 4 or 6. The second byte is the message type, and
+// the remaining bytes are the message payload.
+//
+// The client may send a session configuration request, with no
+// payload, and the server responds with a JSON-encoded
+// SessionConfiguration payload.
+const (
+	controlMessageHeaderSize                   = 2
+	controlMessageSessionConfigurationRequest  = 1
+	controlMessageSessionConfigurationResponse = 2
 )
 
+func makeControlMessage(messageType byte, payload []byte) []byte {
+	message := make([]byte, controlMessageHeaderSize+len(payload))
+	message[1] = messageType
+	copy(message[controlMessageHeaderSize:], payload)
+	return message
+}
+
+func isControlMessage(packet []byte) bool {
+	return len(packet) > 0 && packet[0] == 0
+}
+
+func parseControlMessage(packet []byte) (byte, []byte, bool) {
+	if len(packet) < controlMessageHeaderSize || !isControlMessage(packet) {
+		return 0, nil, false
+	}
+	return packet[1], packet[controlMessageHeaderSize:], true
+}
+
 // NewChannel initializes a new Channel.
 func NewChannel(transport io.ReadWriteCloser, MTU int) *Channel {
 	return &Channel{
@@ -2788,9 +3766,13 @@ func (channel *Channel) ReadPacket() ([]byte, error) {
 }
 
 // WritePacket writes one full packet to the channel.
-// Concurrent calls to WritePacket are not supported.
+// WritePacket and WriteFramedPackets calls are serialized
+// and may be made concurrently.
 func (channel *Channel) WritePacket(packet []byte) error {
 
+	channel.writeMutex.Lock()
+	defer channel.writeMutex.Unlock()
+
 	// Flow control assumed to be provided by the transport. In the case
 	// of SSH, the channel window size will determine whether the packet
 	// data is transmitted immediately or whether the transport.Write will
@@ -2822,8 +3804,13 @@ func (channel *Channel) WritePacket(packet []byte) error {
 
 // WriteFramedPackets writes a buffer of pre-framed packets to
 // the channel.
-// Concurrent calls to WriteFramedPackets are not supported.
+// WritePacket and WriteFramedPackets calls are serialized
+// and may be made concurrently.
 func (channel *Channel) WriteFramedPackets(packetBuffer []byte) error {
+
+	channel.writeMutex.Lock()
+	defer channel.writeMutex.Unlock()
+
 	_, err := channel.transport.Write(packetBuffer)
 	if err != nil {
 		return common.ContextError(err)
@@ -21,6 +21,7 @@ package tun
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -35,6 +36,7 @@ import (
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/juju/ratelimit"
 )
 
 const (
@@ -71,6 +73,261 @@ func TestResetRouting(t *testing.T) {
 	t.Skip("TODO: test conntrack delete effectiveness")
 }
 
+func TestICMPEcho(t *testing.T) {
+	testICMPEcho(t, false)
+	testICMPEcho(t, true)
+}
+
+func testICMPEcho(t *testing.T, useIPv6 bool) {
+
+	// This test exercises processPacket ICMP echo handling directly, without
+	// tun devices: echo requests and replies are rewritten and relayed,
+	// checksums remain valid, unsolicited replies and other ICMP types are
+	// rejected, and echo requests are rate limited.
+
+	var clientIPAddress, upstreamIPAddress, assignedIPAddress net.IP
+	if !useIPv6 {
+		clientIPAddress = net.ParseIP("192.168.0.2").To4()
+		upstreamIPAddress = net.ParseIP("8.8.8.8").To4()
+		assignedIPAddress = net.ParseIP("10.0.0.3").To4()
+	} else {
+		clientIPAddress = net.ParseIP("fd00::2")
+		upstreamIPAddress = net.ParseIP("2001:4860:4860::8888")
+		assignedIPAddress = net.ParseIP("fd19:ca83:e6d5:1c44::3")
+	}
+
+	echoRequestType, echoReplyType := byte(icmpv4TypeEchoRequest), byte(icmpv4TypeEchoReply)
+	if useIPv6 {
+		echoRequestType, echoReplyType = icmpv6TypeEchoRequest, icmpv6TypeEchoReply
+	}
+
+	rateLimit := 5
+
+	session := &session{
+		ICMPEchoRequestLimiter: ratelimit.NewBucketWithRate(
+			float64(rateLimit), int64(rateLimit)),
+	}
+	if !useIPv6 {
+		session.assignedIPv4Address = assignedIPAddress
+	} else {
+		session.assignedIPv6Address = assignedIPAddress
+	}
+
+	metrics := new(packetMetrics)
+
+	originalIdentifier := uint16(1234)
+
+	// The client forwards echo requests and filters out other ICMP types.
+
+	request := makeICMPEchoPacket(
+		echoRequestType, clientIPAddress, upstreamIPAddress, originalIdentifier, 1)
+
+	if !processPacket(metrics, nil, packetDirectionClientUpstream, request) {
+		t.Fatalf("client rejected echo request")
+	}
+
+	if processPacket(
+		metrics,
+		nil,
+		packetDirectionClientUpstream,
+		makeICMPEchoPacket(echoReplyType, clientIPAddress, upstreamIPAddress, 1, 1)) {
+
+		t.Fatalf("client accepted upstream echo reply")
+	}
+
+	// The server rewrites the source address and identifier.
+
+	if !processPacket(metrics, session, packetDirectionServerUpstream, request) {
+		t.Fatalf("server rejected echo request")
+	}
+
+	sourceIPAddress, destinationIPAddress, identifier := parseICMPEchoPacket(t, request)
+
+	if !sourceIPAddress.Equal(assignedIPAddress) ||
+		!destinationIPAddress.Equal(upstreamIPAddress) {
+		t.Fatalf("unexpected rewritten addresses: %s, %s", sourceIPAddress, destinationIPAddress)
+	}
+
+	rewrittenIdentifier := identifier
+
+	// Subsequent echo requests use the same rewritten identifier.
+
+	request = makeICMPEchoPacket(
+		echoRequestType, clientIPAddress, upstreamIPAddress, originalIdentifier, 2)
+
+	if !processPacket(metrics, session, packetDirectionServerUpstream, request) {
+		t.Fatalf("server rejected echo request")
+	}
+
+	_, _, identifier = parseICMPEchoPacket(t, request)
+	if identifier != rewrittenIdentifier {
+		t.Fatalf("unexpected rewritten identifier: %d", identifier)
+	}
+
+	// The server rewrites the echo reply back to the original client
+	// address and identifier.
+
+	reply := makeICMPEchoPacket(
+		echoReplyType, upstreamIPAddress, assignedIPAddress, rewrittenIdentifier, 2)
+
+	if !processPacket(metrics, session, packetDirectionServerDownstream, reply) {
+		t.Fatalf("server rejected echo reply")
+	}
+
+	sourceIPAddress, destinationIPAddress, identifier = parseICMPEchoPacket(t, reply)
+
+	if !sourceIPAddress.Equal(upstreamIPAddress) ||
+		!destinationIPAddress.Equal(clientIPAddress) ||
+		identifier != originalIdentifier {
+		t.Fatalf("unexpected rewritten reply: %s, %s, %d",
+			sourceIPAddress, destinationIPAddress, identifier)
+	}
+
+	if !processPacket(metrics, nil, packetDirectionClientDownstream, reply) {
+		t.Fatalf("client rejected echo reply")
+	}
+
+	// Unsolicited echo replies and other ICMP types are rejected.
+
+	for _, packet := range [][]byte{
+		makeICMPEchoPacket(
+			echoReplyType, upstreamIPAddress, assignedIPAddress, rewrittenIdentifier+1, 1),
+		makeICMPEchoPacket(
+			echoReplyType, clientIPAddress, assignedIPAddress, rewrittenIdentifier, 1),
+		makeICMPEchoPacket(
+			echoRequestType, upstreamIPAddress, assignedIPAddress, rewrittenIdentifier, 1),
+	} {
+		if processPacket(metrics, session, packetDirectionServerDownstream, packet) {
+			t.Fatalf("server accepted unexpected downstream ICMP packet")
+		}
+	}
+
+	// Echo requests exceeding the rate limit are rejected. Two tokens were
+	// consumed by the requests above.
+
+	for i := 0; i < rateLimit; i++ {
+		request = makeICMPEchoPacket(
+			echoRequestType, clientIPAddress, upstreamIPAddress, originalIdentifier, uint16(3+i))
+		accepted := processPacket(metrics, session, packetDirectionServerUpstream, request)
+		if accepted != (i < rateLimit-2) {
+			t.Fatalf("unexpected rate limit result: %d, %v", i, accepted)
+		}
+	}
+
+	// Check metrics.
+
+	metricsPrefix := "icmp_ipv4_"
+	if useIPv6 {
+		metricsPrefix = "icmp_ipv6_"
+	}
+
+	logFields := metrics.snapshot()
+
+	for name, expectedValue := range map[string]int64{
+		metricsPrefix + "packets_up":                        6,
+		metricsPrefix + "packets_down":                      2,
+		"upstream_packet_rejected_disallowed_icmp_type":     1,
+		"downstream_packet_rejected_disallowed_icmp_type":   1,
+		"downstream_packet_rejected_no_icmp_echo_request":   2,
+		"upstream_packet_rejected_icmp_rate_limit_exceeded": 2,
+	} {
+		if logFields[name].(int64) != expectedValue {
+			t.Fatalf("unexpected %s: %d", name, logFields[name])
+		}
+	}
+}
+
+// makeICMPEchoPacket creates an IPv4 or IPv6 ICMP echo packet with valid
+// checksums.
+func makeICMPEchoPacket(
+	ICMPType byte,
+	sourceIPAddress, destinationIPAddress net.IP,
+	identifier, sequence uint16) []byte {
+
+	payload := []byte("ping")
+
+	var packet, ICMPMessage []byte
+
+	if len(sourceIPAddress) == net.IPv4len {
+
+		packet = make([]byte, 28+len(payload))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+		packet[8] = 64
+		packet[9] = internetProtocolICMPv4
+		copy(packet[12:16], sourceIPAddress)
+		copy(packet[16:20], destinationIPAddress)
+		binary.BigEndian.PutUint16(packet[10:12], internetChecksum(packet[0:20]))
+
+		ICMPMessage = packet[20:]
+
+	} else {
+
+		packet = make([]byte, 48+len(payload))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)-40))
+		packet[6] = internetProtocolICMPv6
+		packet[7] = 64
+		copy(packet[8:24], sourceIPAddress)
+		copy(packet[24:40], destinationIPAddress)
+
+		ICMPMessage = packet[40:]
+	}
+
+	ICMPMessage[0] = ICMPType
+	binary.BigEndian.PutUint16(ICMPMessage[4:6], identifier)
+	binary.BigEndian.PutUint16(ICMPMessage[6:8], sequence)
+	copy(ICMPMessage[8:], payload)
+
+	binary.BigEndian.PutUint16(ICMPMessage[2:4], internetChecksum(
+		append(makeICMPChecksumPseudoHeader(packet), ICMPMessage...)))
+
+	return packet
+}
+
+// parseICMPEchoPacket returns the addresses and identifier of an ICMP echo
+// packet created by makeICMPEchoPacket, and verifies the packet checksums.
+func parseICMPEchoPacket(
+	t *testing.T, packet []byte) (net.IP, net.IP, uint16) {
+
+	var sourceIPAddress, destinationIPAddress net.IP
+	var ICMPMessage []byte
+
+	if packet[0]>>4 == 4 {
+		if internetChecksum(packet[0:20]) != 0 {
+			t.Fatalf("invalid IPv4 header checksum")
+		}
+		sourceIPAddress = packet[12:16]
+		destinationIPAddress = packet[16:20]
+		ICMPMessage = packet[20:]
+	} else {
+		sourceIPAddress = packet[8:24]
+		destinationIPAddress = packet[24:40]
+		ICMPMessage = packet[40:]
+	}
+
+	if internetChecksum(
+		append(makeICMPChecksumPseudoHeader(packet), ICMPMessage...)) != 0 {
+		t.Fatalf("invalid ICMP checksum")
+	}
+
+	return sourceIPAddress, destinationIPAddress, binary.BigEndian.Uint16(ICMPMessage[4:6])
+}
+
+func makeICMPChecksumPseudoHeader(packet []byte) []byte {
+
+	// Only ICMPv6 uses a pseudo-header.
+	if packet[0]>>4 == 4 {
+		return nil
+	}
+
+	pseudoHeader := make([]byte, 40)
+	copy(pseudoHeader[0:32], packet[8:40])
+	binary.BigEndian.PutUint32(pseudoHeader[32:36], uint32(len(packet)-40))
+	pseudoHeader[39] = internetProtocolICMPv6
+	return pseudoHeader
+}
+
 func testTunneledTCP(t *testing.T, useIPv6 bool) {
 
 	// This test harness does the following:
@@ -393,8 +650,10 @@ func (server *testServer) run() {
 				signalConn,
 				checkAllowedPortFunc,
 				checkAllowedPortFunc,
+				nil,
 				server.updaterMaker,
-				server.metricsUpdater)
+				server.metricsUpdater,
+				nil)
 
 			signalConn.Wait()
 
@@ -0,0 +1,476 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package websocket implements a minimal WebSocket (RFC 6455) stream transport.
+
+A WebSocket Conn is a net.Conn which carries an arbitrary byte stream in
+binary frames. Stream data may be split into frames arbitrarily; message
+boundaries are not preserved. Ping frames are answered, and close frames
+terminate the stream. Text frames, extensions, and subprotocols are not
+supported.
+
+Client performs the HTTP/1.1 upgrade handshake over an existing connection,
+which may be TLS, and which may be to a CDN that relays WebSockets. Upgrade
+performs the server side of the handshake in an http.Handler.
+*/
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	opcodeContinuation = 0x0
+	opcodeBinary       = 0x2
+	opcodeClose        = 0x8
+	opcodePing         = 0x9
+	opcodePong         = 0xA
+
+	maxControlPayloadLength = 125
+
+	closeFrameWriteTimeout = 1 * time.Second
+
+	// MAX_FRAME_PAYLOAD_LENGTH is the maximum payload size of a frame sent
+	// by Write. Larger writes are split into multiple frames.
+	MAX_FRAME_PAYLOAD_LENGTH = 65536
+
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// Conn is a WebSocket connection, carrying a byte stream in binary frames.
+// Conn implements net.Conn.
+//
+// writeLock is a semaphore, rather than a sync.Mutex, so that close frames
+// may be sent only when no other frame write is in progress: a Write may be
+// blocked indefinitely on a peer that isn't reading, and Close must not
+// wait for it.
+type Conn struct {
+	net.Conn
+	isClient      bool
+	reader        *bufio.Reader
+	readMutex     sync.Mutex
+	readRemaining uint64
+	readMaskKey   []byte
+	readMaskIndex int
+	readMasked    bool
+	readEOF       bool
+	writeLock     chan struct{}
+	closeOnce     sync.Once
+}
+
+// Client performs the client side of the WebSocket handshake over conn,
+// which is typically a TCP or TLS connection. host is the value of the
+// HTTP Host header, path is the request path, and headers are optional
+// additional request headers.
+//
+// Client does not set deadlines on conn; the caller should set a deadline
+// or close conn to interrupt the handshake.
+func Client(
+	conn net.Conn, host, path string, headers http.Header) (*Conn, error) {
+
+	key, err := common.MakeSecureRandomBytes(16)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+
+	request, err := http.NewRequest("GET", "http://"+host+path, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	for name, values := range headers {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+	request.Host = host
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", encodedKey)
+	request.Header.Set("Sec-WebSocket-Version", "13")
+
+	err = request.Write(conn)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, common.ContextError(
+			fmt.Errorf("unexpected status code: %d", response.StatusCode))
+	}
+
+	if !strings.EqualFold(response.Header.Get("Upgrade"), "websocket") ||
+		!headerContainsToken(response.Header, "Connection", "upgrade") {
+		return nil, common.ContextError(errors.New("missing upgrade"))
+	}
+
+	if response.Header.Get("Sec-WebSocket-Accept") != makeAcceptKey(encodedKey) {
+		return nil, common.ContextError(errors.New("unexpected accept key"))
+	}
+
+	return &Conn{
+		Conn:      conn,
+		isClient:  true,
+		reader:    reader,
+		writeLock: make(chan struct{}, 1),
+	}, nil
+}
+
+// Upgrade performs the server side of the WebSocket handshake, hijacking
+// the underlying connection from the http.ResponseWriter. On failure, an
+// HTTP error response is sent.
+//
+// Any deadlines set on the underlying connection, such as by
+// http.Server timeouts, are cleared.
+func Upgrade(
+	responseWriter http.ResponseWriter, request *http.Request) (*Conn, error) {
+
+	key := request.Header.Get("Sec-WebSocket-Key")
+
+	if request.Method != "GET" ||
+		!strings.EqualFold(request.Header.Get("Upgrade"), "websocket") ||
+		!headerContainsToken(request.Header, "Connection", "upgrade") ||
+		request.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+
+		http.Error(responseWriter, "", http.StatusBadRequest)
+		return nil, common.ContextError(errors.New("invalid upgrade request"))
+	}
+
+	hijacker, ok := responseWriter.(http.Hijacker)
+	if !ok {
+		http.Error(responseWriter, "", http.StatusInternalServerError)
+		return nil, common.ContextError(errors.New("hijack not supported"))
+	}
+
+	conn, readWriter, err := hijacker.Hijack()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, common.ContextError(err)
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + makeAcceptKey(key) + "\r\n\r\n"
+
+	_, err = readWriter.WriteString(response)
+	if err == nil {
+		err = readWriter.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, common.ContextError(err)
+	}
+
+	return &Conn{
+		Conn:      conn,
+		isClient:  false,
+		reader:    readWriter.Reader,
+		writeLock: make(chan struct{}, 1),
+	}, nil
+}
+
+// Read reads stream data from binary frames. Read returns io.EOF once the
+// peer has sent a close frame.
+func (conn *Conn) Read(buffer []byte) (int, error) {
+
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+
+	for conn.readRemaining == 0 {
+
+		if conn.readEOF {
+			return 0, io.EOF
+		}
+
+		err := conn.readFrameHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(buffer)) > conn.readRemaining {
+		buffer = buffer[:conn.readRemaining]
+	}
+
+	n, err := conn.reader.Read(buffer)
+	if n > 0 {
+		conn.unmask(buffer[:n])
+		conn.readRemaining -= uint64(n)
+	}
+
+	return n, err
+}
+
+// readFrameHeader reads the next frame header. Control frames are handled
+// completely. For data frames, readRemaining is set to the payload length,
+// and the payload is consumed by Read. The caller must hold readMutex.
+func (conn *Conn) readFrameHeader() error {
+
+	var header [2]byte
+	_, err := io.ReadFull(conn.reader, header[:])
+	if err != nil {
+		return err
+	}
+
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	payloadLength := uint64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 {
+		return common.ContextError(errors.New("unsupported extension"))
+	}
+
+	// Clients must mask frames, and servers must not.
+	if masked == conn.isClient {
+		return common.ContextError(errors.New("unexpected masking"))
+	}
+
+	switch payloadLength {
+	case 126:
+		var extendedLength [2]byte
+		_, err := io.ReadFull(conn.reader, extendedLength[:])
+		if err != nil {
+			return err
+		}
+		payloadLength = uint64(binary.BigEndian.Uint16(extendedLength[:]))
+	case 127:
+		var extendedLength [8]byte
+		_, err := io.ReadFull(conn.reader, extendedLength[:])
+		if err != nil {
+			return err
+		}
+		payloadLength = binary.BigEndian.Uint64(extendedLength[:])
+	}
+
+	conn.readMasked = masked
+	conn.readMaskIndex = 0
+	if masked {
+		if conn.readMaskKey == nil {
+			conn.readMaskKey = make([]byte, 4)
+		}
+		_, err := io.ReadFull(conn.reader, conn.readMaskKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+
+	case opcodeBinary, opcodeContinuation:
+		conn.readRemaining = payloadLength
+		return nil
+
+	case opcodeClose, opcodePing, opcodePong:
+
+		if payloadLength > maxControlPayloadLength {
+			return common.ContextError(errors.New("invalid control frame"))
+		}
+
+		payload := make([]byte, payloadLength)
+		_, err := io.ReadFull(conn.reader, payload)
+		if err != nil {
+			return err
+		}
+		conn.unmask(payload)
+
+		switch opcode {
+		case opcodeClose:
+			conn.readEOF = true
+			conn.writeCloseFrame(payload)
+		case opcodePing:
+			err := conn.writeFrame(opcodePong, payload)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	default:
+		return common.ContextError(fmt.Errorf("unsupported opcode: %d", opcode))
+	}
+}
+
+func (conn *Conn) unmask(buffer []byte) {
+	if !conn.readMasked {
+		return
+	}
+	for i := range buffer {
+		buffer[i] ^= conn.readMaskKey[conn.readMaskIndex]
+		conn.readMaskIndex = (conn.readMaskIndex + 1) % 4
+	}
+}
+
+// Write sends stream data in binary frames.
+func (conn *Conn) Write(buffer []byte) (int, error) {
+
+	n := 0
+	for n < len(buffer) {
+		end := n + MAX_FRAME_PAYLOAD_LENGTH
+		if end > len(buffer) {
+			end = len(buffer)
+		}
+		err := conn.writeFrame(opcodeBinary, buffer[n:end])
+		if err != nil {
+			return n, err
+		}
+		n = end
+	}
+
+	return n, nil
+}
+
+// writeFrame sends a single, final frame.
+func (conn *Conn) writeFrame(opcode byte, payload []byte) error {
+
+	conn.writeLock <- struct{}{}
+	defer func() { <-conn.writeLock }()
+
+	return conn.writeFrameLocked(opcode, payload)
+}
+
+// writeCloseFrame sends a close frame, when one has not yet been sent.
+//
+// The close frame is best effort: it's skipped when another frame write is
+// in progress, and it's sent with a short write deadline, so that neither
+// Close nor the close reply sent by Read, while holding readMutex, blocks
+// on a stalled write or peer. The connection is closed, or the stream
+// terminated, in any case.
+func (conn *Conn) writeCloseFrame(payload []byte) {
+	conn.closeOnce.Do(func() {
+		select {
+		case conn.writeLock <- struct{}{}:
+		default:
+			return
+		}
+		defer func() { <-conn.writeLock }()
+		_ = conn.Conn.SetWriteDeadline(time.Now().Add(closeFrameWriteTimeout))
+		_ = conn.writeFrameLocked(opcodeClose, payload)
+	})
+}
+
+// writeFrameLocked sends a single, final frame. Client frames are masked.
+// The caller must hold writeLock.
+func (conn *Conn) writeFrameLocked(opcode byte, payload []byte) error {
+
+	frame := make([]byte, 0, 14+len(payload))
+
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if conn.isClient {
+		maskBit = 0x80
+	}
+
+	payloadLength := len(payload)
+	switch {
+	case payloadLength < 126:
+		frame = append(frame, maskBit|byte(payloadLength))
+	case payloadLength <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = append(frame, byte(payloadLength>>8), byte(payloadLength))
+	default:
+		frame = append(frame, maskBit|127)
+		var extendedLength [8]byte
+		binary.BigEndian.PutUint64(extendedLength[:], uint64(payloadLength))
+		frame = append(frame, extendedLength[:]...)
+	}
+
+	if conn.isClient {
+		maskKey, err := common.MakeSecureRandomBytes(4)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		frame = append(frame, maskKey...)
+		offset := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[offset+i] ^= maskKey[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := conn.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame, when one has not yet been sent and no Write is
+// in progress, and closes the underlying connection. Close doesn't wait for
+// any blocked Write, which fails once the underlying connection is closed.
+func (conn *Conn) Close() error {
+	conn.writeCloseFrame(nil)
+	return conn.Conn.Close()
+}
+
+// IsClosed implements the common.Closer interface, when the underlying
+// connection does.
+func (conn *Conn) IsClosed() bool {
+	closer, ok := conn.Conn.(common.Closer)
+	if !ok {
+		return false
+	}
+	return closer.IsClosed()
+}
+
+func makeAcceptKey(key string) string {
+	hash := sha1.New()
+	hash.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestWebSocket(t *testing.T) {
+
+	// The server echoes the stream back to the client.
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			conn, err := Upgrade(responseWriter, request)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// A plain HTTP request is rejected.
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", response.StatusCode)
+	}
+
+	tcpConn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+
+	conn, err := Client(tcpConn, host, "/", http.Header{"User-Agent": {"test"}})
+	if err != nil {
+		t.Fatalf("Client failed: %s", err)
+	}
+
+	// The payload size exercises multiple frames and both extended payload
+	// length encodings.
+
+	payload, err := common.MakeSecureRandomBytes(3*MAX_FRAME_PAYLOAD_LENGTH + 100)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		if err == nil {
+			_, err = conn.Write(payload[:10])
+		}
+		writeErr <- err
+	}()
+
+	received := make([]byte, len(payload)+10)
+	_, err = io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	err = <-writeErr
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	if !bytes.Equal(received[:len(payload)], payload) ||
+		!bytes.Equal(received[len(payload):], payload[:10]) {
+		t.Fatalf("unexpected echoed payload")
+	}
+
+	// A ping is answered with a pong, which is not returned as stream data.
+
+	err = conn.writeFrame(opcodePing, []byte("ping"))
+	if err != nil {
+		t.Fatalf("writeFrame failed: %s", err)
+	}
+	_, err = conn.Write([]byte("data"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	received = make([]byte, 4)
+	_, err = io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+	if string(received) != "data" {
+		t.Fatalf("unexpected echoed data: %s", string(received))
+	}
+
+	// A close frame terminates the stream.
+
+	err = conn.writeFrame(opcodeClose, nil)
+	if err != nil {
+		t.Fatalf("writeFrame failed: %s", err)
+	}
+
+	_, err = conn.Read(received)
+	if err != io.EOF {
+		t.Fatalf("unexpected Read result: %v", err)
+	}
+
+	conn.Close()
+}
+
+func TestWebSocketCloseDuringWrite(t *testing.T) {
+
+	makeConns := func() (*Conn, net.Conn) {
+		clientConn, serverConn := net.Pipe()
+		conn := &Conn{
+			Conn:      clientConn,
+			isClient:  true,
+			reader:    bufio.NewReader(clientConn),
+			writeLock: make(chan struct{}, 1),
+		}
+		return conn, serverConn
+	}
+
+	// startBlockedWrite starts a Write that blocks, as the peer reads only
+	// the first byte, which ensures the Write is in progress.
+	startBlockedWrite := func(conn *Conn, serverConn net.Conn) chan error {
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := conn.Write([]byte("data"))
+			writeErr <- err
+		}()
+		var b [1]byte
+		_, err := serverConn.Read(b[:])
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		return writeErr
+	}
+
+	closeWithTimeout := func(conn *Conn) {
+		closed := make(chan struct{})
+		go func() {
+			conn.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Close blocked")
+		}
+	}
+
+	// Close doesn't wait for a blocked Write, which then fails.
+
+	conn, serverConn := makeConns()
+	defer serverConn.Close()
+
+	writeErr := startBlockedWrite(conn, serverConn)
+
+	closeWithTimeout(conn)
+
+	err := <-writeErr
+	if err == nil {
+		t.Fatalf("unexpected Write success")
+	}
+
+	// A close frame received during a blocked Write terminates the stream
+	// without waiting to send the close reply.
+
+	conn, serverConn = makeConns()
+	defer serverConn.Close()
+
+	writeErr = startBlockedWrite(conn, serverConn)
+
+	go func() {
+		_, _ = serverConn.Write([]byte{0x80 | opcodeClose, 0})
+	}()
+
+	var b [1]byte
+	_, err = conn.Read(b[:])
+	if err != io.EOF {
+		t.Fatalf("unexpected Read result: %v", err)
+	}
+
+	closeWithTimeout(conn)
+
+	err = <-writeErr
+	if err == nil {
+		t.Fatalf("unexpected Write success")
+	}
+}
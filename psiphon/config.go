@@ -24,6 +24,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -110,6 +111,13 @@ type Config struct {
 	// free port (a notice reporting the selected port is emitted).
 	LocalSocksProxyPort int
 
+	// UdpgwServerAddress specifies the udpgw server address, as configured
+	// in the server UDPInterceptUdpgwServerAddress, to which UDP datagrams
+	// are port forwarded using the udpgw protocol. When set, the local SOCKS
+	// proxy supports the SOCKS5 UDP ASSOCIATE command. For the default, "",
+	// UDP ASSOCIATE requests are rejected.
+	UdpgwServerAddress string
+
 	// LocalHttpProxyPort specifies a port number for the local HTTP proxy
 	// running at 127.0.0.1. For the default value, 0, the system selects a
 	// free port (a notice reporting the selected port is emitted).
@@ -118,6 +126,41 @@ type Config struct {
 	// DisableLocalHTTPProxy disables running the local HTTP proxy.
 	DisableLocalHTTPProxy bool
 
+	// EnableLocalDNSProxy enables running the local DNS proxy, which accepts
+	// UDP and TCP DNS queries and resolves them through the tunnel. The host
+	// OS resolver may be configured to use the local DNS proxy to prevent DNS
+	// queries from leaking outside of the tunnel.
+	EnableLocalDNSProxy bool
+
+	// LocalDNSProxyPort specifies a port number for the local DNS proxy
+	// running at 127.0.0.1. The same port is used for both UDP and TCP. For
+	// the default value, 0, the system selects a free port (a notice
+	// reporting the selected port is emitted).
+	LocalDNSProxyPort int
+
+	// LocalDNSProxyUpstreamServer specifies the IP address of the DNS server,
+	// reached through the tunnel, to which the local DNS proxy forwards
+	// queries. Queries are forwarded using TCP, so the DNS server must
+	// support TCP requests. Required when EnableLocalDNSProxy is set.
+	LocalDNSProxyUpstreamServer string
+
+	// EnableLocalControlAPI enables running the local control API, a HTTP
+	// server which reports client status, such as the active tunnels, and
+	// accepts commands, such as reconnect and dynamic config updates, with
+	// JSON request and response bodies. The control API always listens on
+	// 127.0.0.1, regardless of ListenInterface.
+	EnableLocalControlAPI bool
+
+	// LocalControlAPIPort specifies a port number for the local control API
+	// running at 127.0.0.1. For the default value, 0, the system selects a
+	// free port (a notice reporting the selected port is emitted).
+	LocalControlAPIPort int
+
+	// LocalControlAPISecret is a shared secret which local control API
+	// requests must present in an "Authorization: Bearer <secret>" header.
+	// Required when EnableLocalControlAPI is set.
+	LocalControlAPISecret string
+
 	// NetworkLatencyMultiplier is a multiplier that is to be applied to
 	// default network event timeouts. Set this to tune performance for
 	// slow networks.
@@ -176,6 +219,15 @@ type Config struct {
 	// the default is TUNNEL_POOL_SIZE, which is recommended.
 	TunnelPoolSize int
 
+	// EnableMultiHopTunnels enables multi-hop tunnels. Each tunnel is
+	// established to an entry server, which must have the multi-hop relay
+	// capability, and then relayed, through a port forward, to an exit
+	// server using the OSSH protocol. Port forwards use the exit server, so
+	// that neither server sees both the client IP address and the client's
+	// destinations. When set, EgressRegion selects the exit server region;
+	// entry servers may be in any region.
+	EnableMultiHopTunnels bool
+
 	// StaggerConnectionWorkersMilliseconds adds a specified delay before
 	// making each server candidate available to connection workers. This
 	// option is enabled when StaggerConnectionWorkersMilliseconds > 0.
@@ -307,6 +359,16 @@ type Config struct {
 	// client binary.
 	RemoteServerListSignaturePublicKey string
 
+	// ServerEntrySignaturePublicKey specifies a public key that's used to
+	// verify the signature of each individual server entry, including
+	// server entries obtained via remote server lists, obfuscated server
+	// lists, handshake discovery, and TargetServerEntry. When specified,
+	// server entries without a valid signature are discarded. Embedded
+	// server entries, which are distributed along with this config, are
+	// not verified. This value is supplied by and depends on the Psiphon
+	// Network.
+	ServerEntrySignaturePublicKey string
+
 	// DisableRemoteServerListFetcher disables fetching remote server lists.
 	// This is used for special case temporary tunnels.
 	DisableRemoteServerListFetcher bool
@@ -449,6 +511,15 @@ type Config struct {
 	// set, TunnelPoolSize must be 1.
 	PacketTunnelTunFileDescriptor int
 
+	// PacketTunnelRequestSessionConfiguration specifies whether to request
+	// the packet tunnel session configuration -- assigned addresses, MTU,
+	// and DNS resolvers -- from each server the packet tunnel connects to.
+	// Each configuration received is reported in a
+	// PacketTunnelSessionConfiguration notice, and the client should apply
+	// it to the tun device. Servers which don't support the request don't
+	// respond, and no notice is emitted.
+	PacketTunnelRequestSessionConfiguration bool
+
 	// SessionID specifies a client session ID to use in the Psiphon API. The
 	// session ID should be a randomly generated value that is used only for a
 	// single session, which is defined as the period between a user starting
@@ -492,13 +563,25 @@ type Config struct {
 	dynamicConfigMutex sync.Mutex
 	sponsorID          string
 	authorizations     []string
+	egressRegion       string
 
 	deviceBinder    DeviceBinder
 	networkIDGetter NetworkIDGetter
 
+	ipRoutesMutex sync.Mutex
+	ipRoutes      *ipRoutes
+
 	committed bool
 }
 
+// ipRoutes records whether the host has IPv4 and IPv6 routes to the public
+// internet on the network identified by networkID.
+type ipRoutes struct {
+	networkID    string
+	hasIPv4Route bool
+	hasIPv6Route bool
+}
+
 // LoadConfig parses a JSON format Psiphon config JSON string and returns a
 // Config struct populated with config values.
 //
@@ -637,6 +720,27 @@ func (config *Config) Commit() error {
 		}
 	}
 
+	if config.UdpgwServerAddress != "" {
+		_, _, err := net.SplitHostPort(config.UdpgwServerAddress)
+		if err != nil {
+			return common.ContextError(fmt.Errorf("invalid UdpgwServerAddress: %s", err))
+		}
+	}
+
+	if config.EnableLocalDNSProxy {
+		if net.ParseIP(config.LocalDNSProxyUpstreamServer) == nil {
+			return common.ContextError(errors.New("invalid LocalDNSProxyUpstreamServer"))
+		}
+	}
+
+	if config.EnableMultiHopTunnels && config.DisableApi {
+		return common.ContextError(errors.New("multi-hop tunnels require the Psiphon API"))
+	}
+
+	if config.EnableLocalControlAPI && config.LocalControlAPISecret == "" {
+		return common.ContextError(errors.New("missing LocalControlAPISecret"))
+	}
+
 	// This constraint is expected by logic in Controller.runTunnels().
 
 	if config.PacketTunnelTunFileDescriptor > 0 && config.TunnelPoolSize != 1 {
@@ -684,6 +788,7 @@ func (config *Config) Commit() error {
 	// Set defaults for dynamic config fields.
 
 	config.SetDynamicConfig(config.SponsorId, config.Authorizations)
+	config.SetEgressRegion(config.EgressRegion)
 
 	// Initialize config.deviceBinder and config.config.networkIDGetter. These
 	// wrap config.DeviceBinder and config.NetworkIDGetter/NetworkID with
@@ -789,6 +894,55 @@ func (config *Config) GetAuthorizations() []string {
 	return config.authorizations
 }
 
+// SetEgressRegion sets the current egress region, overriding the
+// EgressRegion config value. The new value is used when selecting server
+// entries in the next establishment.
+func (config *Config) SetEgressRegion(egressRegion string) {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	config.egressRegion = egressRegion
+}
+
+// GetEgressRegion returns the current egress region.
+func (config *Config) GetEgressRegion() string {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	return config.egressRegion
+}
+
+// hasIPRoutes returns whether the host has IPv4 and IPv6 routes to the
+// public internet. The routes are checked once per network ID and then
+// cached, until reset by resetIPRoutes, rather than on every dial.
+func (config *Config) hasIPRoutes() (bool, bool) {
+
+	networkID := ""
+	if config.networkIDGetter != nil {
+		networkID = config.networkIDGetter.GetNetworkID()
+	}
+
+	config.ipRoutesMutex.Lock()
+	defer config.ipRoutesMutex.Unlock()
+
+	if config.ipRoutes == nil || config.ipRoutes.networkID != networkID {
+		config.ipRoutes = &ipRoutes{
+			networkID:    networkID,
+			hasIPv4Route: hasIPRoute(false, config.deviceBinder),
+			hasIPv6Route: hasIPRoute(true, config.deviceBinder),
+		}
+	}
+
+	return config.ipRoutes.hasIPv4Route, config.ipRoutes.hasIPv6Route
+}
+
+// resetIPRoutes clears the cached routes, which are checked again on the
+// next hasIPRoutes call. This is used when the network may have changed
+// without a change in network ID, as when no NetworkIDGetter is configured.
+func (config *Config) resetIPRoutes() {
+	config.ipRoutesMutex.Lock()
+	defer config.ipRoutesMutex.Unlock()
+	config.ipRoutes = nil
+}
+
 func (config *Config) UseUpstreamProxy() bool {
 	return config.UpstreamProxyURL != ""
 }
@@ -23,6 +23,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -187,3 +188,57 @@ func (suite *ConfigTestSuite) Test_LoadConfig_GoodJson() {
 	}
 	suite.Nil(err, "JSON with null for optional values should succeed")
 }
+
+type testNetworkIDGetter struct {
+	networkID string
+}
+
+func (n *testNetworkIDGetter) GetNetworkID() string {
+	return n.networkID
+}
+
+type testDeviceBinder struct {
+	bindCount int32
+}
+
+func (d *testDeviceBinder) BindToDevice(_ int) (string, error) {
+	atomic.AddInt32(&d.bindCount, 1)
+	return "", nil
+}
+
+func TestIPRoutesCache(t *testing.T) {
+
+	networkIDGetter := &testNetworkIDGetter{networkID: "NETWORK1"}
+	deviceBinder := &testDeviceBinder{}
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		NetworkIDGetter:      networkIDGetter,
+		DeviceBinder:         deviceBinder,
+	}
+	err := config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	// Each check binds one IPv4 and one IPv6 probe socket.
+
+	checkBindCount := func(expectedBindCount int32) {
+		config.hasIPRoutes()
+		bindCount := atomic.LoadInt32(&deviceBinder.bindCount)
+		if bindCount != expectedBindCount {
+			t.Fatalf("unexpected bind count: %d", bindCount)
+		}
+	}
+
+	checkBindCount(2)
+	checkBindCount(2)
+
+	networkIDGetter.networkID = "NETWORK2"
+	checkBindCount(4)
+	checkBindCount(4)
+
+	config.resetIPRoutes()
+	checkBindCount(6)
+}
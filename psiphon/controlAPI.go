@@ -0,0 +1,345 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	CONTROL_API_IO_TIMEOUT            = 10 * time.Second
+	CONTROL_API_MAX_REQUEST_BODY_SIZE = 65536
+)
+
+// ControlAPI is a local HTTP server which exposes client status and
+// commands to other local processes. The API is intended for front ends,
+// such as the console client, which otherwise only observe the client
+// through notices.
+//
+// All requests must include an "Authorization: Bearer <secret>" header,
+// where the secret is Config.LocalControlAPISecret. Response bodies are
+// JSON. The API supports the following requests:
+//
+// GET /status: reports the active tunnels, including the server region,
+// tunnel protocol, and bytes transferred for each tunnel.
+//
+// GET /stats: reports bytes transferred, summed over all active tunnels,
+// and the number of stored SLOKs.
+//
+// POST /reconnect: terminates the next active tunnel, which initiates
+// establishment of a replacement tunnel.
+//
+// POST /dynamic-config: sets the sponsor ID and authorizations used for
+// subsequent tunnels. The request body is a JSON object with optional
+// "sponsor_id" and "authorizations" fields; see Controller.SetDynamicConfig.
+//
+// POST /egress-region: changes the egress region and reconnects. The
+// request body is a JSON object with an "egress_region" field; see
+// Controller.SetEgressRegion.
+type ControlAPI struct {
+	controller             *Controller
+	secret                 string
+	listener               net.Listener
+	serveWaitGroup         *sync.WaitGroup
+	openConns              *common.Conns
+	stopListeningBroadcast chan struct{}
+	listenPort             int
+}
+
+// ControlAPITunnelStatus is the status of a single active tunnel, as
+// reported by the control API.
+type ControlAPITunnelStatus struct {
+	ServerIPAddress    string `json:"server_ip_address"`
+	ServerRegion       string `json:"server_region"`
+	Protocol           string `json:"protocol"`
+	EstablishedSeconds int64  `json:"established_seconds"`
+	TotalBytesSent     int64  `json:"total_bytes_sent"`
+	TotalBytesReceived int64  `json:"total_bytes_received"`
+}
+
+// ControlAPIStatus is the response body for the control API status
+// request.
+type ControlAPIStatus struct {
+	Connected      bool                      `json:"connected"`
+	TunnelPoolSize int                       `json:"tunnel_pool_size"`
+	EgressRegion   string                    `json:"egress_region"`
+	SponsorID      string                    `json:"sponsor_id"`
+	Tunnels        []*ControlAPITunnelStatus `json:"tunnels"`
+}
+
+// ControlAPIStats is the response body for the control API stats request.
+type ControlAPIStats struct {
+	TotalBytesSent     int64 `json:"total_bytes_sent"`
+	TotalBytesReceived int64 `json:"total_bytes_received"`
+	SLOKCount          int   `json:"slok_count"`
+}
+
+// ControlAPIDynamicConfig is the request body for the control API
+// dynamic config request.
+type ControlAPIDynamicConfig struct {
+	SponsorID      string   `json:"sponsor_id"`
+	Authorizations []string `json:"authorizations"`
+}
+
+// ControlAPIEgressRegion is the request body for the control API egress
+// region request.
+type ControlAPIEgressRegion struct {
+	EgressRegion string `json:"egress_region"`
+}
+
+// NewControlAPI initializes and runs a new control API server. The server
+// always listens on 127.0.0.1.
+func NewControlAPI(config *Config, controller *Controller) (*ControlAPI, error) {
+
+	listener, err := net.Listen(
+		"tcp", fmt.Sprintf("127.0.0.1:%d", config.LocalControlAPIPort))
+	if err != nil {
+		if IsAddressInUseError(err) {
+			NoticeControlAPIPortInUse(config.LocalControlAPIPort)
+		}
+		return nil, common.ContextError(err)
+	}
+
+	_, listenPortString, _ := net.SplitHostPort(listener.Addr().String())
+	listenPort, _ := strconv.Atoi(listenPortString)
+
+	controlAPI := &ControlAPI{
+		controller:             controller,
+		secret:                 config.LocalControlAPISecret,
+		listener:               listener,
+		serveWaitGroup:         new(sync.WaitGroup),
+		openConns:              common.NewConns(),
+		stopListeningBroadcast: make(chan struct{}),
+		listenPort:             listenPort,
+	}
+
+	controlAPI.serveWaitGroup.Add(1)
+	go controlAPI.serve()
+
+	NoticeListeningControlAPIPort(controlAPI.listenPort)
+
+	return controlAPI, nil
+}
+
+// Close terminates the control API server.
+func (controlAPI *ControlAPI) Close() {
+	close(controlAPI.stopListeningBroadcast)
+	controlAPI.listener.Close()
+	controlAPI.serveWaitGroup.Wait()
+	controlAPI.openConns.CloseAll()
+}
+
+func (controlAPI *ControlAPI) serve() {
+	defer controlAPI.listener.Close()
+	defer controlAPI.serveWaitGroup.Done()
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/status", controlAPI.handler("GET", controlAPI.statusHandler))
+	serveMux.HandleFunc("/stats", controlAPI.handler("GET", controlAPI.statsHandler))
+	serveMux.HandleFunc("/reconnect", controlAPI.handler("POST", controlAPI.reconnectHandler))
+	serveMux.HandleFunc("/dynamic-config", controlAPI.handler("POST", controlAPI.dynamicConfigHandler))
+	serveMux.HandleFunc("/egress-region", controlAPI.handler("POST", controlAPI.egressRegionHandler))
+
+	httpServer := &http.Server{
+		Handler:      serveMux,
+		ReadTimeout:  CONTROL_API_IO_TIMEOUT,
+		WriteTimeout: CONTROL_API_IO_TIMEOUT,
+		ConnState:    controlAPI.httpConnStateCallback,
+	}
+
+	// Note: will be interrupted by listener.Close() call made by controlAPI.Close()
+	err := httpServer.Serve(controlAPI.listener)
+
+	select {
+	case <-controlAPI.stopListeningBroadcast:
+	default:
+		if err != nil {
+			NoticeAlert("control API failed: %s", common.ContextError(err))
+		}
+	}
+	NoticeInfo("control API stopped")
+}
+
+func (controlAPI *ControlAPI) httpConnStateCallback(conn net.Conn, connState http.ConnState) {
+	switch connState {
+	case http.StateNew:
+		controlAPI.openConns.Add(conn)
+	case http.StateHijacked, http.StateClosed:
+		controlAPI.openConns.Remove(conn)
+	}
+}
+
+// handler wraps a control API request handler with method and
+// authorization checks. The handler returns a value to be sent as the JSON
+// response body.
+func (controlAPI *ControlAPI) handler(
+	method string,
+	handle func(request *http.Request) (interface{}, error)) http.HandlerFunc {
+
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+
+		if !controlAPI.isAuthorized(request) {
+			http.Error(responseWriter, "", http.StatusUnauthorized)
+			return
+		}
+
+		if request.Method != method {
+			http.Error(responseWriter, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		response, err := handle(request)
+		if err != nil {
+			NoticeAlert("control API request %s failed: %s", request.URL.Path, err)
+			http.Error(responseWriter, "", http.StatusBadRequest)
+			return
+		}
+
+		responsePayload, err := json.Marshal(response)
+		if err != nil {
+			NoticeAlert("control API request %s failed: %s", request.URL.Path, common.ContextError(err))
+			http.Error(responseWriter, "", http.StatusInternalServerError)
+			return
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(responsePayload)
+	}
+}
+
+func (controlAPI *ControlAPI) isAuthorized(request *http.Request) bool {
+
+	authorization := request.Header.Get("Authorization")
+	prefix := "Bearer "
+	if !strings.HasPrefix(authorization, prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(
+		[]byte(authorization[len(prefix):]),
+		[]byte(controlAPI.secret)) == 1
+}
+
+func (controlAPI *ControlAPI) statusHandler(_ *http.Request) (interface{}, error) {
+
+	config := controlAPI.controller.config
+
+	status := &ControlAPIStatus{
+		TunnelPoolSize: config.TunnelPoolSize,
+		EgressRegion:   config.GetEgressRegion(),
+		SponsorID:      config.GetSponsorID(),
+		Tunnels:        make([]*ControlAPITunnelStatus, 0),
+	}
+
+	for _, tunnel := range controlAPI.controller.getActiveTunnels() {
+		sent, received := tunnel.GetTotalBytesTransferred()
+		status.Tunnels = append(status.Tunnels, &ControlAPITunnelStatus{
+			ServerIPAddress:    tunnel.serverEntry.IpAddress,
+			ServerRegion:       tunnel.serverEntry.Region,
+			Protocol:           tunnel.protocol,
+			EstablishedSeconds: int64(monotime.Since(tunnel.establishedTime) / time.Second),
+			TotalBytesSent:     sent,
+			TotalBytesReceived: received,
+		})
+	}
+
+	status.Connected = len(status.Tunnels) > 0
+
+	return status, nil
+}
+
+func (controlAPI *ControlAPI) statsHandler(_ *http.Request) (interface{}, error) {
+
+	stats := &ControlAPIStats{}
+
+	for _, tunnel := range controlAPI.controller.getActiveTunnels() {
+		sent, received := tunnel.GetTotalBytesTransferred()
+		stats.TotalBytesSent += sent
+		stats.TotalBytesReceived += received
+	}
+
+	stats.SLOKCount = CountSLOKs()
+
+	return stats, nil
+}
+
+func (controlAPI *ControlAPI) reconnectHandler(_ *http.Request) (interface{}, error) {
+
+	controlAPI.controller.TerminateNextActiveTunnel()
+
+	return struct{}{}, nil
+}
+
+func (controlAPI *ControlAPI) dynamicConfigHandler(request *http.Request) (interface{}, error) {
+
+	body, err := ioutil.ReadAll(
+		io.LimitReader(request.Body, CONTROL_API_MAX_REQUEST_BODY_SIZE))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var dynamicConfig ControlAPIDynamicConfig
+	err = json.Unmarshal(body, &dynamicConfig)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	controlAPI.controller.SetDynamicConfig(
+		dynamicConfig.SponsorID, dynamicConfig.Authorizations)
+
+	NoticeInfo("control API set dynamic config")
+
+	return struct{}{}, nil
+}
+
+func (controlAPI *ControlAPI) egressRegionHandler(request *http.Request) (interface{}, error) {
+
+	body, err := ioutil.ReadAll(
+		io.LimitReader(request.Body, CONTROL_API_MAX_REQUEST_BODY_SIZE))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var egressRegion ControlAPIEgressRegion
+	err = json.Unmarshal(body, &egressRegion)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = controlAPI.controller.SetEgressRegion(egressRegion.EgressRegion)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return struct{}{}, nil
+}
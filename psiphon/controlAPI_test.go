@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestControlAPI(t *testing.T) {
+
+	config := &Config{
+		PropagationChannelId:  "0",
+		SponsorId:             "0",
+		DataStoreDirectory:    testDataDirName,
+		EnableLocalControlAPI: true,
+		LocalControlAPISecret: "secret",
+	}
+	err := config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	// Don't leave a stored egress region for other tests.
+	defer SetKeyValue(DATA_STORE_EGRESS_REGION_KEY, "")
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+
+	controlAPI, err := NewControlAPI(config, controller)
+	if err != nil {
+		t.Fatalf("NewControlAPI failed: %s", err)
+	}
+	defer controlAPI.Close()
+
+	request := func(method, path, secret, body string) (int, []byte) {
+		httpRequest, err := http.NewRequest(
+			method,
+			fmt.Sprintf("http://127.0.0.1:%d%s", controlAPI.listenPort, path),
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		httpRequest.Header.Set("Authorization", "Bearer "+secret)
+		response, err := http.DefaultClient.Do(httpRequest)
+		if err != nil {
+			t.Fatalf("Do failed: %s", err)
+		}
+		defer response.Body.Close()
+		var responseBody json.RawMessage
+		json.NewDecoder(response.Body).Decode(&responseBody)
+		return response.StatusCode, responseBody
+	}
+
+	statusCode, _ := request("GET", "/status", "invalid", "")
+	if statusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code for invalid secret: %d", statusCode)
+	}
+
+	statusCode, _ = request("GET", "/reconnect", "secret", "")
+	if statusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status code for invalid method: %d", statusCode)
+	}
+
+	statusCode, _ = request("POST", "/reconnect", "secret", "")
+	if statusCode != http.StatusOK {
+		t.Fatalf("unexpected status code for reconnect: %d", statusCode)
+	}
+
+	statusCode, _ = request(
+		"POST", "/dynamic-config", "secret",
+		`{"sponsor_id":"1","authorizations":["authorization"]}`)
+	if statusCode != http.StatusOK {
+		t.Fatalf("unexpected status code for dynamic config: %d", statusCode)
+	}
+
+	authorizations := config.GetAuthorizations()
+	if config.GetSponsorID() != "1" ||
+		len(authorizations) != 1 || authorizations[0] != "authorization" {
+
+		t.Fatalf("unexpected dynamic config: %s %v", config.GetSponsorID(), authorizations)
+	}
+
+	statusCode, _ = request(
+		"POST", "/egress-region", "secret", `{"egress_region":"invalid"}`)
+	if statusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status code for invalid egress region: %d", statusCode)
+	}
+
+	statusCode, _ = request(
+		"POST", "/egress-region", "secret", `{"egress_region":"CA"}`)
+	if statusCode != http.StatusOK {
+		t.Fatalf("unexpected status code for egress region: %d", statusCode)
+	}
+
+	statusCode, responseBody := request("GET", "/status", "secret", "")
+	if statusCode != http.StatusOK {
+		t.Fatalf("unexpected status code for status: %d", statusCode)
+	}
+
+	var status ControlAPIStatus
+	err = json.Unmarshal(responseBody, &status)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	if status.Connected ||
+		len(status.Tunnels) != 0 ||
+		status.SponsorID != "1" ||
+		status.EgressRegion != "CA" {
+
+		t.Fatalf("unexpected status: %s", string(responseBody))
+	}
+
+	statusCode, responseBody = request("GET", "/stats", "secret", "")
+	if statusCode != http.StatusOK {
+		t.Fatalf("unexpected status code for stats: %d", statusCode)
+	}
+
+	var stats ControlAPIStats
+	err = json.Unmarshal(responseBody, &stats)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	if stats.TotalBytesSent != 0 || stats.TotalBytesReceived != 0 {
+		t.Fatalf("unexpected stats: %s", string(responseBody))
+	}
+
+	// The egress region selected via the control API is restored by a new
+	// controller, unless the EgressRegion config value has changed.
+
+	for _, testCase := range []struct {
+		configEgressRegion   string
+		expectedEgressRegion string
+	}{
+		{"", "CA"},
+		{"US", "US"},
+	} {
+
+		restoreConfig := &Config{
+			PropagationChannelId: "0",
+			SponsorId:            "0",
+			EgressRegion:         testCase.configEgressRegion,
+		}
+		err = restoreConfig.Commit()
+		if err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+
+		_, err = NewController(restoreConfig)
+		if err != nil {
+			t.Fatalf("NewController failed: %s", err)
+		}
+
+		if restoreConfig.GetEgressRegion() != testCase.expectedEgressRegion {
+			t.Fatalf("unexpected restored egress region: %s", restoreConfig.GetEgressRegion())
+		}
+	}
+}
@@ -51,10 +51,12 @@ type Controller struct {
 	runWaitGroup                            *sync.WaitGroup
 	connectedTunnels                        chan *Tunnel
 	failedTunnels                           chan *Tunnel
+	drainingTunnels                         chan *Tunnel
 	tunnelMutex                             sync.Mutex
 	establishedOnce                         bool
 	tunnels                                 []*Tunnel
-	nextTunnel                              int
+	replaceTunnels                          map[*Tunnel]bool
+	tunnelPoolScheduler                     *tunnelPoolScheduler
 	startedConnectedReporter                bool
 	isEstablishing                          bool
 	establishLimitTunnelProtocolsState      *limitTunnelProtocolsState
@@ -64,6 +66,7 @@ type Controller struct {
 	concurrentIntensiveEstablishTunnels     int
 	peakConcurrentEstablishTunnels          int
 	peakConcurrentIntensiveEstablishTunnels int
+	establishFailedServerEntries            []string
 	establishCtx                            context.Context
 	stopEstablish                           context.CancelFunc
 	establishWaitGroup                      *sync.WaitGroup
@@ -74,6 +77,7 @@ type Controller struct {
 	signalFetchObfuscatedServerLists        chan struct{}
 	signalDownloadUpgrade                   chan string
 	signalReportConnected                   chan struct{}
+	signalRestartEstablishing               chan struct{}
 	serverAffinityDoneBroadcast             chan struct{}
 	packetTunnelClient                      *tun.Client
 	packetTunnelTransport                   *PacketTunnelTransport
@@ -106,11 +110,15 @@ func NewController(config *Config) (controller *Controller, err error) {
 		config:       config,
 		sessionId:    config.SessionID,
 		runWaitGroup: new(sync.WaitGroup),
-		// connectedTunnels and failedTunnels buffer sizes are large enough to
-		// receive full pools of tunnels without blocking. Senders should not block.
+		// connectedTunnels, failedTunnels, and drainingTunnels buffer sizes are
+		// large enough to receive full pools of tunnels without blocking.
+		// Senders should not block.
 		connectedTunnels:         make(chan *Tunnel, config.TunnelPoolSize),
 		failedTunnels:            make(chan *Tunnel, config.TunnelPoolSize),
+		drainingTunnels:          make(chan *Tunnel, config.TunnelPoolSize),
 		tunnels:                  make([]*Tunnel, 0),
+		replaceTunnels:           make(map[*Tunnel]bool),
+		tunnelPoolScheduler:      newTunnelPoolScheduler(),
 		establishedOnce:          false,
 		startedConnectedReporter: false,
 		isEstablishing:           false,
@@ -122,6 +130,15 @@ func NewController(config *Config) (controller *Controller, err error) {
 		signalFetchObfuscatedServerLists:  make(chan struct{}),
 		signalDownloadUpgrade:             make(chan string),
 		signalReportConnected:             make(chan struct{}),
+		signalRestartEstablishing:         make(chan struct{}, 1),
+	}
+
+	// Apply any egress region selected with SetEgressRegion in a previous
+	// run. This requires an open datastore; failure is not fatal, and the
+	// EgressRegion config value is used.
+	err = restoreEgressRegion(config)
+	if err != nil {
+		NoticeAlert("restore egress region failed: %s", err)
 	}
 
 	controller.splitTunnelClassifier = NewSplitTunnelClassifier(config, controller)
@@ -134,12 +151,24 @@ func NewController(config *Config) (controller *Controller, err error) {
 		// that presents a continuosuly existing transport to the tun.Client;
 		// it's set to use new SSH channels after new SSH tunnel establishes.
 
-		packetTunnelTransport := NewPacketTunnelTransport()
+		// When PacketTunnelRequestSessionConfiguration is set, the session
+		// configuration is requested each time a new packet tunnel SSH channel
+		// is established, as each server assigns its own configuration.
+
+		var channelEstablished func()
+		var sessionConfigurationHandler func(*tun.SessionConfiguration)
+		if config.PacketTunnelRequestSessionConfiguration {
+			channelEstablished = controller.requestPacketTunnelSessionConfiguration
+			sessionConfigurationHandler = NoticePacketTunnelSessionConfiguration
+		}
+
+		packetTunnelTransport := NewPacketTunnelTransport(channelEstablished)
 
 		packetTunnelClient, err := tun.NewClient(&tun.ClientConfig{
-			Logger:            NoticeCommonLogger(),
-			TunFileDescriptor: config.PacketTunnelTunFileDescriptor,
-			Transport:         packetTunnelTransport,
+			Logger:                      NoticeCommonLogger(),
+			TunFileDescriptor:           config.PacketTunnelTunFileDescriptor,
+			Transport:                   packetTunnelTransport,
+			SessionConfigurationHandler: sessionConfigurationHandler,
 		})
 		if err != nil {
 			return nil, common.ContextError(err)
@@ -167,6 +196,8 @@ func (controller *Controller) Run(ctx context.Context) {
 	controller.runCtx = runCtx
 	controller.stopRunning = stopRunning
 
+	controller.pruneServerEntries()
+
 	// Start components
 
 	// TODO: IPv6 support
@@ -205,6 +236,24 @@ func (controller *Controller) Run(ctx context.Context) {
 		defer httpProxy.Close()
 	}
 
+	if controller.config.EnableLocalDNSProxy {
+		dnsProxy, err := NewDNSProxy(controller.config, controller, listenIP)
+		if err != nil {
+			NoticeAlert("error initializing local DNS proxy: %s", err)
+			return
+		}
+		defer dnsProxy.Close()
+	}
+
+	if controller.config.EnableLocalControlAPI {
+		controlAPI, err := NewControlAPI(controller.config, controller)
+		if err != nil {
+			NoticeAlert("error initializing local control API: %s", err)
+			return
+		}
+		defer controlAPI.Close()
+	}
+
 	if !controller.config.DisableRemoteServerListFetcher {
 
 		if controller.config.RemoteServerListURLs != nil {
@@ -279,6 +328,56 @@ func (controller *Controller) SetDynamicConfig(sponsorID string, authorizations
 	controller.config.SetDynamicConfig(sponsorID, authorizations)
 }
 
+// SetEgressRegion changes the egress region without restarting the
+// controller. Establishment is restarted, selecting only server entries in
+// the new region, and active tunnels in other regions are replaced. An empty
+// egressRegion selects servers in any region.
+//
+// The selected region is persisted and is used by subsequent runs, unless
+// the EgressRegion config value is changed.
+func (controller *Controller) SetEgressRegion(egressRegion string) error {
+
+	if egressRegion != "" && !isValidEgressRegion(egressRegion) {
+		return common.ContextError(fmt.Errorf("invalid egress region: %s", egressRegion))
+	}
+
+	if egressRegion == controller.config.GetEgressRegion() {
+		return nil
+	}
+
+	controller.config.SetEgressRegion(egressRegion)
+
+	err := storeEgressRegion(controller.config)
+	if err != nil {
+		NoticeAlert("store egress region failed: %s", err)
+	}
+
+	NoticeEgressRegion(egressRegion)
+
+	// Don't block. runTunnels restarts establishment using the current egress
+	// region value, so a pending signal covers any subsequent changes.
+	select {
+	case controller.signalRestartEstablishing <- *new(struct{}):
+	default:
+	}
+
+	return nil
+}
+
+// isValidEgressRegion checks that the egress region is an ISO 3166-1
+// alpha-2 country code.
+func isValidEgressRegion(egressRegion string) bool {
+	if len(egressRegion) != 2 {
+		return false
+	}
+	for _, c := range egressRegion {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
 // TerminateNextActiveTunnel terminates the active tunnel, which will initiate
 // establishment of a new tunnel.
 func (controller *Controller) TerminateNextActiveTunnel() {
@@ -344,6 +443,11 @@ fetcherLoop:
 
 			if err == nil {
 				lastFetchTime = monotime.Now()
+
+				// Newly fetched server entries may supersede stored server
+				// entries or exceed the server entry limit.
+				controller.pruneServerEntries()
+
 				break retryLoop
 			}
 
@@ -592,6 +696,23 @@ loop:
 			// which reference controller.isEstablishing.
 			controller.startEstablishing()
 
+		case drainingTunnel := <-controller.drainingTunnels:
+
+			// The tunnel's server is draining and will soon shut down. The tunnel
+			// remains active while a replacement tunnel is established; the
+			// replacement, which can't be to the same server since the draining
+			// tunnel is active, takes the draining tunnel's slot in the pool, and
+			// the draining tunnel is then closed. See registerTunnel.
+
+			if controller.setReplaceTunnel(drainingTunnel) {
+				NoticeInfo("replacing tunnel: %s", drainingTunnel.serverEntry.IpAddress)
+				controller.startEstablishing()
+			}
+
+		case <-controller.signalRestartEstablishing:
+
+			controller.restartEstablishing()
+
 		case connectedTunnel := <-controller.connectedTunnels:
 
 			// Tunnel establishment has two phases: connection and activation.
@@ -635,6 +756,12 @@ loop:
 
 				err := connectedTunnel.Activate(controller.runCtx, controller)
 
+				// Activation failures due to the controller stopping are not
+				// recorded.
+				if err == nil || controller.runCtx.Err() == nil {
+					controller.recordProtocolOutcome(connectedTunnel, err == nil)
+				}
+
 				if err != nil {
 					NoticeAlert("failed to activate %s: %s", connectedTunnel.serverEntry.IpAddress, err)
 					discardTunnel = true
@@ -667,6 +794,8 @@ loop:
 				break
 			}
 
+			controller.recordServerEntryFailures()
+
 			NoticeActiveTunnel(
 				connectedTunnel.serverEntry.IpAddress,
 				connectedTunnel.protocol,
@@ -777,6 +906,19 @@ func (controller *Controller) SignalTunnelFailure(tunnel *Tunnel) {
 	}
 }
 
+// SignalTunnelDraining implements the TunnelOwner interface. This function
+// is called by Tunnel.operateTunnel when the tunnel's server has signaled
+// that it's draining. The Controller will signal runTunnels to establish a
+// replacement tunnel.
+func (controller *Controller) SignalTunnelDraining(tunnel *Tunnel) {
+	// Don't block. In case there's no room, the tunnel isn't replaced until
+	// it fails.
+	select {
+	case controller.drainingTunnels <- tunnel:
+	default:
+	}
+}
+
 // discardTunnel disposes of a successful connection that is no longer required.
 func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 	NoticeInfo("discard tunnel: %s", tunnel.serverEntry.IpAddress)
@@ -787,15 +929,52 @@ func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 	tunnel.Close(true)
 }
 
+// recordServerEntryFailures records the server entries that failed to
+// connect in the current establishment. Failures are recorded only once a
+// tunnel is established, which demonstrates that the network is working; so
+// server entries are not counted as failing while the network is down.
+func (controller *Controller) recordServerEntryFailures() {
+
+	controller.concurrentEstablishTunnelsMutex.Lock()
+	failedServerEntries := controller.establishFailedServerEntries
+	controller.establishFailedServerEntries = nil
+	controller.concurrentEstablishTunnelsMutex.Unlock()
+
+	if len(failedServerEntries) == 0 {
+		return
+	}
+
+	err := RecordServerEntryFailures(failedServerEntries)
+	if err != nil {
+		NoticeAlert("failed to record server entry failures: %s", err)
+	}
+}
+
+// pruneServerEntries deletes dead, stale, and excess server entries from the
+// data store.
+func (controller *Controller) pruneServerEntries() {
+
+	dead, stale, excess, err := PruneServerEntries(controller.config)
+	if err != nil {
+		NoticeAlert("failed to prune server entries: %s", err)
+		return
+	}
+
+	if dead+stale+excess > 0 {
+		NoticePrunedServerEntries(dead, stale, excess)
+	}
+}
+
 // registerTunnel adds the connected tunnel to the pool of active tunnels
 // which are candidates for port forwarding. Returns true if the pool has an
 // empty slot and false if the pool is full (caller should discard the tunnel).
+//
+// When the pool is full and a tunnel is pending replacement, the connected
+// tunnel replaces, and the pool closes, that tunnel. The active tunnel count
+// doesn't drop while replacing.
 func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	if len(controller.tunnels) >= controller.config.TunnelPoolSize {
-		return false
-	}
 	// Perform a final check just in case we've established
 	// a duplicate connection.
 	for _, activeTunnel := range controller.tunnels {
@@ -804,16 +983,27 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 			return false
 		}
 	}
+	if len(controller.tunnels) >= controller.config.TunnelPoolSize {
+		if !controller.removeReplaceTunnel() {
+			return false
+		}
+	}
 	controller.establishedOnce = true
 	controller.tunnels = append(controller.tunnels, tunnel)
-	NoticeTunnels(len(controller.tunnels))
+	controller.noticeTunnels()
 
 	// Promote this successful tunnel to first rank so it's one
 	// of the first candidates next time establish runs.
 	// Connecting to a TargetServerEntry does not change the
 	// ranking.
+	// For multi-hop tunnels, the entry server is promoted, as candidates
+	// are entry servers.
 	if controller.config.TargetServerEntry == "" {
-		PromoteServerEntry(controller.config, tunnel.serverEntry.IpAddress)
+		promoteServerEntry := tunnel.serverEntry
+		if tunnel.entryTunnel != nil {
+			promoteServerEntry = tunnel.entryTunnel.serverEntry
+		}
+		PromoteServerEntry(controller.config, promoteServerEntry.IpAddress)
 	}
 
 	return true
@@ -829,26 +1019,120 @@ func (controller *Controller) hasEstablishedOnce() bool {
 }
 
 // isFullyEstablished indicates if the pool of active tunnels is full.
+// Tunnels pending replacement don't count towards a full pool.
 func (controller *Controller) isFullyEstablished() bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	return len(controller.tunnels) >= controller.config.TunnelPoolSize
+	return len(controller.tunnels)-len(controller.replaceTunnels) >=
+		controller.config.TunnelPoolSize
 }
 
 // numTunnels returns the number of active and outstanding tunnels.
 // Oustanding is the number of tunnels required to fill the pool of
-// active tunnels.
+// active tunnels, including replacements for tunnels pending
+// replacement.
 func (controller *Controller) numTunnels() (int, int) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
 	active := len(controller.tunnels)
-	outstanding := controller.config.TunnelPoolSize - len(controller.tunnels)
+	outstanding := controller.config.TunnelPoolSize -
+		len(controller.tunnels) + len(controller.replaceTunnels)
 	return active, outstanding
 }
 
+// restartEstablishing applies a change in the egress region. Any in-progress
+// establishment is using a ServerEntryIterator with the previous region, so
+// establishment is stopped and tunnels connected but not yet activated are
+// discarded.
+//
+// Active tunnels in the new egress region are kept. Other active tunnels are
+// replaced in the same way as tunnels to draining servers: each remains
+// active, so the client isn't left without a tunnel, until a replacement in
+// the new region takes its slot in the pool; see registerTunnel.
+// Establishment is restarted only when replacements are required.
+//
+// Concurrency note: only the runTunnels goroutine may call
+// restartEstablishing, which calls startEstablishing/stopEstablishing.
+func (controller *Controller) restartEstablishing() {
+
+	NoticeInfo("restart establishing")
+
+	controller.stopEstablishing()
+
+	for drained := false; !drained; {
+		select {
+		case connectedTunnel := <-controller.connectedTunnels:
+			controller.discardTunnel(connectedTunnel)
+		default:
+			drained = true
+		}
+	}
+
+	egressRegion := controller.config.GetEgressRegion()
+
+	controller.tunnelMutex.Lock()
+	for _, activeTunnel := range controller.tunnels {
+		if (egressRegion == "" || activeTunnel.serverEntry.Region == egressRegion) ||
+			controller.replaceTunnels[activeTunnel] {
+			continue
+		}
+		NoticeInfo("replacing tunnel: %s", activeTunnel.serverEntry.IpAddress)
+		controller.replaceTunnels[activeTunnel] = true
+	}
+	controller.tunnelMutex.Unlock()
+
+	if !controller.isFullyEstablished() {
+		controller.startEstablishing()
+	}
+}
+
+// setReplaceTunnel marks an active tunnel as pending replacement. Returns
+// false when the tunnel is not active or is already pending replacement.
+func (controller *Controller) setReplaceTunnel(tunnel *Tunnel) bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if controller.replaceTunnels[tunnel] {
+		return false
+	}
+	for _, activeTunnel := range controller.tunnels {
+		if tunnel == activeTunnel {
+			controller.replaceTunnels[tunnel] = true
+			return true
+		}
+	}
+	return false
+}
+
+// removeReplaceTunnel removes a tunnel pending replacement from the pool
+// of active tunnels and closes the tunnel. Returns false when no tunnel is
+// pending replacement. The caller must hold tunnelMutex.
+func (controller *Controller) removeReplaceTunnel() bool {
+	for index, activeTunnel := range controller.tunnels {
+		if controller.replaceTunnels[activeTunnel] {
+			controller.tunnels = append(
+				controller.tunnels[:index], controller.tunnels[index+1:]...)
+			delete(controller.replaceTunnels, activeTunnel)
+			controller.tunnelPoolScheduler.removeTunnel(activeTunnel)
+			NoticeInfo("replaced tunnel: %s", activeTunnel.serverEntry.IpAddress)
+			activeTunnel.Close(false)
+			return true
+		}
+	}
+	return false
+}
+
+// getActiveTunnels returns a copy of the list of active tunnels.
+func (controller *Controller) getActiveTunnels() []*Tunnel {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	tunnels := make([]*Tunnel, len(controller.tunnels))
+	copy(tunnels, controller.tunnels)
+	return tunnels
+}
+
 // terminateTunnel removes a tunnel from the pool of active tunnels
-// and closes the tunnel. The next-tunnel state used by getNextActiveTunnel
-// is adjusted as required.
+// and closes the tunnel. The tunnel pool scheduler state used by
+// getNextActiveTunnel is adjusted as required.
 func (controller *Controller) terminateTunnel(tunnel *Tunnel) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
@@ -856,14 +1140,10 @@ func (controller *Controller) terminateTunnel(tunnel *Tunnel) {
 		if tunnel == activeTunnel {
 			controller.tunnels = append(
 				controller.tunnels[:index], controller.tunnels[index+1:]...)
-			if controller.nextTunnel > index {
-				controller.nextTunnel--
-			}
-			if controller.nextTunnel >= len(controller.tunnels) {
-				controller.nextTunnel = 0
-			}
+			delete(controller.replaceTunnels, activeTunnel)
+			controller.tunnelPoolScheduler.removeTunnel(activeTunnel)
 			activeTunnel.Close(false)
-			NoticeTunnels(len(controller.tunnels))
+			controller.noticeTunnels()
 			break
 		}
 	}
@@ -888,22 +1168,53 @@ func (controller *Controller) terminateAllTunnels() {
 	}
 	closeWaitGroup.Wait()
 	controller.tunnels = make([]*Tunnel, 0)
-	controller.nextTunnel = 0
-	NoticeTunnels(len(controller.tunnels))
+	controller.replaceTunnels = make(map[*Tunnel]bool)
+	controller.tunnelPoolScheduler = newTunnelPoolScheduler()
+	controller.noticeTunnels()
+}
+
+// requestPacketTunnelSessionConfiguration requests the packet tunnel session
+// configuration from the server the packet tunnel is currently connected to.
+// The response is reported, asynchronously, by the packet tunnel client's
+// SessionConfigurationHandler.
+func (controller *Controller) requestPacketTunnelSessionConfiguration() {
+	err := controller.packetTunnelClient.RequestSessionConfiguration()
+	if err != nil {
+		NoticeAlert("request packet tunnel session configuration failed: %s", err)
+	}
+}
+
+// noticeTunnels emits a Tunnels notice with the active tunnel count and
+// per-tunnel utilization. The caller must hold tunnelMutex.
+func (controller *Controller) noticeTunnels() {
+	NoticeTunnels(
+		len(controller.tunnels),
+		controller.tunnelPoolScheduler.getUtilization(controller.tunnels))
 }
 
 // getNextActiveTunnel returns the next tunnel from the pool of active
-// tunnels. Currently, tunnel selection order is simple round-robin.
+// tunnels. Tunnels are selected by the tunnel pool scheduler, which
+// weights tunnels by RTT and recent port forward failure rate and avoids
+// degraded tunnels; see tunnelPoolScheduler.
 func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	for i := len(controller.tunnels); i > 0; i-- {
-		tunnel = controller.tunnels[controller.nextTunnel]
-		controller.nextTunnel =
-			(controller.nextTunnel + 1) % len(controller.tunnels)
-		return tunnel
+
+	p := controller.config.clientParameters.Get()
+	degradedFailureRate := p.Float(parameters.TunnelPoolDegradedFailureRate)
+	degradedRTTMultiplier := p.Float(parameters.TunnelPoolDegradedRTTMultiplier)
+	p = nil
+
+	tunnel, degradedChanged := controller.tunnelPoolScheduler.selectTunnel(
+		controller.tunnels, degradedFailureRate, degradedRTTMultiplier)
+
+	// Report utilization when a tunnel becomes degraded or recovers, in
+	// addition to when the tunnel count changes.
+	if degradedChanged {
+		controller.noticeTunnels()
 	}
-	return nil
+
+	return tunnel
 }
 
 // isActiveTunnelServerEntry is used to check if there's already
@@ -970,6 +1281,7 @@ type limitTunnelProtocolsState struct {
 	initialProtocols      protocol.TunnelProtocols
 	initialCandidateCount int
 	protocols             protocol.TunnelProtocols
+	protocolStats         *protocolStats
 }
 
 func (l *limitTunnelProtocolsState) isInitialCandidate(
@@ -988,8 +1300,15 @@ func (l *limitTunnelProtocolsState) isCandidate(
 
 var errNoProtocolSupported = errors.New("server does not support any required protocol")
 
+// selectProtocol selects a tunnel protocol for the server entry. When
+// replayProtocol is not "" and is a candidate protocol, it is selected.
+// Otherwise, when protocolStats is set, the selection is biased by past
+// establishment outcomes on the current network.
 func (l *limitTunnelProtocolsState) selectProtocol(
-	connectTunnelCount int, excludeIntensive bool, serverEntry *protocol.ServerEntry) (string, error) {
+	connectTunnelCount int,
+	excludeIntensive bool,
+	serverEntry *protocol.ServerEntry,
+	replayProtocol string) (string, error) {
 
 	limitProtocols := l.protocols
 
@@ -1006,6 +1325,18 @@ func (l *limitTunnelProtocolsState) selectProtocol(
 		return "", errNoProtocolSupported
 	}
 
+	if replayProtocol != "" && common.Contains(candidateProtocols, replayProtocol) {
+		return replayProtocol, nil
+	}
+
+	if l.protocolStats != nil {
+		selectedProtocol, err := l.protocolStats.selectProtocol(candidateProtocols)
+		if err != nil {
+			return "", common.ContextError(err)
+		}
+		return selectedProtocol, nil
+	}
+
 	// Pick at random from the supported protocols. This ensures that we'll
 	// eventually try all possible protocols. Depending on network
 	// configuration, it may be the case that some protocol is only available
@@ -1043,8 +1374,13 @@ func (controller *Controller) startEstablishing() {
 	controller.concurrentIntensiveEstablishTunnels = 0
 	controller.peakConcurrentEstablishTunnels = 0
 	controller.peakConcurrentIntensiveEstablishTunnels = 0
+	controller.establishFailedServerEntries = nil
 	controller.concurrentEstablishTunnelsMutex.Unlock()
 
+	// The network may have changed since the last establishment, so the
+	// host IP routes are checked again.
+	controller.config.resetIPRoutes()
+
 	aggressiveGarbageCollection()
 	emitMemoryMetrics()
 
@@ -1142,6 +1478,16 @@ func (controller *Controller) launchEstablishing() {
 	// establishLimitTunnelProtocolsState field must be read-only after this
 	// point, allowing concurrent reads by establishment workers.
 
+	// Protocol stats, for adaptive protocol selection, are also loaded once
+	// per establishment, for the current network. Protocol stats are safe
+	// for concurrent use.
+
+	stats, err := loadProtocolStats(controller.config)
+	if err != nil {
+		NoticeAlert("failed to load protocol stats: %s", err)
+		stats = nil
+	}
+
 	p := controller.config.clientParameters.Get()
 
 	controller.establishLimitTunnelProtocolsState = &limitTunnelProtocolsState{
@@ -1149,6 +1495,7 @@ func (controller *Controller) launchEstablishing() {
 		initialProtocols:      p.TunnelProtocols(parameters.InitialLimitTunnelProtocols),
 		initialCandidateCount: p.Int(parameters.InitialLimitTunnelProtocolsCandidateCount),
 		protocols:             p.TunnelProtocols(parameters.LimitTunnelProtocols),
+		protocolStats:         stats,
 	}
 
 	workerPoolSize := controller.config.clientParameters.Get().Int(
@@ -1178,6 +1525,32 @@ func (controller *Controller) launchEstablishing() {
 	go controller.establishCandidateGenerator()
 }
 
+// recordProtocolOutcome records the establishment outcome of a connected
+// tunnel, after activation, for adaptive protocol selection. As activation
+// outcomes are infrequent, the protocol stats are stored immediately.
+func (controller *Controller) recordProtocolOutcome(tunnel *Tunnel, success bool) {
+
+	if controller.establishLimitTunnelProtocolsState == nil ||
+		controller.establishLimitTunnelProtocolsState.protocolStats == nil {
+		return
+	}
+	stats := controller.establishLimitTunnelProtocolsState.protocolStats
+
+	// For multi-hop tunnels, the selected protocol is the entry tunnel
+	// protocol.
+	tunnelProtocol := tunnel.protocol
+	if tunnel.entryTunnel != nil {
+		tunnelProtocol = tunnel.entryTunnel.protocol
+	}
+
+	stats.recordOutcome(tunnelProtocol, success, tunnel.connectDuration)
+
+	err := stats.store()
+	if err != nil {
+		NoticeAlert("failed to store protocol stats: %s", err)
+	}
+}
+
 // stopEstablishing signals the establish goroutines to stop and waits
 // for the group to halt.
 func (controller *Controller) stopEstablishing() {
@@ -1191,6 +1564,16 @@ func (controller *Controller) stopEstablishing() {
 	controller.establishWaitGroup.Wait()
 	NoticeInfo("stopped establishing")
 
+	// Store the protocol stats recorded by the establish workers.
+	if controller.establishLimitTunnelProtocolsState != nil &&
+		controller.establishLimitTunnelProtocolsState.protocolStats != nil {
+
+		err := controller.establishLimitTunnelProtocolsState.protocolStats.store()
+		if err != nil {
+			NoticeAlert("failed to store protocol stats: %s", err)
+		}
+	}
+
 	controller.isEstablishing = false
 	controller.establishCtx = nil
 	controller.stopEstablish = nil
@@ -1470,10 +1853,10 @@ loop:
 
 		initialCount, count := CountServerEntriesWithLimits(
 			controller.config.UseUpstreamProxy(),
-			controller.config.EgressRegion,
+			controller.config.GetEgressRegion(),
 			controller.establishLimitTunnelProtocolsState)
 		NoticeCandidateServers(
-			controller.config.EgressRegion,
+			controller.config.GetEgressRegion(),
 			controller.establishLimitTunnelProtocolsState,
 			initialCount,
 			count)
@@ -1648,10 +2031,46 @@ loop:
 		}
 
 		// There may already be a tunnel to this candidate. If so, skip it.
+		// This is expected for the server affinity candidate when replacing
+		// a tunnel to a draining server.
 		if controller.isActiveTunnelServerEntry(candidateServerEntry.serverEntry) {
+
+			if candidateServerEntry.isServerAffinityCandidate {
+				close(controller.serverAffinityDoneBroadcast)
+			}
+
 			continue
 		}
 
+		// With multi-hop tunnels, candidates are entry servers and must
+		// support relaying to an exit server.
+		if controller.config.EnableMultiHopTunnels &&
+			!candidateServerEntry.serverEntry.SupportsMultiHopRelay() {
+
+			if candidateServerEntry.isServerAffinityCandidate {
+				close(controller.serverAffinityDoneBroadcast)
+			}
+
+			continue
+		}
+
+		// Load any stored dial parameters to replay for this server on the
+		// current network. When replaying, the stored tunnel protocol is
+		// selected, provided it's permitted by the protocol limits below.
+
+		replayDialParams, err := GetDialParameters(
+			controller.config, candidateServerEntry.serverEntry)
+		if err != nil {
+			NoticeAlert("failed to get dial parameters for %s: %s",
+				candidateServerEntry.serverEntry.IpAddress, err)
+			replayDialParams = nil
+		}
+
+		replayProtocol := ""
+		if replayDialParams != nil {
+			replayProtocol = replayDialParams.TunnelProtocol
+		}
+
 		// Select the tunnel protocol. The selection will be made at random from
 		// protocols supported by the server entry, optionally limited by
 		// LimitTunnelProtocols.
@@ -1679,7 +2098,8 @@ loop:
 		selectedProtocol, err := controller.establishLimitTunnelProtocolsState.selectProtocol(
 			controller.establishConnectTunnelCount,
 			excludeIntensive,
-			candidateServerEntry.serverEntry)
+			candidateServerEntry.serverEntry,
+			replayProtocol)
 		if err != nil {
 
 			controller.concurrentEstablishTunnelsMutex.Unlock()
@@ -1722,18 +2142,45 @@ loop:
 
 		controller.concurrentEstablishTunnelsMutex.Unlock()
 
+		if replayDialParams != nil && replayDialParams.TunnelProtocol != selectedProtocol {
+			replayDialParams = nil
+		}
+
 		// ConnectTunnel will allocate significant memory, so first attempt to
 		// reclaim as much as possible.
 		defaultGarbageCollection()
 
+		connectStartTime := monotime.Now()
+
 		tunnel, err := ConnectTunnel(
 			controller.establishCtx,
 			controller.config,
 			controller.sessionId,
 			candidateServerEntry.serverEntry,
 			selectedProtocol,
+			replayDialParams,
 			candidateServerEntry.adjustedEstablishStartTime)
 
+		// For multi-hop tunnels, the connected tunnel is the entry tunnel,
+		// and the tunnel delivered to the controller is the exit tunnel.
+		// ConnectMultiHopTunnel closes the entry tunnel on failure.
+		if err == nil && controller.config.EnableMultiHopTunnels {
+			tunnel, err = ConnectMultiHopTunnel(
+				controller.establishCtx, tunnel, controller)
+		}
+
+		// Record connection failures for adaptive protocol selection. Failures
+		// due to establishment stopping are not recorded. The outcome for a
+		// connected tunnel is recorded by runTunnels, after activation.
+		if err == nil {
+			tunnel.connectDuration = monotime.Since(connectStartTime)
+		} else if !controller.isStopEstablishing() {
+			stats := controller.establishLimitTunnelProtocolsState.protocolStats
+			if stats != nil {
+				stats.recordOutcome(selectedProtocol, false, 0)
+			}
+		}
+
 		controller.concurrentEstablishTunnelsMutex.Lock()
 		if isIntensive {
 			controller.concurrentIntensiveEstablishTunnels -= 1
@@ -1773,6 +2220,12 @@ loop:
 			NoticeInfo("failed to connect to %s: %s",
 				candidateServerEntry.serverEntry.IpAddress, err)
 
+			controller.concurrentEstablishTunnelsMutex.Lock()
+			controller.establishFailedServerEntries = append(
+				controller.establishFailedServerEntries,
+				candidateServerEntry.serverEntry.IpAddress)
+			controller.concurrentEstablishTunnelsMutex.Unlock()
+
 			continue
 		}
 
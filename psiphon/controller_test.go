@@ -431,6 +431,107 @@ func TestFrontedMeekFragmentor(t *testing.T) {
 		})
 }
 
+func TestRestartEstablishing(t *testing.T) {
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   testDataDirName,
+		TunnelPoolSize:       2,
+		DisableTactics:       true,
+	}
+	err := config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+
+	// restartEstablishing may start establishing, which requires the run
+	// context; no tunnels are established, as the data store has no server
+	// entries.
+
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+	controller.runCtx = runCtx
+	controller.stopRunning = stopRunning
+	defer controller.stopEstablishing()
+
+	// The test tunnels have no network connection and are marked as closed,
+	// so that Close is a no-op.
+
+	makeTunnel := func(ipAddress, region string) *Tunnel {
+		return &Tunnel{
+			mutex:    new(sync.Mutex),
+			isClosed: true,
+			serverEntry: &protocol.ServerEntry{
+				IpAddress: ipAddress,
+				Region:    region,
+			},
+			health: newTunnelHealth(0),
+		}
+	}
+
+	caTunnel := makeTunnel("192.168.0.1", "CA")
+	usTunnel := makeTunnel("192.168.0.2", "US")
+	controller.tunnels = []*Tunnel{caTunnel, usTunnel}
+
+	// Tunnels in the new region, or in any region, are kept. Tunnels in
+	// other regions remain active, pending replacement, and establishment is
+	// restarted to find replacements.
+
+	for _, egressRegion := range []string{"", "CA", "US"} {
+
+		controller.replaceTunnels = make(map[*Tunnel]bool)
+
+		config.SetEgressRegion(egressRegion)
+		controller.restartEstablishing()
+
+		if len(controller.tunnels) != 2 {
+			t.Fatalf("unexpected active tunnels: %s: %d", egressRegion, len(controller.tunnels))
+		}
+
+		for _, tunnel := range controller.tunnels {
+			expectReplace := egressRegion != "" && tunnel.serverEntry.Region != egressRegion
+			if controller.replaceTunnels[tunnel] != expectReplace {
+				t.Fatalf("unexpected replace state: %s: %s", egressRegion, tunnel.serverEntry.Region)
+			}
+		}
+
+		expectEstablishing := egressRegion != ""
+		if controller.isEstablishing != expectEstablishing {
+			t.Fatalf("unexpected establishing state: %s", egressRegion)
+		}
+	}
+
+	// A tunnel pending replacement remains active until a replacement in the
+	// new region is registered.
+
+	replacementTunnel := makeTunnel("192.168.0.3", "US")
+
+	if !controller.registerTunnel(replacementTunnel) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	if len(controller.tunnels) != 2 ||
+		controller.tunnels[0] != usTunnel ||
+		controller.tunnels[1] != replacementTunnel ||
+		len(controller.replaceTunnels) != 0 ||
+		!controller.isFullyEstablished() {
+
+		t.Fatalf("unexpected tunnel pool after replacement")
+	}
+}
+
 type controllerRunConfig struct {
 	expectNoServerEntries    bool
 	protocol                 string
@@ -27,6 +27,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -49,14 +50,19 @@ const (
 	slokBucket                  = "SLOKs"
 	tacticsBucket               = "tactics"
 	speedTestSamplesBucket      = "speedTestSamples"
+	dialParametersBucket        = "dialParameters"
+	protocolStatsBucket         = "protocolStats"
+	serverEntryStatsBucket      = "serverEntryStats"
 
 	rankedServerEntryCount = 100
 )
 
 const (
 	DATA_STORE_FILENAME                     = "psiphon.boltdb"
+	DATA_STORE_CORRUPT_FILENAME             = DATA_STORE_FILENAME + ".corrupt"
 	DATA_STORE_LAST_CONNECTED_KEY           = "lastConnected"
 	DATA_STORE_LAST_SERVER_ENTRY_FILTER_KEY = "lastServerEntryFilter"
+	DATA_STORE_EGRESS_REGION_KEY            = "egressRegion"
 	PERSISTENT_STAT_TYPE_REMOTE_SERVER_LIST = remoteServerListStatsBucket
 )
 
@@ -66,7 +72,29 @@ var (
 	datastoreDB             *bolt.DB
 )
 
+// dataStoreBuckets are the buckets created in each data store.
+var dataStoreBuckets = []string{
+	serverEntriesBucket,
+	rankedServerEntriesBucket,
+	splitTunnelRouteETagsBucket,
+	splitTunnelRouteDataBucket,
+	urlETagsBucket,
+	keyValueBucket,
+	tunnelStatsBucket,
+	remoteServerListStatsBucket,
+	slokBucket,
+	tacticsBucket,
+	speedTestSamplesBucket,
+	dialParametersBucket,
+	protocolStatsBucket,
+	serverEntryStatsBucket,
+}
+
 // OpenDataStore opens and initializes the singleton data store instance.
+//
+// The data store is checked for integrity when opened. When the data store
+// is corrupt, it is quarantined and a new data store is rebuilt with any
+// records that can be recovered from it; see recoverDataStore.
 func OpenDataStore(config *Config) error {
 
 	datastoreInitalizeMutex.Lock()
@@ -85,6 +113,16 @@ func OpenDataStore(config *Config) error {
 	var newDB *bolt.DB
 	var err error
 
+	// On the first failure, the datastore file is quarantined and rebuilt.
+	// Should the rebuilt datastore file also fail, it is deleted.
+	discardDataStore := func(retry int) {
+		if retry == 0 {
+			recoverDataStore(config.DataStoreDirectory)
+		} else {
+			os.Remove(filename)
+		}
+	}
+
 	for retry := 0; retry < 3; retry++ {
 
 		if retry > 0 {
@@ -93,24 +131,22 @@ func OpenDataStore(config *Config) error {
 
 		newDB, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
 
-		// The datastore file may be corrupt, so attempt to delete and try again
+		// The datastore file may be corrupt, so attempt to recover and try again
 		if err != nil {
 			NoticeAlert("bolt.Open error: %s", err)
-			os.Remove(filename)
+			discardDataStore(retry)
 			continue
 		}
 
 		// Run consistency checks on datastore and emit errors for diagnostics purposes
 		// We assume this will complete quickly for typical size Psiphon datastores.
-		err = newDB.View(func(tx *bolt.Tx) error {
-			return tx.SynchronousCheck()
-		})
+		err = checkDB(newDB)
 
-		// The datastore file may be corrupt, so attempt to delete and try again
+		// The datastore file may be corrupt, so attempt to recover and try again
 		if err != nil {
 			NoticeAlert("bolt.SynchronousCheck error: %s", err)
 			newDB.Close()
-			os.Remove(filename)
+			discardDataStore(retry)
 			continue
 		}
 
@@ -122,20 +158,7 @@ func OpenDataStore(config *Config) error {
 	}
 
 	err = newDB.Update(func(tx *bolt.Tx) error {
-		requiredBuckets := []string{
-			serverEntriesBucket,
-			rankedServerEntriesBucket,
-			splitTunnelRouteETagsBucket,
-			splitTunnelRouteDataBucket,
-			urlETagsBucket,
-			keyValueBucket,
-			tunnelStatsBucket,
-			remoteServerListStatsBucket,
-			slokBucket,
-			tacticsBucket,
-			speedTestSamplesBucket,
-		}
-		for _, bucket := range requiredBuckets {
+		for _, bucket := range dataStoreBuckets {
 			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
 			if err != nil {
 				return err
@@ -230,6 +253,10 @@ func dataStoreUpdate(fn func(tx *bolt.Tx) error) error {
 // replaced only if replaceIfExists is set or if the the ConfigurationVersion
 // field of the new entry is strictly higher than the existing entry.
 //
+// Whether or not the server entry is replaced, the time at which the server
+// entry was obtained from its source is recorded, for pruning; see
+// PruneServerEntries.
+//
 // If the server entry data is malformed, an alert notice is issued and
 // the entry is skipped; no error is returned.
 func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExists bool) error {
@@ -272,6 +299,19 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 		newer := exists && existingConfigurationVersion < serverEntryFields.GetConfigurationVersion()
 		update := !exists || replaceIfExists || newer
 
+		// The source timestamp is recorded even when the stored server entry
+		// is not updated, as the server entry is still being distributed.
+		statsBucket := tx.Bucket([]byte(serverEntryStatsBucket))
+		stats := getServerEntryStats(statsBucket, ipAddress)
+		sourceTimestamp := getServerEntryFieldsTimestamp(serverEntryFields)
+		if sourceTimestamp.After(stats.LastSourceTimestamp) {
+			stats.LastSourceTimestamp = sourceTimestamp
+			err := putServerEntryStats(statsBucket, ipAddress, stats)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
 		if !update {
 			// Disabling this notice, for now, as it generates too much noise
 			// in diagnostics with clients that always submit embedded servers
@@ -313,6 +353,11 @@ func StoreServerEntries(
 	replaceIfExists bool) error {
 
 	for _, serverEntryFields := range serverEntries {
+
+		if !verifyServerEntrySignature(config, serverEntryFields) {
+			continue
+		}
+
 		err := StoreServerEntry(serverEntryFields, replaceIfExists)
 		if err != nil {
 			return common.ContextError(err)
@@ -345,6 +390,10 @@ func StreamingStoreServerEntries(
 			break
 		}
 
+		if !verifyServerEntrySignature(config, serverEntry) {
+			continue
+		}
+
 		err = StoreServerEntry(serverEntry, replaceIfExists)
 		if err != nil {
 			return common.ContextError(err)
@@ -354,6 +403,34 @@ func StreamingStoreServerEntries(
 	return nil
 }
 
+// verifyServerEntrySignature checks the server entry signature when a
+// ServerEntrySignaturePublicKey is configured. Server entries that fail
+// verification are to be skipped, so that a compromised or spoofed server
+// cannot inject server entries.
+//
+// Embedded server entries are exempt. These are packaged with the client,
+// along with ServerEntrySignaturePublicKey itself, and so are no less
+// trusted than the key; and embedded lists may predate server entry
+// signing, in which case verification would leave no servers to connect
+// to.
+func verifyServerEntrySignature(
+	config *Config, serverEntryFields protocol.ServerEntryFields) bool {
+
+	if config.ServerEntrySignaturePublicKey == "" ||
+		serverEntryFields.GetLocalSource() == protocol.SERVER_ENTRY_SOURCE_EMBEDDED {
+		return true
+	}
+
+	err := serverEntryFields.VerifySignature(config.ServerEntrySignaturePublicKey)
+	if err != nil {
+		NoticeAlert("invalid server entry signature for %s: %s",
+			serverEntryFields.GetIPAddress(), err)
+		return false
+	}
+
+	return true
+}
+
 // PromoteServerEntry assigns the top rank (one more than current
 // max rank) to the specified server entry. Server candidates are
 // iterated in decending rank order, so this server entry will be
@@ -377,6 +454,17 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 			return err
 		}
 
+		// Record the success, for pruning.
+
+		statsBucket := tx.Bucket([]byte(serverEntryStatsBucket))
+		stats := getServerEntryStats(statsBucket, ipAddress)
+		stats.LastSuccessTimestamp = time.Now()
+		stats.ConsecutiveFailures = 0
+		err = putServerEntryStats(statsBucket, ipAddress, stats)
+		if err != nil {
+			return err
+		}
+
 		// Store the current server entry filter (e.g, region, etc.) that
 		// was in use when the entry was promoted. This is used to detect
 		// when the top ranked server entry was promoted under a different
@@ -396,13 +484,275 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 	return nil
 }
 
+// serverEntryStats records the history of a stored server entry, which is
+// used to prune dead and stale server entries. LastSourceTimestamp is the
+// most recent time the server entry was obtained from any source, such as a
+// remote server list or a handshake response.
+type serverEntryStats struct {
+	LastSourceTimestamp  time.Time
+	LastSuccessTimestamp time.Time
+	ConsecutiveFailures  int
+}
+
+// getServerEntryStats returns the stats for the specified server entry. When
+// there is no valid stats record, zero value stats are returned.
+func getServerEntryStats(bucket *bolt.Bucket, ipAddress string) *serverEntryStats {
+
+	stats := &serverEntryStats{}
+
+	data := bucket.Get([]byte(ipAddress))
+	if data != nil {
+		err := json.Unmarshal(data, stats)
+		if err != nil {
+			return &serverEntryStats{}
+		}
+	}
+
+	return stats
+}
+
+func putServerEntryStats(bucket *bolt.Bucket, ipAddress string, stats *serverEntryStats) error {
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = bucket.Put([]byte(ipAddress), data)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// getServerEntryFieldsTimestamp returns the time at which the server entry
+// was obtained from its source. The current time is returned when the
+// server entry has no valid local timestamp.
+func getServerEntryFieldsTimestamp(serverEntryFields protocol.ServerEntryFields) time.Time {
+
+	localTimestamp, _ := serverEntryFields["localTimestamp"].(string)
+	timestamp, err := time.Parse(time.RFC3339, localTimestamp)
+	if err != nil {
+		return time.Now()
+	}
+
+	return timestamp
+}
+
+// RecordServerEntryFailures increments the consecutive failure count of each
+// of the specified server entries. Failures should be recorded only when the
+// network is known to be working, as when another tunnel was established,
+// so that server entries are not counted as failing while offline.
+func RecordServerEntryFailures(ipAddresses []string) error {
+
+	err := dataStoreUpdate(func(tx *bolt.Tx) error {
+
+		serverEntries := tx.Bucket([]byte(serverEntriesBucket))
+		statsBucket := tx.Bucket([]byte(serverEntryStatsBucket))
+
+		for _, ipAddress := range ipAddresses {
+
+			if serverEntries.Get([]byte(ipAddress)) == nil {
+				continue
+			}
+
+			stats := getServerEntryStats(statsBucket, ipAddress)
+			stats.ConsecutiveFailures += 1
+			err := putServerEntryStats(statsBucket, ipAddress, stats)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// PruneServerEntries deletes dead, stale, and excess server entries from the
+// data store, and returns the number of server entries pruned for each
+// reason.
+//
+// A server entry is dead when its consecutive failure count has reached
+// PruneServerEntryFailureThreshold and it has neither been used successfully
+// nor been obtained from a source within PruneServerEntryDeadPeriod. A server
+// entry is stale when it has neither been used successfully nor been obtained
+// from a source within PruneServerEntryStalePeriod; such entries have been
+// superseded, as sources no longer distribute them.
+//
+// When more than MaxServerEntryCount server entries remain, the excess server
+// entries are pruned, in order: entries never used successfully, or used
+// successfully least recently; entries with more consecutive failures; and
+// entries obtained from a source least recently.
+//
+// Any ranking, dial parameters, and stats for pruned server entries are also
+// deleted.
+func PruneServerEntries(config *Config) (int, int, int, error) {
+
+	p := config.clientParameters.Get()
+	failureThreshold := p.Int(parameters.PruneServerEntryFailureThreshold)
+	deadPeriod := p.Duration(parameters.PruneServerEntryDeadPeriod)
+	stalePeriod := p.Duration(parameters.PruneServerEntryStalePeriod)
+	maxCount := p.Int(parameters.MaxServerEntryCount)
+	p = nil
+
+	type pruneCandidate struct {
+		ipAddress string
+		stats     *serverEntryStats
+	}
+
+	deadCount := 0
+	staleCount := 0
+	excessCount := 0
+
+	err := dataStoreUpdate(func(tx *bolt.Tx) error {
+
+		serverEntries := tx.Bucket([]byte(serverEntriesBucket))
+		statsBucket := tx.Bucket([]byte(serverEntryStatsBucket))
+
+		now := time.Now()
+
+		var pruneIPAddresses []string
+		var remaining []*pruneCandidate
+
+		cursor := serverEntries.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+
+			ipAddress := string(key)
+			stats := getServerEntryStats(statsBucket, ipAddress)
+
+			// Server entries stored before stats were recorded use the
+			// server entry local timestamp as the source timestamp.
+			if stats.LastSourceTimestamp.IsZero() {
+				var serverEntryFields protocol.ServerEntryFields
+				err := json.Unmarshal(value, &serverEntryFields)
+				if err != nil {
+					continue
+				}
+				stats.LastSourceTimestamp = getServerEntryFieldsTimestamp(serverEntryFields)
+			}
+
+			sinceSource := now.Sub(stats.LastSourceTimestamp)
+			sinceSuccess := now.Sub(stats.LastSuccessTimestamp)
+
+			if failureThreshold > 0 &&
+				stats.ConsecutiveFailures >= failureThreshold &&
+				sinceSuccess > deadPeriod && sinceSource > deadPeriod {
+
+				pruneIPAddresses = append(pruneIPAddresses, ipAddress)
+				deadCount += 1
+
+			} else if stalePeriod > 0 &&
+				sinceSuccess > stalePeriod && sinceSource > stalePeriod {
+
+				pruneIPAddresses = append(pruneIPAddresses, ipAddress)
+				staleCount += 1
+
+			} else {
+
+				remaining = append(remaining, &pruneCandidate{ipAddress, stats})
+			}
+		}
+
+		if maxCount > 0 && len(remaining) > maxCount {
+
+			sort.SliceStable(remaining, func(i, j int) bool {
+				a := remaining[i].stats
+				b := remaining[j].stats
+				if !a.LastSuccessTimestamp.Equal(b.LastSuccessTimestamp) {
+					return a.LastSuccessTimestamp.After(b.LastSuccessTimestamp)
+				}
+				if a.ConsecutiveFailures != b.ConsecutiveFailures {
+					return a.ConsecutiveFailures < b.ConsecutiveFailures
+				}
+				return a.LastSourceTimestamp.After(b.LastSourceTimestamp)
+			})
+
+			for _, candidate := range remaining[maxCount:] {
+				pruneIPAddresses = append(pruneIPAddresses, candidate.ipAddress)
+				excessCount += 1
+			}
+		}
+
+		if len(pruneIPAddresses) == 0 {
+			return nil
+		}
+
+		// Keys are deleted after the cursor iteration completes, as bolt
+		// cursors are not stable across deletes.
+
+		pruned := make(map[string]bool)
+
+		for _, ipAddress := range pruneIPAddresses {
+			pruned[ipAddress] = true
+
+			err := serverEntries.Delete([]byte(ipAddress))
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			err = statsBucket.Delete([]byte(ipAddress))
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		// Dial parameters are keyed by IP address and network ID.
+
+		dialParameters := tx.Bucket([]byte(dialParametersBucket))
+		var dialParametersKeys [][]byte
+		cursor = dialParameters.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			index := bytes.IndexByte(key, '-')
+			if index != -1 && pruned[string(key[:index])] {
+				dialParametersKeys = append(dialParametersKeys, append([]byte(nil), key...))
+			}
+		}
+		for _, key := range dialParametersKeys {
+			err := dialParameters.Delete(key)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		rankedServerEntries, err := getRankedServerEntries(tx)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		keepRankedServerEntries := make([]string, 0, len(rankedServerEntries))
+		for _, ipAddress := range rankedServerEntries {
+			if !pruned[ipAddress] {
+				keepRankedServerEntries = append(keepRankedServerEntries, ipAddress)
+			}
+		}
+		err = setRankedServerEntries(tx, keepRankedServerEntries)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, 0, 0, common.ContextError(err)
+	}
+
+	return deadCount, staleCount, excessCount, nil
+}
+
 func makeServerEntryFilterValue(config *Config) ([]byte, error) {
 
 	// Currently, only a change of EgressRegion will "break" server affinity.
 	// If the tunnel protocol filter changes, any existing affinity server
 	// either passes the new filter, or it will be skipped anyway.
 
-	return []byte(config.EgressRegion), nil
+	return []byte(config.GetEgressRegion()), nil
 }
 
 func hasServerEntryFilterChanged(config *Config) (bool, error) {
@@ -432,6 +782,62 @@ func hasServerEntryFilterChanged(config *Config) (bool, error) {
 	return changed, nil
 }
 
+// storedEgressRegion is the egress region record stored by
+// storeEgressRegion. Configured is the EgressRegion config value in effect
+// when the Selected egress region was set.
+type storedEgressRegion struct {
+	Configured string
+	Selected   string
+}
+
+// storeEgressRegion records the current egress region, as set by
+// Config.SetEgressRegion, for restoreEgressRegion.
+func storeEgressRegion(config *Config) error {
+
+	value, err := json.Marshal(&storedEgressRegion{
+		Configured: config.EgressRegion,
+		Selected:   config.GetEgressRegion(),
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = SetKeyValue(DATA_STORE_EGRESS_REGION_KEY, string(value))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// restoreEgressRegion applies the egress region recorded by
+// storeEgressRegion. The stored egress region is ignored when the
+// EgressRegion config value has changed since the egress region was
+// stored; in this case, the config value takes precedence.
+func restoreEgressRegion(config *Config) error {
+
+	value, err := GetKeyValue(DATA_STORE_EGRESS_REGION_KEY)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if value == "" {
+		return nil
+	}
+
+	var stored storedEgressRegion
+	err = json.Unmarshal([]byte(value), &stored)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if stored.Configured == config.EgressRegion {
+		config.SetEgressRegion(stored.Selected)
+	}
+
+	return nil
+}
+
 func getRankedServerEntries(tx *bolt.Tx) ([]string, error) {
 	bucket := tx.Bucket([]byte(rankedServerEntriesBucket))
 	data := bucket.Get([]byte(rankedServerEntriesKey))
@@ -511,6 +917,7 @@ func insertRankedServerEntry(tx *bolt.Tx, serverEntryId string, position int) er
 // stored server entries in rank order.
 type ServerEntryIterator struct {
 	config                       *Config
+	egressRegion                 string
 	shuffleHeadLength            int
 	serverEntryIds               []string
 	serverEntryIndex             int
@@ -546,8 +953,22 @@ func NewServerEntryIterator(config *Config) (bool, *ServerEntryIterator, error)
 
 	applyServerAffinity := !filterChanged
 
+	// The egress region is fixed for the lifetime of the iterator. When
+	// Config.SetEgressRegion changes the region, a new iterator must be
+	// created.
+	//
+	// With multi-hop tunnels, the iterator selects entry servers, which
+	// may be in any region. The egress region is applied when selecting
+	// exit servers; see GetMultiHopExitServerEntry.
+
+	egressRegion := config.GetEgressRegion()
+	if config.EnableMultiHopTunnels {
+		egressRegion = ""
+	}
+
 	iterator := &ServerEntryIterator{
 		config:            config,
+		egressRegion:      egressRegion,
 		shuffleHeadLength: config.TunnelPoolSize,
 	}
 
@@ -589,6 +1010,19 @@ func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *Server
 		return false, nil, common.ContextError(err)
 	}
 
+	if config.ServerEntrySignaturePublicKey != "" {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			config.TargetServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_TARGET)
+		if err != nil {
+			return false, nil, common.ContextError(err)
+		}
+		err = serverEntryFields.VerifySignature(config.ServerEntrySignaturePublicKey)
+		if err != nil {
+			return false, nil, common.ContextError(
+				fmt.Errorf("TargetServerEntry has invalid signature: %s", err))
+		}
+	}
+
 	if isTactics {
 
 		if len(serverEntry.GetSupportedTacticsProtocols()) == 0 {
@@ -597,7 +1031,8 @@ func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *Server
 
 	} else {
 
-		if config.EgressRegion != "" && serverEntry.Region != config.EgressRegion {
+		egressRegion := config.GetEgressRegion()
+		if egressRegion != "" && serverEntry.Region != egressRegion {
 			return false, nil, common.ContextError(errors.New("TargetServerEntry does not support EgressRegion"))
 		}
 
@@ -749,8 +1184,9 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 		}
 
 		if data == nil {
-			// In case of data corruption or a bug causing this condition,
-			// do not stop iterating.
+			// The server entry may have been pruned since the iterator was
+			// reset. In case of data corruption or a bug causing this
+			// condition, do not stop iterating.
 			NoticeAlert("ServerEntryIterator.Next: unexpected missing server entry: %s", serverEntryId)
 			continue
 		}
@@ -774,8 +1210,8 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 
 		} else {
 
-			if iterator.config.EgressRegion == "" ||
-				serverEntry.Region == iterator.config.EgressRegion {
+			if iterator.egressRegion == "" ||
+				serverEntry.Region == iterator.egressRegion {
 				break
 			}
 		}
@@ -824,6 +1260,44 @@ func scanServerEntries(scanner func(*protocol.ServerEntry)) error {
 	return nil
 }
 
+// GetMultiHopExitServerEntry selects, at random, a server entry to use as
+// the exit server of a multi-hop tunnel through the specified entry server.
+// The exit server must support the OSSH protocol and, when set, be in the
+// egress region. Returns nil when there is no suitable exit server.
+func GetMultiHopExitServerEntry(
+	config *Config, entryServerEntry *protocol.ServerEntry) (*protocol.ServerEntry, error) {
+
+	egressRegion := config.GetEgressRegion()
+
+	var exitServerEntry *protocol.ServerEntry
+	count := 0
+
+	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+
+		if serverEntry.IpAddress == entryServerEntry.IpAddress ||
+			!serverEntry.SupportsProtocol(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH) ||
+			(egressRegion != "" && serverEntry.Region != egressRegion) {
+			return
+		}
+
+		// Reservoir sampling selects a uniformly random server entry in a
+		// single scan, without storing all candidates.
+		count += 1
+		if rand.Intn(count) == 0 {
+			exitServerEntry = serverEntry
+		}
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if exitServerEntry == nil {
+		return nil, nil
+	}
+
+	return MakeCompatibleServerEntry(exitServerEntry), nil
+}
+
 // CountServerEntries returns a count of stored server entries.
 func CountServerEntries() int {
 	count := 0
@@ -1404,6 +1878,21 @@ func setBucketValue(bucket, key, value []byte) error {
 	return nil
 }
 
+func deleteBucketValue(bucket, key []byte) error {
+
+	err := dataStoreUpdate(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucket)
+		err := bucket.Delete(key)
+		return err
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 func getBucketValue(bucket, key []byte) ([]byte, error) {
 
 	var value []byte
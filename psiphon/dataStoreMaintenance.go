@@ -0,0 +1,477 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Psiphon-Labs/bolt"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// recoverableBuckets are the buckets that are recovered from a corrupt data
+// store. These contain data that is costly or impossible to obtain again:
+// server entries, including server entries obtained via discovery; SLOKs;
+// and tactics. Other data, including server entry rankings, ETags, and
+// stats, is reset.
+var recoverableBuckets = []string{
+	serverEntriesBucket,
+	slokBucket,
+	tacticsBucket,
+}
+
+type bucketRecord struct {
+	key   []byte
+	value []byte
+}
+
+// recoverDataStore quarantines a corrupt data store file and rebuilds a new
+// data store file containing the records that can be recovered from the
+// corrupt data store. Only the most recently quarantined data store file is
+// retained. A DataStoreRecovered notice reports what was recovered and what
+// was lost.
+//
+// When the corrupt data store cannot be quarantined or read, it is deleted
+// and a new, empty data store will be created.
+func recoverDataStore(dataStoreDirectory string) {
+
+	filename := filepath.Join(dataStoreDirectory, DATA_STORE_FILENAME)
+	corruptFilename := filepath.Join(dataStoreDirectory, DATA_STORE_CORRUPT_FILENAME)
+
+	recovered := make(map[string]int)
+	invalid := 0
+
+	os.Remove(corruptFilename)
+
+	err := os.Rename(filename, corruptFilename)
+	if err == nil {
+		recovered, invalid, err = rebuildDataStore(corruptFilename, filename)
+	}
+	if err != nil {
+		NoticeAlert("failed to recover data store: %s", common.ContextError(err))
+		os.Remove(filename)
+		recovered = make(map[string]int)
+		invalid = 0
+	}
+
+	var lost []string
+	for _, bucket := range dataStoreBuckets {
+
+		// The obsolete tunnel stats bucket is always deleted.
+		if bucket == tunnelStatsBucket {
+			continue
+		}
+
+		if _, ok := recovered[bucket]; !ok {
+			lost = append(lost, bucket)
+		}
+	}
+
+	NoticeDataStoreRecovered(corruptFilename, recovered, invalid, lost)
+}
+
+// rebuildDataStore creates a new data store file with the records that can
+// be read from the recoverable buckets of the corrupt data store file.
+// Server entry records are also validated. Returns the number of records
+// recovered for each recovered bucket, and the number of invalid records.
+// A bucket that could only be partially read is omitted from the recovered
+// counts, as its data is considered lost, although the records read are
+// retained.
+func rebuildDataStore(
+	corruptFilename, filename string) (recovered map[string]int, invalid int, reterr error) {
+
+	// bolt may panic when opening or reading a corrupt file. bolt reads the
+	// file via a memory mapping, so reading a corrupt page may instead fault;
+	// faults are converted to panics, which are recovered.
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if e := recover(); e != nil {
+			reterr = common.ContextError(fmt.Errorf("panic: %v", e))
+		}
+	}()
+
+	corruptDB, err := bolt.Open(
+		corruptFilename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+	defer corruptDB.Close()
+
+	newDB, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+	defer newDB.Close()
+
+	recovered = make(map[string]int)
+
+	for _, bucket := range recoverableBuckets {
+
+		records, readErr := readBucketRecords(corruptDB, bucket)
+		if readErr != nil {
+			NoticeAlert("failed to read %s records: %s", bucket, readErr)
+		}
+
+		if bucket == serverEntriesBucket {
+			validRecords := make([]*bucketRecord, 0, len(records))
+			for _, record := range records {
+				if isValidServerEntryRecord(record) {
+					validRecords = append(validRecords, record)
+				} else {
+					invalid += 1
+				}
+			}
+			records = validRecords
+		}
+
+		err = writeBucketRecords(newDB, bucket, records)
+		if err != nil {
+			return nil, 0, common.ContextError(err)
+		}
+
+		if readErr == nil {
+			recovered[bucket] = len(records)
+		}
+	}
+
+	return recovered, invalid, nil
+}
+
+// isValidServerEntryRecord checks that a recovered server entry record
+// decodes, is valid, and is stored under its own IP address.
+func isValidServerEntryRecord(record *bucketRecord) bool {
+
+	var serverEntryFields protocol.ServerEntryFields
+	err := json.Unmarshal(record.value, &serverEntryFields)
+	if err != nil {
+		return false
+	}
+
+	return protocol.ValidateServerEntryFields(serverEntryFields) == nil &&
+		serverEntryFields.GetIPAddress() == string(record.key)
+}
+
+// readBucketRecords reads all of the records in the specified bucket. bolt
+// may panic, or fault, when reading corrupt pages, so faults are converted to
+// panics and panics are recovered and returned as errors, along with any
+// records read before the panic.
+func readBucketRecords(
+	db *bolt.DB, bucket string) (records []*bucketRecord, reterr error) {
+
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if e := recover(); e != nil {
+			reterr = common.ContextError(fmt.Errorf("panic: %v", e))
+		}
+	}()
+
+	err := db.View(func(tx *bolt.Tx) error {
+
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		cursor := b.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+
+			// Skip nested buckets, which are not used.
+			if value == nil {
+				continue
+			}
+
+			// Keys and values are only valid for the life of the
+			// transaction, so they are copied.
+			records = append(records, &bucketRecord{
+				key:   append([]byte(nil), key...),
+				value: append([]byte(nil), value...),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return records, common.ContextError(err)
+	}
+
+	return records, nil
+}
+
+// writeBucketRecords stores the records in the specified bucket, which is
+// created if it doesn't exist.
+func writeBucketRecords(db *bolt.DB, bucket string, records []*bucketRecord) error {
+
+	err := db.Update(func(tx *bolt.Tx) error {
+
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		for _, record := range records {
+			err := b.Put(record.key, record.value)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// listBuckets returns the names of all of the top level buckets.
+func listBuckets(db *bolt.DB) ([]string, error) {
+
+	var buckets []string
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			buckets = append(buckets, string(name))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return buckets, nil
+}
+
+// openDataStoreFileForMaintenance opens the data store file for a
+// maintenance operation. The data store file must exist, and the singleton
+// data store instance must not be open.
+func openDataStoreFileForMaintenance(config *Config, readOnly bool) (*bolt.DB, error) {
+
+	datastoreReferenceMutex.Lock()
+	isOpen := datastoreDB != nil
+	datastoreReferenceMutex.Unlock()
+
+	if isOpen {
+		return nil, common.ContextError(errors.New("db is open"))
+	}
+
+	filename := filepath.Join(config.DataStoreDirectory, DATA_STORE_FILENAME)
+
+	_, err := os.Stat(filename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	db, err := bolt.Open(
+		filename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return db, nil
+}
+
+// CheckDataStore runs consistency checks on the data store file. Unlike
+// OpenDataStore, a corrupt data store is not recovered. CheckDataStore must
+// not be called while the data store is open.
+func CheckDataStore(config *Config) error {
+
+	db, err := openDataStoreFileForMaintenance(config, true)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer db.Close()
+
+	err = checkDB(db)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// checkDB runs the bolt consistency checks. Reading a corrupt page of the
+// memory mapped data store file may fault rather than panic, so faults are
+// converted to panics, which SynchronousCheck recovers.
+func checkDB(db *bolt.DB) error {
+
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.SynchronousCheck()
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// CompactDataStore rewrites the data store file, omitting the free pages
+// left by deleted records, and returns the original and compacted file
+// sizes. The data store must pass consistency checks. CompactDataStore must
+// not be called while the data store is open.
+func CompactDataStore(config *Config) (int64, int64, error) {
+
+	err := CheckDataStore(config)
+	if err != nil {
+		return 0, 0, common.ContextError(err)
+	}
+
+	filename := filepath.Join(config.DataStoreDirectory, DATA_STORE_FILENAME)
+	compactFilename := filename + ".compact"
+
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return 0, 0, common.ContextError(err)
+	}
+	originalSize := fileInfo.Size()
+
+	db, err := openDataStoreFileForMaintenance(config, false)
+	if err != nil {
+		return 0, 0, common.ContextError(err)
+	}
+
+	os.Remove(compactFilename)
+
+	compactDB, err := bolt.Open(compactFilename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		db.Close()
+		return 0, 0, common.ContextError(err)
+	}
+
+	// Both files are closed before the compacted file replaces the original
+	// file, as open files cannot be replaced on some platforms.
+	err = copyDataStore(db, compactDB)
+	compactDB.Close()
+	db.Close()
+	if err != nil {
+		os.Remove(compactFilename)
+		return 0, 0, common.ContextError(err)
+	}
+
+	err = os.Rename(compactFilename, filename)
+	if err != nil {
+		os.Remove(compactFilename)
+		return 0, 0, common.ContextError(err)
+	}
+
+	fileInfo, err = os.Stat(filename)
+	if err != nil {
+		return 0, 0, common.ContextError(err)
+	}
+
+	return originalSize, fileInfo.Size(), nil
+}
+
+// copyDataStore copies all of the buckets and records in db to newDB.
+func copyDataStore(db, newDB *bolt.DB) error {
+
+	buckets, err := listBuckets(db)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	for _, bucket := range buckets {
+
+		records, err := readBucketRecords(db, bucket)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		err = writeBucketRecords(newDB, bucket, records)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	return nil
+}
+
+// ExportDataStore writes the contents of the data store, as JSON, to the
+// specified writer. The export is an object mapping each bucket name to an
+// object mapping record keys to values. Keys that are not valid UTF-8 and
+// values that are not valid JSON are base64 encoded strings.
+// ExportDataStore must not be called while the data store is open.
+func ExportDataStore(config *Config, writer io.Writer) error {
+
+	db, err := openDataStoreFileForMaintenance(config, true)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer db.Close()
+
+	buckets, err := listBuckets(db)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	export := make(map[string]map[string]json.RawMessage)
+
+	for _, bucket := range buckets {
+
+		records, err := readBucketRecords(db, bucket)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		exportRecords := make(map[string]json.RawMessage)
+
+		for _, record := range records {
+
+			key := string(record.key)
+			if !utf8.Valid(record.key) {
+				key = base64.StdEncoding.EncodeToString(record.key)
+			}
+
+			value := json.RawMessage(record.value)
+			if !json.Valid(record.value) {
+				value, err = json.Marshal(
+					base64.StdEncoding.EncodeToString(record.value))
+				if err != nil {
+					return common.ContextError(err)
+				}
+			}
+
+			exportRecords[key] = value
+		}
+
+		export[bucket] = exportRecords
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(export)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,539 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/bolt"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestPruneServerEntries(t *testing.T) {
+
+	dataDirName, err := ioutil.TempDir("", "psiphon-prune-server-entries-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirName)
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   dataDirName,
+		NetworkID:            "NETWORK1",
+	}
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	_, err = config.clientParameters.Set(
+		"", false, map[string]interface{}{
+			parameters.PruneServerEntryFailureThreshold: 10,
+			parameters.PruneServerEntryDeadPeriod:       "168h",
+			parameters.PruneServerEntryStalePeriod:      "2160h",
+			parameters.MaxServerEntryCount:              3,
+		})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	deadServer := "192.168.0.1"
+	failingServer := "192.168.0.2"
+	staleServer := "192.168.0.3"
+	successfulServer := "192.168.0.4"
+	freshServer1 := "192.168.0.5"
+	freshServer2 := "192.168.0.6"
+
+	now := time.Now()
+	sourceTimestamps := map[string]time.Time{
+		deadServer:       now.Add(-30 * 24 * time.Hour),
+		failingServer:    now.Add(-30 * 24 * time.Hour),
+		staleServer:      now.Add(-100 * 24 * time.Hour),
+		successfulServer: now.Add(-100 * 24 * time.Hour),
+		freshServer1:     now,
+		freshServer2:     now,
+	}
+
+	for ipAddress, sourceTimestamp := range sourceTimestamps {
+		serverEntryFields := protocol.ServerEntryFields{"ipAddress": ipAddress}
+		serverEntryFields.SetLocalTimestamp(sourceTimestamp.UTC().Format(time.RFC3339))
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		failedServerEntries := []string{deadServer}
+		if i < 9 {
+			failedServerEntries = append(failedServerEntries, failingServer)
+		}
+		err = RecordServerEntryFailures(failedServerEntries)
+		if err != nil {
+			t.Fatalf("RecordServerEntryFailures failed: %s", err)
+		}
+	}
+
+	err = PromoteServerEntry(config, successfulServer)
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+
+	err = setBucketValue(
+		[]byte(dialParametersBucket),
+		makeDialParametersKey(deadServer, "NETWORK1"),
+		[]byte("{}"))
+	if err != nil {
+		t.Fatalf("setBucketValue failed: %s", err)
+	}
+
+	// The dead server exceeds the failure threshold and the dead period; the
+	// stale server exceeds the stale period; and, of the remaining servers,
+	// the failing server is evicted to satisfy MaxServerEntryCount. The
+	// successful server is not stale, as it was recently used successfully.
+
+	dead, stale, excess, err := PruneServerEntries(config)
+	if err != nil {
+		t.Fatalf("PruneServerEntries failed: %s", err)
+	}
+	if dead != 1 || stale != 1 || excess != 1 {
+		t.Fatalf("unexpected pruned counts: %d %d %d", dead, stale, excess)
+	}
+
+	expectedServers := map[string]bool{
+		deadServer:       false,
+		failingServer:    false,
+		staleServer:      false,
+		successfulServer: true,
+		freshServer1:     true,
+		freshServer2:     true,
+	}
+
+	for ipAddress, expected := range expectedServers {
+		value, err := getBucketValue([]byte(serverEntriesBucket), []byte(ipAddress))
+		if err != nil {
+			t.Fatalf("getBucketValue failed: %s", err)
+		}
+		if (value != nil) != expected {
+			t.Fatalf("unexpected server entry state: %s", ipAddress)
+		}
+	}
+
+	var rankedServerEntries []string
+	err = dataStoreView(func(tx *bolt.Tx) error {
+		var err error
+		rankedServerEntries, err = getRankedServerEntries(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("getRankedServerEntries failed: %s", err)
+	}
+	for _, ipAddress := range rankedServerEntries {
+		if !expectedServers[ipAddress] {
+			t.Fatalf("unexpected ranked server entry: %s", ipAddress)
+		}
+	}
+
+	value, err := getBucketValue(
+		[]byte(dialParametersBucket),
+		makeDialParametersKey(deadServer, "NETWORK1"))
+	if err != nil {
+		t.Fatalf("getBucketValue failed: %s", err)
+	}
+	if value != nil {
+		t.Fatalf("unexpected dial parameters for pruned server entry")
+	}
+
+	// Pruning is idempotent.
+
+	dead, stale, excess, err = PruneServerEntries(config)
+	if err != nil {
+		t.Fatalf("PruneServerEntries failed: %s", err)
+	}
+	if dead != 0 || stale != 0 || excess != 0 {
+		t.Fatalf("unexpected pruned counts: %d %d %d", dead, stale, excess)
+	}
+}
+
+func TestStoreSignedServerEntries(t *testing.T) {
+
+	dataDirName, err := ioutil.TempDir("", "psiphon-signed-server-entries-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirName)
+
+	publicKey, privateKey, err := protocol.NewServerEntrySignatureKeyPair()
+	if err != nil {
+		t.Fatalf("NewServerEntrySignatureKeyPair failed: %s", err)
+	}
+
+	config := &Config{
+		PropagationChannelId:          "0",
+		SponsorId:                     "0",
+		DataStoreDirectory:            dataDirName,
+		ServerEntrySignaturePublicKey: publicKey,
+	}
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	signedServer := "192.168.0.1"
+	unsignedServer := "192.168.0.2"
+	modifiedServer := "192.168.0.3"
+	embeddedServer := "192.168.0.5"
+
+	signedServerEntry := protocol.ServerEntryFields{"ipAddress": signedServer}
+	err = signedServerEntry.AddSignature(publicKey, privateKey)
+	if err != nil {
+		t.Fatalf("AddSignature failed: %s", err)
+	}
+
+	unsignedServerEntry := protocol.ServerEntryFields{"ipAddress": unsignedServer}
+	unsignedServerEntry.SetLocalSource(protocol.SERVER_ENTRY_SOURCE_DISCOVERY)
+
+	// Embedded server entries are stored without a signature.
+	embeddedServerEntry := protocol.ServerEntryFields{"ipAddress": embeddedServer}
+	embeddedServerEntry.SetLocalSource(protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+
+	modifiedServerEntry := protocol.ServerEntryFields{"ipAddress": "192.168.0.4"}
+	err = modifiedServerEntry.AddSignature(publicKey, privateKey)
+	if err != nil {
+		t.Fatalf("AddSignature failed: %s", err)
+	}
+	modifiedServerEntry["ipAddress"] = modifiedServer
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{
+			signedServerEntry, unsignedServerEntry, modifiedServerEntry, embeddedServerEntry},
+		true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+
+	expectedServers := map[string]bool{
+		signedServer:   true,
+		unsignedServer: false,
+		modifiedServer: false,
+		embeddedServer: true,
+	}
+
+	for ipAddress, expected := range expectedServers {
+		value, err := getBucketValue([]byte(serverEntriesBucket), []byte(ipAddress))
+		if err != nil {
+			t.Fatalf("getBucketValue failed: %s", err)
+		}
+		if (value != nil) != expected {
+			t.Fatalf("unexpected server entry state: %s", ipAddress)
+		}
+	}
+}
+
+func TestDataStoreRecovery(t *testing.T) {
+
+	dataDirName, err := ioutil.TempDir("", "psiphon-data-store-recovery-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirName)
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   dataDirName,
+	}
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	var recoveredNotices []map[string]interface{}
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err == nil && noticeType == "DataStoreRecovered" {
+				recoveredNotices = append(recoveredNotices, payload)
+			}
+		}))
+	defer SetNoticeWriter(ioutil.Discard)
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	serverEntries := []string{"192.168.0.1", "192.168.0.2"}
+	for _, ipAddress := range serverEntries {
+		err = StoreServerEntry(protocol.ServerEntryFields{"ipAddress": ipAddress}, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	records := []struct {
+		bucket string
+		key    string
+		value  string
+	}{
+		{serverEntriesBucket, "192.168.0.3", "invalid"},
+		{slokBucket, "SLOK-ID", "SLOK-KEY"},
+		{keyValueBucket, "key", "value"},
+	}
+	for _, record := range records {
+		err = setBucketValue([]byte(record.bucket), []byte(record.key), []byte(record.value))
+		if err != nil {
+			t.Fatalf("setBucketValue failed: %s", err)
+		}
+	}
+
+	CloseDataStore()
+
+	// The datastore maintenance operations run on the closed datastore.
+
+	err = CheckDataStore(config)
+	if err != nil {
+		t.Fatalf("CheckDataStore failed: %s", err)
+	}
+
+	_, _, err = CompactDataStore(config)
+	if err != nil {
+		t.Fatalf("CompactDataStore failed: %s", err)
+	}
+
+	var export bytes.Buffer
+	err = ExportDataStore(config, &export)
+	if err != nil {
+		t.Fatalf("ExportDataStore failed: %s", err)
+	}
+	var exported map[string]map[string]interface{}
+	err = json.Unmarshal(export.Bytes(), &exported)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	if len(exported[serverEntriesBucket]) != 3 ||
+		exported[keyValueBucket]["key"] != base64.StdEncoding.EncodeToString([]byte("value")) {
+		t.Fatalf("unexpected export: %s", export.String())
+	}
+
+	// Rebuild the datastore: valid server entries and SLOKs are recovered,
+	// while invalid server entries and other data are lost.
+
+	recoverDataStore(dataDirName)
+
+	if len(recoveredNotices) != 1 {
+		t.Fatalf("unexpected DataStoreRecovered notices: %d", len(recoveredNotices))
+	}
+	recovered, _ := recoveredNotices[0]["recovered"].(map[string]interface{})
+	invalid, _ := recoveredNotices[0]["invalid"].(float64)
+	lost, _ := recoveredNotices[0]["lost"].([]interface{})
+	if recovered[serverEntriesBucket] != float64(2) ||
+		recovered[slokBucket] != float64(1) ||
+		invalid != 1 {
+		t.Fatalf("unexpected DataStoreRecovered notice: %+v", recoveredNotices[0])
+	}
+	lostKeyValues := false
+	for _, bucket := range lost {
+		if bucket == keyValueBucket {
+			lostKeyValues = true
+		}
+	}
+	if !lostKeyValues {
+		t.Fatalf("unexpected DataStoreRecovered notice: %+v", recoveredNotices[0])
+	}
+
+	_, err = os.Stat(filepath.Join(dataDirName, DATA_STORE_CORRUPT_FILENAME))
+	if err != nil {
+		t.Fatalf("missing corrupt datastore: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	if CountServerEntries() != len(serverEntries) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	value, err := getBucketValue([]byte(keyValueBucket), []byte("key"))
+	if err != nil {
+		t.Fatalf("getBucketValue failed: %s", err)
+	}
+	if value != nil {
+		t.Fatalf("unexpected recovered key value")
+	}
+
+	CloseDataStore()
+
+	// A datastore with a corrupt page, which faults rather than panics when
+	// read, is recovered. The SLOK bucket, spanning multiple pages, is
+	// corrupted by pointing one of its branch page elements far beyond the
+	// memory mapped file; its readable records are retained, but the bucket
+	// is reported as lost.
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		err = setBucketValue(
+			[]byte(slokBucket),
+			[]byte(fmt.Sprintf("SLOK-ID-%04d", i)),
+			bytes.Repeat([]byte("K"), 100))
+		if err != nil {
+			t.Fatalf("setBucketValue failed: %s", err)
+		}
+	}
+
+	CloseDataStore()
+
+	filename := filepath.Join(dataDirName, DATA_STORE_FILENAME)
+
+	db, err := bolt.Open(filename, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("bolt.Open failed: %s", err)
+	}
+	pageSize := db.Info().PageSize
+	var root uint64
+	err = db.View(func(tx *bolt.Tx) error {
+		root = uint64(tx.Bucket([]byte(slokBucket)).Root())
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("View failed: %s", err)
+	}
+
+	// A bolt page header is the page ID, flags, count, and overflow; each
+	// branch page element is the position, key size, and child page ID.
+
+	file, err := os.OpenFile(filename, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %s", err)
+	}
+	header := make([]byte, 16)
+	_, err = file.ReadAt(header, int64(root)*int64(pageSize))
+	if err != nil {
+		t.Fatalf("ReadAt failed: %s", err)
+	}
+	flags := binary.LittleEndian.Uint16(header[8:10])
+	count := binary.LittleEndian.Uint16(header[10:12])
+	if flags != 0x01 || count < 2 {
+		t.Fatalf("unexpected SLOK bucket root page: %x %d", flags, count)
+	}
+	childPageID := make([]byte, 8)
+	binary.LittleEndian.PutUint64(childPageID, 1<<30)
+	_, err = file.WriteAt(
+		childPageID, int64(root)*int64(pageSize)+16+int64(count-1)*16+8)
+	file.Close()
+	if err != nil {
+		t.Fatalf("WriteAt failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	if len(recoveredNotices) != 2 {
+		t.Fatalf("unexpected DataStoreRecovered notices: %d", len(recoveredNotices))
+	}
+	recovered, _ = recoveredNotices[1]["recovered"].(map[string]interface{})
+	lost, _ = recoveredNotices[1]["lost"].([]interface{})
+	if recovered[serverEntriesBucket] != float64(2) {
+		t.Fatalf("unexpected DataStoreRecovered notice: %+v", recoveredNotices[1])
+	}
+	if _, ok := recovered[slokBucket]; ok {
+		t.Fatalf("unexpected DataStoreRecovered notice: %+v", recoveredNotices[1])
+	}
+	lostSLOKs := false
+	for _, bucket := range lost {
+		if bucket == slokBucket {
+			lostSLOKs = true
+		}
+	}
+	if !lostSLOKs {
+		t.Fatalf("unexpected DataStoreRecovered notice: %+v", recoveredNotices[1])
+	}
+
+	if CountServerEntries() != len(serverEntries) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	value, err = getBucketValue([]byte(slokBucket), []byte("SLOK-ID-0000"))
+	if err != nil {
+		t.Fatalf("getBucketValue failed: %s", err)
+	}
+	if value == nil {
+		t.Fatalf("missing recovered SLOK")
+	}
+
+	CloseDataStore()
+
+	// An unreadable datastore is replaced with a new, empty datastore.
+
+	err = ioutil.WriteFile(
+		filepath.Join(dataDirName, DATA_STORE_FILENAME), []byte("corrupt"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	if len(recoveredNotices) != 3 {
+		t.Fatalf("unexpected DataStoreRecovered notices: %d", len(recoveredNotices))
+	}
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// DialParameters records the dial parameters -- tunnel protocol, dial
+// address, meek fronting and TLS parameters, fragmentor and user agent
+// selections -- that were used for a successful tunnel to a server on a
+// particular network.
+//
+// Most dial parameters are selected at random, and a combination that
+// succeeded on a network is likely to succeed again on the same network.
+// Successful dial parameters are stored, keyed by server entry and network
+// ID, and are replayed on the next connection to the same server on the
+// same network. Stored dial parameters expire after ReplayDialParametersTTL
+// and are deleted when a replay fails, after which new dial parameters are
+// selected at random.
+//
+// Dial parameters are only recorded and replayed when a NetworkIDGetter is
+// configured.
+type DialParameters struct {
+	serverIPAddress string
+	networkID       string
+
+	// IsReplay indicates that the dial parameters were loaded from the
+	// datastore rather than selected at random.
+	IsReplay bool `json:"-"`
+
+	// FirstSuccessTimestamp is the time the dial parameters were first
+	// successfully used. Replaying does not extend the TTL.
+	FirstSuccessTimestamp time.Time
+
+	ServerEntryConfigurationVersion int
+	TunnelProtocol                  string
+	DialAddress                     string
+	SSHClientVersion                string
+	FragmentorCoinFlip              bool
+	SelectedUserAgent               bool
+	UserAgent                       string
+
+	// Custom is the TransportDialParameters.Custom value, when that value
+	// is a string, as it is for the QUIC SNI address. Other types of
+	// custom dial parameters are not replayed.
+	Custom string
+
+	MeekDialAddress         string
+	MeekSNIServerName       string
+	MeekHostHeader          string
+	MeekTransformedHostName bool
+	MeekTLSProfile          string
+}
+
+func makeDialParametersKey(serverIPAddress, networkID string) []byte {
+	return []byte(serverIPAddress + "-" + networkID)
+}
+
+// GetDialParameters returns the stored dial parameters for the specified
+// server entry and the current network, which are to be replayed. nil is
+// returned when there are no stored dial parameters or when the stored dial
+// parameters have expired or are no longer valid for the server entry or
+// the current client parameters.
+func GetDialParameters(
+	config *Config, serverEntry *protocol.ServerEntry) (*DialParameters, error) {
+
+	if config.networkIDGetter == nil {
+		return nil, nil
+	}
+
+	p := config.clientParameters.Get()
+	TTL := p.Duration(parameters.ReplayDialParametersTTL)
+	limitTLSProfiles := p.TLSProfiles(parameters.LimitTLSProfiles)
+	p = nil
+
+	if TTL <= 0 {
+		return nil, nil
+	}
+
+	networkID := config.networkIDGetter.GetNetworkID()
+
+	value, err := getBucketValue(
+		[]byte(dialParametersBucket),
+		makeDialParametersKey(serverEntry.IpAddress, networkID))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	var dialParams DialParameters
+	err = json.Unmarshal(value, &dialParams)
+	if err != nil {
+		// Invalid records are deleted and otherwise ignored.
+		_ = DeleteDialParameters(serverEntry.IpAddress, networkID)
+		return nil, nil
+	}
+
+	if time.Since(dialParams.FirstSuccessTimestamp) > TTL ||
+		dialParams.ServerEntryConfigurationVersion != serverEntry.ConfigurationVersion ||
+		!serverEntry.SupportsProtocol(dialParams.TunnelProtocol) ||
+		(dialParams.MeekTLSProfile != "" &&
+			len(limitTLSProfiles) > 0 &&
+			!common.Contains(limitTLSProfiles, dialParams.MeekTLSProfile)) {
+
+		_ = DeleteDialParameters(serverEntry.IpAddress, networkID)
+		return nil, nil
+	}
+
+	dialParams.serverIPAddress = serverEntry.IpAddress
+	dialParams.networkID = networkID
+	dialParams.IsReplay = true
+
+	return &dialParams, nil
+}
+
+// DeleteDialParameters deletes any stored dial parameters for the
+// specified server and network.
+func DeleteDialParameters(serverIPAddress, networkID string) error {
+
+	err := deleteBucketValue(
+		[]byte(dialParametersBucket),
+		makeDialParametersKey(serverIPAddress, networkID))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// makeDialParameters records the dial parameters selected for a dial.
+// Returns nil when dial parameters are not recorded.
+func makeDialParameters(
+	config *Config,
+	transportDialParams *TransportDialParameters,
+	dialStats *DialStats) *DialParameters {
+
+	if config.networkIDGetter == nil {
+		return nil
+	}
+
+	dialParams := &DialParameters{
+		serverIPAddress:                 transportDialParams.ServerEntry.IpAddress,
+		networkID:                       config.networkIDGetter.GetNetworkID(),
+		ServerEntryConfigurationVersion: transportDialParams.ServerEntry.ConfigurationVersion,
+		TunnelProtocol:                  transportDialParams.TunnelProtocol,
+		DialAddress:                     transportDialParams.DialAddress,
+		SSHClientVersion:                transportDialParams.SSHClientVersion,
+		FragmentorCoinFlip:              transportDialParams.FragmentorCoinFlip,
+		SelectedUserAgent:               dialStats.SelectedUserAgent,
+		UserAgent:                       dialStats.UserAgent,
+	}
+
+	if custom, ok := transportDialParams.Custom.(string); ok {
+		dialParams.Custom = custom
+	}
+
+	if transportDialParams.MeekConfig != nil {
+		meekConfig := transportDialParams.MeekConfig
+		dialParams.MeekDialAddress = meekConfig.DialAddress
+		dialParams.MeekSNIServerName = meekConfig.SNIServerName
+		dialParams.MeekHostHeader = meekConfig.HostHeader
+		dialParams.MeekTransformedHostName = meekConfig.TransformedHostName
+		dialParams.MeekTLSProfile = meekConfig.TLSProfile
+	}
+
+	return dialParams
+}
+
+// applyTransportDialParameters overrides the newly selected transport dial
+// parameters with the replayed dial parameters.
+func (dialParams *DialParameters) applyTransportDialParameters(
+	transportDialParams *TransportDialParameters) {
+
+	transportDialParams.DialAddress = dialParams.DialAddress
+	transportDialParams.SSHClientVersion = dialParams.SSHClientVersion
+	transportDialParams.FragmentorCoinFlip = dialParams.FragmentorCoinFlip
+
+	if _, ok := transportDialParams.Custom.(string); ok {
+		transportDialParams.Custom = dialParams.Custom
+	}
+
+	if transportDialParams.MeekConfig != nil {
+		meekConfig := transportDialParams.MeekConfig
+		meekConfig.DialAddress = dialParams.MeekDialAddress
+		meekConfig.SNIServerName = dialParams.MeekSNIServerName
+		meekConfig.HostHeader = dialParams.MeekHostHeader
+		meekConfig.TransformedHostName = dialParams.MeekTransformedHostName
+		meekConfig.TLSProfile = dialParams.MeekTLSProfile
+	}
+}
+
+// applyDialConfig overrides the newly selected user agent with the replayed
+// user agent. The user agent is replayed only when it was, and still is,
+// selected by the client rather than specified in the config custom
+// headers.
+func (dialParams *DialParameters) applyDialConfig(
+	dialConfig *DialConfig, dialStats *DialStats) {
+
+	if dialStats.SelectedUserAgent && dialParams.SelectedUserAgent {
+		if dialConfig.CustomHeaders == nil {
+			dialConfig.CustomHeaders = make(http.Header)
+		}
+		dialConfig.CustomHeaders.Set("User-Agent", dialParams.UserAgent)
+		dialStats.UserAgent = dialParams.UserAgent
+	}
+
+	dialStats.IsReplay = true
+}
+
+// Succeeded stores the dial parameters after a successful tunnel
+// establishment. Replayed dial parameters are not stored again, so that
+// replaying does not extend the TTL.
+func (dialParams *DialParameters) Succeeded() {
+
+	if dialParams.IsReplay {
+		return
+	}
+
+	dialParams.FirstSuccessTimestamp = time.Now()
+
+	value, err := json.Marshal(dialParams)
+	if err != nil {
+		NoticeAlert("store dial parameters failed: %s", common.ContextError(err))
+		return
+	}
+
+	err = setBucketValue(
+		[]byte(dialParametersBucket),
+		makeDialParametersKey(dialParams.serverIPAddress, dialParams.networkID),
+		value)
+	if err != nil {
+		NoticeAlert("store dial parameters failed: %s", common.ContextError(err))
+	}
+}
+
+// Failed deletes any stored dial parameters after a failed tunnel
+// establishment. A failed replay invalidates the stored dial parameters.
+func (dialParams *DialParameters) Failed() {
+
+	if !dialParams.IsReplay {
+		return
+	}
+
+	NoticeInfo("delete dial parameters for %s", dialParams.serverIPAddress)
+
+	err := DeleteDialParameters(dialParams.serverIPAddress, dialParams.networkID)
+	if err != nil {
+		NoticeAlert("delete dial parameters failed: %s", common.ContextError(err))
+	}
+}
@@ -0,0 +1,339 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestDialParametersReplay(t *testing.T) {
+
+	dataDirName, err := ioutil.TempDir("", "psiphon-dial-parameters-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirName)
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   dataDirName,
+		NetworkID:            "NETWORK1",
+	}
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	serverEntry := &protocol.ServerEntry{
+		IpAddress:            "192.168.0.1",
+		Capabilities:         []string{protocol.GetCapability(protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS)},
+		MeekServerPort:       443,
+		ConfigurationVersion: 1,
+	}
+
+	dialParams, err := GetDialParameters(config, serverEntry)
+	if err != nil {
+		t.Fatalf("GetDialParameters failed: %s", err)
+	}
+	if dialParams != nil {
+		t.Fatalf("unexpected dial parameters")
+	}
+
+	// Record and store successful dial parameters.
+
+	transportDialParams := &TransportDialParameters{
+		ServerEntry:        serverEntry,
+		TunnelProtocol:     protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+		FragmentorCoinFlip: true,
+		MeekConfig: &MeekConfig{
+			DialAddress:         "192.168.0.1:443",
+			SNIServerName:       "www.example.org",
+			HostHeader:          "192.168.0.1",
+			TransformedHostName: true,
+			TLSProfile:          protocol.TLS_PROFILE_CHROME_58,
+		},
+	}
+
+	dialStats := &DialStats{
+		SelectedUserAgent: true,
+		UserAgent:         "user-agent",
+	}
+
+	dialParams = makeDialParameters(config, transportDialParams, dialStats)
+	if dialParams == nil || dialParams.IsReplay {
+		t.Fatalf("unexpected dial parameters")
+	}
+
+	dialParams.Succeeded()
+
+	// The stored dial parameters are replayed, and override newly selected
+	// dial parameters.
+
+	replayDialParams, err := GetDialParameters(config, serverEntry)
+	if err != nil {
+		t.Fatalf("GetDialParameters failed: %s", err)
+	}
+	if replayDialParams == nil || !replayDialParams.IsReplay ||
+		replayDialParams.TunnelProtocol != protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS {
+		t.Fatalf("unexpected replay dial parameters: %+v", replayDialParams)
+	}
+
+	newTransportDialParams := &TransportDialParameters{
+		ServerEntry:    serverEntry,
+		TunnelProtocol: protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+		MeekConfig: &MeekConfig{
+			DialAddress:   "192.168.0.1:443",
+			SNIServerName: "www.example.com",
+			HostHeader:    "192.168.0.1",
+			TLSProfile:    protocol.TLS_PROFILE_FIREFOX_56,
+		},
+	}
+	replayDialParams.applyTransportDialParameters(newTransportDialParams)
+
+	if !newTransportDialParams.FragmentorCoinFlip ||
+		newTransportDialParams.MeekConfig.SNIServerName != "www.example.org" ||
+		!newTransportDialParams.MeekConfig.TransformedHostName ||
+		newTransportDialParams.MeekConfig.TLSProfile != protocol.TLS_PROFILE_CHROME_58 {
+		t.Fatalf("unexpected replayed transport dial parameters: %+v", newTransportDialParams.MeekConfig)
+	}
+
+	newDialConfig := &DialConfig{}
+	newDialStats := &DialStats{SelectedUserAgent: true}
+	replayDialParams.applyDialConfig(newDialConfig, newDialStats)
+
+	if newDialConfig.CustomHeaders.Get("User-Agent") != "user-agent" ||
+		newDialStats.UserAgent != "user-agent" ||
+		!newDialStats.IsReplay {
+		t.Fatalf("unexpected replayed dial stats: %+v", newDialStats)
+	}
+
+	// Stored dial parameters are not replayed on other networks.
+
+	otherNetworkConfig := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   dataDirName,
+		NetworkID:            "NETWORK2",
+	}
+	err = otherNetworkConfig.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	otherDialParams, err := GetDialParameters(otherNetworkConfig, serverEntry)
+	if err != nil {
+		t.Fatalf("GetDialParameters failed: %s", err)
+	}
+	if otherDialParams != nil {
+		t.Fatalf("unexpected dial parameters for other network")
+	}
+
+	// A failed replay invalidates the stored dial parameters.
+
+	replayDialParams.Failed()
+
+	replayDialParams, err = GetDialParameters(config, serverEntry)
+	if err != nil {
+		t.Fatalf("GetDialParameters failed: %s", err)
+	}
+	if replayDialParams != nil {
+		t.Fatalf("unexpected dial parameters after failure")
+	}
+
+	// Stored dial parameters expire after ReplayDialParametersTTL.
+
+	dialParams.FirstSuccessTimestamp = time.Now().Add(-2 * time.Hour)
+	value, err := json.Marshal(dialParams)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	err = setBucketValue(
+		[]byte(dialParametersBucket),
+		makeDialParametersKey(serverEntry.IpAddress, "NETWORK1"),
+		value)
+	if err != nil {
+		t.Fatalf("setBucketValue failed: %s", err)
+	}
+
+	_, err = config.clientParameters.Set(
+		"", false, map[string]interface{}{parameters.ReplayDialParametersTTL: "1h"})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	replayDialParams, err = GetDialParameters(config, serverEntry)
+	if err != nil {
+		t.Fatalf("GetDialParameters failed: %s", err)
+	}
+	if replayDialParams != nil {
+		t.Fatalf("unexpected expired dial parameters")
+	}
+
+	// Dial parameters for a changed server entry are not replayed.
+
+	dialParams.Succeeded()
+
+	serverEntry.ConfigurationVersion = 2
+
+	replayDialParams, err = GetDialParameters(config, serverEntry)
+	if err != nil {
+		t.Fatalf("GetDialParameters failed: %s", err)
+	}
+	if replayDialParams != nil {
+		t.Fatalf("unexpected dial parameters for changed server entry")
+	}
+}
+
+func TestDialSshReplay(t *testing.T) {
+	testDialSshReplay(t, true)
+	testDialSshReplay(t, false)
+}
+
+func testDialSshReplay(t *testing.T, fragmentorCoinFlip bool) {
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   testDataDirName,
+	}
+	err := config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	// A newly selected fragmentor coin flip would be the opposite of the
+	// replayed coin flip.
+
+	fragmentorProbability := 1.0
+	if fragmentorCoinFlip {
+		fragmentorProbability = 0.0
+	}
+
+	_, err = config.clientParameters.Set(
+		"", false, map[string]interface{}{
+			parameters.TunnelConnectTimeout:    "1s",
+			parameters.FragmentorProbability:   fragmentorProbability,
+			parameters.FragmentorMinTotalBytes: 1000,
+			parameters.FragmentorMaxTotalBytes: 1000,
+			parameters.FragmentorMinDelay:      "0s",
+			parameters.FragmentorMaxDelay:      "0s",
+		})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	// The listener stands in for the meek server at the replayed dial
+	// address. The dial is expected to fail, as the listener doesn't respond.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	dialAddress := listener.Addr().String()
+
+	var dialed int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.StoreInt32(&dialed, 1)
+			conn.Close()
+		}
+	}()
+
+	var fragmented int32
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil || noticeType != "Info" {
+				return
+			}
+			message, ok := payload["message"].(string)
+			if ok && strings.HasPrefix(message, "fragment "+dialAddress) {
+				atomic.StoreInt32(&fragmented, 1)
+			}
+		}))
+	defer SetNoticeWriter(ioutil.Discard)
+
+	meekCookieEncryptionPublicKey, err := common.MakeSecureRandomBytes(32)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+
+	serverEntry := &protocol.ServerEntry{
+		IpAddress:                     "192.168.0.1",
+		Capabilities:                  []string{protocol.GetCapability(protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK)},
+		MeekServerPort:                80,
+		MeekCookieEncryptionPublicKey: base64.StdEncoding.EncodeToString(meekCookieEncryptionPublicKey),
+		MeekObfuscatedKey:             "key",
+	}
+
+	replayDialParams := &DialParameters{
+		IsReplay:           true,
+		TunnelProtocol:     protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		FragmentorCoinFlip: fragmentorCoinFlip,
+		MeekDialAddress:    dialAddress,
+		MeekHostHeader:     dialAddress,
+	}
+
+	_, err = dialSsh(
+		context.Background(),
+		config,
+		serverEntry,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		"",
+		replayDialParams,
+		nil)
+	if err == nil {
+		t.Fatalf("unexpected dialSsh success")
+	}
+
+	if atomic.LoadInt32(&dialed) != 1 {
+		t.Fatalf("replayed dial address not dialed")
+	}
+
+	if (atomic.LoadInt32(&fragmented) == 1) != fragmentorCoinFlip {
+		t.Fatalf("replayed fragmentor coin flip not applied: %v", fragmentorCoinFlip)
+	}
+}
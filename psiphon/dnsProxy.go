@@ -0,0 +1,491 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// DNSProxy is a DNS server that accepts local host UDP and TCP DNS
+// queries and, for each query, establishes a port forward through the
+// tunnel to the configured upstream DNS server and relays the query and
+// response. This allows the host OS resolver to be pointed at the client
+// to ensure DNS queries are not leaked outside of the tunnel.
+//
+// Upstream queries are always sent using DNS over TCP, as port forwards are
+// TCP streams. Successful and NXDOMAIN responses are cached, by question and
+// by the DNSSEC DO and CD query flags, for the lifetime of their records.
+type DNSProxy struct {
+	config                 *Config
+	tunneler               Tunneler
+	upstreamServerAddress  string
+	udpConn                *net.UDPConn
+	tcpListener            net.Listener
+	serveWaitGroup         *sync.WaitGroup
+	openConns              *common.Conns
+	stopListeningBroadcast chan struct{}
+	cacheMutex             sync.Mutex
+	cache                  map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	response   *dns.Msg
+	insertTime monotime.Time
+	expiry     monotime.Time
+}
+
+var _DNS_PROXY_TYPE = "DNS"
+
+const (
+	DNS_PROXY_MAX_UDP_QUERY_SIZE = 65535
+)
+
+// NewDNSProxy initializes a new DNS server. It begins listening for UDP
+// queries and TCP connections on the same port, starts goroutines that run
+// the UDP read loop and the TCP accept loop, and returns leaving the loops
+// running.
+func NewDNSProxy(
+	config *Config,
+	tunneler Tunneler,
+	listenIP string) (proxy *DNSProxy, err error) {
+
+	upstreamServerAddress := net.JoinHostPort(
+		config.LocalDNSProxyUpstreamServer, strconv.Itoa(DNS_PORT))
+
+	udpAddr, err := net.ResolveUDPAddr(
+		"udp", fmt.Sprintf("%s:%d", listenIP, config.LocalDNSProxyPort))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		if IsAddressInUseError(err) {
+			NoticeDNSProxyPortInUse(config.LocalDNSProxyPort)
+		}
+		return nil, common.ContextError(err)
+	}
+
+	// When LocalDNSProxyPort is 0, the TCP listener uses the same port as
+	// selected by the system for the UDP listener.
+
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	tcpListener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenIP, port))
+	if err != nil {
+		udpConn.Close()
+		if IsAddressInUseError(err) {
+			NoticeDNSProxyPortInUse(port)
+		}
+		return nil, common.ContextError(err)
+	}
+
+	proxy = &DNSProxy{
+		config:                 config,
+		tunneler:               tunneler,
+		upstreamServerAddress:  upstreamServerAddress,
+		udpConn:                udpConn,
+		tcpListener:            tcpListener,
+		serveWaitGroup:         new(sync.WaitGroup),
+		openConns:              common.NewConns(),
+		stopListeningBroadcast: make(chan struct{}),
+		cache:                  make(map[string]*dnsCacheEntry),
+	}
+	proxy.serveWaitGroup.Add(2)
+	go proxy.serveUDP()
+	go proxy.serveTCP()
+	NoticeListeningDNSProxyPort(port)
+	return proxy, nil
+}
+
+// Close terminates the listeners and waits for the serve goroutines
+// to complete.
+func (proxy *DNSProxy) Close() {
+	close(proxy.stopListeningBroadcast)
+	proxy.udpConn.Close()
+	proxy.tcpListener.Close()
+	proxy.openConns.CloseAll()
+	proxy.serveWaitGroup.Wait()
+}
+
+func (proxy *DNSProxy) serveUDP() {
+	defer proxy.serveWaitGroup.Done()
+
+	buffer := make([]byte, DNS_PROXY_MAX_UDP_QUERY_SIZE)
+
+loop:
+	for {
+		n, clientAddr, err := proxy.udpConn.ReadFromUDP(buffer)
+
+		select {
+		case <-proxy.stopListeningBroadcast:
+			break loop
+		default:
+		}
+
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				NoticeAlert("DNS proxy UDP read temporary error: %s", err)
+				continue
+			}
+			NoticeLocalProxyError(_DNS_PROXY_TYPE, common.ContextError(err))
+			break loop
+		}
+
+		query := new(dns.Msg)
+		err = query.Unpack(buffer[:n])
+		if err != nil {
+			// Malformed queries are dropped.
+			continue
+		}
+
+		proxy.serveWaitGroup.Add(1)
+		go func() {
+			defer proxy.serveWaitGroup.Done()
+			err := proxy.handleUDPQuery(query, clientAddr)
+			if err != nil {
+				NoticeLocalProxyError(_DNS_PROXY_TYPE, common.ContextError(err))
+			}
+		}()
+	}
+	NoticeInfo("DNS proxy UDP read loop stopped")
+}
+
+func (proxy *DNSProxy) handleUDPQuery(query *dns.Msg, clientAddr *net.UDPAddr) error {
+
+	response, err := proxy.resolve(query)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	packet, err := response.Pack()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// The upstream response, received over TCP, may exceed what the client
+	// will accept over UDP. In this case, send an empty, truncated response,
+	// which signals the client to retry over TCP.
+
+	maxSize := dns.MinMsgSize
+	if opt := query.IsEdns0(); opt != nil && int(opt.UDPSize()) > maxSize {
+		maxSize = int(opt.UDPSize())
+	}
+
+	if len(packet) > maxSize {
+		truncated := new(dns.Msg)
+		truncated.SetReply(query)
+		truncated.Rcode = response.Rcode
+		truncated.RecursionAvailable = response.RecursionAvailable
+		truncated.Truncated = true
+		packet, err = truncated.Pack()
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	_, err = proxy.udpConn.WriteToUDP(packet, clientAddr)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+func (proxy *DNSProxy) serveTCP() {
+	defer proxy.serveWaitGroup.Done()
+
+loop:
+	for {
+		conn, err := proxy.tcpListener.Accept()
+
+		select {
+		case <-proxy.stopListeningBroadcast:
+			if conn != nil {
+				conn.Close()
+			}
+			break loop
+		default:
+		}
+
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				NoticeAlert("DNS proxy TCP accept temporary error: %s", err)
+				continue
+			}
+			NoticeLocalProxyError(_DNS_PROXY_TYPE, common.ContextError(err))
+			break loop
+		}
+
+		proxy.serveWaitGroup.Add(1)
+		go func() {
+			defer proxy.serveWaitGroup.Done()
+			err := proxy.handleTCPConn(conn)
+			if err != nil {
+				NoticeLocalProxyError(_DNS_PROXY_TYPE, common.ContextError(err))
+			}
+		}()
+	}
+	NoticeInfo("DNS proxy TCP accept loop stopped")
+}
+
+// handleTCPConn serves any number of sequential queries from a single
+// local TCP connection.
+func (proxy *DNSProxy) handleTCPConn(conn net.Conn) error {
+	defer conn.Close()
+	defer proxy.openConns.Remove(conn)
+
+	if !proxy.openConns.Add(conn) {
+		return nil
+	}
+
+	dnsConn := &dns.Conn{Conn: conn}
+
+	for {
+		query, err := dnsConn.ReadMsg()
+		if err != nil {
+			// The client closed the connection, or sent a malformed query.
+			return nil
+		}
+
+		response, err := proxy.resolve(query)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		err = dnsConn.WriteMsg(response)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+}
+
+// resolve returns the response for the query, either from the cache or
+// from the upstream DNS server.
+func (proxy *DNSProxy) resolve(query *dns.Msg) (*dns.Msg, error) {
+
+	// Only standard queries with exactly one question are supported;
+	// this is the only form used in practice.
+
+	if query.Response ||
+		query.Opcode != dns.OpcodeQuery ||
+		len(query.Question) != 1 {
+
+		response := new(dns.Msg)
+		response.SetRcode(query, dns.RcodeNotImplemented)
+		return response, nil
+	}
+
+	response := proxy.getCachedResponse(query)
+	if response != nil {
+		return response, nil
+	}
+
+	response, err := proxy.forward(query)
+	if err != nil {
+		response := new(dns.Msg)
+		response.SetRcode(query, dns.RcodeServerFailure)
+		NoticeAlert("DNS proxy query failed: %s", common.ContextError(err))
+		return response, nil
+	}
+
+	proxy.cacheResponse(query, response)
+
+	return response, nil
+}
+
+// forward sends the query to the upstream DNS server through the tunnel
+// and returns the response.
+func (proxy *DNSProxy) forward(query *dns.Msg) (*dns.Msg, error) {
+
+	requestTimeout := proxy.config.GetClientParameters().Duration(
+		parameters.DNSProxyRequestTimeout)
+
+	// Always tunnel DNS queries, regardless of split tunnel classification,
+	// as the purpose of the DNS proxy is to avoid DNS leaks.
+
+	conn, err := proxy.tunneler.Dial(proxy.upstreamServerAddress, true, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Tunneled conns don't support deadlines, so the request timeout is
+	// enforced by closing the conn.
+
+	timer := time.AfterFunc(requestTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	dnsConn := &dns.Conn{Conn: conn}
+	defer dnsConn.Close()
+
+	err = dnsConn.WriteMsg(query)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	response, err := dnsConn.ReadMsg()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if response.Id != query.Id {
+		return nil, common.ContextError(errors.New("unexpected response ID"))
+	}
+
+	return response, nil
+}
+
+// getDNSCacheKey returns the cache key for the query. Names are case
+// insensitive. The DNSSEC OK (DO) and Checking Disabled (CD) flags select
+// whether DNSSEC records are included and whether the upstream server
+// validates, so responses to queries with different flags are cached
+// separately.
+func getDNSCacheKey(query *dns.Msg) string {
+	question := query.Question[0]
+	dnssecOK := false
+	opt := query.IsEdns0()
+	if opt != nil {
+		dnssecOK = opt.Do()
+	}
+	return fmt.Sprintf("%s/%d/%d/%t/%t",
+		strings.ToLower(question.Name), question.Qtype, question.Qclass,
+		dnssecOK, query.CheckingDisabled)
+}
+
+// getCachedResponse returns a copy of a cached response for the query, with
+// the query ID, with the query question, and with record TTLs reduced by the
+// time spent in the cache. The question is copied as-is since resolvers may
+// randomize the case of the question name, as in DNS 0x20, and expect it to
+// be echoed. Returns nil when there is no unexpired cache entry.
+func (proxy *DNSProxy) getCachedResponse(query *dns.Msg) *dns.Msg {
+
+	key := getDNSCacheKey(query)
+
+	proxy.cacheMutex.Lock()
+	entry, ok := proxy.cache[key]
+	if ok && monotime.Now().After(entry.expiry) {
+		delete(proxy.cache, key)
+		ok = false
+	}
+	proxy.cacheMutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	response := entry.response.Copy()
+	response.Id = query.Id
+	response.Question = append([]dns.Question(nil), query.Question...)
+
+	elapsed := uint32(monotime.Since(entry.insertTime) / time.Second)
+
+	for _, records := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range records {
+			header := record.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+
+	return response
+}
+
+// cacheResponse adds a response to the cache. Only successful and NXDOMAIN
+// responses are cached. The cache lifetime is the minimum TTL of the answer
+// and authority records, capped by DNSProxyCacheMaxTTL. For negative
+// responses, the authority section contains the SOA record which determines
+// the negative caching TTL.
+func (proxy *DNSProxy) cacheResponse(query *dns.Msg, response *dns.Msg) {
+
+	p := proxy.config.GetClientParameters()
+	maxEntries := p.Int(parameters.DNSProxyCacheMaxEntries)
+	maxTTL := p.Duration(parameters.DNSProxyCacheMaxTTL)
+	p = nil
+
+	if maxEntries == 0 || maxTTL == 0 {
+		return
+	}
+
+	if response.Truncated ||
+		(response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return
+	}
+
+	ttl := maxTTL
+	hasRecords := false
+	for _, records := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, record := range records {
+			recordTTL := time.Duration(record.Header().Ttl) * time.Second
+			if recordTTL < ttl {
+				ttl = recordTTL
+			}
+			hasRecords = true
+		}
+	}
+
+	if !hasRecords || ttl == 0 {
+		return
+	}
+
+	now := monotime.Now()
+
+	proxy.cacheMutex.Lock()
+	defer proxy.cacheMutex.Unlock()
+
+	if len(proxy.cache) >= maxEntries {
+		for key, entry := range proxy.cache {
+			if now.After(entry.expiry) {
+				delete(proxy.cache, key)
+			}
+		}
+	}
+
+	// When the cache remains full, evict an arbitrary entry.
+
+	for key := range proxy.cache {
+		if len(proxy.cache) < maxEntries {
+			break
+		}
+		delete(proxy.cache, key)
+	}
+
+	proxy.cache[getDNSCacheKey(query)] = &dnsCacheEntry{
+		response:   response.Copy(),
+		insertTime: now,
+		expiry:     now.Add(ttl),
+	}
+}
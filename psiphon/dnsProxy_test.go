@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+)
+
+// testDNSTunneler is a Tunneler which serves DNS port forwards with an
+// in-process DNS server that answers every A query with the same address.
+type testDNSTunneler struct {
+	dnsServerAddress string
+	answer           net.IP
+	queryCount       int32
+}
+
+func (t *testDNSTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	if remoteAddr != t.dnsServerAddress || !alwaysTunnel {
+		return nil, errors.New("unexpected remote address")
+	}
+
+	clientConn, serverConn := net.Pipe()
+
+	go func() {
+		dnsConn := &dns.Conn{Conn: serverConn}
+		defer dnsConn.Close()
+		query, err := dnsConn.ReadMsg()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&t.queryCount, 1)
+		response := new(dns.Msg)
+		response.SetReply(query)
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   query.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: t.answer,
+		})
+		dnsConn.WriteMsg(response)
+	}()
+
+	return clientConn, nil
+}
+
+func (t *testDNSTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return nil, errors.New("unsupported")
+}
+
+func (t *testDNSTunneler) SignalComponentFailure() {
+}
+
+func TestDNSProxy(t *testing.T) {
+
+	config := &Config{
+		PropagationChannelId:        "0",
+		SponsorId:                   "0",
+		EnableLocalDNSProxy:         true,
+		LocalDNSProxyUpstreamServer: "192.0.2.53",
+	}
+	err := config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	tunneler := &testDNSTunneler{
+		dnsServerAddress: "192.0.2.53:53",
+		answer:           net.ParseIP("192.0.2.1"),
+	}
+
+	proxy, err := NewDNSProxy(config, tunneler, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewDNSProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	proxyAddress := proxy.udpConn.LocalAddr().String()
+
+	// The first query is forwarded upstream; the following queries, over
+	// both UDP and TCP, and with a differently cased question name, are
+	// served from the cache. Queries with the DNSSEC DO or CD flags set are
+	// cached separately.
+
+	testCases := []struct {
+		network            string
+		name               string
+		dnssecOK           bool
+		checkingDisabled   bool
+		expectedQueryCount int32
+	}{
+		{"udp", "example.org.", false, false, 1},
+		{"udp", "example.org.", false, false, 1},
+		{"tcp", "example.org.", false, false, 1},
+		{"udp", "ExAmPlE.oRg.", false, false, 1},
+		{"udp", "example.org.", true, false, 2},
+		{"udp", "EXAMPLE.ORG.", true, false, 2},
+		{"udp", "example.org.", false, true, 3},
+		{"udp", "example.org.", true, true, 4},
+	}
+
+	for i, testCase := range testCases {
+
+		conn, err := net.Dial(testCase.network, proxyAddress)
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		dnsConn := &dns.Conn{Conn: conn}
+
+		query := new(dns.Msg)
+		query.SetQuestion(testCase.name, dns.TypeA)
+		query.RecursionDesired = true
+		query.CheckingDisabled = testCase.checkingDisabled
+		if testCase.dnssecOK {
+			query.SetEdns0(4096, true)
+		}
+
+		err = dnsConn.WriteMsg(query)
+		if err != nil {
+			t.Fatalf("WriteMsg failed: %s", err)
+		}
+
+		response, err := dnsConn.ReadMsg()
+		dnsConn.Close()
+		if err != nil {
+			t.Fatalf("ReadMsg failed: %s", err)
+		}
+
+		if response.Id != query.Id ||
+			response.Rcode != dns.RcodeSuccess ||
+			len(response.Question) != 1 ||
+			response.Question[0].Name != testCase.name ||
+			len(response.Answer) != 1 {
+
+			t.Fatalf("unexpected response %d: %s", i, response)
+		}
+
+		a, ok := response.Answer[0].(*dns.A)
+		if !ok || !a.A.Equal(tunneler.answer) || a.Hdr.Ttl > 60 {
+			t.Fatalf("unexpected answer %d: %s", i, response.Answer[0])
+		}
+
+		queryCount := atomic.LoadInt32(&tunneler.queryCount)
+		if queryCount != testCase.expectedQueryCount {
+			t.Fatalf("unexpected upstream query count %d: %d", i, queryCount)
+		}
+	}
+}
@@ -38,27 +38,32 @@ const (
 )
 
 // NewTCPFragmentorDialer creates a TCP dialer that wraps dialed conns in
-// FragmentorConn. A single FragmentorProbability coin flip is made and all
-// conns get the same treatment.
+// FragmentorConn. All conns get the same treatment: when coinFlip is not
+// nil, it is used; otherwise a single FragmentorProbability coin flip is
+// made.
 func NewTCPFragmentorDialer(
 	config *DialConfig,
 	tunnelProtocol string,
-	clientParameters *parameters.ClientParameters) Dialer {
+	clientParameters *parameters.ClientParameters,
+	coinFlip *bool) Dialer {
 
-	p := clientParameters.Get()
-	coinFlip := p.WeightedCoinFlip(parameters.FragmentorProbability)
-	p = nil
+	if coinFlip == nil {
+		flip := clientParameters.Get().WeightedCoinFlip(parameters.FragmentorProbability)
+		coinFlip = &flip
+	}
 
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
 		if network != "tcp" {
 			return nil, common.ContextError(fmt.Errorf("%s unsupported", network))
 		}
-		return DialTCPFragmentor(ctx, addr, config, tunnelProtocol, clientParameters, &coinFlip)
+		return DialTCPFragmentor(ctx, addr, config, tunnelProtocol, clientParameters, coinFlip)
 	}
 }
 
 // DialTCPFragmentor performs a DialTCP and wraps the dialed conn in a
 // FragmentorConn, subject to FragmentorProbability and FragmentorLimitProtocols.
+// When coinFlip is not nil, it is used in place of a new FragmentorProbability
+// coin flip.
 func DialTCPFragmentor(
 	ctx context.Context,
 	addr string,
@@ -79,7 +84,11 @@ func DialTCPFragmentor(
 		return conn, nil
 	}
 
-	if !p.WeightedCoinFlip(parameters.FragmentorProbability) {
+	if coinFlip != nil {
+		if !*coinFlip {
+			return conn, nil
+		}
+	} else if !p.WeightedCoinFlip(parameters.FragmentorProbability) {
 		return conn, nil
 	}
 
@@ -111,6 +111,11 @@ type MeekConfig struct {
 	// incuding buffers are allocated.
 	RoundTripperOnly bool
 
+	// FragmentorCoinFlip, when not nil, is the FragmentorProbability coin
+	// flip outcome to apply to all underlying TCP conns. When nil, a new
+	// coin flip is made.
+	FragmentorCoinFlip *bool
+
 	// The following values are used to create the obfuscated meek cookie.
 
 	MeekCookieEncryptionPublicKey string
@@ -239,7 +244,8 @@ func DialMeek(
 		tcpDialer := NewTCPFragmentorDialer(
 			dialConfig,
 			meekConfig.ClientTunnelProtocol,
-			meekConfig.ClientParameters)
+			meekConfig.ClientParameters,
+			meekConfig.FragmentorCoinFlip)
 
 		tlsConfig := &CustomTLSConfig{
 			ClientParameters:              meekConfig.ClientParameters,
@@ -358,14 +364,16 @@ func DialMeek(
 			dialer = NewTCPFragmentorDialer(
 				copyDialConfig,
 				meekConfig.ClientTunnelProtocol,
-				meekConfig.ClientParameters)
+				meekConfig.ClientParameters,
+				meekConfig.FragmentorCoinFlip)
 
 		} else {
 
 			baseDialer := NewTCPFragmentorDialer(
 				dialConfig,
 				meekConfig.ClientTunnelProtocol,
-				meekConfig.ClientParameters)
+				meekConfig.ClientParameters,
+				meekConfig.FragmentorCoinFlip)
 
 			// The dialer ignores address that http.Transport will pass in (derived
 			// from the HTTP request URL) and always dials meekConfig.DialAddress.
@@ -32,6 +32,8 @@ import (
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
 )
 
 type noticeLogger struct {
@@ -389,6 +391,14 @@ func NoticeCandidateServers(
 		"count", count)
 }
 
+// NoticeEgressRegion reports the egress region selected with
+// Controller.SetEgressRegion. An empty region indicates any region.
+func NoticeEgressRegion(region string) {
+	singletonNoticeLogger.outputNotice(
+		"EgressRegion", 0,
+		"region", region)
+}
+
 // NoticeAvailableEgressRegions is what regions are available for egress from.
 // Consecutive reports of the same list of regions are suppressed.
 func NoticeAvailableEgressRegions(regions []string) {
@@ -406,6 +416,7 @@ func noticeWithDialStats(noticeType, ipAddress, region, protocol string, dialSta
 		"ipAddress", ipAddress,
 		"region", region,
 		"protocol", protocol,
+		"isReplay", dialStats.IsReplay,
 	}
 
 	if dialStats.SelectedSSHClientVersion {
@@ -488,6 +499,15 @@ func NoticeActiveTunnel(ipAddress, protocol string, isTCS bool) {
 		"isTCS", isTCS)
 }
 
+// NoticeMultiHopTunnel reports the entry and exit servers of a connected
+// multi-hop tunnel.
+func NoticeMultiHopTunnel(entryIPAddress, exitIPAddress string) {
+	singletonNoticeLogger.outputNotice(
+		"MultiHopTunnel", noticeIsDiagnostic,
+		"entryIPAddress", entryIPAddress,
+		"exitIPAddress", exitIPAddress)
+}
+
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalSocksProxyPort
 func NoticeSocksProxyPortInUse(port int) {
 	singletonNoticeLogger.outputNotice(
@@ -516,6 +536,34 @@ func NoticeListeningHttpProxyPort(port int) {
 		"port", port)
 }
 
+// NoticeDNSProxyPortInUse is a failure to use the configured LocalDNSProxyPort
+func NoticeDNSProxyPortInUse(port int) {
+	singletonNoticeLogger.outputNotice(
+		"DNSProxyPortInUse", noticeShowUser,
+		"port", port)
+}
+
+// NoticeListeningDNSProxyPort is the selected port for the listening local DNS proxy
+func NoticeListeningDNSProxyPort(port int) {
+	singletonNoticeLogger.outputNotice(
+		"ListeningDNSProxyPort", 0,
+		"port", port)
+}
+
+// NoticeControlAPIPortInUse is a failure to use the configured LocalControlAPIPort
+func NoticeControlAPIPortInUse(port int) {
+	singletonNoticeLogger.outputNotice(
+		"ControlAPIPortInUse", 0,
+		"port", port)
+}
+
+// NoticeListeningControlAPIPort is the selected port for the listening local control API
+func NoticeListeningControlAPIPort(port int) {
+	singletonNoticeLogger.outputNotice(
+		"ListeningControlAPIPort", 0,
+		"port", port)
+}
+
 // NoticeClientUpgradeAvailable is an available client upgrade, as per the handshake. The
 // client should download and install an upgrade.
 func NoticeClientUpgradeAvailable(version string) {
@@ -561,10 +609,28 @@ func NoticeClientRegion(region string) {
 // NoticeTunnels is how many active tunnels are available. The client should use this to
 // determine connecting/unexpected disconnect state transitions. When count is 0, the core is
 // disconnected; when count > 1, the core is connected.
-func NoticeTunnels(count int) {
+// The notice also reports the utilization of each active tunnel. When a tunnel becomes
+// degraded or recovers, the notice is emitted again with an unchanged count.
+func NoticeTunnels(count int, utilization []*TunnelUtilization) {
 	singletonNoticeLogger.outputNotice(
 		"Tunnels", 0,
-		"count", count)
+		"count", count,
+		"tunnels", utilization)
+}
+
+// NoticePacketTunnelSessionConfiguration reports the packet tunnel session
+// configuration assigned by the server. The client should apply this
+// configuration -- addresses, MTU, and DNS resolvers -- to its tun device.
+// The notice is emitted again, with a new configuration, when the packet
+// tunnel reconnects to a different server.
+func NoticePacketTunnelSessionConfiguration(sessionConfiguration *tun.SessionConfiguration) {
+	singletonNoticeLogger.outputNotice(
+		"PacketTunnelSessionConfiguration", 0,
+		"IPv4AddressCIDR", sessionConfiguration.IPv4AddressCIDR,
+		"IPv6AddressCIDR", sessionConfiguration.IPv6AddressCIDR,
+		"MTU", sessionConfiguration.MTU,
+		"DNSResolverIPv4Address", sessionConfiguration.DNSResolverIPv4Address,
+		"DNSResolverIPv6Address", sessionConfiguration.DNSResolverIPv6Address)
 }
 
 // NoticeSessionId is the session ID used across all tunnels established by the controller.
@@ -690,6 +756,32 @@ func NoticeRemoteServerListResourceDownloaded(url string) {
 		"url", url)
 }
 
+// NoticeDataStoreRecovered indicates that a corrupt data store was
+// quarantined, as corruptFilename, and that a new data store was rebuilt.
+// recovered is the number of records recovered for each recovered bucket,
+// invalid is the number of corrupt records that were discarded, and lost
+// lists the buckets whose data was lost.
+func NoticeDataStoreRecovered(
+	corruptFilename string, recovered map[string]int, invalid int, lost []string) {
+
+	singletonNoticeLogger.outputNotice(
+		"DataStoreRecovered", 0,
+		"corruptFilename", corruptFilename,
+		"recovered", recovered,
+		"invalid", invalid,
+		"lost", lost)
+}
+
+// NoticePrunedServerEntries reports the number of dead, stale, and excess
+// server entries that were pruned from the data store.
+func NoticePrunedServerEntries(dead, stale, excess int) {
+	singletonNoticeLogger.outputNotice(
+		"PrunedServerEntries", noticeIsDiagnostic,
+		"dead", dead,
+		"stale", stale,
+		"excess", excess)
+}
+
 // NoticeSLOKSeeded indicates that the SLOK with the specified ID was received from
 // the Psiphon server. The "duplicate" flags indicates whether the SLOK was previously known.
 func NoticeSLOKSeeded(slokID string, duplicate bool) {
@@ -720,6 +812,20 @@ func NoticeActiveAuthorizationIDs(activeAuthorizationIDs []string) {
 		"IDs", activeAuthorizationIDs)
 }
 
+// NoticeQuotas reports the client's data transfer quotas, and the bytes
+// remaining in the current period for each quota, as of the handshake.
+func NoticeQuotas(quotas []protocol.QuotaStatus) {
+
+	// Never emit 'null' instead of empty list
+	if quotas == nil {
+		quotas = make([]protocol.QuotaStatus, 0)
+	}
+
+	singletonNoticeLogger.outputNotice(
+		"Quotas", 0,
+		"quotas", quotas)
+}
+
 func NoticeBindToDevice(deviceInfo string) {
 	outputRepetitiveNotice(
 		"BindToDevice", deviceInfo, 0,
@@ -33,27 +33,32 @@ import (
 // disconnect from and reconnect to the same or different Psiphon servers. PacketTunnelTransport
 // allows the Psiphon client to substitute new transport channels on-the-fly.
 type PacketTunnelTransport struct {
-	runCtx        context.Context
-	stopRunning   context.CancelFunc
-	workers       *sync.WaitGroup
-	readMutex     sync.Mutex
-	writeMutex    sync.Mutex
-	channelReady  *sync.Cond
-	channelMutex  sync.Mutex
-	channelConn   net.Conn
-	channelTunnel *Tunnel
+	runCtx             context.Context
+	stopRunning        context.CancelFunc
+	workers            *sync.WaitGroup
+	readMutex          sync.Mutex
+	writeMutex         sync.Mutex
+	channelReady       *sync.Cond
+	channelMutex       sync.Mutex
+	channelConn        net.Conn
+	channelTunnel      *Tunnel
+	channelEstablished func()
 }
 
-// NewPacketTunnelTransport initializes a PacketTunnelTransport.
-func NewPacketTunnelTransport() *PacketTunnelTransport {
+// NewPacketTunnelTransport initializes a PacketTunnelTransport. When
+// channelEstablished is not nil, it is called each time a new transport
+// channel is in use; e.g., to request a new packet tunnel session
+// configuration.
+func NewPacketTunnelTransport(channelEstablished func()) *PacketTunnelTransport {
 
 	runCtx, stopRunning := context.WithCancel(context.Background())
 
 	return &PacketTunnelTransport{
-		runCtx:       runCtx,
-		stopRunning:  stopRunning,
-		workers:      new(sync.WaitGroup),
-		channelReady: sync.NewCond(new(sync.Mutex)),
+		runCtx:             runCtx,
+		stopRunning:        stopRunning,
+		workers:            new(sync.WaitGroup),
+		channelReady:       sync.NewCond(new(sync.Mutex)),
+		channelEstablished: channelEstablished,
 	}
 }
 
@@ -161,6 +166,14 @@ func (p *PacketTunnelTransport) UseTunnel(tunnel *Tunnel) {
 
 		p.setChannel(channelConn, tunnel)
 
+		if p.channelEstablished != nil {
+			// channelEstablished is not run as a worker, since it may write
+			// to the transport, and a write blocks in getChannel when the new
+			// channel has already failed; Close waits for workers before
+			// waking blocked writes.
+			go p.channelEstablished()
+		}
+
 	}(tunnel)
 }
 
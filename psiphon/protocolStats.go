@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	PROTOCOL_STATS_STORE_PERIOD = 30 * time.Second
+)
+
+// protocolStats records, for one network, the tunnel establishment outcomes
+// for each tunnel protocol, and uses those outcomes to bias tunnel protocol
+// selection towards protocols that succeed on the network.
+//
+// Selection is an epsilon-greedy multi-armed bandit policy. With
+// AdaptiveProtocolSelectionProbability, the candidate protocol with the
+// highest score is selected; otherwise, a candidate protocol is selected at
+// random, which continues to explore protocols with few or stale outcomes.
+// The candidate protocols are always subject to the tunnel protocol limits.
+//
+// A protocol's score is its success rate, with an add-one prior so that
+// protocols with no outcomes score 0.5, reduced by its mean connection
+// latency relative to TunnelConnectTimeout. Outcomes are exponentially
+// decayed by AdaptiveProtocolSelectionDecay, so that the policy adapts when
+// network conditions change.
+//
+// protocolStats are stored in the datastore, keyed by network ID, and are
+// only used when a NetworkIDGetter is configured. Outcomes are stored at most
+// once every PROTOCOL_STATS_STORE_PERIOD as they are recorded, and when
+// establishment stops.
+type protocolStats struct {
+	networkID          string
+	probability        float64
+	decay              float64
+	latencyScale       time.Duration
+	mutex              sync.Mutex
+	outcomes           map[string]*protocolOutcomes
+	hasUnstoredChanges bool
+	lastStoreTime      monotime.Time
+}
+
+// protocolOutcomes are the decayed establishment outcomes for one tunnel
+// protocol.
+type protocolOutcomes struct {
+	Successes   float64
+	Failures    float64
+	MeanLatency time.Duration
+}
+
+// loadProtocolStats loads the stored protocol stats for the current network.
+// Returns nil when protocol stats are not used.
+func loadProtocolStats(config *Config) (*protocolStats, error) {
+
+	if config.networkIDGetter == nil {
+		return nil, nil
+	}
+
+	p := config.clientParameters.Get()
+	probability := p.Float(parameters.AdaptiveProtocolSelectionProbability)
+	decay := p.Float(parameters.AdaptiveProtocolSelectionDecay)
+	latencyScale := p.Duration(parameters.TunnelConnectTimeout)
+	p = nil
+
+	if probability <= 0.0 {
+		return nil, nil
+	}
+
+	// A decay greater than 1.0 would amplify, not decay, past outcomes.
+	if decay > 1.0 {
+		decay = 1.0
+	}
+
+	stats := &protocolStats{
+		networkID:     config.networkIDGetter.GetNetworkID(),
+		probability:   probability,
+		decay:         decay,
+		latencyScale:  latencyScale,
+		outcomes:      make(map[string]*protocolOutcomes),
+		lastStoreTime: monotime.Now(),
+	}
+
+	value, err := getBucketValue(
+		[]byte(protocolStatsBucket), []byte(stats.networkID))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if value != nil {
+		err = json.Unmarshal(value, &stats.outcomes)
+		if err != nil {
+			// Invalid records are replaced and otherwise ignored.
+			NoticeAlert("invalid protocol stats: %s", common.ContextError(err))
+			stats.outcomes = make(map[string]*protocolOutcomes)
+		}
+	}
+
+	return stats, nil
+}
+
+// recordOutcome records a tunnel establishment outcome for the specified
+// tunnel protocol. latency is the connection time, and is used only for
+// successful outcomes. Unstored outcomes are stored when
+// PROTOCOL_STATS_STORE_PERIOD has elapsed since the last store.
+func (stats *protocolStats) recordOutcome(
+	tunnelProtocol string, success bool, latency time.Duration) {
+
+	stats.mutex.Lock()
+
+	outcomes, ok := stats.outcomes[tunnelProtocol]
+	if !ok {
+		outcomes = &protocolOutcomes{}
+		stats.outcomes[tunnelProtocol] = outcomes
+	}
+
+	outcomes.Successes *= stats.decay
+	outcomes.Failures *= stats.decay
+
+	if success {
+		outcomes.Successes += 1
+		if outcomes.MeanLatency == 0 {
+			outcomes.MeanLatency = latency
+		} else {
+			outcomes.MeanLatency = time.Duration(
+				stats.decay*float64(outcomes.MeanLatency) +
+					(1.0-stats.decay)*float64(latency))
+		}
+	} else {
+		outcomes.Failures += 1
+	}
+
+	stats.hasUnstoredChanges = true
+
+	storeDue := monotime.Since(stats.lastStoreTime) >= PROTOCOL_STATS_STORE_PERIOD
+
+	stats.mutex.Unlock()
+
+	if storeDue {
+		err := stats.store()
+		if err != nil {
+			NoticeAlert("failed to store protocol stats: %s", err)
+		}
+	}
+}
+
+// score returns the selection score for the specified tunnel protocol. The
+// caller must hold the mutex.
+func (stats *protocolStats) score(tunnelProtocol string) float64 {
+
+	outcomes, ok := stats.outcomes[tunnelProtocol]
+	if !ok {
+		return 0.5
+	}
+
+	score := (outcomes.Successes + 1.0) /
+		(outcomes.Successes + outcomes.Failures + 2.0)
+
+	if stats.latencyScale > 0 {
+		score /= 1.0 + float64(outcomes.MeanLatency)/float64(stats.latencyScale)
+	}
+
+	return score
+}
+
+// selectProtocol selects a tunnel protocol from the candidate protocols.
+// Ties between the highest scoring candidates are broken at random.
+func (stats *protocolStats) selectProtocol(candidateProtocols []string) (string, error) {
+
+	if !common.FlipWeightedCoin(stats.probability) {
+		index, err := common.MakeSecureRandomInt(len(candidateProtocols))
+		if err != nil {
+			return "", common.ContextError(err)
+		}
+		return candidateProtocols[index], nil
+	}
+
+	stats.mutex.Lock()
+	var bestProtocols []string
+	bestScore := -1.0
+	for _, tunnelProtocol := range candidateProtocols {
+		score := stats.score(tunnelProtocol)
+		if score > bestScore {
+			bestProtocols = []string{tunnelProtocol}
+			bestScore = score
+		} else if score == bestScore {
+			bestProtocols = append(bestProtocols, tunnelProtocol)
+		}
+	}
+	stats.mutex.Unlock()
+
+	index, err := common.MakeSecureRandomInt(len(bestProtocols))
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	return bestProtocols[index], nil
+}
+
+// store stores the protocol stats, if there are any unstored outcomes.
+func (stats *protocolStats) store() error {
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	if !stats.hasUnstoredChanges {
+		return nil
+	}
+
+	value, err := json.Marshal(stats.outcomes)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = setBucketValue(
+		[]byte(protocolStatsBucket), []byte(stats.networkID), value)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	stats.hasUnstoredChanges = false
+	stats.lastStoreTime = monotime.Now()
+
+	return nil
+}
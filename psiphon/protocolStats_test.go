@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestAdaptiveProtocolSelection(t *testing.T) {
+
+	dataDirName, err := ioutil.TempDir("", "psiphon-protocol-stats-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirName)
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   dataDirName,
+		NetworkID:            "NETWORK1",
+	}
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	// Always select the best scoring protocol.
+	_, err = config.clientParameters.Set(
+		"", false, map[string]interface{}{parameters.AdaptiveProtocolSelectionProbability: 1.0})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	stats, err := loadProtocolStats(config)
+	if err != nil {
+		t.Fatalf("loadProtocolStats failed: %s", err)
+	}
+
+	failingProtocol := protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH
+	fastProtocol := protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK
+	slowProtocol := protocol.TUNNEL_PROTOCOL_FRONTED_MEEK
+
+	candidateProtocols := []string{failingProtocol, fastProtocol, slowProtocol}
+
+	// With no outcomes, all candidates are selected.
+
+	selected := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		selectedProtocol, err := stats.selectProtocol(candidateProtocols)
+		if err != nil {
+			t.Fatalf("selectProtocol failed: %s", err)
+		}
+		selected[selectedProtocol] = true
+	}
+	if len(selected) != len(candidateProtocols) {
+		t.Fatalf("unexpected selected protocols: %+v", selected)
+	}
+
+	// The best scoring protocol is selected: successes outscore failures,
+	// and lower latency outscores higher latency.
+
+	for i := 0; i < 5; i++ {
+		stats.recordOutcome(failingProtocol, false, 0)
+		stats.recordOutcome(fastProtocol, true, 1*time.Second)
+		stats.recordOutcome(slowProtocol, true, 10*time.Second)
+	}
+
+	checkSelected := func(stats *protocolStats, candidateProtocols []string, expectedProtocol string) {
+		for i := 0; i < 100; i++ {
+			selectedProtocol, err := stats.selectProtocol(candidateProtocols)
+			if err != nil {
+				t.Fatalf("selectProtocol failed: %s", err)
+			}
+			if selectedProtocol != expectedProtocol {
+				t.Fatalf("unexpected selected protocol: %s", selectedProtocol)
+			}
+		}
+	}
+
+	checkSelected(stats, candidateProtocols, fastProtocol)
+
+	// Selection is limited to the candidate protocols.
+
+	checkSelected(stats, []string{failingProtocol, slowProtocol}, slowProtocol)
+
+	// Protocol stats are stored per network.
+
+	err = stats.store()
+	if err != nil {
+		t.Fatalf("store failed: %s", err)
+	}
+
+	stats, err = loadProtocolStats(config)
+	if err != nil {
+		t.Fatalf("loadProtocolStats failed: %s", err)
+	}
+
+	checkSelected(stats, candidateProtocols, fastProtocol)
+
+	// Outcomes are stored once PROTOCOL_STATS_STORE_PERIOD has elapsed
+	// since the last store.
+
+	stats.lastStoreTime -= monotime.Time(PROTOCOL_STATS_STORE_PERIOD)
+	stats.recordOutcome(slowProtocol, true, 10*time.Second)
+	if stats.hasUnstoredChanges {
+		t.Fatalf("unexpected unstored protocol stats")
+	}
+
+	// Recent failures outweigh decayed successes.
+
+	for i := 0; i < 10; i++ {
+		stats.recordOutcome(fastProtocol, false, 0)
+	}
+
+	checkSelected(stats, candidateProtocols, slowProtocol)
+
+	// The decay is capped at 1.0.
+
+	_, err = config.clientParameters.Set(
+		"", false, map[string]interface{}{
+			parameters.AdaptiveProtocolSelectionProbability: 1.0,
+			parameters.AdaptiveProtocolSelectionDecay:       2.0,
+		})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	stats, err = loadProtocolStats(config)
+	if err != nil {
+		t.Fatalf("loadProtocolStats failed: %s", err)
+	}
+	if stats.decay != 1.0 {
+		t.Fatalf("unexpected decay: %f", stats.decay)
+	}
+
+	otherNetworkConfig := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataStoreDirectory:   dataDirName,
+		NetworkID:            "NETWORK2",
+	}
+	err = otherNetworkConfig.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	otherStats, err := loadProtocolStats(otherNetworkConfig)
+	if err != nil {
+		t.Fatalf("loadProtocolStats failed: %s", err)
+	}
+	if len(otherStats.outcomes) != 0 {
+		t.Fatalf("unexpected protocol stats for other network")
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	ADMIN_AUTHORIZATION_PREFIX = "Bearer "
+)
+
+// RunAdminServer runs a HTTP server which exposes an admin API for runtime
+// control of the server. All requests must be authenticated with the
+// AdminAPIKey. Responses are JSON. The API is:
+//
+// GET /clients: list established clients; see ClientSummary.
+//
+// POST /clients/stop?session_id=<ID>: disconnect a client.
+//
+// POST /clients/revoke_authorizations?session_id=<ID>: revoke a client's
+// authorizations.
+//
+// GET /establish_tunnels: get whether new tunnels are established.
+//
+// POST /establish_tunnels?establish=<true|false>: set whether new tunnels
+// are established, as with SIGTSTP and SIGCONT.
+//
+// GET /reloaders: list the components which may be reloaded.
+//
+// POST /reload[?reloader=<description>]: reload the specified component,
+// or all components when none is specified, as with SIGUSR1.
+//
+// GET /load: get the current load stats, as logged in "server_load"
+// events. Port forward quality metrics are not reset.
+//
+// RunAdminServer blocks until shutdownBroadcast is signalled or an error
+// occurs.
+func RunAdminServer(
+	support *SupportServices,
+	shutdownBroadcast <-chan struct{}) error {
+
+	server := &http.Server{
+		Handler:      newAdminHandler(support),
+		ReadTimeout:  WEB_SERVER_IO_TIMEOUT,
+		WriteTimeout: WEB_SERVER_IO_TIMEOUT,
+	}
+
+	localAddress := support.Config.AdminListenAddress
+
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("starting admin server")
+
+	errors := make(chan error)
+	waitGroup := new(sync.WaitGroup)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		// Note: will be interrupted by listener.Close()
+		err := server.Serve(listener)
+
+		select {
+		case <-shutdownBroadcast:
+		default:
+			if err != nil {
+				select {
+				case errors <- common.ContextError(err):
+				default:
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-shutdownBroadcast:
+	case err = <-errors:
+	}
+
+	listener.Close()
+
+	waitGroup.Wait()
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("stopped admin server")
+
+	return err
+}
+
+type adminServer struct {
+	support *SupportServices
+}
+
+func newAdminHandler(support *SupportServices) http.Handler {
+
+	adminServer := &adminServer{support: support}
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/clients", adminServer.handler(http.MethodGet, adminServer.clientsHandler))
+	serveMux.HandleFunc("/clients/stop", adminServer.handler(http.MethodPost, adminServer.stopClientHandler))
+	serveMux.HandleFunc("/clients/revoke_authorizations", adminServer.handler(http.MethodPost, adminServer.revokeClientAuthorizationsHandler))
+	serveMux.HandleFunc("/establish_tunnels", adminServer.establishTunnelsHandler)
+	serveMux.HandleFunc("/reloaders", adminServer.handler(http.MethodGet, adminServer.reloadersHandler))
+	serveMux.HandleFunc("/reload", adminServer.handler(http.MethodPost, adminServer.reloadHandler))
+	serveMux.HandleFunc("/load", adminServer.handler(http.MethodGet, adminServer.loadHandler))
+
+	return serveMux
+}
+
+// authenticate checks that the request presents the admin API key.
+func (adminServer *adminServer) authenticate(r *http.Request) bool {
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, ADMIN_AUTHORIZATION_PREFIX) {
+		return false
+	}
+	key := strings.TrimPrefix(authorization, ADMIN_AUTHORIZATION_PREFIX)
+
+	return subtle.ConstantTimeCompare(
+		[]byte(key), []byte(adminServer.support.Config.AdminAPIKey)) == 1
+}
+
+// handler wraps an admin API handler with authentication and a check that
+// the request has the specified method. The wrapped handler returns a
+// response value, which is encoded as JSON, or an error. Errors are
+// reported to the admin client.
+func (adminServer *adminServer) handler(
+	method string,
+	handler func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if !adminServer.authenticate(r) {
+			log.WithContextFields(
+				LogFields{"remoteAddress": r.RemoteAddr}).Warning("unauthorized admin request")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		response, err := handler(r)
+		if err != nil {
+			log.WithContextFields(
+				LogFields{"path": r.URL.Path, "error": err}).Warning("admin request failed")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if response == nil {
+			response = struct{}{}
+		}
+
+		responseJSON, err := json.Marshal(response)
+		if err != nil {
+			log.WithContextFields(
+				LogFields{"path": r.URL.Path, "error": err}).Warning("admin response failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		log.WithContextFields(
+			LogFields{"path": r.URL.Path, "query": r.URL.RawQuery}).Info("admin request")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseJSON)
+	}
+}
+
+func (adminServer *adminServer) getTunnelServer() (*TunnelServer, error) {
+	tunnelServer := adminServer.support.TunnelServer
+	if tunnelServer == nil {
+		return nil, common.ContextError(errors.New("no tunnel server"))
+	}
+	return tunnelServer, nil
+}
+
+func getAdminSessionID(r *http.Request) (string, error) {
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		return "", common.ContextError(errors.New("missing session_id"))
+	}
+	return sessionID, nil
+}
+
+func (adminServer *adminServer) clientsHandler(_ *http.Request) (interface{}, error) {
+
+	tunnelServer, err := adminServer.getTunnelServer()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return tunnelServer.GetClientSummaries(), nil
+}
+
+func (adminServer *adminServer) stopClientHandler(r *http.Request) (interface{}, error) {
+
+	tunnelServer, err := adminServer.getTunnelServer()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	sessionID, err := getAdminSessionID(r)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = tunnelServer.StopClient(sessionID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return nil, nil
+}
+
+func (adminServer *adminServer) revokeClientAuthorizationsHandler(r *http.Request) (interface{}, error) {
+
+	tunnelServer, err := adminServer.getTunnelServer()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	sessionID, err := getAdminSessionID(r)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = tunnelServer.RevokeClientAuthorizations(sessionID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return nil, nil
+}
+
+type adminEstablishTunnelsResponse struct {
+	Establish bool `json:"establish"`
+}
+
+func (adminServer *adminServer) establishTunnelsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Both GET and POST are supported for /establish_tunnels.
+
+	method := http.MethodGet
+	if r.Method == http.MethodPost {
+		method = http.MethodPost
+	}
+
+	adminServer.handler(method, func(r *http.Request) (interface{}, error) {
+
+		tunnelServer, err := adminServer.getTunnelServer()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		if r.Method == http.MethodPost {
+			establish, err := strconv.ParseBool(r.URL.Query().Get("establish"))
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			tunnelServer.SetEstablishTunnels(establish)
+		}
+
+		return &adminEstablishTunnelsResponse{
+			Establish: tunnelServer.GetEstablishTunnels(),
+		}, nil
+
+	})(w, r)
+}
+
+func (adminServer *adminServer) reloadersHandler(_ *http.Request) (interface{}, error) {
+	return adminServer.support.GetReloaderDescriptions(), nil
+}
+
+func (adminServer *adminServer) reloadHandler(r *http.Request) (interface{}, error) {
+
+	if _, err := adminServer.getTunnelServer(); err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	description := r.URL.Query().Get("reloader")
+	if description == "" {
+		adminServer.support.Reload()
+		return nil, nil
+	}
+
+	err := adminServer.support.ReloadComponent(description)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return nil, nil
+}
+
+type adminLoadResponse struct {
+	ProtocolStats ProtocolStats `json:"protocol_stats"`
+	RegionStats   RegionStats   `json:"region_stats"`
+}
+
+func (adminServer *adminServer) loadHandler(_ *http.Request) (interface{}, error) {
+
+	tunnelServer, err := adminServer.getTunnelServer()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	protocolStats, regionStats := tunnelServer.PeekLoadStats()
+
+	return &adminLoadResponse{
+		ProtocolStats: protocolStats,
+		RegionStats:   regionStats,
+	}, nil
+}
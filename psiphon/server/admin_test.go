@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+
+	apiKey := "ADMIN-API-KEY"
+
+	support := &SupportServices{
+		Config: &Config{AdminAPIKey: apiKey},
+		TunnelServer: &TunnelServer{
+			sshServer: &sshServer{
+				establishTunnels: 1,
+				clients:          make(map[string]*sshClient),
+			},
+		},
+	}
+
+	handler := newAdminHandler(support)
+
+	testCases := []struct {
+		description    string
+		method         string
+		path           string
+		key            string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"no key", http.MethodGet, "/clients", "", http.StatusUnauthorized, ""},
+		{"wrong key", http.MethodGet, "/clients", "WRONG-KEY", http.StatusUnauthorized, ""},
+		{"wrong method", http.MethodPost, "/clients", apiKey, http.StatusMethodNotAllowed, ""},
+		{"list clients", http.MethodGet, "/clients", apiKey, http.StatusOK, "[]"},
+		{"stop missing session ID", http.MethodPost, "/clients/stop", apiKey, http.StatusBadRequest, ""},
+		{"stop unknown session ID", http.MethodPost, "/clients/stop?session_id=X", apiKey, http.StatusBadRequest, ""},
+		{"revoke unknown session ID", http.MethodPost, "/clients/revoke_authorizations?session_id=X", apiKey, http.StatusBadRequest, ""},
+		{"get establish", http.MethodGet, "/establish_tunnels", apiKey, http.StatusOK, `{"establish":true}`},
+		{"set establish", http.MethodPost, "/establish_tunnels?establish=false", apiKey, http.StatusOK, `{"establish":false}`},
+		{"get updated establish", http.MethodGet, "/establish_tunnels", apiKey, http.StatusOK, `{"establish":false}`},
+		{"invalid establish", http.MethodPost, "/establish_tunnels?establish=X", apiKey, http.StatusBadRequest, ""},
+		{"establish no key", http.MethodPost, "/establish_tunnels?establish=true", "", http.StatusUnauthorized, ""},
+	}
+
+	for _, testCase := range testCases {
+
+		request := httptest.NewRequest(testCase.method, testCase.path, nil)
+		if testCase.key != "" {
+			request.Header.Set("Authorization", "Bearer "+testCase.key)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != testCase.expectedStatus {
+			t.Fatalf("unexpected status: %s: %d", testCase.description, recorder.Code)
+		}
+
+		if testCase.expectedBody != "" &&
+			strings.TrimSpace(recorder.Body.String()) != testCase.expectedBody {
+
+			t.Fatalf("unexpected body: %s: %s", testCase.description, recorder.Body.String())
+		}
+	}
+
+	if support.TunnelServer.GetEstablishTunnels() {
+		t.Fatalf("unexpected establish tunnels")
+	}
+}
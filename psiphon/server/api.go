@@ -34,6 +34,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 )
 
 const (
@@ -216,6 +217,10 @@ func handshakeAPIRequestHandler(
 
 	httpsRequestRegexes := db.GetHttpsRequestRegexes(sponsorID)
 
+	// The regexes are also used by the server to determine domains for
+	// packet tunnel domain bytes. Any invalid regexes are skipped.
+	domainBytesRegexps, _ := transferstats.MakeRegexps(nil, httpsRequestRegexes)
+
 	// Flag the SSH client as having completed its handshake. This
 	// may reselect traffic rules and starts allowing port forwards.
 
@@ -225,10 +230,11 @@ func handshakeAPIRequestHandler(
 	activeAuthorizationIDs, authorizedAccessTypes, err := support.TunnelServer.SetClientHandshakeState(
 		sessionID,
 		handshakeState{
-			completed:         true,
-			apiProtocol:       apiProtocol,
-			apiParams:         copyBaseRequestParams(params),
-			expectDomainBytes: len(httpsRequestRegexes) > 0,
+			completed:          true,
+			apiProtocol:        apiProtocol,
+			apiParams:          copyBaseRequestParams(params),
+			expectDomainBytes:  len(httpsRequestRegexes) > 0,
+			domainBytesRegexps: domainBytesRegexps,
 		},
 		authorizations)
 	if err != nil {
@@ -270,6 +276,11 @@ func handshakeAPIRequestHandler(
 		}
 	}
 
+	quotas, err := support.TunnelServer.GetClientQuotaStatus(sessionID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
 	// The log comes _after_ SetClientHandshakeState, in case that call rejects
 	// the state change (for example, if a second handshake is performed)
 	//
@@ -295,6 +306,7 @@ func handshakeAPIRequestHandler(
 		ServerTimestamp:        common.GetCurrentTimestamp(),
 		ActiveAuthorizationIDs: activeAuthorizationIDs,
 		TacticsPayload:         marshaledTacticsPayload,
+		Quotas:                 quotas,
 	}
 
 	responsePayload, err := json.Marshal(handshakeResponse)
@@ -459,6 +471,33 @@ func statusAPIRequestHandler(
 		}
 	}
 
+	// Packet tunnel domain bytes transferred stats
+	// These are recorded by the server and logged in the same format as
+	// client-reported domain bytes. The stats are taken only once all
+	// input is validated, as they're reset when taken.
+
+	if domainBytesExpected {
+
+		packetTunnelDomainBytes, err := support.TunnelServer.TakePacketTunnelDomainBytes(sessionID)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		for domain, bytes := range packetTunnelDomainBytes {
+
+			domainBytesFields := getRequestLogFields(
+				"domain_bytes",
+				geoIPData,
+				authorizedAccessTypes,
+				params,
+				statusRequestParams)
+
+			domainBytesFields["domain"] = domain
+			domainBytesFields["bytes"] = bytes
+
+			logQueue = append(logQueue, domainBytesFields)
+		}
+	}
+
 	for _, logItem := range logQueue {
 		log.LogRawFieldsWithTimestamp(logItem)
 	}
@@ -547,9 +586,11 @@ var baseRequestParams = []requestParamSpec{
 	{"meek_transformed_host_name", isBooleanFlag, requestParamOptional},
 	{"user_agent", isAnyString, requestParamOptional},
 	{"tls_profile", isAnyString, requestParamOptional},
+	{"is_replay", isBooleanFlag, requestParamOptional},
 	{"server_entry_region", isRegionCode, requestParamOptional},
 	{"server_entry_source", isServerEntrySource, requestParamOptional},
 	{"server_entry_timestamp", isISO8601Date, requestParamOptional},
+	{"multihop_entry_session_id", isHexDigits, requestParamOptional},
 	{tactics.APPLIED_TACTICS_TAG_PARAMETER_NAME, isAnyString, requestParamOptional},
 }
 
@@ -725,7 +766,7 @@ func getRequestLogFields(
 				// Due to a client bug, clients may deliever an incorrect ""
 				// value for speed_test_samples via the web API protocol. Omit
 				// the field in this case.
-			case "tunnel_whole_device", "meek_transformed_host_name", "connected":
+			case "tunnel_whole_device", "meek_transformed_host_name", "connected", "is_replay":
 				// Submitted value could be "0" or "1"
 				// "0" and non "0"/"1" values should be transformed to false
 				// "1" should be transformed to true
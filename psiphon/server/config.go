@@ -92,9 +92,16 @@ type Config struct {
 	// event logging.
 	HostID string
 
-	// ServerIPAddress is the public IP address of the server.
+	// ServerIPAddress is the public IP address of the server. This may be
+	// an IPv4 or IPv6 address.
 	ServerIPAddress string
 
+	// ServerIPv6Address is an optional, additional public IPv6 address of
+	// the server. When set, tunnel protocol listeners are also bound to
+	// this address, with the same ports as for ServerIPAddress. Marionette
+	// and TapDance listeners are not bound to ServerIPv6Address.
+	ServerIPv6Address string
+
 	// WebServerPort is the listening port of the web server.
 	// When <= 0, no web server component is run.
 	WebServerPort int
@@ -244,10 +251,31 @@ type Config struct {
 	// The default, 0, disables load logging.
 	LoadMonitorPeriodSeconds int
 
+	// MetricsListenAddress specifies a network address ("<host>:<port>") on
+	// which to run a HTTP server that exposes server load, packet tunnel, and
+	// runtime metrics, in the OpenMetrics text format, at the path "/metrics".
+	// The metrics server has no authentication and must not be publicly
+	// reachable. The default, blank, disables the metrics server.
+	MetricsListenAddress string
+
+	// AdminListenAddress specifies a network address ("<host>:<port>") on
+	// which to run a HTTP admin API server, which supports listing and
+	// stopping connected clients, revoking client authorizations, toggling
+	// tunnel establishment, reloading support services, and fetching load
+	// stats. The admin server is not encrypted and should listen only on a
+	// loopback or otherwise private address. The default, blank, disables
+	// the admin server.
+	AdminListenAddress string
+
+	// AdminAPIKey is the secret key which admin API requests must present
+	// in an "Authorization: Bearer <key>" header. AdminAPIKey is required
+	// when AdminListenAddress is set.
+	AdminAPIKey string
+
 	// ProcessProfileOutputDirectory is the path of a directory to which
-	// process profiles will be written when signaled with SIGUSR2. The
+	// process profiles will be written when signaled with SIGHUP. The
 	// files are overwritten on each invocation. When set to the default
-	// value, blank, no profiles are written on SIGUSR2. Profiles include
+	// value, blank, no profiles are written on SIGHUP. Profiles include
 	// the default profiles here: https://golang.org/pkg/runtime/pprof/#Profile.
 	ProcessProfileOutputDirectory string
 
@@ -267,6 +295,16 @@ type Config struct {
 	// OSL Config, the OSL schemes to apply to Psiphon client tunnels.
 	OSLConfigFilename string
 
+	// DomainBlocklistsFilename is the path of a file containing
+	// JSON-encoded domain blocklists; see DomainBlocklists. The traffic
+	// rules select which blocklists apply to each client.
+	DomainBlocklistsFilename string
+
+	// QuotaDatabaseFilename is the path of the database file in which
+	// per-client quota usage is persisted; see TrafficRules.Quotas. When
+	// blank, traffic rules quotas are not enforced.
+	QuotaDatabaseFilename string
+
 	// RunPacketTunnel specifies whether to run a packet tunnel.
 	RunPacketTunnel bool
 
@@ -285,6 +323,26 @@ type Config struct {
 	// tun.ServerConfig.SudoNetworkConfigCommands.
 	PacketTunnelSudoNetworkConfigCommands bool
 
+	// PacketTunnelICMPEchoRequestsPerSecond specifies
+	// tun.ServerConfig.ICMPEchoRequestsPerSecond.
+	PacketTunnelICMPEchoRequestsPerSecond int
+
+	// PacketTunnelUserspaceStack specifies tun.ServerConfig.UserspaceStack.
+	// When set, packet tunnel client flows are relayed through port
+	// forwards, subject to the same limits and accounting as SSH port
+	// forwards, and no tun device or network configuration is required.
+	PacketTunnelUserspaceStack bool
+
+	// HostBandwidthReadBytesPerSecond and HostBandwidthWriteBytesPerSecond
+	// specify server-wide budgets for data transfer with all clients, read
+	// (upstream) and written (downstream) respectively. When a budget is
+	// exceeded, clients share the budget in proportion to their traffic
+	// rules BandwidthWeight. Budgets apply to all client traffic, including
+	// port forwards and packet tunnel flows, in addition to any per-client
+	// traffic rules rate limits. The default, 0, is no budget.
+	HostBandwidthReadBytesPerSecond  int64
+	HostBandwidthWriteBytesPerSecond int64
+
 	// MaxConcurrentSSHHandshakes specifies a limit on the number of concurrent
 	// SSH handshake negotiations. This is set to mitigate spikes in memory
 	// allocations and CPU usage associated with SSH handshakes when many clients
@@ -295,6 +353,15 @@ type Config struct {
 	// The default, 0 is no limit.
 	MaxConcurrentSSHHandshakes int
 
+	// DrainTimeoutSeconds specifies how long the server drains before
+	// stopping, when stopped by SIGTERM or after handing off its listeners
+	// to a new server process on SIGUSR2. While draining, no new tunnels are
+	// established and connected clients are signaled to establish
+	// replacement tunnels to other servers; the server stops once all
+	// clients have disconnected or the timeout is reached. The default, 0,
+	// is to stop immediately, disconnecting all clients.
+	DrainTimeoutSeconds int
+
 	// PeriodicGarbageCollectionSeconds turns on periodic calls to runtime.GC,
 	// every specified number of seconds, to force garbage collection.
 	// The default, 0 is off.
@@ -327,6 +394,16 @@ func (config *Config) RunLoadMonitor() bool {
 	return config.LoadMonitorPeriodSeconds > 0
 }
 
+// RunMetricsServer indicates whether to run a metrics server component.
+func (config *Config) RunMetricsServer() bool {
+	return config.MetricsListenAddress != ""
+}
+
+// RunAdminServer indicates whether to run an admin API server component.
+func (config *Config) RunAdminServer() bool {
+	return config.AdminListenAddress != ""
+}
+
 // RunPeriodicGarbageCollection indicates whether to run periodic garbage collection.
 func (config *Config) RunPeriodicGarbageCollection() bool {
 	return config.PeriodicGarbageCollectionSeconds > 0
@@ -345,6 +422,13 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		return nil, errors.New("ServerIPAddress is required")
 	}
 
+	if config.ServerIPv6Address != "" {
+		IP := net.ParseIP(config.ServerIPv6Address)
+		if IP == nil || IP.To4() != nil {
+			return nil, errors.New("ServerIPv6Address is invalid")
+		}
+	}
+
 	if config.WebServerPort > 0 && (config.WebServerSecret == "" || config.WebServerCertificate == "" ||
 		config.WebServerPrivateKey == "") {
 
@@ -352,6 +436,21 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 			"Web server requires WebServerSecret, WebServerCertificate, WebServerPrivateKey")
 	}
 
+	if config.MetricsListenAddress != "" {
+		if err := validateNetworkAddress(config.MetricsListenAddress, false); err != nil {
+			return nil, errors.New("MetricsListenAddress is invalid")
+		}
+	}
+
+	if config.AdminListenAddress != "" {
+		if err := validateNetworkAddress(config.AdminListenAddress, false); err != nil {
+			return nil, errors.New("AdminListenAddress is invalid")
+		}
+		if config.AdminAPIKey == "" {
+			return nil, errors.New("Admin server requires AdminAPIKey")
+		}
+	}
+
 	if config.WebServerPortForwardAddress != "" {
 		if err := validateNetworkAddress(config.WebServerPortForwardAddress, false); err != nil {
 			return nil, errors.New("WebServerPortForwardAddress is invalid")
@@ -390,19 +489,14 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 					tunnelProtocol)
 			}
 		}
-		if protocol.TunnelProtocolUsesMeekHTTP(tunnelProtocol) ||
-			protocol.TunnelProtocolUsesMeekHTTPS(tunnelProtocol) {
-			if config.MeekCookieEncryptionPrivateKey == "" || config.MeekObfuscatedKey == "" {
-				return nil, fmt.Errorf(
-					"Tunnel protocol %s requires MeekCookieEncryptionPrivateKey, MeekObfuscatedKey",
-					tunnelProtocol)
-			}
+		serverTransport := GetServerTransport(tunnelProtocol)
+		if serverTransport == nil {
+			return nil, fmt.Errorf("Unsupported tunnel protocol: %s", tunnelProtocol)
 		}
-		if protocol.TunnelProtocolUsesMarionette(tunnelProtocol) {
-			if port != 0 {
-				return nil, fmt.Errorf(
-					"Tunnel protocol %s port is specified in format, not TunnelProtocolPorts",
-					tunnelProtocol)
+		if serverTransport.ValidateConfig != nil {
+			err := serverTransport.ValidateConfig(&config, port)
+			if err != nil {
+				return nil, err
 			}
 		}
 	}
@@ -453,6 +547,7 @@ type GenerateConfigParams struct {
 	SkipPanickingLogWriter      bool
 	LogLevel                    string
 	ServerIPAddress             string
+	ServerIPv6Address           string
 	WebServerPort               int
 	EnableSSHAPIRequests        bool
 	TunnelProtocolPorts         map[string]int
@@ -483,6 +578,13 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		return nil, nil, nil, nil, nil, common.ContextError(errors.New("invalid IP address"))
 	}
 
+	if params.ServerIPv6Address != "" {
+		IP := net.ParseIP(params.ServerIPv6Address)
+		if IP == nil || IP.To4() != nil {
+			return nil, nil, nil, nil, nil, common.ContextError(errors.New("invalid IPv6 address"))
+		}
+	}
+
 	if len(params.TunnelProtocolPorts) == 0 {
 		return nil, nil, nil, nil, nil, common.ContextError(errors.New("no tunnel protocols"))
 	}
@@ -626,6 +728,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		GeoIPDatabaseFilenames:         nil,
 		HostID:                         "example-host-id",
 		ServerIPAddress:                params.ServerIPAddress,
+		ServerIPv6Address:              params.ServerIPv6Address,
 		DiscoveryValueHMACKey:          discoveryValueHMACKey,
 		WebServerPort:                  params.WebServerPort,
 		WebServerSecret:                webServerSecret,
@@ -766,6 +869,8 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		meekPort = params.TunnelProtocolPorts["UNFRONTED-MEEK-SESSION-TICKET-OSSH"]
 	}
 
+	webSocketPort := params.TunnelProtocolPorts["UNFRONTED-WEBSOCKET-OSSH"]
+
 	// Note: fronting params are a stub; this server entry will exercise
 	// client and server fronting code paths, but not actually traverse
 	// a fronting hop.
@@ -783,6 +888,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 
 	serverEntry := &protocol.ServerEntry{
 		IpAddress:                     params.ServerIPAddress,
+		IpAddressV6:                   params.ServerIPv6Address,
 		WebServerPort:                 serverEntryWebServerPort,
 		WebServerSecret:               webServerSecret,
 		WebServerCertificate:          strippedWebServerCertificate,
@@ -804,6 +910,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		TacticsRequestPublicKey:       tacticsRequestPublicKey,
 		TacticsRequestObfuscatedKey:   tacticsRequestObfuscatedKey,
 		MarionetteFormat:              params.MarionetteFormat,
+		WebSocketServerPort:           webSocketPort,
 		ConfigurationVersion:          1,
 	}
 
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/wildcard"
+)
+
+// DomainBlocklists is a set of named domain blocklists. The traffic rules
+// for each client select, by name, the blocklists that apply to the
+// client; see TrafficRules.DomainBlocklists. Port forwards to, and packet
+// tunnel DNS queries for, blocked domains are rejected. The Reload
+// function supports hot reloading of blocklists data while the server is
+// running.
+//
+// The blocklists file is a JSON object mapping blocklist names to lists
+// of domain entries. An entry without a '*' wildcard matches the domain
+// and all of its subdomains; e.g., "example.org" matches both
+// "example.org" and "www.example.org". An entry with a '*' wildcard, such
+// as "c2-*.example.org", is matched against the entire domain. Matching
+// is case insensitive.
+type DomainBlocklists struct {
+	common.ReloadableFile
+	blocklists map[string]*domainBlocklist
+}
+
+type domainBlocklist struct {
+	domains  map[string]bool
+	patterns []string
+}
+
+// NewDomainBlocklists initializes a DomainBlocklists with the blocklists
+// data in the specified file. When filename is "", there are no
+// blocklists.
+func NewDomainBlocklists(filename string) (*DomainBlocklists, error) {
+
+	blocklists := &DomainBlocklists{}
+
+	blocklists.ReloadableFile = common.NewReloadableFile(
+		filename,
+		func(fileContent []byte) error {
+
+			var entries map[string][]string
+			err := json.Unmarshal(fileContent, &entries)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			newBlocklists, err := makeDomainBlocklists(entries)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			// Modify actual blocklists only after validation
+			blocklists.blocklists = newBlocklists
+
+			return nil
+		})
+
+	_, err := blocklists.Reload()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return blocklists, nil
+}
+
+func makeDomainBlocklists(
+	entries map[string][]string) (map[string]*domainBlocklist, error) {
+
+	blocklists := make(map[string]*domainBlocklist)
+
+	for name, domains := range entries {
+
+		blocklist := &domainBlocklist{
+			domains: make(map[string]bool),
+		}
+
+		for _, domain := range domains {
+
+			domain = normalizeDomain(domain)
+
+			if domain == "" {
+				return nil, common.ContextError(
+					fmt.Errorf("invalid domain in blocklist: %s", name))
+			}
+
+			if strings.Contains(domain, "*") {
+				blocklist.patterns = append(blocklist.patterns, domain)
+			} else {
+				blocklist.domains[domain] = true
+			}
+		}
+
+		blocklists[name] = blocklist
+	}
+
+	return blocklists, nil
+}
+
+// IsBlocked returns true when the domain is blocked by any of the named
+// blocklists. Unknown blocklist names are ignored.
+func (blocklists *DomainBlocklists) IsBlocked(
+	blocklistNames []string, domain string) bool {
+
+	if len(blocklistNames) == 0 {
+		return false
+	}
+
+	domain = normalizeDomain(domain)
+
+	blocklists.ReloadableFile.RLock()
+	defer blocklists.ReloadableFile.RUnlock()
+
+	for _, name := range blocklistNames {
+
+		blocklist, ok := blocklists.blocklists[name]
+		if !ok {
+			continue
+		}
+
+		// Check the domain and each parent domain.
+
+		parentDomain := domain
+		for {
+			if blocklist.domains[parentDomain] {
+				return true
+			}
+			index := strings.Index(parentDomain, ".")
+			if index == -1 {
+				break
+			}
+			parentDomain = parentDomain[index+1:]
+		}
+
+		for _, pattern := range blocklist.patterns {
+			if wildcard.Match(pattern, domain) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestDomainBlocklists(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-domain-blocklists-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	blocklistsFilename := filepath.Join(testDataDirName, "blocklists.json")
+
+	err = ioutil.WriteFile(
+		blocklistsFilename,
+		[]byte(`
+		{
+		    "malware" : ["c2.example.org", "C2-*.example.com."],
+		    "sponsor" : ["example.net"]
+		}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	blocklists, err := NewDomainBlocklists(blocklistsFilename)
+	if err != nil {
+		t.Fatalf("NewDomainBlocklists failed: %s", err)
+	}
+
+	testCases := []struct {
+		blocklistNames  []string
+		domain          string
+		expectedBlocked bool
+	}{
+		{[]string{"malware"}, "c2.example.org", true},
+		{[]string{"malware"}, "C2.Example.Org.", true},
+		{[]string{"malware"}, "www.c2.example.org", true},
+		{[]string{"malware"}, "example.org", false},
+		{[]string{"malware"}, "notc2.example.org", false},
+		{[]string{"malware"}, "c2-1.example.com", true},
+		{[]string{"malware"}, "c2.example.com", false},
+		{[]string{"malware"}, "example.net", false},
+		{[]string{"sponsor"}, "example.net", true},
+		{[]string{"sponsor"}, "c2.example.org", false},
+		{[]string{"unknown", "sponsor"}, "www.example.net", true},
+		{[]string{}, "c2.example.org", false},
+		{nil, "c2.example.org", false},
+	}
+
+	for _, testCase := range testCases {
+		blocked := blocklists.IsBlocked(testCase.blocklistNames, testCase.domain)
+		if blocked != testCase.expectedBlocked {
+			t.Fatalf("unexpected result for %v, %s: %v",
+				testCase.blocklistNames, testCase.domain, blocked)
+		}
+	}
+
+	// Blocklists are hot reloaded. Invalid blocklists are not loaded.
+
+	err = ioutil.WriteFile(
+		blocklistsFilename,
+		[]byte(`{"malware" : ["example.org"]}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	reloaded, err := blocklists.Reload()
+	if !reloaded || err != nil {
+		t.Fatalf("Reload failed: %v, %v", reloaded, err)
+	}
+
+	if !blocklists.IsBlocked([]string{"malware"}, "www.example.org") ||
+		blocklists.IsBlocked([]string{"malware"}, "c2-1.example.com") ||
+		blocklists.IsBlocked([]string{"sponsor"}, "example.net") {
+		t.Fatalf("unexpected reloaded blocklists")
+	}
+
+	err = ioutil.WriteFile(
+		blocklistsFilename,
+		[]byte(`{"malware" : [""]}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	_, err = blocklists.Reload()
+	if err == nil {
+		t.Fatalf("unexpected Reload success")
+	}
+
+	if !blocklists.IsBlocked([]string{"malware"}, "www.example.org") {
+		t.Fatalf("unexpected blocklists after failed reload")
+	}
+
+	// Without a blocklists file, no domains are blocked.
+
+	blocklists, err = NewDomainBlocklists("")
+	if err != nil {
+		t.Fatalf("NewDomainBlocklists failed: %s", err)
+	}
+
+	if blocklists.IsBlocked([]string{"malware"}, "c2.example.org") {
+		t.Fatalf("unexpected blocked domain")
+	}
+}
+
+func TestDomainBlocklistsTrafficRules(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-domain-blocklists-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	err = ioutil.WriteFile(
+		trafficRulesFilename,
+		[]byte(`
+		{
+		    "DefaultRules" : {
+		        "DomainBlocklists" : ["malware"]
+		    },
+		    "FilteredRules" : [
+		        {
+		            "Filter" : {
+		                "HandshakeParameters" : {
+		                    "sponsor_id" : ["SPONSOR"]
+		                }
+		            },
+		            "Rules" : {
+		                "DomainBlocklists" : ["malware", "sponsor"]
+		            }
+		        },
+		        {
+		            "Filter" : {
+		                "Regions" : ["CA"]
+		            },
+		            "Rules" : {
+		                "DomainBlocklists" : []
+		            }
+		        }
+		    ]
+		}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	trafficRulesSet, err := NewTrafficRulesSet(trafficRulesFilename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	testCases := []struct {
+		region                   string
+		sponsorID                string
+		expectedDomainBlocklists []string
+	}{
+		{"US", "", []string{"malware"}},
+		{"US", "SPONSOR", []string{"malware", "sponsor"}},
+		{"CA", "", []string{}},
+	}
+
+	for _, testCase := range testCases {
+
+		state := handshakeState{
+			completed:   true,
+			apiProtocol: "ssh",
+			apiParams:   common.APIParameters{"sponsor_id": testCase.sponsorID},
+		}
+
+		trafficRules := trafficRulesSet.GetTrafficRules(
+			true, "OSSH", GeoIPData{Country: testCase.region}, state,
+			TrafficRulesConditions{})
+
+		if !reflect.DeepEqual(
+			trafficRules.DomainBlocklists, testCase.expectedDomainBlocklists) {
+
+			t.Fatalf("unexpected DomainBlocklists for %s, %s: %v",
+				testCase.region, testCase.sponsorID, trafficRules.DomainBlocklists)
+		}
+	}
+}
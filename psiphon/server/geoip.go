@@ -38,13 +38,16 @@ const (
 // GeoIPData is GeoIP data for a client session. Individual client
 // IP addresses are neither logged nor explicitly referenced during a session.
 // The GeoIP country, city, and ISP corresponding to a client IP address are
-// resolved and then logged along with usage stats. The DiscoveryValue is
+// resolved and then logged along with usage stats. The TimeZone, an IANA
+// time zone name or "" when unknown, is used for traffic rules time-of-day
+// filtering and is not logged. The DiscoveryValue is
 // a special value derived from the client IP that's used to compartmentalize
 // discoverable servers (see calculateDiscoveryValue for details).
 type GeoIPData struct {
 	Country        string
 	City           string
 	ISP            string
+	TimeZone       string
 	DiscoveryValue int
 }
 
@@ -141,6 +144,9 @@ func (geoIP *GeoIPService) Lookup(ipAddress string) GeoIPData {
 		City struct {
 			Names map[string]string `maxminddb:"names"`
 		} `maxminddb:"city"`
+		Location struct {
+			TimeZone string `maxminddb:"time_zone"`
+		} `maxminddb:"location"`
 		ISP string `maxminddb:"isp"`
 	}
 
@@ -169,6 +175,8 @@ func (geoIP *GeoIPService) Lookup(ipAddress string) GeoIPData {
 		result.ISP = geoIPFields.ISP
 	}
 
+	result.TimeZone = geoIPFields.Location.TimeZone
+
 	result.DiscoveryValue = calculateDiscoveryValue(
 		geoIP.discoveryValueHMACKey, ipAddress)
 
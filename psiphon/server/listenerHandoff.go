@@ -0,0 +1,784 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	LISTENER_HANDOFF_ENVIRONMENT_VARIABLE            = "PSIPHON_SERVER_LISTENER_HANDOFF"
+	LISTENER_HANDOFF_SUPERVISOR_ENVIRONMENT_VARIABLE = "PSIPHON_SERVER_LISTENER_HANDOFF_SUPERVISOR"
+	LISTENER_HANDOFF_READY_TIMEOUT                   = 30 * time.Second
+	LISTENER_HANDOFF_MAX_LISTENERS                   = 256
+
+	LISTENER_HANDOFF_MESSAGE_ATTACH  = "attach"
+	LISTENER_HANDOFF_MESSAGE_READY   = "ready"
+	LISTENER_HANDOFF_MESSAGE_HANDOFF = "handoff"
+	LISTENER_HANDOFF_MESSAGE_RESULT  = "result"
+)
+
+// Listener hand-off enables upgrading or restarting a running server
+// without refusing connections. The running server starts a new server
+// process, which inherits the running server's TCP listening sockets as
+// extra files. The inherited file descriptors, keyed by listening
+// address, and the descriptor of a pipe used to signal readiness, are
+// passed to the new process in an environment variable.
+//
+// The new process uses an inherited socket in place of binding a new
+// listener for the same address; see listenTCPTransport. Once all of its
+// listeners are bound, the new process signals readiness, and the running
+// server stops accepting connections and may then drain its clients.
+//
+// Only TCP listeners are handed off. QUIC, Marionette, and TapDance
+// listeners are not, and will fail to bind in the new process while the
+// running server holds them. Meek tunnels, which span many TCP
+// connections, do not survive the hand-off.
+//
+// When the server process is run by a supervisor, as it is when wrapped by
+// panicwrap, the supervisor performs the hand-off; see
+// RunListenerHandoffSupervisor. The running server sends its listening
+// sockets to the supervisor over a Unix domain socket, and the supervisor
+// starts the new server process, in the same way it started the running
+// server, and passes the sockets to the new process over the same Unix
+// domain socket. The supervisor remains the parent of all server
+// processes, so the supervised PID doesn't change, and the new process is
+// wrapped and receives forwarded signals.
+//
+// Otherwise, the running server starts the new process itself. In this
+// case, a process supervisor must not stop the new process when the
+// original process exits.
+
+type listenerHandoffParameters struct {
+	Listeners map[string]int
+	ReadyFD   int
+}
+
+var inheritedListeners struct {
+	once           sync.Once
+	mutex          sync.Mutex
+	files          map[string]*os.File
+	readyFD        *os.File
+	supervisorConn *net.UnixConn
+}
+
+func loadInheritedListeners() {
+
+	inheritedListeners.once.Do(func() {
+
+		if os.Getenv(LISTENER_HANDOFF_SUPERVISOR_ENVIRONMENT_VARIABLE) != "" {
+			loadSupervisorListeners()
+			return
+		}
+
+		value := os.Getenv(LISTENER_HANDOFF_ENVIRONMENT_VARIABLE)
+		if value == "" {
+			return
+		}
+
+		// Unset the environment variable so that it's not passed on to any
+		// subsequent hand-off process.
+		os.Unsetenv(LISTENER_HANDOFF_ENVIRONMENT_VARIABLE)
+
+		var params listenerHandoffParameters
+		err := json.Unmarshal([]byte(value), &params)
+		if err != nil {
+			log.WithContextFields(
+				LogFields{"error": err}).Warning("invalid listener hand-off parameters")
+			return
+		}
+
+		inheritedListeners.files = make(map[string]*os.File)
+		for localAddress, fd := range params.Listeners {
+			inheritedListeners.files[localAddress] = os.NewFile(
+				uintptr(fd), "listener-"+localAddress)
+		}
+
+		if params.ReadyFD > 0 {
+			inheritedListeners.readyFD = os.NewFile(
+				uintptr(params.ReadyFD), "listener-handoff-ready")
+		}
+	})
+}
+
+// loadSupervisorListeners receives, from the supervisor, any listeners
+// handed off to this process. When there are listeners, the supervisor
+// connection is retained to signal readiness.
+func loadSupervisorListeners() {
+
+	conn, err := dialListenerHandoffSupervisor()
+	if err != nil {
+		log.WithContextFields(
+			LogFields{"error": err}).Warning("dial listener hand-off supervisor failed")
+		return
+	}
+
+	err = writeListenerHandoffMessage(
+		conn,
+		&listenerHandoffMessage{
+			Type: LISTENER_HANDOFF_MESSAGE_ATTACH,
+			PID:  os.Getpid(),
+		},
+		nil)
+	if err != nil {
+		conn.Close()
+		log.WithContextFields(
+			LogFields{"error": err}).Warning("attach to listener hand-off supervisor failed")
+		return
+	}
+
+	message, files, err := readListenerHandoffMessage(conn)
+	if err == nil && len(files) != len(message.Listeners) {
+		closeFiles(files)
+		err = errors.New("unexpected listener count")
+	}
+	if err != nil {
+		conn.Close()
+		log.WithContextFields(
+			LogFields{"error": err}).Warning("attach to listener hand-off supervisor failed")
+		return
+	}
+
+	if len(files) == 0 {
+		conn.Close()
+		return
+	}
+
+	inheritedListeners.files = make(map[string]*os.File)
+	for i, localAddress := range message.Listeners {
+		inheritedListeners.files[localAddress] = files[i]
+	}
+
+	inheritedListeners.supervisorConn = conn
+}
+
+// getInheritedListener returns the listener inherited, in a listener
+// hand-off, for the specified local address. Returns nil when there is no
+// inherited listener for the address. Each inherited listener is returned
+// at most once.
+func getInheritedListener(localAddress string) (net.Listener, error) {
+
+	loadInheritedListeners()
+
+	inheritedListeners.mutex.Lock()
+	defer inheritedListeners.mutex.Unlock()
+
+	file, ok := inheritedListeners.files[localAddress]
+	if !ok {
+		return nil, nil
+	}
+	delete(inheritedListeners.files, localAddress)
+
+	// net.FileListener duplicates the file descriptor, so the inherited
+	// file is closed in all cases.
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("inherited listener")
+
+	return listener, nil
+}
+
+// completeListenerHandoff closes any inherited listeners that were not
+// used, as may happen when the server config has changed, and signals to
+// the process that handed off the listeners that this process is ready.
+// completeListenerHandoff must be called once all listeners are bound.
+func completeListenerHandoff() {
+
+	loadInheritedListeners()
+
+	inheritedListeners.mutex.Lock()
+	defer inheritedListeners.mutex.Unlock()
+
+	for localAddress, file := range inheritedListeners.files {
+		log.WithContextFields(
+			LogFields{"localAddress": localAddress}).Info("unused inherited listener")
+		file.Close()
+	}
+	inheritedListeners.files = nil
+
+	if inheritedListeners.readyFD != nil {
+		_, err := inheritedListeners.readyFD.Write([]byte{0})
+		if err != nil {
+			log.WithContextFields(
+				LogFields{"error": err}).Warning("signal listener hand-off ready failed")
+		}
+		inheritedListeners.readyFD.Close()
+		inheritedListeners.readyFD = nil
+	}
+
+	if inheritedListeners.supervisorConn != nil {
+		err := writeListenerHandoffMessage(
+			inheritedListeners.supervisorConn,
+			&listenerHandoffMessage{Type: LISTENER_HANDOFF_MESSAGE_READY},
+			nil)
+		if err != nil {
+			log.WithContextFields(
+				LogFields{"error": err}).Warning("signal listener hand-off ready failed")
+		}
+		inheritedListeners.supervisorConn.Close()
+		inheritedListeners.supervisorConn = nil
+	}
+}
+
+// startListenerHandoff starts a new server process which inherits the
+// specified listeners, and waits for the new process to signal that it's
+// ready, up to LISTENER_HANDOFF_READY_TIMEOUT. The caller must stop
+// accepting on the listeners only after startListenerHandoff succeeds.
+//
+// When this process is run by a listener hand-off supervisor, the
+// supervisor starts the new process. Otherwise, the new process runs the
+// executable at the path in os.Args[0], rather than os.Executable, so that
+// an upgraded binary installed at the same path is run.
+func startListenerHandoff(listeners map[string]*net.TCPListener) error {
+
+	if len(listeners) == 0 {
+		return common.ContextError(errors.New("no listeners to hand off"))
+	}
+
+	if os.Getenv(LISTENER_HANDOFF_SUPERVISOR_ENVIRONMENT_VARIABLE) != "" {
+		err := requestSupervisorListenerHandoff(listeners)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		return nil
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer readyReader.Close()
+
+	// Extra files are assigned file descriptors 3, 4, ..., in order, in the
+	// new process.
+
+	files := []*os.File{readyWriter}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	params := listenerHandoffParameters{
+		Listeners: make(map[string]int),
+		ReadyFD:   3,
+	}
+
+	for localAddress, listener := range listeners {
+		file, err := listener.File()
+		if err != nil {
+			return common.ContextError(err)
+		}
+		params.Listeners[localAddress] = 3 + len(files)
+		files = append(files, file)
+	}
+
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	var env []string
+	for _, value := range os.Environ() {
+		if !strings.HasPrefix(value, LISTENER_HANDOFF_ENVIRONMENT_VARIABLE+"=") {
+			env = append(env, value)
+		}
+	}
+	env = append(env, LISTENER_HANDOFF_ENVIRONMENT_VARIABLE+"="+string(paramsJSON))
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	err = cmd.Start()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// Close this process's copy of the pipe writer so that the read below
+	// fails if the new process exits without signaling.
+	readyWriter.Close()
+	files = files[1:]
+
+	log.WithContextFields(
+		LogFields{"pid": cmd.Process.Pid}).Info("started listener hand-off process")
+
+	readyErr := make(chan error, 1)
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		readyErr <- err
+	}()
+
+	timer := time.NewTimer(LISTENER_HANDOFF_READY_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case err = <-readyErr:
+	case <-timer.C:
+		err = errors.New("timed out")
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return common.ContextError(err)
+	}
+
+	// Reap the new process in the unlikely case that it exits before this
+	// process.
+	go cmd.Wait()
+
+	return nil
+}
+
+// requestSupervisorListenerHandoff sends the listeners to the supervisor,
+// which starts the new process, and waits for the supervisor to report
+// that the new process is ready, or has failed.
+func requestSupervisorListenerHandoff(listeners map[string]*net.TCPListener) error {
+
+	var localAddresses []string
+	var files []*os.File
+	defer func() {
+		closeFiles(files)
+	}()
+
+	for localAddress, listener := range listeners {
+		file, err := listener.File()
+		if err != nil {
+			return common.ContextError(err)
+		}
+		localAddresses = append(localAddresses, localAddress)
+		files = append(files, file)
+	}
+
+	conn, err := dialListenerHandoffSupervisor()
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer conn.Close()
+
+	err = writeListenerHandoffMessage(
+		conn,
+		&listenerHandoffMessage{
+			Type:      LISTENER_HANDOFF_MESSAGE_HANDOFF,
+			Listeners: localAddresses,
+		},
+		files)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// The supervisor enforces LISTENER_HANDOFF_READY_TIMEOUT; this deadline
+	// is a failsafe.
+	conn.SetReadDeadline(time.Now().Add(2 * LISTENER_HANDOFF_READY_TIMEOUT))
+
+	message, receivedFiles, err := readListenerHandoffMessage(conn)
+	closeFiles(receivedFiles)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if message.Error != "" {
+		return common.ContextError(errors.New(message.Error))
+	}
+
+	return nil
+}
+
+// RunListenerHandoffSupervisor runs a server process, and any new server
+// processes started by listener hand-offs, and returns once all server
+// processes have exited. runProcess must start a server process, which
+// will call RunServices, wait for it to exit, and return its exit status;
+// for example, runProcess may call panicwrap.Wrap. runProcess is called
+// concurrently, once for each server process.
+//
+// The supervisor listens on a Unix domain socket, the path of which is
+// passed to the server processes in an environment variable. A server
+// process that is handing off its listeners sends them to the supervisor,
+// which calls runProcess to start the new server process, sends the
+// listeners to the new process, and reports to the original process once
+// the new process is ready or has failed.
+//
+// The returned exit status is that of the current server process, which is
+// the most recent process to complete a hand-off. Any signals the processes
+// are to receive must be forwarded by runProcess, to the process it runs;
+// the original process, which may still be draining clients, continues to
+// receive signals until it exits.
+func RunListenerHandoffSupervisor(runProcess func() (int, error)) (int, error) {
+
+	dirName, err := ioutil.TempDir("", "psiphon-server-supervisor")
+	if err != nil {
+		return 1, common.ContextError(err)
+	}
+	defer os.RemoveAll(dirName)
+
+	socketName := filepath.Join(dirName, "supervisor.sock")
+
+	listener, err := net.ListenUnix(
+		"unixpacket", &net.UnixAddr{Name: socketName, Net: "unixpacket"})
+	if err != nil {
+		return 1, common.ContextError(err)
+	}
+	defer listener.Close()
+
+	err = os.Setenv(LISTENER_HANDOFF_SUPERVISOR_ENVIRONMENT_VARIABLE, socketName)
+	if err != nil {
+		return 1, common.ContextError(err)
+	}
+	defer os.Unsetenv(LISTENER_HANDOFF_SUPERVISOR_ENVIRONMENT_VARIABLE)
+
+	supervisor := &listenerHandoffSupervisor{
+		runProcess: runProcess,
+		exits:      make(chan listenerHandoffProcessExit),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				return
+			}
+			go supervisor.handleConnection(conn)
+		}
+	}()
+
+	supervisor.mutex.Lock()
+	supervisor.startProcess()
+	supervisor.mutex.Unlock()
+
+	exitStatus := 1
+	var exitErr error
+
+	for {
+		exit := <-supervisor.exits
+
+		supervisor.mutex.Lock()
+		supervisor.running -= 1
+		running := supervisor.running
+		isCurrent := exit.id == supervisor.currentID
+		supervisor.mutex.Unlock()
+
+		if isCurrent {
+			exitStatus, exitErr = exit.exitStatus, exit.err
+		}
+
+		if running == 0 {
+			break
+		}
+	}
+
+	if exitErr != nil {
+		return exitStatus, common.ContextError(exitErr)
+	}
+
+	return exitStatus, nil
+}
+
+// listenerHandoffMessage is a message exchanged between a server process
+// and the listener hand-off supervisor. Listener socket file descriptors,
+// in the same order as Listeners, are sent with the message.
+type listenerHandoffMessage struct {
+	Type      string
+	PID       int      `json:",omitempty"`
+	Listeners []string `json:",omitempty"`
+	Error     string   `json:",omitempty"`
+}
+
+type listenerHandoffSupervisor struct {
+	runProcess func() (int, error)
+	exits      chan listenerHandoffProcessExit
+	mutex      sync.Mutex
+	nextID     int
+	currentID  int
+	running    int
+	pending    *pendingListenerHandoff
+}
+
+type listenerHandoffProcessExit struct {
+	id         int
+	exitStatus int
+	err        error
+}
+
+type pendingListenerHandoff struct {
+	localAddresses []string
+	files          []*os.File
+	attached       bool
+	pid            int
+	ready          chan struct{}
+}
+
+// startProcess calls runProcess in a new goroutine, and returns the process
+// ID, assigned by the supervisor, and a channel that's closed when the
+// process exits. The caller must hold the mutex.
+func (supervisor *listenerHandoffSupervisor) startProcess() (int, chan struct{}) {
+
+	id := supervisor.nextID
+	supervisor.nextID += 1
+	supervisor.running += 1
+
+	exited := make(chan struct{})
+
+	go func() {
+		exitStatus, err := supervisor.runProcess()
+		close(exited)
+		supervisor.exits <- listenerHandoffProcessExit{
+			id:         id,
+			exitStatus: exitStatus,
+			err:        err,
+		}
+	}()
+
+	return id, exited
+}
+
+func (supervisor *listenerHandoffSupervisor) handleConnection(conn *net.UnixConn) {
+
+	defer conn.Close()
+
+	message, files, err := readListenerHandoffMessage(conn)
+	if err != nil {
+		return
+	}
+
+	switch message.Type {
+
+	case LISTENER_HANDOFF_MESSAGE_ATTACH:
+		closeFiles(files)
+		supervisor.handleAttach(conn, message.PID)
+
+	case LISTENER_HANDOFF_MESSAGE_HANDOFF:
+		result := &listenerHandoffMessage{Type: LISTENER_HANDOFF_MESSAGE_RESULT}
+		err := supervisor.handOff(message.Listeners, files)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		_ = writeListenerHandoffMessage(conn, result, nil)
+
+	default:
+		closeFiles(files)
+	}
+}
+
+// handleAttach sends the pending hand-off listeners, if any, to a newly
+// started server process, and waits for the process to signal that it's
+// ready.
+func (supervisor *listenerHandoffSupervisor) handleAttach(conn *net.UnixConn, pid int) {
+
+	supervisor.mutex.Lock()
+
+	// Only the process started for the pending hand-off attaches while the
+	// hand-off is pending.
+
+	pending := supervisor.pending
+	if pending != nil && pending.attached {
+		pending = nil
+	}
+
+	reply := &listenerHandoffMessage{Type: LISTENER_HANDOFF_MESSAGE_ATTACH}
+	var files []*os.File
+	if pending != nil {
+		pending.attached = true
+		pending.pid = pid
+		reply.Listeners = pending.localAddresses
+		files = pending.files
+	}
+
+	// The listener files are sent while holding the mutex, as handOff closes
+	// the files once the hand-off is no longer pending.
+
+	err := writeListenerHandoffMessage(conn, reply, files)
+
+	supervisor.mutex.Unlock()
+
+	if err != nil || pending == nil {
+		return
+	}
+
+	message, receivedFiles, err := readListenerHandoffMessage(conn)
+	closeFiles(receivedFiles)
+	if err == nil && message.Type == LISTENER_HANDOFF_MESSAGE_READY {
+		close(pending.ready)
+	}
+}
+
+// handOff starts a new server process, which receives the listeners, and
+// waits, up to LISTENER_HANDOFF_READY_TIMEOUT, for the new process to
+// signal that it's ready. The new process becomes the current process. On
+// failure, the new process is killed.
+func (supervisor *listenerHandoffSupervisor) handOff(
+	localAddresses []string, files []*os.File) error {
+
+	defer closeFiles(files)
+
+	if len(localAddresses) == 0 || len(localAddresses) != len(files) {
+		return common.ContextError(errors.New("unexpected listener count"))
+	}
+
+	pending := &pendingListenerHandoff{
+		localAddresses: localAddresses,
+		files:          files,
+		ready:          make(chan struct{}),
+	}
+
+	supervisor.mutex.Lock()
+	if supervisor.pending != nil {
+		supervisor.mutex.Unlock()
+		return common.ContextError(errors.New("hand-off in progress"))
+	}
+	supervisor.pending = pending
+	id, exited := supervisor.startProcess()
+	supervisor.mutex.Unlock()
+
+	timer := time.NewTimer(LISTENER_HANDOFF_READY_TIMEOUT)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-pending.ready:
+	case <-exited:
+		err = errors.New("process exited")
+	case <-timer.C:
+		err = errors.New("timed out")
+	}
+
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+
+	supervisor.pending = nil
+
+	if err != nil {
+		if pending.pid > 0 {
+			syscall.Kill(pending.pid, syscall.SIGKILL)
+		}
+		return common.ContextError(err)
+	}
+
+	supervisor.currentID = id
+
+	return nil
+}
+
+func dialListenerHandoffSupervisor() (*net.UnixConn, error) {
+
+	socketName := os.Getenv(LISTENER_HANDOFF_SUPERVISOR_ENVIRONMENT_VARIABLE)
+
+	conn, err := net.DialUnix(
+		"unixpacket", nil, &net.UnixAddr{Name: socketName, Net: "unixpacket"})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return conn, nil
+}
+
+func writeListenerHandoffMessage(
+	conn *net.UnixConn, message *listenerHandoffMessage, files []*os.File) error {
+
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	var oob []byte
+	if len(files) > 0 {
+		fds := make([]int, len(files))
+		for i, file := range files {
+			fds[i] = int(file.Fd())
+		}
+		oob = syscall.UnixRights(fds...)
+	}
+
+	_, _, err = conn.WriteMsgUnix(messageJSON, oob, nil)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// readListenerHandoffMessage reads a message and any file descriptors sent
+// with it. The caller must close the returned files.
+func readListenerHandoffMessage(
+	conn *net.UnixConn) (*listenerHandoffMessage, []*os.File, error) {
+
+	buffer := make([]byte, 65536)
+	oob := make([]byte, syscall.CmsgSpace(4*LISTENER_HANDOFF_MAX_LISTENERS))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buffer, oob)
+	if err != nil {
+		return nil, nil, common.ContextError(err)
+	}
+
+	var files []*os.File
+
+	if oobn > 0 {
+		controlMessages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+		for i := range controlMessages {
+			fds, err := syscall.ParseUnixRights(&controlMessages[i])
+			if err != nil {
+				closeFiles(files)
+				return nil, nil, common.ContextError(err)
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), "listener-handoff"))
+			}
+		}
+	}
+
+	var message listenerHandoffMessage
+	err = json.Unmarshal(buffer[:n], &message)
+	if err != nil {
+		closeFiles(files)
+		return nil, nil, common.ContextError(
+			fmt.Errorf("invalid listener hand-off message: %s", err))
+	}
+
+	return &message, files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/panicwrap"
+)
+
+func TestListenerHandoff(t *testing.T) {
+
+	// Simulate the state of a new server process after a listener hand-off:
+	// listener and ready pipe file descriptors are open, and the hand-off
+	// parameters are in the environment.
+
+	dupListenerFD := func() (string, int) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %s", err)
+		}
+		defer listener.Close()
+		file, err := listener.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatalf("File failed: %s", err)
+		}
+		defer file.Close()
+		fd, err := syscall.Dup(int(file.Fd()))
+		if err != nil {
+			t.Fatalf("Dup failed: %s", err)
+		}
+		return listener.Addr().String(), fd
+	}
+
+	localAddress, listenerFD := dupListenerFD()
+	unusedLocalAddress, unusedListenerFD := dupListenerFD()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %s", err)
+	}
+	defer readyReader.Close()
+	readyFD, err := syscall.Dup(int(readyWriter.Fd()))
+	if err != nil {
+		t.Fatalf("Dup failed: %s", err)
+	}
+	readyWriter.Close()
+
+	paramsJSON, err := json.Marshal(
+		listenerHandoffParameters{
+			Listeners: map[string]int{
+				localAddress:       listenerFD,
+				unusedLocalAddress: unusedListenerFD,
+			},
+			ReadyFD: readyFD,
+		})
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	os.Setenv(LISTENER_HANDOFF_ENVIRONMENT_VARIABLE, string(paramsJSON))
+
+	host, portStr, _ := net.SplitHostPort(localAddress)
+	port, _ := strconv.Atoi(portStr)
+
+	// The inherited listener is used in place of binding a new listener.
+
+	listener, err := listenTCPTransport(nil, host, port)
+	if err != nil {
+		t.Fatalf("listenTCPTransport failed: %s", err)
+	}
+	defer listener.Close()
+
+	if listener.Addr().String() != localAddress {
+		t.Fatalf("unexpected listener address: %s", listener.Addr().String())
+	}
+
+	// The inherited listener is used only once, so binding the same address
+	// again fails.
+
+	_, err = listenTCPTransport(nil, host, port)
+	if err == nil {
+		t.Fatalf("unexpected listenTCPTransport success")
+	}
+
+	if os.Getenv(LISTENER_HANDOFF_ENVIRONMENT_VARIABLE) != "" {
+		t.Fatalf("unexpected listener hand-off environment variable")
+	}
+
+	completeListenerHandoff()
+
+	readyReader.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, err = readyReader.Read(make([]byte, 1))
+	if err != nil {
+		t.Fatalf("Read ready failed: %s", err)
+	}
+
+	// The inherited listener accepts connections, and the unused inherited
+	// listener is closed.
+
+	conn, err := net.Dial("tcp", localAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	conn.Close()
+
+	conn, err = net.Dial("tcp", unusedLocalAddress)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("unexpected Dial success")
+	}
+}
+
+const listenerHandoffTestAddressEnvironmentVariable = "PSIPHON_SERVER_LISTENER_HANDOFF_TEST_ADDRESS"
+
+func TestListenerHandoffSupervisor(t *testing.T) {
+
+	// Run a test server under panicwrap, in the same way Server/main.go runs
+	// the server: the test binary is run as the supervisor process, which
+	// runs the test server in panicwrap child processes; see
+	// runListenerHandoffTestProcess. The test server reports its PID, and
+	// whether it's wrapped, to each client.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	localAddress := listener.Addr().String()
+	listener.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenerHandoffSupervisor$")
+	cmd.Env = append(
+		os.Environ(), listenerHandoffTestAddressEnvironmentVariable+"="+localAddress)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	getServerProcess := func(excludePID string) (string, error) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			conn, err := net.Dial("tcp", localAddress)
+			if err == nil {
+				conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+				var line string
+				line, err = bufio.NewReader(conn).ReadString('\n')
+				conn.Close()
+				if err == nil {
+					fields := strings.Fields(line)
+					if len(fields) != 2 || fields[1] != "true" {
+						return "", fmt.Errorf("unexpected server process: %s", line)
+					}
+					if fields[0] != excludePID {
+						return fields[0], nil
+					}
+				}
+			}
+			if time.Now().After(deadline) {
+				return "", fmt.Errorf("no server process: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	originalPID, err := getServerProcess("")
+	if err != nil {
+		t.Fatalf("getServerProcess failed: %s", err)
+	}
+
+	// The hand-off signal is sent to the supervisor, and forwarded to the
+	// server process. The new server process is a wrapped child of the
+	// supervisor.
+
+	cmd.Process.Signal(syscall.SIGUSR2)
+
+	_, err = getServerProcess(originalPID)
+	if err != nil {
+		t.Fatalf("getServerProcess failed: %s", err)
+	}
+
+	// The supervisor forwards the stop signal to the new server process,
+	// and exits, with the exit status of the new server process, once it
+	// exits.
+
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-waitErr:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("supervisor did not exit")
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.Sys().(syscall.WaitStatus).ExitStatus() != 3 {
+		t.Fatalf("unexpected supervisor exit: %v", err)
+	}
+}
+
+// runListenerHandoffTestProcess runs the listener hand-off supervisor, or,
+// in a panicwrap child process, a test server which hands off its listener
+// on SIGUSR2 and exits with status 3 on SIGTERM.
+func runListenerHandoffTestProcess(localAddress string) {
+
+	newWrapConfig := func() *panicwrap.WrapConfig {
+		return &panicwrap.WrapConfig{
+			Handler:        func(string) {},
+			ForwardSignals: []os.Signal{syscall.SIGTERM, syscall.SIGUSR2},
+		}
+	}
+
+	if !panicwrap.Wrapped(newWrapConfig()) {
+		exitStatus, err := RunListenerHandoffSupervisor(
+			func() (int, error) {
+				return panicwrap.Wrap(newWrapConfig())
+			})
+		if err != nil {
+			fmt.Printf("RunListenerHandoffSupervisor failed: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(exitStatus)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGUSR2)
+
+	host, portStr, _ := net.SplitHostPort(localAddress)
+	port, _ := strconv.Atoi(portStr)
+
+	listener, err := listenTCPTransport(nil, host, port)
+	if err != nil {
+		fmt.Printf("listenTCPTransport failed: %s\n", err)
+		os.Exit(1)
+	}
+
+	completeListenerHandoff()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "%d %t\n", os.Getpid(), panicwrap.Wrapped(nil))
+			conn.Close()
+		}
+	}()
+
+	for {
+		switch <-signals {
+		case syscall.SIGUSR2:
+			err := startListenerHandoff(
+				map[string]*net.TCPListener{localAddress: listener.(*net.TCPListener)})
+			if err != nil {
+				fmt.Printf("startListenerHandoff failed: %s\n", err)
+				os.Exit(1)
+			}
+			listener.Close()
+			os.Exit(0)
+		case syscall.SIGTERM:
+			os.Exit(3)
+		}
+	}
+}
@@ -157,6 +157,13 @@ func NewMeekServer(
 	return meekServer, nil
 }
 
+// getSessionCount returns the number of current meek sessions.
+func (server *MeekServer) getSessionCount() int {
+	server.sessionsLock.RLock()
+	defer server.sessionsLock.RUnlock()
+	return len(server.sessions)
+}
+
 // Run runs the meek server; this function blocks while serving HTTP or
 // HTTPS connections on the specified listener. This function also runs
 // a goroutine which cleans up expired meek client sessions.
@@ -0,0 +1,350 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	METRICS_NAME_PREFIX  = "psiphond_"
+	METRICS_CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// RunMetricsServer runs a HTTP server which exposes server metrics, in the
+// OpenMetrics text format, for scraping by monitoring systems such as
+// Prometheus. The metrics include the same load stats and runtime metrics
+// that are periodically logged in "server_load" events, meek session
+// counts, SSH handshake concurrency, and packet tunnel packet metrics.
+//
+// Load stats are gauges. Port forward quality metrics, such as
+// "tcp_port_forward_dialed_count", and packet tunnel metrics are counters
+// which are never reset. The quality metrics in the load stats, which are
+// reset on each "server_load" log, are not exported.
+//
+// RunMetricsServer blocks until shutdownBroadcast is signalled or an error
+// occurs.
+func RunMetricsServer(
+	support *SupportServices,
+	shutdownBroadcast <-chan struct{}) error {
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+		w.Write(getMetrics(support))
+	})
+
+	server := &http.Server{
+		Handler:      serveMux,
+		ReadTimeout:  WEB_SERVER_IO_TIMEOUT,
+		WriteTimeout: WEB_SERVER_IO_TIMEOUT,
+	}
+
+	localAddress := support.Config.MetricsListenAddress
+
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("starting metrics server")
+
+	errors := make(chan error)
+	waitGroup := new(sync.WaitGroup)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		// Note: will be interrupted by listener.Close()
+		err := server.Serve(listener)
+
+		select {
+		case <-shutdownBroadcast:
+		default:
+			if err != nil {
+				select {
+				case errors <- common.ContextError(err):
+				default:
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-shutdownBroadcast:
+	case err = <-errors:
+	}
+
+	listener.Close()
+
+	waitGroup.Wait()
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("stopped metrics server")
+
+	return err
+}
+
+// getMetrics returns a complete OpenMetrics text format exposition of the
+// current server metrics.
+func getMetrics(support *SupportServices) []byte {
+
+	metrics := new(metricsWriter)
+
+	tunnelServer := support.TunnelServer
+
+	if tunnelServer != nil {
+
+		establishTunnels := 0
+		if tunnelServer.GetEstablishTunnels() {
+			establishTunnels = 1
+		}
+		metrics.writeFamily(
+			"establish_tunnels", "gauge",
+			"Whether the server is establishing new tunnels.")
+		metrics.writeSample("establish_tunnels", nil, establishTunnels)
+
+		protocolStats, regionStats := tunnelServer.PeekLoadStats()
+		qualityProtocolStats, qualityRegionStats := tunnelServer.GetQualityMetricsTotals()
+		removeStats(protocolStats, regionStats, qualityProtocolStats["ALL"])
+		metrics.writeLoadStats(protocolStats, regionStats)
+		metrics.writeQualityMetricsTotals(qualityProtocolStats, qualityRegionStats)
+
+		metrics.writeFamily(
+			"meek_sessions", "gauge",
+			"Number of current meek sessions.")
+		meekSessionCounts := tunnelServer.GetMeekSessionCounts()
+		for _, tunnelProtocol := range sortedKeys(meekSessionCounts) {
+			metrics.writeSample(
+				"meek_sessions",
+				[]string{"protocol", tunnelProtocol},
+				meekSessionCounts[tunnelProtocol])
+		}
+
+		SSHHandshakeCount, SSHHandshakeLimit := tunnelServer.GetSSHHandshakeStats()
+		if SSHHandshakeLimit > 0 {
+			metrics.writeFamily(
+				"concurrent_ssh_handshakes", "gauge",
+				"Number of SSH handshakes in progress.")
+			metrics.writeSample("concurrent_ssh_handshakes", nil, SSHHandshakeCount)
+			metrics.writeFamily(
+				"max_concurrent_ssh_handshakes", "gauge",
+				"MaxConcurrentSSHHandshakes limit.")
+			metrics.writeSample("max_concurrent_ssh_handshakes", nil, SSHHandshakeLimit)
+		}
+	}
+
+	if support.PacketTunnelServer != nil {
+		packetMetrics := support.PacketTunnelServer.GetMetrics()
+		for _, name := range sortedKeys(packetMetrics) {
+			metricName := "packet_tunnel_" + name
+			metrics.writeFamily(
+				metricName, "counter",
+				"Packet tunnel "+strings.Replace(name, "_", " ", -1)+".")
+			metrics.writeSample(metricName+"_total", nil, packetMetrics[name])
+		}
+	}
+
+	runtimeMetrics := getRuntimeMetrics()
+	for _, name := range sortedKeys(runtimeMetrics) {
+		value := runtimeMetrics[name]
+		if _, ok := value.(string); ok {
+			// Omit non-numeric values, such as the "last_gc" timestamp.
+			continue
+		}
+		metricName := "runtime_" + name
+		metrics.writeFamily(
+			metricName, "gauge",
+			"Go runtime "+strings.Replace(name, "_", " ", -1)+".")
+		metrics.writeSample(metricName, nil, value)
+	}
+
+	metrics.buffer.WriteString("# EOF\n")
+
+	return metrics.buffer.Bytes()
+}
+
+// metricsWriter writes metric families and samples in the OpenMetrics text
+// format. Each metric family must be written, with all of its samples,
+// before the next family.
+type metricsWriter struct {
+	buffer bytes.Buffer
+}
+
+func (metrics *metricsWriter) writeFamily(name, metricType, help string) {
+	fmt.Fprintf(&metrics.buffer, "# TYPE %s%s %s\n", METRICS_NAME_PREFIX, name, metricType)
+	fmt.Fprintf(&metrics.buffer, "# HELP %s%s %s\n", METRICS_NAME_PREFIX, name, help)
+}
+
+// writeSample writes a single metric sample. labels is a list of label
+// name and value pairs.
+func (metrics *metricsWriter) writeSample(name string, labels []string, value interface{}) {
+
+	metrics.buffer.WriteString(METRICS_NAME_PREFIX)
+	metrics.buffer.WriteString(name)
+
+	if len(labels) > 0 {
+		metrics.buffer.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				metrics.buffer.WriteString(",")
+			}
+			fmt.Fprintf(&metrics.buffer, "%s=\"%s\"", labels[i], escapeMetricsLabelValue(labels[i+1]))
+		}
+		metrics.buffer.WriteString("}")
+	}
+
+	fmt.Fprintf(&metrics.buffer, " %v\n", value)
+}
+
+// writeLoadStats writes each load stat as a gauge metric family, with one
+// sample per tunnel protocol, including "ALL"; and a corresponding "region_"
+// metric family, with one sample per region and tunnel protocol.
+func (metrics *metricsWriter) writeLoadStats(
+	protocolStats ProtocolStats, regionStats RegionStats) {
+
+	metrics.writeStats("gauge", "Load stat", protocolStats, regionStats)
+}
+
+// writeQualityMetricsTotals writes the port forward quality metrics totals
+// as counter metric families, in the same form as writeLoadStats.
+func (metrics *metricsWriter) writeQualityMetricsTotals(
+	protocolStats ProtocolStats, regionStats RegionStats) {
+
+	metrics.writeStats("counter", "Total", protocolStats, regionStats)
+}
+
+func (metrics *metricsWriter) writeStats(
+	metricType, helpPrefix string,
+	protocolStats ProtocolStats, regionStats RegionStats) {
+
+	// OpenMetrics counter sample names have a "_total" suffix.
+	sampleSuffix := ""
+	if metricType == "counter" {
+		sampleSuffix = "_total"
+	}
+
+	statNames := make(map[string]bool)
+	for _, stats := range protocolStats {
+		for name := range stats {
+			statNames[name] = true
+		}
+	}
+
+	for _, name := range sortedKeys(statNames) {
+
+		metrics.writeFamily(
+			name, metricType,
+			helpPrefix+" "+name+", by tunnel protocol.")
+
+		for _, tunnelProtocol := range sortedKeys(protocolStats) {
+			metrics.writeSample(
+				name+sampleSuffix,
+				[]string{"protocol", tunnelProtocol},
+				protocolStats[tunnelProtocol][name])
+		}
+
+		regionName := "region_" + name
+
+		metrics.writeFamily(
+			regionName, metricType,
+			helpPrefix+" "+name+", by client region and tunnel protocol.")
+
+		for _, region := range sortedKeys(regionStats) {
+			for _, tunnelProtocol := range sortedKeys(regionStats[region]) {
+				metrics.writeSample(
+					regionName+sampleSuffix,
+					[]string{"region", region, "protocol", tunnelProtocol},
+					regionStats[region][tunnelProtocol][name])
+			}
+		}
+	}
+}
+
+// removeStats deletes the named stats from the protocol and region stats.
+func removeStats(
+	protocolStats ProtocolStats, regionStats RegionStats, names map[string]int64) {
+
+	for name := range names {
+		for _, stats := range protocolStats {
+			delete(stats, name)
+		}
+		for _, regionProtocolStats := range regionStats {
+			for _, stats := range regionProtocolStats {
+				delete(stats, name)
+			}
+		}
+	}
+}
+
+func escapeMetricsLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return value
+}
+
+// sortedKeys returns the sorted keys of a map with string keys. Metrics
+// samples are emitted in a stable order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]bool:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]int64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case common.LogFields:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case LogFields:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case ProtocolStats:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]map[string]int64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case RegionStats:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriter(t *testing.T) {
+
+	metrics := new(metricsWriter)
+
+	protocolStats := ProtocolStats{
+		"ALL":                 {"accepted_clients": 2},
+		"OSSH":                {"accepted_clients": 2},
+		"UNFRONTED-MEEK-OSSH": {"accepted_clients": 0},
+	}
+	regionStats := RegionStats{
+		"US": {
+			"ALL":  {"accepted_clients": 1},
+			"OSSH": {"accepted_clients": 1},
+		},
+		"C\"A": {
+			"ALL":  {"accepted_clients": 1},
+			"OSSH": {"accepted_clients": 1},
+		},
+	}
+
+	metrics.writeLoadStats(protocolStats, regionStats)
+
+	expected := `# TYPE psiphond_accepted_clients gauge
+# HELP psiphond_accepted_clients Load stat accepted_clients, by tunnel protocol.
+psiphond_accepted_clients{protocol="ALL"} 2
+psiphond_accepted_clients{protocol="OSSH"} 2
+psiphond_accepted_clients{protocol="UNFRONTED-MEEK-OSSH"} 0
+# TYPE psiphond_region_accepted_clients gauge
+# HELP psiphond_region_accepted_clients Load stat accepted_clients, by client region and tunnel protocol.
+psiphond_region_accepted_clients{region="C\"A",protocol="ALL"} 1
+psiphond_region_accepted_clients{region="C\"A",protocol="OSSH"} 1
+psiphond_region_accepted_clients{region="US",protocol="ALL"} 1
+psiphond_region_accepted_clients{region="US",protocol="OSSH"} 1
+`
+
+	if metrics.buffer.String() != expected {
+		t.Fatalf("unexpected load stats metrics:\n%s", metrics.buffer.String())
+	}
+}
+
+func TestGetMetrics(t *testing.T) {
+
+	output := string(getMetrics(&SupportServices{Config: &Config{}}))
+
+	if !strings.HasSuffix(output, "\n# EOF\n") {
+		t.Fatalf("missing EOF marker")
+	}
+
+	if !strings.Contains(output, "\npsiphond_runtime_num_goroutine ") {
+		t.Fatalf("missing runtime metrics")
+	}
+
+	if strings.Contains(output, "last_gc") {
+		t.Fatalf("unexpected non-numeric metric")
+	}
+}
+
+func TestQualityMetricsTotals(t *testing.T) {
+
+	sshServer := &sshServer{
+		support: &SupportServices{
+			Config: &Config{
+				TunnelProtocolPorts: map[string]int{"OSSH": 22},
+			},
+		},
+		acceptedClientCounts: make(map[string]map[string]int64),
+		clients:              make(map[string]*sshClient),
+		qualityMetricsTotals: make(map[string]map[string]*qualityMetrics),
+	}
+
+	client := &sshClient{
+		sshServer:      sshServer,
+		tunnelProtocol: "OSSH",
+		geoIPData:      GeoIPData{Country: "US"},
+	}
+	sshServer.clients["1"] = client
+
+	client.updateQualityMetricsWithDialResult(true, 100*time.Millisecond)
+	client.updateQualityMetricsWithDialResult(false, 200*time.Millisecond)
+	client.updateQualityMetricsWithRejectedDialingLimit()
+
+	// The totals are not reset by "server_load" logging, and include
+	// disconnected clients.
+
+	protocolStats, _ := sshServer.getLoadStats(true)
+	if protocolStats["ALL"]["tcp_port_forward_dialed_count"] != 1 {
+		t.Fatalf("unexpected load stats: %+v", protocolStats["ALL"])
+	}
+
+	protocolStats, _ = sshServer.getLoadStats(true)
+	if protocolStats["ALL"]["tcp_port_forward_dialed_count"] != 0 {
+		t.Fatalf("unexpected load stats: %+v", protocolStats["ALL"])
+	}
+
+	delete(sshServer.clients, "1")
+
+	client.updateQualityMetricsWithDialResult(true, 100*time.Millisecond)
+
+	protocolStats, regionStats := sshServer.getQualityMetricsTotals()
+
+	expectedStats := map[string]int64{
+		"tcp_port_forward_dialed_count":                 2,
+		"tcp_port_forward_dialed_duration":              200,
+		"tcp_port_forward_failed_count":                 1,
+		"tcp_port_forward_failed_duration":              200,
+		"tcp_port_forward_rejected_dialing_limit_count": 1,
+	}
+
+	for _, stats := range []map[string]int64{
+		protocolStats["ALL"],
+		protocolStats["OSSH"],
+		regionStats["US"]["ALL"],
+		regionStats["US"]["OSSH"]} {
+
+		if !reflect.DeepEqual(stats, expectedStats) {
+			t.Fatalf("unexpected quality metrics totals: %+v", stats)
+		}
+	}
+
+	metrics := new(metricsWriter)
+	metrics.writeQualityMetricsTotals(protocolStats, regionStats)
+	output := metrics.buffer.String()
+
+	if !strings.Contains(output,
+		"# TYPE psiphond_tcp_port_forward_dialed_count counter\n") ||
+		!strings.Contains(output,
+			"\npsiphond_tcp_port_forward_dialed_count_total{protocol=\"ALL\"} 2\n") ||
+		!strings.Contains(output,
+			"\npsiphond_region_tcp_port_forward_dialed_count_total{region=\"US\",protocol=\"OSSH\"} 2\n") {
+
+		t.Fatalf("unexpected quality metrics totals metrics:\n%s", output)
+	}
+}
@@ -29,6 +29,8 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -47,6 +49,8 @@ type Database struct {
 	Sponsors         map[string]Sponsor         `json:"sponsors"`
 	Versions         map[string][]ClientVersion `json:"client_versions"`
 	DefaultSponsorID string                     `json:"default_sponsor_id"`
+
+	serverIPAddresses map[string]bool
 }
 
 type Host struct {
@@ -71,9 +75,11 @@ type Server struct {
 	Id                          string          `json:"id"`
 	InternalIpAddress           string          `json:"internal_ip_address"`
 	IpAddress                   string          `json:"ip_address"`
+	IpAddressV6                 string          `json:"ipv6_address"`
 	IsEmbedded                  bool            `json:"is_embedded"`
 	IsPermanent                 bool            `json:"is_permanent"`
 	PropogationChannelId        string          `json:"propagation_channel_id"`
+	Signature                   string          `json:"signature"`
 	SshHostKey                  string          `json:"ssh_host_key"`
 	SshObfuscatedKey            string          `json:"ssh_obfuscated_key"`
 	SshObfuscatedPort           int             `json:"ssh_obfuscated_port"`
@@ -144,6 +150,16 @@ func NewDatabase(filename string) (*Database, error) {
 			database.Versions = newDatabase.Versions
 			database.DefaultSponsorID = newDatabase.DefaultSponsorID
 
+			database.serverIPAddresses = make(map[string]bool)
+			for _, server := range database.Servers {
+				for _, IPAddress := range []string{server.IpAddress, server.IpAddressV6} {
+					IP := net.ParseIP(IPAddress)
+					if IP != nil {
+						database.serverIPAddresses[IP.String()] = true
+					}
+				}
+			}
+
 			return nil
 		})
 
@@ -155,6 +171,15 @@ func NewDatabase(filename string) (*Database, error) {
 	return database, nil
 }
 
+// IsServerIPAddress indicates whether the IP address is the IPv4 or IPv6
+// address of a server in the database.
+func (db *Database) IsServerIPAddress(IP net.IP) bool {
+	db.ReloadableFile.RLock()
+	defer db.ReloadableFile.RUnlock()
+
+	return db.serverIPAddresses[IP.String()]
+}
+
 // GetRandomizedHomepages returns a randomly ordered list of home pages
 // for the specified sponsor, region, and platform.
 func (db *Database) GetRandomizedHomepages(sponsorID, clientRegion string, isMobilePlatform bool) []string {
@@ -442,6 +467,7 @@ func (db *Database) getEncodedServerEntry(server Server) string {
 	// Extended (new) entry fields are in a JSON string
 	var extendedConfig struct {
 		IpAddress                     string   `json:"ipAddress"`
+		IpAddressV6                   string   `json:"ipAddressV6"`
 		WebServerPort                 string   `json:"webServerPort"` // not an int
 		WebServerSecret               string   `json:"webServerSecret"`
 		WebServerCertificate          string   `json:"webServerCertificate"`
@@ -459,10 +485,12 @@ func (db *Database) getEncodedServerEntry(server Server) string {
 		TacticsRequestPublicKey       string   `json:"tacticsRequestPublicKey"`
 		TacticsRequestObfuscatedKey   string   `json:"tacticsRequestObfuscatedKey"`
 		ConfigurationVersion          int      `json:"configurationVersion"`
+		Signature                     string   `json:"signature,omitempty"`
 	}
 
 	// NOTE: also putting original values in extended config for easier parsing by new clients
 	extendedConfig.IpAddress = server.IpAddress
+	extendedConfig.IpAddressV6 = server.IpAddressV6
 	extendedConfig.WebServerPort = server.WebServerPort
 	extendedConfig.WebServerSecret = server.WebServerSecret
 	extendedConfig.WebServerCertificate = webServerCertificate
@@ -518,8 +546,18 @@ func (db *Database) getEncodedServerEntry(server Server) string {
 		}
 	}
 
+	// The capabilities are sorted so that the encoded server entry is
+	// deterministic, as required for the offline signature to verify.
+	sort.Strings(extendedConfig.Capabilities)
+
 	extendedConfig.ConfigurationVersion = server.ConfigurationVersion
 
+	// The server entry signature is generated offline, over the server
+	// entry as encoded here, and stored in the database. The signing key is
+	// never distributed to servers, so a compromised server cannot sign
+	// server entries. See protocol.ServerEntryFields.AddSignature.
+	extendedConfig.Signature = server.Signature
+
 	jsonDump, err := json.Marshal(extendedConfig)
 	if err != nil {
 		return ""
@@ -21,8 +21,15 @@ package psinet
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 )
 
 func TestDiscoveryBuckets(t *testing.T) {
@@ -133,3 +140,154 @@ func TestDiscoveryBuckets(t *testing.T) {
 	})
 
 }
+
+func TestEncodedServerEntryIPv6Address(t *testing.T) {
+
+	db := &Database{
+		Hosts: map[string]Host{
+			"1": {Id: "1", Region: "CA"},
+		},
+	}
+
+	server := Server{
+		HostId:               "1",
+		IpAddress:            "192.0.2.1",
+		IpAddressV6:          "2001:db8::1",
+		WebServerPort:        "8000",
+		WebServerSecret:      "<webServerSecret>",
+		WebServerCertificate: "<webServerCertificate>",
+		SshPort:              "22",
+	}
+
+	encodedServerEntry := db.getEncodedServerEntry(server)
+	if encodedServerEntry == "" {
+		t.Fatalf("getEncodedServerEntry failed")
+	}
+
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		encodedServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+
+	err = protocol.ValidateServerEntryFields(serverEntryFields)
+	if err != nil {
+		t.Fatalf("ValidateServerEntryFields failed: %s", err)
+	}
+
+	if serverEntryFields.GetIPAddress() != server.IpAddress ||
+		serverEntryFields.GetIPv6Address() != server.IpAddressV6 {
+
+		t.Fatalf("unexpected server entry IP addresses: %s %s",
+			serverEntryFields.GetIPAddress(), serverEntryFields.GetIPv6Address())
+	}
+}
+
+func TestSignedEncodedServerEntry(t *testing.T) {
+
+	// The signing key pair is generated and used offline; only the
+	// resulting signature is stored in the database.
+
+	publicKey, privateKey, err := protocol.NewServerEntrySignatureKeyPair()
+	if err != nil {
+		t.Fatalf("NewServerEntrySignatureKeyPair failed: %s", err)
+	}
+
+	db := &Database{
+		Hosts: map[string]Host{
+			"1": {Id: "1", Region: "CA", MeekServerPort: 443},
+		},
+	}
+
+	server := Server{
+		HostId:               "1",
+		IpAddress:            "192.0.2.1",
+		WebServerPort:        "8000",
+		WebServerSecret:      "<webServerSecret>",
+		WebServerCertificate: "<webServerCertificate>",
+		SshPort:              "22",
+		Capabilities:         map[string]bool{"OSSH": true, "SSH": true, "UNFRONTED-MEEK": true, "handshake": true},
+		ConfigurationVersion: 1,
+	}
+
+	decodeServerEntry := func() protocol.ServerEntryFields {
+		encodedServerEntry := db.getEncodedServerEntry(server)
+		if encodedServerEntry == "" {
+			t.Fatalf("getEncodedServerEntry failed")
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_DISCOVERY)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		return serverEntryFields
+	}
+
+	serverEntryFields := decodeServerEntry()
+
+	err = serverEntryFields.VerifySignature(publicKey)
+	if err == nil {
+		t.Fatalf("unexpected VerifySignature success")
+	}
+
+	err = serverEntryFields.AddSignature(publicKey, privateKey)
+	if err != nil {
+		t.Fatalf("AddSignature failed: %s", err)
+	}
+
+	server.Signature = serverEntryFields["signature"].(string)
+
+	// Each encoding, with map-ordered capabilities, must verify.
+
+	for i := 0; i < 10; i++ {
+		err = decodeServerEntry().VerifySignature(publicKey)
+		if err != nil {
+			t.Fatalf("VerifySignature failed: %s", err)
+		}
+	}
+
+	db.Hosts["1"] = Host{Id: "1", Region: "US", MeekServerPort: 443}
+
+	err = decodeServerEntry().VerifySignature(publicKey)
+	if err == nil {
+		t.Fatalf("unexpected VerifySignature success")
+	}
+}
+
+func TestIsServerIPAddress(t *testing.T) {
+
+	testDirectory, err := ioutil.TempDir("", "psinet-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDirectory)
+
+	filename := filepath.Join(testDirectory, "psinet.json")
+
+	err = ioutil.WriteFile(
+		filename,
+		[]byte(`{"servers": [{"ip_address": "192.0.2.1", "ipv6_address": "2001:db8::1"}]}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	db, err := NewDatabase(filename)
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %s", err)
+	}
+
+	for _, testCase := range []struct {
+		IPAddress string
+		expected  bool
+	}{
+		{"192.0.2.1", true},
+		{"2001:0db8:0000::1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::2", false},
+	} {
+		if db.IsServerIPAddress(net.ParseIP(testCase.IPAddress)) != testCase.expected {
+			t.Fatalf("unexpected IsServerIPAddress result for %s", testCase.IPAddress)
+		}
+	}
+}
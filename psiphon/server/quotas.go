@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/bolt"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	QUOTA_PERIOD_DAY   = "day"
+	QUOTA_PERIOD_MONTH = "month"
+
+	QUOTA_KEY_PREFIX_AUTHORIZATION = "authorization:"
+	QUOTA_KEY_PREFIX_SESSION       = "session:"
+
+	QUOTA_UPDATE_PERIOD = 10 * time.Second
+	QUOTA_FLUSH_PERIOD  = 10 * time.Second
+	QUOTA_PRUNE_PERIOD  = 1 * time.Hour
+)
+
+// QuotaStore is a persistent store of per-client quota usage. Usage is
+// recorded, for each quota period, in a bucket named for the period type
+// and the current calendar period, in UTC; e.g., "day/2018-06-01" and
+// "month/2018-06". Each bucket maps quota keys, which identify clients
+// by authorization ID or client session lineage, to total bytes
+// transferred in the period. Buckets for past periods are deleted by
+// Prune.
+//
+// Usage added by AddUsage is held in memory and written to the database by
+// Flush, which records the usage of all clients in a single transaction,
+// rather than one transaction per client update. Usage not yet flushed is
+// included in the usage returned by AddUsage. Close flushes any pending
+// usage.
+//
+// Quota usage is local to each server; usage is not shared between
+// servers.
+type QuotaStore struct {
+	db      *bolt.DB
+	mutex   sync.Mutex
+	pending map[string]map[string]int64
+}
+
+// NewQuotaStore opens or creates the quota database in the specified
+// file.
+func NewQuotaStore(filename string) (*QuotaStore, error) {
+
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &QuotaStore{
+		db:      db,
+		pending: make(map[string]map[string]int64),
+	}, nil
+}
+
+// Close flushes any pending usage and closes the quota database.
+func (store *QuotaStore) Close() error {
+	flushErr := store.Flush()
+	err := store.db.Close()
+	if err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// AddUsage adds bytes transferred to the usage recorded for the client
+// identified by key in the current period of each quota, and returns the
+// resulting usage for each quota, in the same order as quotas. When bytes
+// is 0, the current usage is returned without modifying the store. Added
+// usage is pending until the next Flush.
+//
+// Quotas with the same period share a single usage count.
+func (store *QuotaStore) AddUsage(
+	key string, quotas []Quota, bytes int64, now time.Time) ([]int64, error) {
+
+	usage := make([]int64, len(quotas))
+
+	if len(quotas) == 0 {
+		return usage, nil
+	}
+
+	bucketNames := make([]string, len(quotas))
+	for i, quota := range quotas {
+		bucketName, err := getQuotaBucketName(quota.Period, now)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		bucketNames[i] = bucketName
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		for i, bucketName := range bucketNames {
+			bucket := tx.Bucket([]byte(bucketName))
+			if bucket != nil {
+				usage[i] = decodeQuotaUsage(bucket.Get([]byte(key)))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Quotas with the same period share a bucket; the bytes are added to
+	// each bucket only once.
+
+	if bytes > 0 {
+		added := make(map[string]bool)
+		for _, bucketName := range bucketNames {
+			if added[bucketName] {
+				continue
+			}
+			pendingUsage, ok := store.pending[bucketName]
+			if !ok {
+				pendingUsage = make(map[string]int64)
+				store.pending[bucketName] = pendingUsage
+			}
+			pendingUsage[key] += bytes
+			added[bucketName] = true
+		}
+	}
+
+	for i, bucketName := range bucketNames {
+		usage[i] += store.pending[bucketName][key]
+	}
+
+	return usage, nil
+}
+
+// Flush writes all pending usage to the database, in a single transaction.
+// On failure, the usage remains pending and is written by the next Flush.
+func (store *QuotaStore) Flush() error {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if len(store.pending) == 0 {
+		return nil
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+
+		for bucketName, pendingUsage := range store.pending {
+
+			bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+			if err != nil {
+				return err
+			}
+
+			for key, bytes := range pendingUsage {
+				value := decodeQuotaUsage(bucket.Get([]byte(key))) + bytes
+				err := bucket.Put([]byte(key), encodeQuotaUsage(value))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	store.pending = make(map[string]map[string]int64)
+
+	return nil
+}
+
+// Prune deletes usage records, including pending usage, for all periods
+// other than the current day and month. Returns the number of periods
+// deleted from the database.
+func (store *QuotaStore) Prune(now time.Time) (int, error) {
+
+	currentBucketNames := make(map[string]bool)
+	for _, period := range []string{QUOTA_PERIOD_DAY, QUOTA_PERIOD_MONTH} {
+		bucketName, _ := getQuotaBucketName(period, now)
+		currentBucketNames[bucketName] = true
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for bucketName := range store.pending {
+		if !currentBucketNames[bucketName] {
+			delete(store.pending, bucketName)
+		}
+	}
+
+	deleteCount := 0
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+
+		// Bucket deletion is done outside the ForEach iteration.
+
+		var deleteBucketNames [][]byte
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !currentBucketNames[string(name)] {
+				deleteBucketNames = append(
+					deleteBucketNames, append([]byte(nil), name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range deleteBucketNames {
+			err := tx.DeleteBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		deleteCount = len(deleteBucketNames)
+
+		return nil
+	})
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return deleteCount, nil
+}
+
+func getQuotaBucketName(period string, now time.Time) (string, error) {
+
+	now = now.UTC()
+
+	var periodID string
+	switch period {
+	case QUOTA_PERIOD_DAY:
+		periodID = now.Format("2006-01-02")
+	case QUOTA_PERIOD_MONTH:
+		periodID = now.Format("2006-01")
+	default:
+		return "", common.ContextError(
+			fmt.Errorf("invalid quota period: %s", period))
+	}
+
+	return strings.Join([]string{period, periodID}, "/"), nil
+}
+
+func encodeQuotaUsage(value int64) []byte {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(value))
+	return buffer
+}
+
+func decodeQuotaUsage(buffer []byte) int64 {
+	if len(buffer) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(buffer))
+}
+
+// getQuotaKey returns the key used to account for a client's quota
+// usage. Clients with an active authorization are identified by the
+// authorization ID, so that usage follows the authorization across
+// devices and sessions; other clients are identified by their client
+// session lineage, the client session ID which persists across
+// reconnections and, for multi-hop exit tunnels, the session ID of the
+// entry tunnel.
+func getQuotaKey(authorizationIDs []string, sessionLineageID string) string {
+	if len(authorizationIDs) > 0 {
+		return QUOTA_KEY_PREFIX_AUTHORIZATION + authorizationIDs[0]
+	}
+	return QUOTA_KEY_PREFIX_SESSION + sessionLineageID
+}
@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestQuotaStore(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-quota-store-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	quotaDatabaseFilename := filepath.Join(testDataDirName, "quotas.db")
+
+	store, err := NewQuotaStore(quotaDatabaseFilename)
+	if err != nil {
+		t.Fatalf("NewQuotaStore failed: %s", err)
+	}
+
+	quotas := []Quota{
+		{Period: QUOTA_PERIOD_DAY, Bytes: 100},
+		{Period: QUOTA_PERIOD_MONTH, Bytes: 1000},
+		{Period: QUOTA_PERIOD_DAY, Bytes: 200},
+	}
+
+	day1 := time.Date(2018, time.June, 30, 23, 0, 0, 0, time.UTC)
+	day2 := day1.Add(2 * time.Hour)
+	day3 := day1.Add(26 * time.Hour)
+
+	key := getQuotaKey(nil, "SESSION")
+	otherKey := getQuotaKey([]string{"AUTHORIZATION"}, "SESSION")
+
+	testCases := []struct {
+		description   string
+		key           string
+		bytes         int64
+		now           time.Time
+		expectedUsage []int64
+	}{
+		{"initial usage", key, 10, day1, []int64{10, 10, 10}},
+		{"add usage", key, 20, day1, []int64{30, 30, 30}},
+		{"get usage", key, 0, day1, []int64{30, 30, 30}},
+		{"other key", otherKey, 5, day1, []int64{5, 5, 5}},
+		{"new day and month", key, 1, day2, []int64{1, 1, 1}},
+		{"new day", key, 2, day3, []int64{2, 3, 2}},
+		{"get new day usage", key, 0, day3, []int64{2, 3, 2}},
+	}
+
+	for _, testCase := range testCases {
+		usage, err := store.AddUsage(
+			testCase.key, quotas, testCase.bytes, testCase.now)
+		if err != nil {
+			t.Fatalf("AddUsage failed: %s: %s", testCase.description, err)
+		}
+		if !reflect.DeepEqual(usage, testCase.expectedUsage) {
+			t.Fatalf("unexpected usage: %s: %v", testCase.description, usage)
+		}
+	}
+
+	usage, err := store.AddUsage(key, []Quota{}, 1, day3)
+	if err != nil || len(usage) != 0 {
+		t.Fatalf("unexpected AddUsage result: %v, %s", usage, err)
+	}
+
+	_, err = store.AddUsage(key, []Quota{{Period: "week"}}, 1, day3)
+	if err == nil {
+		t.Fatalf("unexpected AddUsage success")
+	}
+
+	// Usage is pending until flushed. A single Flush writes the pending
+	// usage of all keys and periods, and subsequent usage is added to the
+	// flushed usage.
+
+	if len(store.pending) != 5 {
+		t.Fatalf("unexpected pending periods: %d", len(store.pending))
+	}
+
+	err = store.Flush()
+	if err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+
+	if len(store.pending) != 0 {
+		t.Fatalf("unexpected pending periods: %d", len(store.pending))
+	}
+
+	usage, err = store.AddUsage(otherKey, quotas, 0, day1)
+	if err != nil {
+		t.Fatalf("AddUsage failed: %s", err)
+	}
+	if !reflect.DeepEqual(usage, []int64{5, 5, 5}) {
+		t.Fatalf("unexpected flushed usage: %v", usage)
+	}
+
+	usage, err = store.AddUsage(key, quotas, 1, day3)
+	if err != nil {
+		t.Fatalf("AddUsage failed: %s", err)
+	}
+	if !reflect.DeepEqual(usage, []int64{3, 4, 3}) {
+		t.Fatalf("unexpected usage: %v", usage)
+	}
+
+	// Usage, including pending usage, is persisted.
+
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+
+	store, err = NewQuotaStore(quotaDatabaseFilename)
+	if err != nil {
+		t.Fatalf("NewQuotaStore failed: %s", err)
+	}
+	defer store.Close()
+
+	usage, err = store.AddUsage(key, quotas, 0, day3)
+	if err != nil {
+		t.Fatalf("AddUsage failed: %s", err)
+	}
+	if !reflect.DeepEqual(usage, []int64{3, 4, 3}) {
+		t.Fatalf("unexpected persisted usage: %v", usage)
+	}
+
+	// Past periods are pruned.
+
+	pruneCount, err := store.Prune(day3)
+	if err != nil {
+		t.Fatalf("Prune failed: %s", err)
+	}
+
+	// The day1, day2 and June periods are pruned.
+	if pruneCount != 3 {
+		t.Fatalf("unexpected prune count: %d", pruneCount)
+	}
+
+	// day2 is in the current month, so only the day2 usage is pruned.
+
+	usage, err = store.AddUsage(key, quotas, 0, day2)
+	if err != nil {
+		t.Fatalf("AddUsage failed: %s", err)
+	}
+	if !reflect.DeepEqual(usage, []int64{0, 4, 0}) {
+		t.Fatalf("unexpected pruned usage: %v", usage)
+	}
+
+	usage, err = store.AddUsage(key, quotas, 0, day3)
+	if err != nil {
+		t.Fatalf("AddUsage failed: %s", err)
+	}
+	if !reflect.DeepEqual(usage, []int64{3, 4, 3}) {
+		t.Fatalf("unexpected current usage: %v", usage)
+	}
+}
+
+func TestQuotasTrafficRules(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-quotas-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	err = ioutil.WriteFile(
+		trafficRulesFilename,
+		[]byte(`
+		{
+		    "DefaultRules" : {
+		        "Quotas" : [
+		            {"Period" : "month", "Bytes" : 1000000, "ExhaustedBytesPerSecond" : 1000}
+		        ]
+		    },
+		    "FilteredRules" : [
+		        {
+		            "Filter" : {
+		                "AuthorizedAccessTypes" : ["unlimited"]
+		            },
+		            "Rules" : {
+		                "Quotas" : []
+		            }
+		        }
+		    ]
+		}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	trafficRulesSet, err := NewTrafficRulesSet(trafficRulesFilename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	testCases := []struct {
+		authorizedAccessTypes []string
+		expectedQuotas        []Quota
+	}{
+		{nil, []Quota{{Period: QUOTA_PERIOD_MONTH, Bytes: 1000000, ExhaustedBytesPerSecond: 1000}}},
+		{[]string{"unlimited"}, []Quota{}},
+	}
+
+	for _, testCase := range testCases {
+
+		state := handshakeState{
+			completed:             true,
+			apiProtocol:           "ssh",
+			apiParams:             common.APIParameters{},
+			authorizedAccessTypes: testCase.authorizedAccessTypes,
+		}
+
+		trafficRules := trafficRulesSet.GetTrafficRules(
+			true, "OSSH", GeoIPData{}, state, TrafficRulesConditions{})
+
+		if !reflect.DeepEqual(trafficRules.Quotas, testCase.expectedQuotas) {
+			t.Fatalf("unexpected Quotas for %v: %v",
+				testCase.authorizedAccessTypes, trafficRules.Quotas)
+		}
+	}
+
+	// Invalid quotas are rejected.
+
+	for _, invalidQuota := range []string{
+		`{"Period" : "week", "Bytes" : 1000}`,
+		`{"Period" : "day", "Bytes" : -1}`,
+		`{"Period" : "day", "Bytes" : 1000, "ExhaustedBytesPerSecond" : -1}`,
+	} {
+
+		err = ioutil.WriteFile(
+			trafficRulesFilename,
+			[]byte(`{"DefaultRules" : {"Quotas" : [`+invalidQuota+`]}}`),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		_, err = trafficRulesSet.Reload()
+		if err == nil {
+			t.Fatalf("unexpected Reload success: %s", invalidQuota)
+		}
+	}
+}
@@ -54,6 +54,13 @@ var mockWebServerPort = 8080
 func TestMain(m *testing.M) {
 	flag.Parse()
 
+	// Run as a listener hand-off test process; see
+	// TestListenerHandoffSupervisor.
+	localAddress := os.Getenv(listenerHandoffTestAddressEnvironmentVariable)
+	if localAddress != "" {
+		runListenerHandoffTestProcess(localAddress)
+	}
+
 	var err error
 	for _, interfaceName := range []string{"eth0", "en0"} {
 		var serverIPv4Address, serverIPv6Address net.IP
@@ -194,6 +201,21 @@ func TestUnfrontedMeekSessionTicket(t *testing.T) {
 		})
 }
 
+func TestUnfrontedWebSocket(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "UNFRONTED-WEBSOCKET-OSSH",
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: true,
+		})
+}
+
 func TestQUICOSSH(t *testing.T) {
 	runServer(t,
 		&runServerConfig{
@@ -564,7 +586,7 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 
 	// Exercise server_load logging
 	p, _ := os.FindProcess(os.Getpid())
-	p.Signal(syscall.SIGUSR2)
+	p.Signal(syscall.SIGHUP)
 
 	// connect to server with client
 
@@ -24,6 +24,8 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -34,6 +36,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
@@ -90,6 +93,8 @@ func RunServices(configJSON []byte) error {
 			EgressInterface:             config.PacketTunnelEgressInterface,
 			DownstreamPacketQueueSize:   config.PacketTunnelDownstreamPacketQueueSize,
 			SessionIdleExpirySeconds:    config.PacketTunnelSessionIdleExpirySeconds,
+			ICMPEchoRequestsPerSecond:   config.PacketTunnelICMPEchoRequestsPerSecond,
+			UserspaceStack:              config.PacketTunnelUserspaceStack,
 		})
 		if err != nil {
 			log.WithContextFields(LogFields{"error": err}).Error("init packet tunnel failed")
@@ -147,6 +152,50 @@ func RunServices(configJSON []byte) error {
 		}()
 	}
 
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		ticker := time.NewTicker(TRAFFIC_RULES_CONDITIONS_UPDATE_PERIOD)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-shutdownBroadcast:
+				return
+			case <-ticker.C:
+				tunnelServer.UpdateTrafficRulesConditions()
+			}
+		}
+	}()
+
+	if supportServices.QuotaStore != nil {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			flushTicker := time.NewTicker(QUOTA_FLUSH_PERIOD)
+			defer flushTicker.Stop()
+			pruneTicker := time.NewTicker(QUOTA_PRUNE_PERIOD)
+			defer pruneTicker.Stop()
+			for {
+				select {
+				case <-shutdownBroadcast:
+					return
+				case <-flushTicker.C:
+					err := supportServices.QuotaStore.Flush()
+					if err != nil {
+						log.WithContextFields(LogFields{"error": err}).Warning("flush quotas failed")
+					}
+				case <-pruneTicker.C:
+					pruneCount, err := supportServices.QuotaStore.Prune(time.Now())
+					if err != nil {
+						log.WithContextFields(LogFields{"error": err}).Warning("prune quotas failed")
+					} else if pruneCount > 0 {
+						log.WithContextFields(LogFields{"count": pruneCount}).Info("pruned quota periods")
+					}
+				}
+			}
+		}()
+	}
+
 	if config.RunWebServer() {
 		waitGroup.Add(1)
 		go func() {
@@ -159,6 +208,30 @@ func RunServices(configJSON []byte) error {
 		}()
 	}
 
+	if config.RunMetricsServer() {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			err := RunMetricsServer(supportServices, shutdownBroadcast)
+			select {
+			case errors <- err:
+			default:
+			}
+		}()
+	}
+
+	if config.RunAdminServer() {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			err := RunAdminServer(supportServices, shutdownBroadcast)
+			select {
+			case errors <- err:
+			default:
+			}
+		}()
+	}
+
 	// The tunnel server is always run; it launches multiple
 	// listeners, depending on which tunnel protocols are enabled.
 	waitGroup.Add(1)
@@ -192,7 +265,8 @@ func RunServices(configJSON []byte) error {
 	// where 'panicwrap.Wrap' is called. The handled signals below, and the
 	// list there must be kept in sync to ensure proper signal handling
 
-	// An OS signal triggers an orderly shutdown
+	// An OS signal triggers an orderly shutdown. SIGTERM first drains
+	// clients, when configured.
 	systemStopSignal := make(chan os.Signal, 1)
 	signal.Notify(systemStopSignal, os.Interrupt, os.Kill, syscall.SIGTERM)
 
@@ -200,9 +274,14 @@ func RunServices(configJSON []byte) error {
 	reloadSupportServicesSignal := make(chan os.Signal, 1)
 	signal.Notify(reloadSupportServicesSignal, syscall.SIGUSR1)
 
-	// SIGUSR2 triggers an immediate load log and optional process profile output
+	// SIGUSR2 triggers a hand-off of listeners to a new server process,
+	// followed by a drain and shutdown
+	handOffListenersSignal := make(chan os.Signal, 1)
+	signal.Notify(handOffListenersSignal, syscall.SIGUSR2)
+
+	// SIGHUP triggers an immediate load log and optional process profile output
 	logServerLoadSignal := make(chan os.Signal, 1)
-	signal.Notify(logServerLoadSignal, syscall.SIGUSR2)
+	signal.Notify(logServerLoadSignal, syscall.SIGHUP)
 
 	// SIGTSTP triggers tunnelServer to stop establishing new tunnels
 	stopEstablishingTunnelsSignal := make(chan os.Signal, 1)
@@ -236,8 +315,21 @@ loop:
 			}
 			logServerLoad(tunnelServer)
 
-		case <-systemStopSignal:
+		case <-handOffListenersSignal:
+			handOffErr := tunnelServer.HandOffListeners()
+			if handOffErr != nil {
+				log.WithContextFields(LogFields{"error": handOffErr}).Error("hand off listeners failed")
+				break
+			}
+			log.WithContext().Info("shutdown by listener hand-off")
+			drainTunnelServer(config, tunnelServer, systemStopSignal)
+			break loop
+
+		case stopSignal := <-systemStopSignal:
 			log.WithContext().Info("shutdown by system")
+			if stopSignal == syscall.SIGTERM {
+				drainTunnelServer(config, tunnelServer, systemStopSignal)
+			}
 			break loop
 
 		case err = <-errors:
@@ -249,9 +341,46 @@ loop:
 	close(shutdownBroadcast)
 	waitGroup.Wait()
 
+	// The quota store is closed, flushing pending usage, after the tunnel
+	// server has stopped. Note that sshClient shutdown is not synchronized
+	// with tunnel server shutdown, so final quota updates for clients that
+	// are still stopping may be lost.
+
+	if supportServices.QuotaStore != nil {
+		closeErr := supportServices.QuotaStore.Close()
+		if closeErr != nil {
+			log.WithContextFields(LogFields{"error": closeErr}).Warning("close quota store failed")
+		}
+	}
+
 	return err
 }
 
+// drainTunnelServer drains tunnelServer clients for up to the configured
+// DrainTimeoutSeconds. A further stop signal ends the drain immediately.
+func drainTunnelServer(
+	config *Config, tunnelServer *TunnelServer, stopSignal <-chan os.Signal) {
+
+	if config.DrainTimeoutSeconds <= 0 {
+		return
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Duration(config.DrainTimeoutSeconds)*time.Second)
+	defer cancelFunc()
+
+	go func() {
+		select {
+		case <-stopSignal:
+			log.WithContext().Info("drain interrupted by system")
+			cancelFunc()
+		case <-ctx.Done():
+		}
+	}()
+
+	tunnelServer.Drain(ctx)
+}
+
 func getRuntimeMetrics() LogFields {
 
 	numGoroutine := runtime.NumGoroutine()
@@ -361,6 +490,44 @@ func outputProcessProfiles(config *Config) {
 	}
 }
 
+// cpuUtilizationSampler samples the CPU utilization of the server
+// process, as a fraction of the total capacity of all CPUs, over the
+// time elapsed since the previous sample.
+type cpuUtilizationSampler struct {
+	lastSampleTime monotime.Time
+	lastCPUTime    time.Duration
+}
+
+// sample returns the CPU utilization since the previous sample. The first
+// sample returns 0.
+func (sampler *cpuUtilizationSampler) sample() float64 {
+
+	var usage syscall.Rusage
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("Getrusage failed")
+		return 0
+	}
+
+	sampleTime := monotime.Now()
+	cpuTime := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+
+	utilization := 0.0
+
+	if sampler.lastSampleTime != 0 {
+		elapsed := sampleTime.Sub(sampler.lastSampleTime)
+		if elapsed > 0 {
+			utilization = float64(cpuTime-sampler.lastCPUTime) /
+				(float64(elapsed) * float64(runtime.NumCPU()))
+		}
+	}
+
+	sampler.lastSampleTime = sampleTime
+	sampler.lastCPUTime = cpuTime
+
+	return utilization
+}
+
 func logServerLoad(server *TunnelServer) {
 
 	protocolStats, regionStats := server.GetLoadStats()
@@ -401,12 +568,14 @@ type SupportServices struct {
 	Config             *Config
 	TrafficRulesSet    *TrafficRulesSet
 	OSLConfig          *osl.Config
+	DomainBlocklists   *DomainBlocklists
 	PsinetDatabase     *psinet.Database
 	GeoIPService       *GeoIPService
 	DNSResolver        *DNSResolver
 	TunnelServer       *TunnelServer
 	PacketTunnelServer *tun.Server
 	TacticsServer      *tactics.Server
+	QuotaStore         *QuotaStore
 }
 
 // NewSupportServices initializes a new SupportServices.
@@ -422,6 +591,11 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 		return nil, common.ContextError(err)
 	}
 
+	domainBlocklists, err := NewDomainBlocklists(config.DomainBlocklistsFilename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
 	psinetDatabase, err := psinet.NewDatabase(config.PsinetDatabaseFilename)
 	if err != nil {
 		return nil, common.ContextError(err)
@@ -447,29 +621,77 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 		return nil, common.ContextError(err)
 	}
 
+	var quotaStore *QuotaStore
+	if config.QuotaDatabaseFilename != "" {
+		quotaStore, err = NewQuotaStore(config.QuotaDatabaseFilename)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
 	return &SupportServices{
-		Config:          config,
-		TrafficRulesSet: trafficRulesSet,
-		OSLConfig:       oslConfig,
-		PsinetDatabase:  psinetDatabase,
-		GeoIPService:    geoIPService,
-		DNSResolver:     dnsResolver,
-		TacticsServer:   tacticsServer,
+		Config:           config,
+		TrafficRulesSet:  trafficRulesSet,
+		OSLConfig:        oslConfig,
+		DomainBlocklists: domainBlocklists,
+		PsinetDatabase:   psinetDatabase,
+		GeoIPService:     geoIPService,
+		DNSResolver:      dnsResolver,
+		TacticsServer:    tacticsServer,
+		QuotaStore:       quotaStore,
 	}, nil
 }
 
-// Reload reinitializes traffic rules, psinet database, and geo IP database
-// components. If any component fails to reload, an error is logged and
+// Reload reinitializes traffic rules, domain blocklists, psinet database,
+// and geo IP database components. If any component fails to reload, an error is logged and
 // Reload proceeds, using the previous state of the component.
 func (support *SupportServices) Reload() {
+	support.reload(support.getReloaders())
+}
 
-	reloaders := append(
+// ReloadComponent reinitializes the single component with the specified
+// description, as returned by GetReloaderDescriptions. An error is
+// returned when there is no such component; reload failures are logged, as
+// in Reload.
+func (support *SupportServices) ReloadComponent(description string) error {
+
+	for _, reloader := range support.getReloaders() {
+		if reloader.WillReload() && reloader.LogDescription() == description {
+			support.reload([]common.Reloader{reloader})
+			return nil
+		}
+	}
+
+	return common.ContextError(fmt.Errorf("unknown reloader: %s", description))
+}
+
+// GetReloaderDescriptions returns the descriptions of the components which
+// may be reloaded.
+func (support *SupportServices) GetReloaderDescriptions() []string {
+
+	descriptions := make([]string, 0)
+	for _, reloader := range support.getReloaders() {
+		if reloader.WillReload() {
+			descriptions = append(descriptions, reloader.LogDescription())
+		}
+	}
+
+	return descriptions
+}
+
+func (support *SupportServices) getReloaders() []common.Reloader {
+
+	return append(
 		[]common.Reloader{
 			support.TrafficRulesSet,
 			support.OSLConfig,
+			support.DomainBlocklists,
 			support.PsinetDatabase,
 			support.TacticsServer},
 		support.GeoIPService.Reloaders()...)
+}
+
+func (support *SupportServices) reload(reloaders []common.Reloader) {
 
 	// Note: established clients aren't notified when tactics change after a
 	// reload; new tactics will be obtained on the next client handshake or
@@ -24,6 +24,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -35,8 +37,11 @@ const (
 	DEFAULT_MAX_TCP_DIALING_PORT_FORWARD_COUNT                = 64
 	DEFAULT_MAX_TCP_PORT_FORWARD_COUNT                        = 512
 	DEFAULT_MAX_UDP_PORT_FORWARD_COUNT                        = 32
+	DEFAULT_BANDWIDTH_WEIGHT                                  = 1
 	DEFAULT_MEEK_RATE_LIMITER_GARBAGE_COLLECTOR_TRIGGER_COUNT = 5000
 	DEFAULT_MEEK_RATE_LIMITER_REAP_HISTORY_FREQUENCY_SECONDS  = 600
+	TRAFFIC_RULES_CONDITIONS_UPDATE_PERIOD                    = 1 * time.Minute
+	TRAFFIC_RULES_SERVER_LOAD_HYSTERESIS                      = 0.1
 )
 
 // TrafficRulesSet represents the various traffic rules to
@@ -115,6 +120,29 @@ type TrafficRulesFilter struct {
 	// region matches.
 	Regions []string
 
+	// ISPs is a list of client GeoIP ISPs that the client must resolve to
+	// to match this filter. When omitted or empty, any client ISP matches.
+	ISPs []string
+
+	// MinEstablishedClients specifies a minimum number of clients that must
+	// be established on the server to match this filter. When omitted or 0,
+	// the number of established clients is not checked.
+	MinEstablishedClients int
+
+	// MinCPUUtilization specifies a minimum server process CPU utilization
+	// required to match this filter. CPU utilization is a fraction, in the
+	// range 0.0 to 1.0, of the total capacity of all CPUs, sampled over the
+	// most recent TRAFFIC_RULES_CONDITIONS_UPDATE_PERIOD. When omitted or 0,
+	// CPU utilization is not checked.
+	MinCPUUtilization float64
+
+	// TimeOfDay is a list of daily time windows, at least one of which must
+	// include the current time, in the client's local time zone, to match
+	// this filter. The client's time zone is determined by GeoIP lookup; when
+	// the time zone is unknown, UTC is used. When omitted or empty, any time
+	// of day matches.
+	TimeOfDay []TimeOfDayWindow
+
 	// APIProtocol specifies whether the client must use the SSH
 	// API protocol (when "ssh") or the web API protocol (when "web").
 	// When omitted or blank, any API protocol matches.
@@ -138,9 +166,51 @@ type TrafficRulesFilter struct {
 	AuthorizationsRevoked bool
 }
 
+// TimeOfDayWindow specifies a daily time window. Start and End are times
+// of day in "HH:MM" format; the window includes Start and excludes End.
+// When End is earlier than Start, the window spans midnight; e.g., Start
+// "22:00" and End "02:00".
+type TimeOfDayWindow struct {
+	Start string
+	End   string
+}
+
+// TrafficRulesConditions are the server conditions, which change over
+// time, that are matched by the load and time-of-day criteria of
+// TrafficRulesFilters. Load conditions are periodically sampled; see
+// TunnelServer.UpdateTrafficRulesConditions.
+type TrafficRulesConditions struct {
+	Now                time.Time
+	EstablishedClients int
+	CPUUtilization     float64
+
+	// serverLoadMatches records whether each distinct set of filter server
+	// load criteria is met, with hysteresis applied. When nil, the criteria
+	// are checked directly against EstablishedClients and CPUUtilization.
+	// See TrafficRulesSet.SetServerLoadMatches.
+	serverLoadMatches map[serverLoadCriteria]bool
+}
+
+// serverLoadCriteria identifies a distinct set of filter server load
+// criteria. Criteria are identified by value, rather than by filter, so
+// that the match state is retained when the traffic rules are reloaded.
+type serverLoadCriteria struct {
+	minEstablishedClients int
+	minCPUUtilization     float64
+}
+
 // TrafficRules specify the limits placed on client traffic.
 type TrafficRules struct {
 
+	// BandwidthWeight is the client's weight in the server-wide bandwidth
+	// scheduler, which shares the HostBandwidthReadBytesPerSecond and
+	// HostBandwidthWriteBytesPerSecond budgets among clients. Active
+	// clients receive shares of the budgets in proportion to their
+	// weights; e.g., authorized clients may be assigned a higher weight.
+	// The weight must be > 0. When omitted in DefaultRules,
+	// DEFAULT_BANDWIDTH_WEIGHT is used.
+	BandwidthWeight *int
+
 	// RateLimits specifies data transfer rate limits for the
 	// client traffic.
 	RateLimits RateLimits
@@ -209,6 +279,54 @@ type TrafficRules struct {
 	// forwards where the client sends an IP address. Domain
 	// names aren not resolved before checking AllowSubnets.
 	AllowSubnets []string
+
+	// AllowPsiphonServerRelay specifies whether clients may port forward
+	// to other Psiphon servers, as listed in the psinet database. Multi-hop
+	// clients relay their tunnel to an exit server through a port forward
+	// on an entry server; entry servers, which have the multi-hop relay
+	// capability, must allow relaying. When omitted in DefaultRules,
+	// relaying is allowed, as it was before this rule was introduced;
+	// set AllowPsiphonServerRelay to false in DefaultRules to deny
+	// relaying, and use FilteredRules to allow it for specific clients.
+	AllowPsiphonServerRelay *bool
+
+	// DomainBlocklists specifies the names of domain blocklists, defined
+	// in the DomainBlocklistsFilename file, to apply to the client. TCP
+	// port forwards to blocked domains are rejected, and packet tunnel
+	// DNS queries for blocked domains receive an NXDOMAIN response.
+	// Blocklists may be selected for specific sponsors or regions using
+	// FilteredRules. When omitted in DefaultRules, no domains are blocked.
+	DomainBlocklists []string
+
+	// Quotas specifies data transfer quotas which span tunnels and
+	// sessions. Quota usage is accounted for by authorization ID, when the
+	// client has an active authorization, or else by client session
+	// lineage, and is persisted in the QuotaDatabaseFilename database.
+	// Quotas are enforced only when QuotaDatabaseFilename is configured.
+	//
+	// A free tier with a monthly cap may be configured with a month Quota
+	// in DefaultRules, and a paid unlimited tier with an empty Quotas list
+	// in FilteredRules for the paid authorized access type. Note that the
+	// client session ID, which identifies the session lineage of clients
+	// without an authorization, is chosen by the client, and a client that
+	// starts a new session starts with no usage. When omitted in
+	// DefaultRules, there are no quotas.
+	Quotas []Quota
+}
+
+// Quota specifies a limit on the total number of bytes a client may
+// transfer, upstream and downstream combined, in each Period. Periods are
+// calendar days or months in UTC.
+//
+// When a quota is exhausted, the client is throttled to
+// ExhaustedBytesPerSecond, in each direction, for the remainder of the
+// period. When ExhaustedBytesPerSecond is 0, the client is instead
+// disconnected, and subsequent tunnels are disconnected immediately after
+// the handshake.
+type Quota struct {
+	Period                  string
+	Bytes                   int64
+	ExhaustedBytesPerSecond int64
 }
 
 // RateLimits is a clone of common.RateLimits with pointers
@@ -312,6 +430,22 @@ func (set *TrafficRulesSet) Validate() error {
 				errors.New("TrafficRules values must be >= 0"))
 		}
 
+		if rules.BandwidthWeight != nil && *rules.BandwidthWeight <= 0 {
+			return common.ContextError(
+				errors.New("BandwidthWeight must be > 0"))
+		}
+
+		for _, quota := range rules.Quotas {
+			if quota.Period != QUOTA_PERIOD_DAY && quota.Period != QUOTA_PERIOD_MONTH {
+				return common.ContextError(
+					fmt.Errorf("invalid quota period: %s", quota.Period))
+			}
+			if quota.Bytes < 0 || quota.ExhaustedBytesPerSecond < 0 {
+				return common.ContextError(
+					errors.New("Quota values must be >= 0"))
+			}
+		}
+
 		for _, subnet := range rules.AllowSubnets {
 			_, _, err := net.ParseCIDR(subnet)
 			if err != nil {
@@ -344,6 +478,24 @@ func (set *TrafficRulesSet) Validate() error {
 			}
 		}
 
+		if filteredRule.Filter.MinEstablishedClients < 0 ||
+			filteredRule.Filter.MinCPUUtilization < 0 ||
+			filteredRule.Filter.MinCPUUtilization > 1 {
+			return common.ContextError(
+				errors.New("invalid server load filter"))
+		}
+
+		for _, window := range filteredRule.Filter.TimeOfDay {
+			start, end, err := window.parse()
+			if err != nil {
+				return common.ContextError(err)
+			}
+			if start == end {
+				return common.ContextError(
+					fmt.Errorf("empty time of day window: %s", window.Start))
+			}
+		}
+
 		err := validateTrafficRules(&filteredRule.Rules)
 		if err != nil {
 			return common.ContextError(err)
@@ -353,14 +505,16 @@ func (set *TrafficRulesSet) Validate() error {
 	return nil
 }
 
-// GetTrafficRules determines the traffic rules for a client based on its attributes.
+// GetTrafficRules determines the traffic rules for a client based on its attributes
+// and the current server conditions.
 // For the return value TrafficRules, all pointer and slice fields are initialized,
 // so nil checks are not required. The caller must not modify the returned TrafficRules.
 func (set *TrafficRulesSet) GetTrafficRules(
 	isFirstTunnelInSession bool,
 	tunnelProtocol string,
 	geoIPData GeoIPData,
-	state handshakeState) TrafficRules {
+	state handshakeState,
+	conditions TrafficRulesConditions) TrafficRules {
 
 	set.ReloadableFile.RLock()
 	defer set.ReloadableFile.RUnlock()
@@ -436,6 +590,10 @@ func (set *TrafficRulesSet) GetTrafficRules(
 			intPtr(DEFAULT_MAX_TCP_PORT_FORWARD_COUNT)
 	}
 
+	if trafficRules.BandwidthWeight == nil {
+		trafficRules.BandwidthWeight = intPtr(DEFAULT_BANDWIDTH_WEIGHT)
+	}
+
 	if trafficRules.MaxUDPPortForwardCount == nil {
 		trafficRules.MaxUDPPortForwardCount =
 			intPtr(DEFAULT_MAX_UDP_PORT_FORWARD_COUNT)
@@ -453,6 +611,19 @@ func (set *TrafficRulesSet) GetTrafficRules(
 		trafficRules.AllowSubnets = make([]string, 0)
 	}
 
+	if trafficRules.AllowPsiphonServerRelay == nil {
+		allowPsiphonServerRelay := true
+		trafficRules.AllowPsiphonServerRelay = &allowPsiphonServerRelay
+	}
+
+	if trafficRules.DomainBlocklists == nil {
+		trafficRules.DomainBlocklists = make([]string, 0)
+	}
+
+	if trafficRules.Quotas == nil {
+		trafficRules.Quotas = make([]Quota, 0)
+	}
+
 	// TODO: faster lookup?
 	for _, filteredRules := range set.FilteredRules {
 
@@ -470,6 +641,20 @@ func (set *TrafficRulesSet) GetTrafficRules(
 			}
 		}
 
+		if len(filteredRules.Filter.ISPs) > 0 {
+			if !common.Contains(filteredRules.Filter.ISPs, geoIPData.ISP) {
+				continue
+			}
+		}
+
+		if !filteredRules.Filter.matchesServerLoad(conditions) {
+			continue
+		}
+
+		if !filteredRules.Filter.matchesTimeOfDay(conditions.Now, geoIPData.TimeZone) {
+			continue
+		}
+
 		if filteredRules.Filter.APIProtocol != "" {
 			if !state.completed {
 				continue
@@ -568,6 +753,10 @@ func (set *TrafficRulesSet) GetTrafficRules(
 			trafficRules.MaxTCPPortForwardCount = filteredRules.Rules.MaxTCPPortForwardCount
 		}
 
+		if filteredRules.Rules.BandwidthWeight != nil {
+			trafficRules.BandwidthWeight = filteredRules.Rules.BandwidthWeight
+		}
+
 		if filteredRules.Rules.MaxUDPPortForwardCount != nil {
 			trafficRules.MaxUDPPortForwardCount = filteredRules.Rules.MaxUDPPortForwardCount
 		}
@@ -584,6 +773,18 @@ func (set *TrafficRulesSet) GetTrafficRules(
 			trafficRules.AllowSubnets = filteredRules.Rules.AllowSubnets
 		}
 
+		if filteredRules.Rules.AllowPsiphonServerRelay != nil {
+			trafficRules.AllowPsiphonServerRelay = filteredRules.Rules.AllowPsiphonServerRelay
+		}
+
+		if filteredRules.Rules.DomainBlocklists != nil {
+			trafficRules.DomainBlocklists = filteredRules.Rules.DomainBlocklists
+		}
+
+		if filteredRules.Rules.Quotas != nil {
+			trafficRules.Quotas = filteredRules.Rules.Quotas
+		}
+
 		break
 	}
 
@@ -597,6 +798,208 @@ func (set *TrafficRulesSet) GetTrafficRules(
 	return trafficRules
 }
 
+// SetServerLoadMatches records, in conditions, whether the server load
+// criteria of each filter are met.
+//
+// To prevent traffic rules from flapping when server load hovers around a
+// threshold, criteria that were met in the previous conditions continue to
+// be met until load falls below the thresholds by more than
+// TRAFFIC_RULES_SERVER_LOAD_HYSTERESIS, a fraction of each threshold.
+func (set *TrafficRulesSet) SetServerLoadMatches(
+	conditions *TrafficRulesConditions, previous TrafficRulesConditions) {
+
+	set.ReloadableFile.RLock()
+	defer set.ReloadableFile.RUnlock()
+
+	serverLoadMatches := make(map[serverLoadCriteria]bool)
+
+	for _, filteredRules := range set.FilteredRules {
+
+		filter := &filteredRules.Filter
+
+		if !filter.hasServerLoadCriteria() {
+			continue
+		}
+
+		criteria := filter.getServerLoadCriteria()
+
+		if _, ok := serverLoadMatches[criteria]; ok {
+			continue
+		}
+
+		scale := 1.0
+		if previous.serverLoadMatches[criteria] {
+			scale = 1.0 - TRAFFIC_RULES_SERVER_LOAD_HYSTERESIS
+		}
+
+		serverLoadMatches[criteria] = filter.meetsServerLoad(*conditions, scale)
+	}
+
+	conditions.serverLoadMatches = serverLoadMatches
+}
+
+// GetConditionsSignature summarizes the outcome of the load and
+// time-of-day criteria of all filters, for the specified server conditions
+// and client time zone. Changes in server conditions and time of day affect
+// the traffic rules selected for a client only when the client's signature
+// changes.
+//
+// Signatures are per client, so that clients connecting and disconnecting
+// do not change the signatures of other clients.
+func (set *TrafficRulesSet) GetConditionsSignature(
+	conditions TrafficRulesConditions, timeZone string) string {
+
+	set.ReloadableFile.RLock()
+	defer set.ReloadableFile.RUnlock()
+
+	var signature []byte
+
+	appendMatch := func(match bool) {
+		if match {
+			signature = append(signature, '1')
+		} else {
+			signature = append(signature, '0')
+		}
+	}
+
+	for _, filteredRules := range set.FilteredRules {
+
+		if filteredRules.Filter.hasServerLoadCriteria() {
+			appendMatch(filteredRules.Filter.matchesServerLoad(conditions))
+		}
+
+		if len(filteredRules.Filter.TimeOfDay) > 0 {
+			appendMatch(filteredRules.Filter.matchesTimeOfDay(conditions.Now, timeZone))
+		}
+	}
+
+	return string(signature)
+}
+
+func (filter *TrafficRulesFilter) hasServerLoadCriteria() bool {
+	return filter.MinEstablishedClients > 0 || filter.MinCPUUtilization > 0
+}
+
+func (filter *TrafficRulesFilter) getServerLoadCriteria() serverLoadCriteria {
+	return serverLoadCriteria{
+		minEstablishedClients: filter.MinEstablishedClients,
+		minCPUUtilization:     filter.MinCPUUtilization,
+	}
+}
+
+func (filter *TrafficRulesFilter) matchesServerLoad(
+	conditions TrafficRulesConditions) bool {
+
+	if !filter.hasServerLoadCriteria() {
+		return true
+	}
+
+	if conditions.serverLoadMatches != nil {
+		match, ok := conditions.serverLoadMatches[filter.getServerLoadCriteria()]
+		if ok {
+			return match
+		}
+	}
+
+	return filter.meetsServerLoad(conditions, 1.0)
+}
+
+// meetsServerLoad checks the server load criteria, with each threshold
+// scaled by the specified factor.
+func (filter *TrafficRulesFilter) meetsServerLoad(
+	conditions TrafficRulesConditions, scale float64) bool {
+
+	if filter.MinEstablishedClients > 0 &&
+		float64(conditions.EstablishedClients) < scale*float64(filter.MinEstablishedClients) {
+		return false
+	}
+
+	if filter.MinCPUUtilization > 0 &&
+		conditions.CPUUtilization < scale*filter.MinCPUUtilization {
+		return false
+	}
+
+	return true
+}
+
+func (filter *TrafficRulesFilter) matchesTimeOfDay(
+	now time.Time, timeZone string) bool {
+
+	if len(filter.TimeOfDay) == 0 {
+		return true
+	}
+
+	localNow := now.In(getTimeZoneLocation(timeZone))
+	minuteOfDay := localNow.Hour()*60 + localNow.Minute()
+
+	for _, window := range filter.TimeOfDay {
+
+		// Windows are checked in Validate.
+		start, end, err := window.parse()
+		if err != nil {
+			continue
+		}
+
+		if start < end {
+			if minuteOfDay >= start && minuteOfDay < end {
+				return true
+			}
+		} else {
+			if minuteOfDay >= start || minuteOfDay < end {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parse returns the window start and end as minutes of the day.
+func (window *TimeOfDayWindow) parse() (int, int, error) {
+
+	start, err := time.Parse("15:04", window.Start)
+	if err != nil {
+		return 0, 0, common.ContextError(err)
+	}
+
+	end, err := time.Parse("15:04", window.End)
+	if err != nil {
+		return 0, 0, common.ContextError(err)
+	}
+
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+var timeZoneLocationsMutex sync.Mutex
+var timeZoneLocations = make(map[string]*time.Location)
+
+// getTimeZoneLocation returns the location for an IANA time zone name.
+// Locations are cached, as time.LoadLocation reads the time zone database
+// on each call. UTC is returned for unknown or invalid time zones.
+func getTimeZoneLocation(timeZone string) *time.Location {
+
+	if timeZone == "" {
+		return time.UTC
+	}
+
+	timeZoneLocationsMutex.Lock()
+	defer timeZoneLocationsMutex.Unlock()
+
+	location, ok := timeZoneLocations[timeZone]
+	if ok {
+		return location
+	}
+
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	timeZoneLocations[timeZone] = location
+
+	return location
+}
+
 // GetMeekRateLimiterConfig gets a snapshot of the meek rate limiter
 // configuration values.
 func (set *TrafficRulesSet) GetMeekRateLimiterConfig() (int, int, []string, int, int) {
@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficRulesConditionFilters(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-traffic-rules-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	err = ioutil.WriteFile(
+		trafficRulesFilename,
+		[]byte(`
+		{
+		    "DefaultRules" : {
+		        "RateLimits" : {"ReadBytesPerSecond" : 1}
+		    },
+		    "FilteredRules" : [
+		        {
+		            "Filter" : {
+		                "ISPs" : ["ISP1"]
+		            },
+		            "Rules" : {
+		                "RateLimits" : {"ReadBytesPerSecond" : 2}
+		            }
+		        },
+		        {
+		            "Filter" : {
+		                "MinEstablishedClients" : 100,
+		                "MinCPUUtilization" : 0.5
+		            },
+		            "Rules" : {
+		                "RateLimits" : {"ReadBytesPerSecond" : 3}
+		            }
+		        },
+		        {
+		            "Filter" : {
+		                "TimeOfDay" : [
+		                    {"Start" : "08:00", "End" : "09:00"},
+		                    {"Start" : "22:00", "End" : "02:00"}
+		                ]
+		            },
+		            "Rules" : {
+		                "RateLimits" : {"ReadBytesPerSecond" : 4}
+		            }
+		        }
+		    ]
+		}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	trafficRulesSet, err := NewTrafficRulesSet(trafficRulesFilename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	noon := time.Date(2018, time.June, 1, 12, 0, 0, 0, time.UTC)
+	morning := time.Date(2018, time.June, 1, 8, 30, 0, 0, time.UTC)
+	night := time.Date(2018, time.June, 1, 23, 0, 0, 0, time.UTC)
+	earlyMorning := time.Date(2018, time.June, 2, 1, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		description                string
+		geoIPData                  GeoIPData
+		conditions                 TrafficRulesConditions
+		expectedReadBytesPerSecond int64
+	}{
+		{"default", GeoIPData{}, TrafficRulesConditions{Now: noon}, 1},
+		{"ISP", GeoIPData{ISP: "ISP1"}, TrafficRulesConditions{Now: noon}, 2},
+		{"other ISP", GeoIPData{ISP: "ISP2"}, TrafficRulesConditions{Now: noon}, 1},
+		{"load", GeoIPData{}, TrafficRulesConditions{Now: noon, EstablishedClients: 100, CPUUtilization: 0.5}, 3},
+		{"clients only", GeoIPData{}, TrafficRulesConditions{Now: noon, EstablishedClients: 100}, 1},
+		{"CPU only", GeoIPData{}, TrafficRulesConditions{Now: noon, CPUUtilization: 0.9}, 1},
+		{"morning", GeoIPData{}, TrafficRulesConditions{Now: morning}, 4},
+		{"night", GeoIPData{}, TrafficRulesConditions{Now: night}, 4},
+		{"early morning", GeoIPData{}, TrafficRulesConditions{Now: earlyMorning}, 4},
+		{"unknown time zone", GeoIPData{TimeZone: "Invalid/Zone"}, TrafficRulesConditions{Now: morning}, 4},
+		// 12:00 UTC is 08:00 EDT.
+		{"local morning", GeoIPData{TimeZone: "America/New_York"}, TrafficRulesConditions{Now: noon}, 4},
+		{"local afternoon", GeoIPData{TimeZone: "America/New_York"}, TrafficRulesConditions{Now: morning}, 1},
+	}
+
+	for _, testCase := range testCases {
+
+		trafficRules := trafficRulesSet.GetTrafficRules(
+			true, "OSSH", testCase.geoIPData, handshakeState{}, testCase.conditions)
+
+		if *trafficRules.RateLimits.ReadBytesPerSecond != testCase.expectedReadBytesPerSecond {
+			t.Fatalf("unexpected ReadBytesPerSecond: %s: %d",
+				testCase.description, *trafficRules.RateLimits.ReadBytesPerSecond)
+		}
+	}
+
+	// The signature changes only when load or time-of-day filter outcomes
+	// change.
+
+	for _, timeZone := range []string{"", "America/New_York"} {
+
+		signature := trafficRulesSet.GetConditionsSignature(
+			TrafficRulesConditions{Now: noon}, timeZone)
+
+		if trafficRulesSet.GetConditionsSignature(
+			TrafficRulesConditions{Now: noon.Add(time.Minute), EstablishedClients: 99}, timeZone) != signature {
+			t.Fatalf("unexpected signature change: %s", timeZone)
+		}
+
+		if trafficRulesSet.GetConditionsSignature(
+			TrafficRulesConditions{Now: noon, EstablishedClients: 100, CPUUtilization: 0.5}, timeZone) == signature {
+			t.Fatalf("unexpected unchanged signature for load: %s", timeZone)
+		}
+	}
+
+	// 13:00 UTC is in neither UTC window; it is 09:00 EDT, the end of the
+	// morning window in America/New_York.
+
+	if trafficRulesSet.GetConditionsSignature(TrafficRulesConditions{Now: noon}, "") !=
+		trafficRulesSet.GetConditionsSignature(TrafficRulesConditions{Now: noon.Add(time.Hour)}, "") {
+		t.Fatalf("unexpected signature change for time of day")
+	}
+
+	if trafficRulesSet.GetConditionsSignature(TrafficRulesConditions{Now: noon}, "America/New_York") ==
+		trafficRulesSet.GetConditionsSignature(TrafficRulesConditions{Now: noon.Add(time.Hour)}, "America/New_York") {
+		t.Fatalf("unexpected unchanged signature for time of day")
+	}
+
+	// Server load matches are subject to hysteresis.
+
+	var previous TrafficRulesConditions
+
+	for _, testCase := range []struct {
+		establishedClients int
+		cpuUtilization     float64
+		expectedMatch      bool
+	}{
+		{99, 0.5, false},
+		{100, 0.5, true},
+		{95, 0.46, true},
+		{91, 0.5, true},
+		{89, 0.5, false},
+		{95, 0.5, false},
+		{100, 0.5, true},
+		{100, 0.44, false},
+	} {
+
+		conditions := TrafficRulesConditions{
+			Now:                noon,
+			EstablishedClients: testCase.establishedClients,
+			CPUUtilization:     testCase.cpuUtilization,
+		}
+
+		trafficRulesSet.SetServerLoadMatches(&conditions, previous)
+
+		trafficRules := trafficRulesSet.GetTrafficRules(
+			true, "OSSH", GeoIPData{}, handshakeState{}, conditions)
+
+		match := *trafficRules.RateLimits.ReadBytesPerSecond == 3
+		if match != testCase.expectedMatch {
+			t.Fatalf("unexpected server load match: %d, %f: %t",
+				testCase.establishedClients, testCase.cpuUtilization, match)
+		}
+
+		previous = conditions
+	}
+
+	// Invalid filters are rejected.
+
+	for _, invalidFilter := range []string{
+		`{"MinEstablishedClients" : -1}`,
+		`{"MinCPUUtilization" : 1.5}`,
+		`{"TimeOfDay" : [{"Start" : "8am", "End" : "09:00"}]}`,
+		`{"TimeOfDay" : [{"Start" : "08:00", "End" : "24:00"}]}`,
+		`{"TimeOfDay" : [{"Start" : "08:00", "End" : "08:00"}]}`,
+	} {
+
+		err = ioutil.WriteFile(
+			trafficRulesFilename,
+			[]byte(`{"FilteredRules" : [{"Filter" : `+invalidFilter+`, "Rules" : {}}]}`),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		_, err = trafficRulesSet.Reload()
+		if err == nil {
+			t.Fatalf("unexpected Reload success: %s", invalidFilter)
+		}
+	}
+}
+
+func TestTrafficRulesClientChurn(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-traffic-rules-churn-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	// The load filter isn't met by the few test clients, and the time of
+	// day filter window includes all times of day, so no client's filter
+	// outcomes change.
+
+	err = ioutil.WriteFile(
+		trafficRulesFilename,
+		[]byte(`
+		{
+		    "DefaultRules" : {
+		        "RateLimits" : {"ReadBytesPerSecond" : 1}
+		    },
+		    "FilteredRules" : [
+		        {
+		            "Filter" : {
+		                "MinEstablishedClients" : 100
+		            },
+		            "Rules" : {
+		                "RateLimits" : {"ReadBytesPerSecond" : 2}
+		            }
+		        },
+		        {
+		            "Filter" : {
+		                "TimeOfDay" : [{"Start" : "00:00", "End" : "23:59"}]
+		            },
+		            "Rules" : {
+		                "RateLimits" : {"ReadBytesPerSecond" : 3}
+		            }
+		        }
+		    ]
+		}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	trafficRulesSet, err := NewTrafficRulesSet(trafficRulesFilename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	sshServer := &sshServer{
+		support: &SupportServices{TrafficRulesSet: trafficRulesSet},
+		clients: make(map[string]*sshClient),
+	}
+
+	addClient := func(sessionID, timeZone string) {
+		client := &sshClient{
+			sshServer: sshServer,
+			geoIPData: GeoIPData{TimeZone: timeZone},
+			sessionID: sessionID,
+		}
+		client.setTrafficRules()
+		sshServer.clients[sessionID] = client
+	}
+
+	addClient("1", "")
+	addClient("2", "America/New_York")
+
+	if sshServer.updateTrafficRulesConditions() != 0 {
+		t.Fatalf("unexpected traffic rules reset")
+	}
+
+	// Clients, in new time zones, connecting and disconnecting must not
+	// reset the traffic rules of other clients.
+
+	addClient("3", "Asia/Tokyo")
+	delete(sshServer.clients, "2")
+
+	if sshServer.updateTrafficRulesConditions() != 0 {
+		t.Fatalf("unexpected traffic rules reset after client churn")
+	}
+
+	// A change in a filter outcome resets the traffic rules of only the
+	// affected clients.
+
+	for i := 4; i < 102; i++ {
+		addClient(fmt.Sprintf("%d", i), "")
+	}
+
+	if sshServer.updateTrafficRulesConditions() != len(sshServer.clients) {
+		t.Fatalf("unexpected traffic rules reset count")
+	}
+
+	if sshServer.updateTrafficRulesConditions() != 0 {
+		t.Fatalf("unexpected traffic rules reset")
+	}
+}
+
+func TestTrafficRulesPsiphonServerRelay(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-traffic-rules-relay-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	for _, testCase := range []struct {
+		description   string
+		defaultRules  string
+		geoIPData     GeoIPData
+		expectedAllow bool
+	}{
+		// Relaying is allowed when not configured.
+		{"omitted", `{}`, GeoIPData{}, true},
+		{"omitted, filtered", `{}`, GeoIPData{ISP: "ISP1"}, false},
+		{"denied", `{"AllowPsiphonServerRelay" : false}`, GeoIPData{}, false},
+		{"denied, filtered", `{"AllowPsiphonServerRelay" : false}`, GeoIPData{ISP: "ISP2"}, true},
+	} {
+
+		err = ioutil.WriteFile(
+			trafficRulesFilename,
+			[]byte(`
+			{
+			    "DefaultRules" : `+testCase.defaultRules+`,
+			    "FilteredRules" : [
+			        {
+			            "Filter" : {"ISPs" : ["ISP1"]},
+			            "Rules" : {"AllowPsiphonServerRelay" : false}
+			        },
+			        {
+			            "Filter" : {"ISPs" : ["ISP2"]},
+			            "Rules" : {"AllowPsiphonServerRelay" : true}
+			        }
+			    ]
+			}`),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		trafficRulesSet, err := NewTrafficRulesSet(trafficRulesFilename)
+		if err != nil {
+			t.Fatalf("NewTrafficRulesSet failed: %s", err)
+		}
+
+		trafficRules := trafficRulesSet.GetTrafficRules(
+			true, "OSSH", testCase.geoIPData, handshakeState{}, TrafficRulesConditions{Now: time.Now()})
+
+		if *trafficRules.AllowPsiphonServerRelay != testCase.expectedAllow {
+			t.Fatalf("unexpected AllowPsiphonServerRelay: %s: %t",
+				testCase.description, *trafficRules.AllowPsiphonServerRelay)
+		}
+	}
+}
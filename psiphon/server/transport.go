@@ -0,0 +1,272 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
+)
+
+// ServerTransport is the server side of a tunnel protocol transport. The
+// tunnel server binds a listener for each tunnel protocol in
+// TunnelProtocolPorts, using the registered ServerTransport, and runs the
+// (obfuscated) SSH layer over each client connection.
+type ServerTransport struct {
+
+	// ValidateConfig is optional and, when set, checks any server config
+	// values required by the transport. listenPort is the
+	// TunnelProtocolPorts value for the transport.
+	ValidateConfig func(config *Config, listenPort int) error
+
+	// ListenIPv4Only indicates that the transport listens only on
+	// ServerIPAddress, and not also on ServerIPv6Address.
+	ListenIPv4Only bool
+
+	// Listen binds the transport listener.
+	Listen func(
+		support *SupportServices,
+		listenIPAddress string,
+		listenPort int) (net.Listener, error)
+
+	// Serve is optional. When set, Serve runs the transport over the
+	// listener, calling HandleClient for each client connection, and blocks
+	// until the listener is closed or shutdown is broadcast. When not set,
+	// each connection accepted from the listener is a client connection.
+	Serve func(serveParams *TransportServeParameters) error
+}
+
+// TransportServeParameters is the input to ServerTransport.Serve.
+type TransportServeParameters struct {
+	Support        *SupportServices
+	Listener       net.Listener
+	TunnelProtocol string
+
+	// HandleClient runs the SSH layer over a client connection.
+	// clientTunnelProtocol is the tunnel protocol declared by the client,
+	// or "" when there is none; see protocol.UseClientTunnelProtocol.
+	HandleClient func(clientTunnelProtocol string, clientConn net.Conn)
+
+	ShutdownBroadcast <-chan struct{}
+
+	sshServer *sshServer
+}
+
+var serverTransports = make(map[string]*ServerTransport)
+
+// RegisterServerTransport registers the server transport for the specified
+// tunnel protocol, which must already be registered with
+// protocol.RegisterTransport. RegisterServerTransport is not safe for
+// concurrent use and must be called from an init function.
+//
+// RegisterServerTransport panics if the tunnel protocol is not registered
+// or if a server transport is already registered for the tunnel protocol.
+func RegisterServerTransport(tunnelProtocol string, transport *ServerTransport) {
+
+	if protocol.GetTransport(tunnelProtocol) == nil {
+		panic(fmt.Sprintf("unregistered tunnel protocol: %s", tunnelProtocol))
+	}
+	if _, ok := serverTransports[tunnelProtocol]; ok {
+		panic(fmt.Sprintf("duplicate server transport: %s", tunnelProtocol))
+	}
+
+	serverTransports[tunnelProtocol] = transport
+}
+
+// GetServerTransport returns the server transport registered for the
+// specified tunnel protocol, or nil when there is none.
+func GetServerTransport(tunnelProtocol string) *ServerTransport {
+	return serverTransports[tunnelProtocol]
+}
+
+func init() {
+
+	for _, tunnelProtocol := range []string{
+		protocol.TUNNEL_PROTOCOL_SSH,
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH} {
+
+		RegisterServerTransport(
+			tunnelProtocol,
+			&ServerTransport{
+				Listen: listenTCPTransport,
+			})
+	}
+
+	for _, tunnelProtocol := range []string{
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET,
+		protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+		protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP} {
+
+		tunnelProtocol := tunnelProtocol
+
+		RegisterServerTransport(
+			tunnelProtocol,
+			&ServerTransport{
+				ValidateConfig: func(config *Config, _ int) error {
+					if config.MeekCookieEncryptionPrivateKey == "" || config.MeekObfuscatedKey == "" {
+						return fmt.Errorf(
+							"Tunnel protocol %s requires MeekCookieEncryptionPrivateKey, MeekObfuscatedKey",
+							tunnelProtocol)
+					}
+					return nil
+				},
+				Listen: listenTCPTransport,
+				Serve:  serveMeekTransport,
+			})
+	}
+
+	for _, tunnelProtocol := range []string{
+		protocol.TUNNEL_PROTOCOL_FRONTED_WEBSOCKET,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_WEBSOCKET} {
+
+		RegisterServerTransport(
+			tunnelProtocol,
+			&ServerTransport{
+				Listen: listenTCPTransport,
+				Serve:  serveWebSocketTransport,
+			})
+	}
+
+	RegisterServerTransport(
+		protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
+		&ServerTransport{
+			Listen: func(
+				_ *SupportServices,
+				listenIPAddress string,
+				listenPort int) (net.Listener, error) {
+
+				listener, err := quic.Listen(
+					net.JoinHostPort(listenIPAddress, strconv.Itoa(listenPort)))
+				if err != nil {
+					return nil, common.ContextError(err)
+				}
+				return listener, nil
+			},
+		})
+
+	RegisterServerTransport(
+		protocol.TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH,
+		&ServerTransport{
+			ValidateConfig: func(_ *Config, listenPort int) error {
+				if listenPort != 0 {
+					return fmt.Errorf(
+						"Tunnel protocol %s port is specified in format, not TunnelProtocolPorts",
+						protocol.TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH)
+				}
+				return nil
+			},
+			ListenIPv4Only: true,
+			Listen: func(
+				support *SupportServices,
+				listenIPAddress string,
+				_ int) (net.Listener, error) {
+
+				listener, err := marionette.Listen(
+					listenIPAddress,
+					support.Config.MarionetteFormat)
+				if err != nil {
+					return nil, common.ContextError(err)
+				}
+				return listener, nil
+			},
+		})
+
+	RegisterServerTransport(
+		protocol.TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH,
+		&ServerTransport{
+			ListenIPv4Only: true,
+			Listen: func(
+				_ *SupportServices,
+				listenIPAddress string,
+				listenPort int) (net.Listener, error) {
+
+				listener, err := tapdance.Listen(
+					net.JoinHostPort(listenIPAddress, strconv.Itoa(listenPort)))
+				if err != nil {
+					return nil, common.ContextError(err)
+				}
+				return listener, nil
+			},
+		})
+}
+
+func listenTCPTransport(
+	_ *SupportServices,
+	listenIPAddress string,
+	listenPort int) (net.Listener, error) {
+
+	localAddress := net.JoinHostPort(listenIPAddress, strconv.Itoa(listenPort))
+
+	// Use the listener inherited from the previous server process, if any;
+	// see startListenerHandoff.
+	listener, err := getInheritedListener(localAddress)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if listener != nil {
+		return listener, nil
+	}
+
+	listener, err = net.Listen("tcp", localAddress)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return listener, nil
+}
+
+func serveMeekTransport(serveParams *TransportServeParameters) error {
+
+	meekServer, err := NewMeekServer(
+		serveParams.Support,
+		serveParams.Listener,
+		protocol.TunnelProtocolUsesMeekHTTPS(serveParams.TunnelProtocol),
+		protocol.TunnelProtocolUsesObfuscatedSessionTickets(serveParams.TunnelProtocol),
+		serveParams.HandleClient,
+		serveParams.ShutdownBroadcast)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	sshServer := serveParams.sshServer
+
+	sshServer.meekServersMutex.Lock()
+	sshServer.meekServers[meekServer] = serveParams.TunnelProtocol
+	sshServer.meekServersMutex.Unlock()
+
+	err = meekServer.Run()
+
+	sshServer.meekServersMutex.Lock()
+	delete(sshServer.meekServers, meekServer)
+	sshServer.meekServersMutex.Unlock()
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -38,14 +38,12 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/accesscontrol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 	"github.com/marusama/semaphore"
 	cache "github.com/patrickmn/go-cache"
 )
@@ -63,6 +61,7 @@ const (
 	SSH_SEND_OSL_RETRY_FACTOR             = 2
 	OSL_SESSION_CACHE_TTL                 = 5 * time.Minute
 	MAX_AUTHORIZATIONS                    = 16
+	DRAIN_CLIENTS_POLL_PERIOD             = 1 * time.Second
 )
 
 // TunnelServer is the main server that accepts Psiphon client
@@ -78,6 +77,8 @@ type TunnelServer struct {
 	listenerError     chan error
 	shutdownBroadcast <-chan struct{}
 	sshServer         *sshServer
+	tcpListenersMutex sync.Mutex
+	tcpListeners      map[string]*net.TCPListener
 }
 
 // NewTunnelServer initializes a new tunnel server.
@@ -133,63 +134,79 @@ func (server *TunnelServer) Run() error {
 	// start accepting connections on each.
 
 	var listeners []*sshListener
+	tcpListeners := make(map[string]*net.TCPListener)
 
-	for tunnelProtocol, listenPort := range support.Config.TunnelProtocolPorts {
-
-		localAddress := fmt.Sprintf(
-			"%s:%d", support.Config.ServerIPAddress, listenPort)
+	// When ServerIPv6Address is configured, each tunnel protocol listener,
+	// except for those with ListenIPv4Only transports, such as Marionette and
+	// TapDance, is also bound to that address.
 
-		var listener net.Listener
-		var err error
+	listenIPAddresses := []string{support.Config.ServerIPAddress}
+	if support.Config.ServerIPv6Address != "" {
+		listenIPAddresses = append(listenIPAddresses, support.Config.ServerIPv6Address)
+	}
 
-		if protocol.TunnelProtocolUsesQUIC(tunnelProtocol) {
+	for tunnelProtocol, listenPort := range support.Config.TunnelProtocolPorts {
 
-			listener, err = quic.Listen(localAddress)
+		serverTransport := GetServerTransport(tunnelProtocol)
+		if serverTransport == nil {
+			for _, existingListener := range listeners {
+				existingListener.Listener.Close()
+			}
+			return common.ContextError(
+				fmt.Errorf("unsupported tunnel protocol: %s", tunnelProtocol))
+		}
 
-		} else if protocol.TunnelProtocolUsesMarionette(tunnelProtocol) {
+		for i, listenIPAddress := range listenIPAddresses {
 
-			listener, err = marionette.Listen(
-				support.Config.ServerIPAddress,
-				support.Config.MarionetteFormat)
+			if i > 0 && serverTransport.ListenIPv4Only {
+				continue
+			}
 
-		} else if protocol.TunnelProtocolUsesTapdance(tunnelProtocol) {
+			localAddress := net.JoinHostPort(listenIPAddress, strconv.Itoa(listenPort))
 
-			listener, err = tapdance.Listen(localAddress)
+			listener, err := serverTransport.Listen(support, listenIPAddress, listenPort)
+			if err != nil {
+				for _, existingListener := range listeners {
+					existingListener.Listener.Close()
+				}
+				return common.ContextError(err)
+			}
 
-		} else {
+			// TCP listeners may be handed off to a new server process; see
+			// HandOffListeners.
+			if tcpListener, ok := listener.(*net.TCPListener); ok {
+				tcpListeners[localAddress] = tcpListener
+			}
 
-			listener, err = net.Listen("tcp", localAddress)
-		}
+			tacticsListener := tactics.NewListener(
+				listener,
+				support.TacticsServer,
+				tunnelProtocol,
+				func(IPAddress string) common.GeoIPData {
+					return common.GeoIPData(support.GeoIPService.Lookup(IPAddress))
+				})
 
-		if err != nil {
-			for _, existingListener := range listeners {
-				existingListener.Listener.Close()
-			}
-			return common.ContextError(err)
+			log.WithContextFields(
+				LogFields{
+					"localAddress":   localAddress,
+					"tunnelProtocol": tunnelProtocol,
+				}).Info("listening")
+
+			listeners = append(
+				listeners,
+				&sshListener{
+					Listener:       tacticsListener,
+					localAddress:   localAddress,
+					tunnelProtocol: tunnelProtocol,
+				})
 		}
+	}
 
-		tacticsListener := tactics.NewListener(
-			listener,
-			support.TacticsServer,
-			tunnelProtocol,
-			func(IPAddress string) common.GeoIPData {
-				return common.GeoIPData(support.GeoIPService.Lookup(IPAddress))
-			})
+	completeListenerHandoff()
 
-		log.WithContextFields(
-			LogFields{
-				"localAddress":   localAddress,
-				"tunnelProtocol": tunnelProtocol,
-			}).Info("listening")
-
-		listeners = append(
-			listeners,
-			&sshListener{
-				Listener:       tacticsListener,
-				localAddress:   localAddress,
-				tunnelProtocol: tunnelProtocol,
-			})
-	}
+	server.tcpListenersMutex.Lock()
+	server.tcpListeners = tcpListeners
+	server.tcpListenersMutex.Unlock()
 
 	for _, listener := range listeners {
 		server.runWaitGroup.Add(1)
@@ -237,8 +254,38 @@ func (server *TunnelServer) Run() error {
 // broken down by protocol ("SSH", "OSSH", etc.) and type. Types of stats
 // include current connected client count, total number of current port
 // forwards.
+//
+// Port forward quality metrics, such as "tcp_port_forward_dialed_count", are
+// counted since the previous GetLoadStats call, and are reset.
 func (server *TunnelServer) GetLoadStats() (ProtocolStats, RegionStats) {
-	return server.sshServer.getLoadStats()
+	return server.sshServer.getLoadStats(true)
+}
+
+// PeekLoadStats returns the same load stats as GetLoadStats, but does not
+// reset the port forward quality metrics.
+func (server *TunnelServer) PeekLoadStats() (ProtocolStats, RegionStats) {
+	return server.sshServer.getLoadStats(false)
+}
+
+// GetQualityMetricsTotals returns the port forward quality metrics, such as
+// "tcp_port_forward_dialed_count", counted since the server started. Unlike
+// the quality metrics in the load stats, these totals are never reset and
+// include disconnected clients.
+func (server *TunnelServer) GetQualityMetricsTotals() (ProtocolStats, RegionStats) {
+	return server.sshServer.getQualityMetricsTotals()
+}
+
+// GetSSHHandshakeStats returns the number of SSH handshakes currently in
+// progress and the MaxConcurrentSSHHandshakes limit. When there is no limit,
+// concurrent SSH handshakes are not counted and both values are 0.
+func (server *TunnelServer) GetSSHHandshakeStats() (int, int) {
+	return server.sshServer.getSSHHandshakeStats()
+}
+
+// GetMeekSessionCounts returns the number of current meek sessions for each
+// running meek tunnel protocol.
+func (server *TunnelServer) GetMeekSessionCounts() map[string]int64 {
+	return server.sshServer.getMeekSessionCounts()
 }
 
 // ResetAllClientTrafficRules resets all established client traffic rules
@@ -290,6 +337,35 @@ func (server *TunnelServer) ExpectClientDomainBytes(
 	return server.sshServer.expectClientDomainBytes(sessionID)
 }
 
+// TakePacketTunnelDomainBytes returns the domain bytes transferred by the
+// client's packet tunnel flows since the previous call, and resets the
+// counts. Unlike port forward domain bytes, which are reported by the
+// client, packet tunnel domain bytes are recorded by the server.
+func (server *TunnelServer) TakePacketTunnelDomainBytes(
+	sessionID string) (map[string]int64, error) {
+
+	return server.sshServer.takePacketTunnelDomainBytes(sessionID)
+}
+
+// GetClientQuotaStatus returns the client's traffic rules quotas and the
+// bytes remaining in the current period of each quota. The status is
+// empty when the client has no quotas or when quotas are not enforced.
+func (server *TunnelServer) GetClientQuotaStatus(
+	sessionID string) ([]protocol.QuotaStatus, error) {
+
+	return server.sshServer.getClientQuotaStatus(sessionID)
+}
+
+// UpdateTrafficRulesConditions samples the server load conditions used in
+// traffic rules filtering. When the outcome of any traffic rules load or
+// time-of-day filter changes for a client, that client's traffic rules are
+// reset.
+// UpdateTrafficRulesConditions is to be called periodically; see
+// TRAFFIC_RULES_CONDITIONS_UPDATE_PERIOD.
+func (server *TunnelServer) UpdateTrafficRulesConditions() {
+	server.sshServer.updateTrafficRulesConditions()
+}
+
 // SetEstablishTunnels sets whether new tunnels may be established or not.
 // When not establishing, incoming connections are immediately closed.
 func (server *TunnelServer) SetEstablishTunnels(establish bool) {
@@ -301,6 +377,77 @@ func (server *TunnelServer) GetEstablishTunnels() bool {
 	return server.sshServer.getEstablishTunnels()
 }
 
+// ClientSummary is a summary of a connected client, as reported by the
+// admin API. Bytes transferred include protocol overhead. Duration is in
+// milliseconds and, as in "server_tunnel" logs, is the time until the last
+// data was received from the client.
+type ClientSummary struct {
+	SessionID             string    `json:"session_id"`
+	TunnelProtocol        string    `json:"tunnel_protocol"`
+	Region                string    `json:"region"`
+	ISP                   string    `json:"isp"`
+	HandshakeCompleted    bool      `json:"handshake_completed"`
+	AuthorizedAccessTypes []string  `json:"authorized_access_types"`
+	AuthorizationsRevoked bool      `json:"authorizations_revoked"`
+	StartTime             time.Time `json:"start_time"`
+	Duration              int64     `json:"duration"`
+	BytesUp               int64     `json:"bytes_up"`
+	BytesDown             int64     `json:"bytes_down"`
+}
+
+// GetClientSummaries returns a summary of each established client.
+func (server *TunnelServer) GetClientSummaries() []ClientSummary {
+	return server.sshServer.getClientSummaries()
+}
+
+// StopClient disconnects the client with the specified session ID.
+func (server *TunnelServer) StopClient(sessionID string) error {
+	return server.sshServer.stopClient(sessionID)
+}
+
+// RevokeClientAuthorizations revokes the authorizations of the client with
+// the specified session ID. The client's traffic rules are reset to those
+// for an unauthorized client.
+func (server *TunnelServer) RevokeClientAuthorizations(sessionID string) error {
+	return server.sshServer.revokeClientAuthorizations(sessionID)
+}
+
+// HandOffListeners starts a new server process which inherits the tunnel
+// server's TCP listeners, and then stops accepting connections on those
+// listeners in this process. Existing clients are not affected; use Drain
+// to move clients off this process before shutting down.
+//
+// HandOffListeners fails, and this process continues accepting connections,
+// when the new process fails to start or to bind its listeners.
+func (server *TunnelServer) HandOffListeners() error {
+
+	server.tcpListenersMutex.Lock()
+	defer server.tcpListenersMutex.Unlock()
+
+	err := startListenerHandoff(server.tcpListeners)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	server.sshServer.setListenersHandedOff()
+
+	for _, listener := range server.tcpListeners {
+		listener.Close()
+	}
+	server.tcpListeners = nil
+
+	return nil
+}
+
+// Drain stops establishing new tunnels, signals connected clients to
+// establish replacement tunnels to other servers, and waits until all
+// clients have disconnected or ctx is done. Clients which don't support
+// server requests are not signaled and remain connected until they
+// disconnect or the tunnel server is shut down.
+func (server *TunnelServer) Drain(ctx context.Context) {
+	server.sshServer.drainClients(ctx)
+}
+
 type sshServer struct {
 	// Note: 64-bit ints used with atomic operations are placed
 	// at the start of struct to ensure 64-bit alignment.
@@ -309,6 +456,7 @@ type sshServer struct {
 	authFailedCount              int64
 	support                      *SupportServices
 	establishTunnels             int32
+	listenersHandedOff           int32
 	concurrentSSHHandshakes      semaphore.Semaphore
 	shutdownBroadcast            <-chan struct{}
 	sshHostKey                   ssh.Signer
@@ -320,6 +468,15 @@ type sshServer struct {
 	oslSessionCache              *cache.Cache
 	authorizationSessionIDsMutex sync.Mutex
 	authorizationSessionIDs      map[string]string
+	meekServersMutex             sync.Mutex
+	meekServers                  map[*MeekServer]string
+	trafficRulesConditionsMutex  sync.Mutex
+	trafficRulesConditions       TrafficRulesConditions
+	qualityMetricsTotalsMutex    sync.Mutex
+	qualityMetricsTotals         map[string]map[string]*qualityMetrics
+	cpuUtilizationSampler        cpuUtilizationSampler
+	readBandwidthScheduler       *common.BandwidthScheduler
+	writeBandwidthScheduler      *common.BandwidthScheduler
 }
 
 func newSSHServer(
@@ -342,6 +499,16 @@ func newSSHServer(
 		concurrentSSHHandshakes = semaphore.New(support.Config.MaxConcurrentSSHHandshakes)
 	}
 
+	var readBandwidthScheduler, writeBandwidthScheduler *common.BandwidthScheduler
+	if support.Config.HostBandwidthReadBytesPerSecond > 0 {
+		readBandwidthScheduler = common.NewBandwidthScheduler(
+			support.Config.HostBandwidthReadBytesPerSecond)
+	}
+	if support.Config.HostBandwidthWriteBytesPerSecond > 0 {
+		writeBandwidthScheduler = common.NewBandwidthScheduler(
+			support.Config.HostBandwidthWriteBytesPerSecond)
+	}
+
 	// The OSL session cache temporarily retains OSL seed state
 	// progress for disconnected clients. This enables clients
 	// that disconnect and immediately reconnect to the same
@@ -365,6 +532,10 @@ func newSSHServer(
 		clients:                 make(map[string]*sshClient),
 		oslSessionCache:         oslSessionCache,
 		authorizationSessionIDs: make(map[string]string),
+		meekServers:             make(map[*MeekServer]string),
+		qualityMetricsTotals:    make(map[string]map[string]*qualityMetrics),
+		readBandwidthScheduler:  readBandwidthScheduler,
+		writeBandwidthScheduler: writeBandwidthScheduler,
 	}, nil
 }
 
@@ -391,6 +562,16 @@ func (sshServer *sshServer) getEstablishTunnels() bool {
 	return atomic.LoadInt32(&sshServer.establishTunnels) == 1
 }
 
+func (sshServer *sshServer) setListenersHandedOff() {
+	atomic.StoreInt32(&sshServer.listenersHandedOff, 1)
+}
+
+// getListenersHandedOff indicates whether listeners were handed off to
+// another process and closed, in which case listener errors are expected.
+func (sshServer *sshServer) getListenersHandedOff() bool {
+	return atomic.LoadInt32(&sshServer.listenersHandedOff) == 1
+}
+
 // runListener is intended to run an a goroutine; it blocks
 // running a particular listener. If an unrecoverable error
 // occurs, it will send the error to the listenerError channel.
@@ -438,22 +619,24 @@ func (sshServer *sshServer) runListener(
 	// TunnelServer.Run will properly shut down instead of remaining
 	// running.
 
-	if protocol.TunnelProtocolUsesMeekHTTP(listenerTunnelProtocol) ||
-		protocol.TunnelProtocolUsesMeekHTTPS(listenerTunnelProtocol) {
+	serverTransport := GetServerTransport(listenerTunnelProtocol)
 
-		meekServer, err := NewMeekServer(
-			sshServer.support,
-			listener,
-			protocol.TunnelProtocolUsesMeekHTTPS(listenerTunnelProtocol),
-			protocol.TunnelProtocolUsesObfuscatedSessionTickets(listenerTunnelProtocol),
-			handleClient,
-			sshServer.shutdownBroadcast)
+	if serverTransport != nil && serverTransport.Serve != nil {
 
-		if err == nil {
-			err = meekServer.Run()
-		}
+		err := serverTransport.Serve(
+			&TransportServeParameters{
+				Support:           sshServer.support,
+				Listener:          listener,
+				TunnelProtocol:    listenerTunnelProtocol,
+				HandleClient:      handleClient,
+				ShutdownBroadcast: sshServer.shutdownBroadcast,
+				sshServer:         sshServer,
+			})
 
 		if err != nil {
+			if sshServer.getListenersHandedOff() {
+				return
+			}
 			select {
 			case listenerError <- common.ContextError(err):
 			default:
@@ -482,6 +665,10 @@ func (sshServer *sshServer) runListener(
 					continue
 				}
 
+				if sshServer.getListenersHandedOff() {
+					return
+				}
+
 				select {
 				case listenerError <- common.ContextError(err):
 				default:
@@ -582,7 +769,7 @@ func (sshServer *sshServer) unregisterEstablishedClient(client *sshClient) {
 type ProtocolStats map[string]map[string]int64
 type RegionStats map[string]map[string]map[string]int64
 
-func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
+func (sshServer *sshServer) getLoadStats(resetQualityMetrics bool) (ProtocolStats, RegionStats) {
 
 	sshServer.clientsMutex.Lock()
 	defer sshServer.clientsMutex.Unlock()
@@ -679,11 +866,13 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 				client.qualityMetrics.tcpPortForwardRejectedDialingLimitCount
 		}
 
-		client.qualityMetrics.tcpPortForwardDialedCount = 0
-		client.qualityMetrics.tcpPortForwardDialedDuration = 0
-		client.qualityMetrics.tcpPortForwardFailedCount = 0
-		client.qualityMetrics.tcpPortForwardFailedDuration = 0
-		client.qualityMetrics.tcpPortForwardRejectedDialingLimitCount = 0
+		if resetQualityMetrics {
+			client.qualityMetrics.tcpPortForwardDialedCount = 0
+			client.qualityMetrics.tcpPortForwardDialedDuration = 0
+			client.qualityMetrics.tcpPortForwardFailedCount = 0
+			client.qualityMetrics.tcpPortForwardFailedDuration = 0
+			client.qualityMetrics.tcpPortForwardRejectedDialingLimitCount = 0
+		}
 
 		client.Unlock()
 	}
@@ -691,6 +880,107 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 	return protocolStats, regionStats
 }
 
+// updateQualityMetricsTotals applies update to the server lifetime quality
+// metrics totals for the specified tunnel protocol and client region.
+func (sshServer *sshServer) updateQualityMetricsTotals(
+	tunnelProtocol, region string, update func(*qualityMetrics)) {
+
+	sshServer.qualityMetricsTotalsMutex.Lock()
+	defer sshServer.qualityMetricsTotalsMutex.Unlock()
+
+	regionTotals, ok := sshServer.qualityMetricsTotals[region]
+	if !ok {
+		regionTotals = make(map[string]*qualityMetrics)
+		sshServer.qualityMetricsTotals[region] = regionTotals
+	}
+
+	totals, ok := regionTotals[tunnelProtocol]
+	if !ok {
+		totals = new(qualityMetrics)
+		regionTotals[tunnelProtocol] = totals
+	}
+
+	update(totals)
+}
+
+func (sshServer *sshServer) getQualityMetricsTotals() (ProtocolStats, RegionStats) {
+
+	sshServer.qualityMetricsTotalsMutex.Lock()
+	defer sshServer.qualityMetricsTotalsMutex.Unlock()
+
+	// Explicitly populate with zeros to ensure 0 counts for all
+	// running tunnel protocols.
+	zeroProtocolStats := func() map[string]map[string]int64 {
+		stats := make(map[string]map[string]int64)
+		stats["ALL"] = new(qualityMetrics).getStats()
+		for tunnelProtocol := range sshServer.support.Config.TunnelProtocolPorts {
+			stats[tunnelProtocol] = new(qualityMetrics).getStats()
+		}
+		return stats
+	}
+
+	protocolStats := zeroProtocolStats()
+	regionStats := make(RegionStats)
+
+	for region, regionTotals := range sshServer.qualityMetricsTotals {
+
+		regionStats[region] = zeroProtocolStats()
+
+		for tunnelProtocol, totals := range regionTotals {
+
+			if protocolStats[tunnelProtocol] == nil {
+				protocolStats[tunnelProtocol] = new(qualityMetrics).getStats()
+			}
+			if regionStats[region][tunnelProtocol] == nil {
+				regionStats[region][tunnelProtocol] = new(qualityMetrics).getStats()
+			}
+
+			stats := []map[string]int64{
+				protocolStats["ALL"],
+				protocolStats[tunnelProtocol],
+				regionStats[region]["ALL"],
+				regionStats[region][tunnelProtocol]}
+
+			for _, stat := range stats {
+				for name, value := range totals.getStats() {
+					stat[name] += value
+				}
+			}
+		}
+	}
+
+	return protocolStats, regionStats
+}
+
+func (sshServer *sshServer) getSSHHandshakeStats() (int, int) {
+	if sshServer.support.Config.MaxConcurrentSSHHandshakes <= 0 {
+		return 0, 0
+	}
+	return sshServer.concurrentSSHHandshakes.GetCount(),
+		sshServer.concurrentSSHHandshakes.GetLimit()
+}
+
+func (sshServer *sshServer) getMeekSessionCounts() map[string]int64 {
+
+	sshServer.meekServersMutex.Lock()
+	defer sshServer.meekServersMutex.Unlock()
+
+	// Explicitly populate with zeros to ensure 0 counts for all
+	// running meek protocols.
+	counts := make(map[string]int64)
+	for tunnelProtocol := range sshServer.support.Config.TunnelProtocolPorts {
+		if protocol.TunnelProtocolUsesMeek(tunnelProtocol) {
+			counts[tunnelProtocol] = 0
+		}
+	}
+
+	for meekServer, tunnelProtocol := range sshServer.meekServers {
+		counts[tunnelProtocol] += int64(meekServer.getSessionCount())
+	}
+
+	return counts
+}
+
 func (sshServer *sshServer) resetAllClientTrafficRules() {
 
 	sshServer.clientsMutex.Lock()
@@ -705,6 +995,74 @@ func (sshServer *sshServer) resetAllClientTrafficRules() {
 	}
 }
 
+// updateTrafficRulesConditions samples the server load conditions and
+// resets the traffic rules of each client for which the outcome of any load
+// or time-of-day filter has changed. Returns the number of clients reset.
+func (sshServer *sshServer) updateTrafficRulesConditions() int {
+
+	sshServer.trafficRulesConditionsMutex.Lock()
+
+	cpuUtilization := sshServer.cpuUtilizationSampler.sample()
+
+	sshServer.clientsMutex.Lock()
+	establishedClients := len(sshServer.clients)
+	clients := make([]*sshClient, 0, len(sshServer.clients))
+	for _, client := range sshServer.clients {
+		clients = append(clients, client)
+	}
+	sshServer.clientsMutex.Unlock()
+
+	conditions := TrafficRulesConditions{
+		Now:                time.Now(),
+		EstablishedClients: establishedClients,
+		CPUUtilization:     cpuUtilization,
+	}
+
+	sshServer.support.TrafficRulesSet.SetServerLoadMatches(
+		&conditions, sshServer.trafficRulesConditions)
+
+	sshServer.trafficRulesConditions = conditions
+
+	sshServer.trafficRulesConditionsMutex.Unlock()
+
+	// Resetting traffic rules also resets the client's throttling state, so
+	// only clients for which the filter outcomes have changed are reset.
+	//
+	// Note: setTrafficRules calls getTrafficRulesConditions, so
+	// trafficRulesConditionsMutex must not be held.
+
+	resetCount := 0
+	for _, client := range clients {
+		if client.trafficRulesConditionsChanged(conditions) {
+			client.setTrafficRules()
+			resetCount += 1
+		}
+	}
+
+	if resetCount > 0 {
+		log.WithContextFields(
+			LogFields{
+				"establishedClients": establishedClients,
+				"cpuUtilization":     cpuUtilization,
+				"resetClients":       resetCount,
+			}).Info("traffic rules conditions changed")
+	}
+
+	return resetCount
+}
+
+// getTrafficRulesConditions returns the most recently sampled server load
+// conditions, with the current time.
+func (sshServer *sshServer) getTrafficRulesConditions() TrafficRulesConditions {
+	sshServer.trafficRulesConditionsMutex.Lock()
+	conditions := sshServer.trafficRulesConditions
+	sshServer.trafficRulesConditionsMutex.Unlock()
+
+	conditions.Now = time.Now()
+
+	return conditions
+}
+
 func (sshServer *sshServer) resetAllClientOSLConfigs() {
 
 	// Flush cached seed state. This has the same effect
@@ -764,13 +1122,13 @@ func (sshServer *sshServer) getClientHandshaked(
 	return completed, exhausted, nil
 }
 
-func (sshServer *sshServer) revokeClientAuthorizations(sessionID string) {
+func (sshServer *sshServer) revokeClientAuthorizations(sessionID string) error {
 	sshServer.clientsMutex.Lock()
 	client := sshServer.clients[sessionID]
 	sshServer.clientsMutex.Unlock()
 
 	if client == nil {
-		return
+		return common.ContextError(errors.New("unknown session ID"))
 	}
 
 	// sshClient.handshakeState.authorizedAccessTypes is not cleared. Clearing
@@ -787,6 +1145,8 @@ func (sshServer *sshServer) revokeClientAuthorizations(sessionID string) {
 	// authorization state.
 
 	client.setTrafficRules()
+
+	return nil
 }
 
 func (sshServer *sshServer) expectClientDomainBytes(
@@ -803,6 +1163,68 @@ func (sshServer *sshServer) expectClientDomainBytes(
 	return client.expectDomainBytes(), nil
 }
 
+func (sshServer *sshServer) takePacketTunnelDomainBytes(
+	sessionID string) (map[string]int64, error) {
+
+	sshServer.clientsMutex.Lock()
+	client := sshServer.clients[sessionID]
+	sshServer.clientsMutex.Unlock()
+
+	if client == nil {
+		return nil, common.ContextError(errors.New("unknown session ID"))
+	}
+
+	return client.takePacketTunnelDomainBytes(), nil
+}
+
+func (sshServer *sshServer) getClientQuotaStatus(
+	sessionID string) ([]protocol.QuotaStatus, error) {
+
+	sshServer.clientsMutex.Lock()
+	client := sshServer.clients[sessionID]
+	sshServer.clientsMutex.Unlock()
+
+	if client == nil {
+		return nil, common.ContextError(errors.New("unknown session ID"))
+	}
+
+	return client.getQuotaStatus(), nil
+}
+
+func (sshServer *sshServer) getClientSummaries() []ClientSummary {
+
+	sshServer.clientsMutex.Lock()
+	clients := make([]*sshClient, 0, len(sshServer.clients))
+	for _, client := range sshServer.clients {
+		clients = append(clients, client)
+	}
+	sshServer.clientsMutex.Unlock()
+
+	summaries := make([]ClientSummary, len(clients))
+	for i, client := range clients {
+		summaries[i] = client.getSummary()
+	}
+
+	return summaries
+}
+
+func (sshServer *sshServer) stopClient(sessionID string) error {
+
+	sshServer.clientsMutex.Lock()
+	client := sshServer.clients[sessionID]
+	sshServer.clientsMutex.Unlock()
+
+	if client == nil {
+		return common.ContextError(errors.New("unknown session ID"))
+	}
+
+	log.WithContextFields(LogFields{"session_id": sessionID}).Info("stopping client")
+
+	client.stop()
+
+	return nil
+}
+
 func (sshServer *sshServer) stopClients() {
 
 	sshServer.clientsMutex.Lock()
@@ -816,6 +1238,48 @@ func (sshServer *sshServer) stopClients() {
 	}
 }
 
+// drainClients stops establishing new tunnels and, until all clients have
+// disconnected or ctx is done, periodically signals each client to
+// establish a replacement tunnel. Clients are signaled only once, after
+// completing the API handshake; polling ensures clients that complete the
+// handshake while draining are also signaled.
+func (sshServer *sshServer) drainClients(ctx context.Context) {
+
+	sshServer.setEstablishTunnels(false)
+
+	log.WithContext().Info("draining clients")
+
+	ticker := time.NewTicker(DRAIN_CLIENTS_POLL_PERIOD)
+	defer ticker.Stop()
+
+	for {
+
+		sshServer.clientsMutex.Lock()
+		clients := make([]*sshClient, 0, len(sshServer.clients))
+		for _, client := range sshServer.clients {
+			clients = append(clients, client)
+		}
+		sshServer.clientsMutex.Unlock()
+
+		if len(clients) == 0 {
+			log.WithContext().Info("drained clients")
+			return
+		}
+
+		for _, client := range clients {
+			client.signalDraining()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.WithContextFields(
+				LogFields{"remaining_clients": len(clients)}).Info("drain ended")
+			return
+		}
+	}
+}
+
 func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.Conn) {
 
 	// Calling clientConn.RemoteAddr at this point, before any Read calls,
@@ -914,18 +1378,31 @@ type sshClient struct {
 	sshConn                              ssh.Conn
 	activityConn                         *common.ActivityMonitoredConn
 	throttledConn                        *common.ThrottledConn
+	readBandwidthFlow                    *common.BandwidthFlow
+	writeBandwidthFlow                   *common.BandwidthFlow
 	geoIPData                            GeoIPData
 	sessionID                            string
 	isFirstTunnelInSession               bool
 	supportsServerRequests               bool
+	drainSignaled                        bool
 	handshakeState                       handshakeState
 	udpChannel                           ssh.Channel
 	packetTunnelChannel                  ssh.Channel
 	trafficRules                         TrafficRules
+	trafficRulesConditionsSignature      string
 	tcpTrafficState                      trafficState
 	udpTrafficState                      trafficState
 	qualityMetrics                       qualityMetrics
 	tcpPortForwardLRU                    *common.LRUConns
+	packetTunnelUDPPortForwardLRU        *common.LRUConns
+	packetTunnelDomainBytes              map[string]*int64
+	quotaUpdateMutex                     sync.Mutex
+	quotaKey                             string
+	quotaPendingBytes                    *int64
+	connBytesUp                          *int64
+	connBytesDown                        *int64
+	quotaStatus                          []protocol.QuotaStatus
+	quotaRateLimits                      *common.RateLimits
 	oslClientSeedState                   *osl.ClientSeedState
 	signalIssueSLOKs                     chan struct{}
 	runCtx                               context.Context
@@ -943,6 +1420,7 @@ type trafficState struct {
 	concurrentPortForwardCount            int64
 	peakConcurrentPortForwardCount        int64
 	totalPortForwardCount                 int64
+	blockedDomainCount                    int64
 	availablePortForwardCond              *sync.Cond
 }
 
@@ -951,6 +1429,8 @@ type trafficState struct {
 // and, in aggregate, is a measure of the quality of the
 // upstream link. These stats are recorded by each sshClient
 // and then reported and reset in sshServer.getLoadStats().
+// The same stats are also accumulated, and never reset, in
+// sshServer.qualityMetricsTotals.
 type qualityMetrics struct {
 	tcpPortForwardDialedCount               int64
 	tcpPortForwardDialedDuration            time.Duration
@@ -959,6 +1439,35 @@ type qualityMetrics struct {
 	tcpPortForwardRejectedDialingLimitCount int64
 }
 
+func (metrics *qualityMetrics) addDialResult(
+	tcpPortForwardDialSuccess bool, dialDuration time.Duration) {
+
+	if tcpPortForwardDialSuccess {
+		metrics.tcpPortForwardDialedCount += 1
+		metrics.tcpPortForwardDialedDuration += dialDuration
+
+	} else {
+		metrics.tcpPortForwardFailedCount += 1
+		metrics.tcpPortForwardFailedDuration += dialDuration
+	}
+}
+
+func (metrics *qualityMetrics) addRejectedDialingLimit() {
+	metrics.tcpPortForwardRejectedDialingLimitCount += 1
+}
+
+// getStats returns the metrics as named stats, with durations in
+// milliseconds, as in the load stats.
+func (metrics *qualityMetrics) getStats() map[string]int64 {
+	return map[string]int64{
+		"tcp_port_forward_dialed_count":                 metrics.tcpPortForwardDialedCount,
+		"tcp_port_forward_dialed_duration":              int64(metrics.tcpPortForwardDialedDuration / time.Millisecond),
+		"tcp_port_forward_failed_count":                 metrics.tcpPortForwardFailedCount,
+		"tcp_port_forward_failed_duration":              int64(metrics.tcpPortForwardFailedDuration / time.Millisecond),
+		"tcp_port_forward_rejected_dialing_limit_count": metrics.tcpPortForwardRejectedDialingLimitCount,
+	}
+}
+
 type handshakeState struct {
 	completed             bool
 	apiProtocol           string
@@ -966,6 +1475,7 @@ type handshakeState struct {
 	authorizedAccessTypes []string
 	authorizationsRevoked bool
 	expectDomainBytes     bool
+	domainBytesRegexps    *transferstats.Regexps
 }
 
 func newSshClient(
@@ -978,14 +1488,18 @@ func newSshClient(
 	// unthrottled bytes during the initial protocol negotiation.
 
 	client := &sshClient{
-		sshServer:              sshServer,
-		tunnelProtocol:         tunnelProtocol,
-		geoIPData:              geoIPData,
-		isFirstTunnelInSession: true,
-		tcpPortForwardLRU:      common.NewLRUConns(),
-		signalIssueSLOKs:       make(chan struct{}, 1),
-		runCtx:                 runCtx,
-		stopRunning:            stopRunning,
+		sshServer:                     sshServer,
+		tunnelProtocol:                tunnelProtocol,
+		geoIPData:                     geoIPData,
+		isFirstTunnelInSession:        true,
+		tcpPortForwardLRU:             common.NewLRUConns(),
+		packetTunnelUDPPortForwardLRU: common.NewLRUConns(),
+		quotaPendingBytes:             new(int64),
+		connBytesUp:                   new(int64),
+		connBytesDown:                 new(int64),
+		signalIssueSLOKs:              make(chan struct{}, 1),
+		runCtx:                        runCtx,
+		stopRunning:                   stopRunning,
 	}
 
 	client.tcpTrafficState.availablePortForwardCond = sync.NewCond(new(sync.Mutex))
@@ -1016,12 +1530,19 @@ func (sshClient *sshClient) run(
 	// must actively use the connection or send SSH keep alive requests to keep
 	// the connection active. Writes are not considered reliable activity indicators
 	// due to buffering.
+	//
+	// The ActivityMonitoredConn also counts all bytes transferred, including
+	// protocol overhead, for traffic rules quotas and the admin API.
 
 	activityConn, err := common.NewActivityMonitoredConn(
 		clientConn,
 		SSH_CONNECTION_READ_DEADLINE,
 		false,
-		nil,
+		&clientBytesUpdater{
+			quotaBytes: sshClient.quotaPendingBytes,
+			bytesUp:    sshClient.connBytesUp,
+			bytesDown:  sshClient.connBytesDown,
+		},
 		nil)
 	if err != nil {
 		clientConn.Close()
@@ -1035,6 +1556,17 @@ func (sshClient *sshClient) run(
 	throttledConn := common.NewThrottledConn(clientConn, sshClient.rateLimits())
 	clientConn = throttledConn
 
+	// When server-wide bandwidth budgets are configured, further wrap the
+	// connection in a ScheduledConn, which fairly shares the budgets among
+	// all clients. All port forward and packet tunnel traffic is carried by
+	// this connection.
+
+	readBandwidthFlow, writeBandwidthFlow := sshClient.newBandwidthFlows()
+	if readBandwidthFlow != nil || writeBandwidthFlow != nil {
+		clientConn = common.NewScheduledConn(
+			clientConn, readBandwidthFlow, writeBandwidthFlow)
+	}
+
 	// Run the initial [obfuscated] SSH handshake in a goroutine so we can both
 	// respect shutdownBroadcast and implement a specific handshake timeout.
 	// The timeout is to reclaim network resources in case the handshake takes
@@ -1161,6 +1693,8 @@ func (sshClient *sshClient) run(
 	}
 	sshClient.logTunnel(additionalMetrics)
 
+	sshClient.logPacketTunnelDomainBytes()
+
 	// Transfer OSL seed state -- the OSL progress -- from the closing
 	// client to the session cache so the client can resume its progress
 	// if it reconnects to this same server.
@@ -1380,6 +1914,16 @@ func (sshClient *sshClient) runTunnel(
 		}()
 	}
 
+	// Start quota accounting
+
+	if sshClient.sshServer.support.QuotaStore != nil {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			sshClient.runQuotaUpdater()
+		}()
+	}
+
 	// Lifecycle of a TCP port forward:
 	//
 	// 1. A "direct-tcpip" SSH request is received from the client.
@@ -1569,7 +2113,11 @@ func (sshClient *sshClient) runTunnel(
 				return sshClient.isPortForwardPermitted(portForwardTypeUDP, false, upstreamIPAddress, port)
 			}
 
-			flowActivityUpdaterMaker := func(
+			checkAllowedDomainFunc := func(domain string) bool {
+				return sshClient.isDomainPermitted(portForwardTypeUDP, domain)
+			}
+
+			flowActivityUpdaterMaker := func(
 				upstreamHostname string, upstreamIPAddress net.IP) []tun.FlowActivityUpdater {
 
 				var updaters []tun.FlowActivityUpdater
@@ -1577,6 +2125,10 @@ func (sshClient *sshClient) runTunnel(
 				if oslUpdater != nil {
 					updaters = append(updaters, oslUpdater)
 				}
+				domainBytesUpdater := sshClient.newPacketTunnelDomainBytesUpdater(upstreamHostname)
+				if domainBytesUpdater != nil {
+					updaters = append(updaters, domainBytesUpdater)
+				}
 				return updaters
 			}
 
@@ -1592,13 +2144,38 @@ func (sshClient *sshClient) runTunnel(
 				sshClient.Unlock()
 			}
 
+			var flowDialer tun.FlowDialer
+
+			if sshClient.sshServer.support.Config.PacketTunnelUserspaceStack {
+
+				// In userspace stack mode, each flow is relayed through a port
+				// forward, which performs OSL seeding and bytes transferred
+				// accounting in place of the flow and metrics updaters. Domain
+				// bytes, which require the flow hostname, are still recorded
+				// by flow updaters.
+
+				flowActivityUpdaterMaker = func(
+					upstreamHostname string, _ net.IP) []tun.FlowActivityUpdater {
+
+					domainBytesUpdater := sshClient.newPacketTunnelDomainBytesUpdater(upstreamHostname)
+					if domainBytesUpdater == nil {
+						return nil
+					}
+					return []tun.FlowActivityUpdater{domainBytesUpdater}
+				}
+				metricUpdater = nil
+				flowDialer = sshClient.dialPacketTunnelFlow
+			}
+
 			err = sshClient.sshServer.support.PacketTunnelServer.ClientConnected(
 				sshClient.sessionID,
 				packetTunnelChannel,
 				checkAllowedTCPPortFunc,
 				checkAllowedUDPPortFunc,
+				checkAllowedDomainFunc,
 				flowActivityUpdaterMaker,
-				metricUpdater)
+				metricUpdater,
+				flowDialer)
 			if err != nil {
 				log.WithContextFields(LogFields{"error": err}).Warning("start packet tunnel client failed")
 				sshClient.setPacketTunnelChannel(nil)
@@ -1752,11 +2329,15 @@ func (sshClient *sshClient) logTunnel(additionalMetrics LogFields) {
 	logFields["peak_concurrent_dialing_port_forward_count_tcp"] = sshClient.tcpTrafficState.peakConcurrentDialingPortForwardCount
 	logFields["peak_concurrent_port_forward_count_tcp"] = sshClient.tcpTrafficState.peakConcurrentPortForwardCount
 	logFields["total_port_forward_count_tcp"] = sshClient.tcpTrafficState.totalPortForwardCount
+	logFields["blocked_domain_count_tcp"] = sshClient.tcpTrafficState.blockedDomainCount
 	logFields["bytes_up_udp"] = sshClient.udpTrafficState.bytesUp
 	logFields["bytes_down_udp"] = sshClient.udpTrafficState.bytesDown
 	// sshClient.udpTrafficState.peakConcurrentDialingPortForwardCount isn't meaningful
 	logFields["peak_concurrent_port_forward_count_udp"] = sshClient.udpTrafficState.peakConcurrentPortForwardCount
 	logFields["total_port_forward_count_udp"] = sshClient.udpTrafficState.totalPortForwardCount
+	logFields["blocked_domain_count_udp"] = sshClient.udpTrafficState.blockedDomainCount
+	logFields["quota_exhausted"] = sshClient.quotaRateLimits != nil
+	logFields["drain_signaled"] = sshClient.drainSignaled
 
 	// Pre-calculate a total-tunneled-bytes field. This total is used
 	// extensively in analytics and is more performant when pre-calculated.
@@ -1818,6 +2399,147 @@ func (sshClient *sshClient) runOSLSender() {
 	}
 }
 
+// runQuotaUpdater periodically records the client's bytes transferred in
+// the quota store and applies any quota exhaustion action. A final update
+// is made when the tunnel stops.
+func (sshClient *sshClient) runQuotaUpdater() {
+
+	ticker := time.NewTicker(QUOTA_UPDATE_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sshClient.updateQuotas()
+		case <-sshClient.runCtx.Done():
+			sshClient.updateQuotas()
+			return
+		}
+	}
+}
+
+// updateQuotas adds the client's pending bytes transferred to its usage
+// for each traffic rules quota and updates the quota status. When any
+// quota is exhausted, the client is throttled to the lowest
+// ExhaustedBytesPerSecond of the exhausted quotas; when that rate is 0,
+// the client is disconnected.
+//
+// Quota usage is not recorded until the handshake, when the quota key is
+// determined; bytes transferred before the handshake remain pending and
+// are recorded in the first update after the handshake. Bytes transferred
+// while the client has no quotas are not recorded.
+//
+// The usage is added to the quota store's pending usage, which the store
+// writes to its database periodically, for all clients in a single
+// transaction.
+func (sshClient *sshClient) updateQuotas() {
+
+	quotaStore := sshClient.sshServer.support.QuotaStore
+	if quotaStore == nil {
+		return
+	}
+
+	// updateQuotas is invoked both by runQuotaUpdater and the handshake;
+	// quotaUpdateMutex ensures that a stale quota status, from a concurrent
+	// update, doesn't overwrite a more recent status.
+
+	sshClient.quotaUpdateMutex.Lock()
+	defer sshClient.quotaUpdateMutex.Unlock()
+
+	sshClient.Lock()
+	quotaKey := sshClient.quotaKey
+	quotas := sshClient.trafficRules.Quotas
+	sshClient.Unlock()
+
+	if quotaKey == "" {
+		return
+	}
+
+	bytes := atomic.SwapInt64(sshClient.quotaPendingBytes, 0)
+
+	usage, err := quotaStore.AddUsage(quotaKey, quotas, bytes, time.Now())
+	if err != nil {
+		// Retain the pending bytes for the next update.
+		atomic.AddInt64(sshClient.quotaPendingBytes, bytes)
+		log.WithContextFields(LogFields{"error": err}).Warning("update quotas failed")
+		return
+	}
+
+	quotaStatus := make([]protocol.QuotaStatus, len(quotas))
+	var quotaRateLimits *common.RateLimits
+
+	for i, quota := range quotas {
+
+		remainingBytes := quota.Bytes - usage[i]
+		if remainingBytes < 0 {
+			remainingBytes = 0
+		}
+
+		quotaStatus[i] = protocol.QuotaStatus{
+			Period:         quota.Period,
+			Bytes:          quota.Bytes,
+			RemainingBytes: remainingBytes,
+		}
+
+		if remainingBytes > 0 {
+			continue
+		}
+
+		if quotaRateLimits == nil ||
+			quota.ExhaustedBytesPerSecond < quotaRateLimits.ReadBytesPerSecond {
+
+			quotaRateLimits = &common.RateLimits{
+				ReadBytesPerSecond:  quota.ExhaustedBytesPerSecond,
+				WriteBytesPerSecond: quota.ExhaustedBytesPerSecond,
+			}
+		}
+	}
+
+	// With CloseAfterExhausted set and no unthrottled bytes, the
+	// ThrottledConn closes on the next read or write.
+
+	if quotaRateLimits != nil && quotaRateLimits.ReadBytesPerSecond == 0 {
+		quotaRateLimits.CloseAfterExhausted = true
+	}
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	changed := (sshClient.quotaRateLimits == nil) != (quotaRateLimits == nil) ||
+		(quotaRateLimits != nil && *sshClient.quotaRateLimits != *quotaRateLimits)
+
+	sshClient.quotaStatus = quotaStatus
+	sshClient.quotaRateLimits = quotaRateLimits
+
+	if changed {
+
+		if quotaRateLimits != nil {
+			log.WithContextFields(
+				LogFields{
+					"sessionID":      sshClient.sessionID,
+					"bytesPerSecond": quotaRateLimits.ReadBytesPerSecond,
+				}).Debug("quota exhausted")
+		}
+
+		if sshClient.throttledConn != nil {
+			sshClient.throttledConn.SetLimits(sshClient.getRateLimits())
+		}
+	}
+}
+
+func (sshClient *sshClient) getQuotaStatus() []protocol.QuotaStatus {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	// Note: sshClient.quotaStatus is read-only once set; it's replaced, not
+	// modified, on each update.
+
+	if sshClient.quotaStatus == nil {
+		return make([]protocol.QuotaStatus, 0)
+	}
+	return sshClient.quotaStatus
+}
+
 // sendOSLRequest will invoke osl.GetSeedPayload to issue SLOKs and
 // generate a payload, and send an OSL request to the client when
 // there are new SLOKs in the payload.
@@ -1855,6 +2577,61 @@ func (sshClient *sshClient) sendOSLRequest() error {
 	return nil
 }
 
+// signalDraining sends a drain request to the client, which signals the
+// client to establish a replacement tunnel to another server. The request
+// is sent at most once, and only once the API handshake has completed.
+// signalDraining doesn't block.
+func (sshClient *sshClient) signalDraining() {
+
+	if !sshClient.supportsServerRequests {
+		return
+	}
+
+	sshClient.Lock()
+	send := sshClient.handshakeState.completed && !sshClient.drainSignaled
+	if send {
+		sshClient.drainSignaled = true
+	}
+	sshClient.Unlock()
+
+	if !send {
+		return
+	}
+
+	go func() {
+		_, _, err := sshClient.sshConn.SendRequest(
+			protocol.PSIPHON_API_DRAIN_REQUEST_NAME, false, nil)
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Warning("send drain request failed")
+		}
+	}()
+}
+
+func (sshClient *sshClient) getSummary() ClientSummary {
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	authorizedAccessTypes := sshClient.handshakeState.authorizedAccessTypes
+	if authorizedAccessTypes == nil {
+		authorizedAccessTypes = make([]string, 0)
+	}
+
+	return ClientSummary{
+		SessionID:             sshClient.sessionID,
+		TunnelProtocol:        sshClient.tunnelProtocol,
+		Region:                sshClient.geoIPData.Country,
+		ISP:                   sshClient.geoIPData.ISP,
+		HandshakeCompleted:    sshClient.handshakeState.completed,
+		AuthorizedAccessTypes: authorizedAccessTypes,
+		AuthorizationsRevoked: sshClient.handshakeState.authorizationsRevoked,
+		StartTime:             sshClient.activityConn.GetStartTime(),
+		Duration:              int64(sshClient.activityConn.GetActiveDuration() / time.Millisecond),
+		BytesUp:               atomic.LoadInt64(sshClient.connBytesUp),
+		BytesDown:             atomic.LoadInt64(sshClient.connBytesDown),
+	}
+}
+
 func (sshClient *sshClient) rejectNewChannel(newChannel ssh.NewChannel, logMessage string) {
 
 	// We always return the reject reason "Prohibited":
@@ -2022,12 +2799,33 @@ func (sshClient *sshClient) setHandshakeState(
 	sshClient.setTrafficRules()
 	sshClient.setOSLConfig()
 
+	// Once the quota key is set, record any bytes transferred so far and
+	// determine the quota status, which is returned in the handshake
+	// response.
+
+	// The session lineage of a multi-hop exit tunnel is the entry tunnel
+	// session, so that usage through any exit server is accounted to the
+	// same client session.
+
+	sessionLineageID := sshClient.sessionID
+	entrySessionID, err := getStringRequestParam(
+		state.apiParams, "multihop_entry_session_id")
+	if err == nil {
+		sessionLineageID = entrySessionID
+	}
+
+	sshClient.Lock()
+	sshClient.quotaKey = getQuotaKey(authorizationIDs, sessionLineageID)
+	sshClient.Unlock()
+
+	sshClient.updateQuotas()
+
 	return authorizationIDs, authorizedAccessTypes, nil
 }
 
 // getHandshaked returns whether the client has completed a handshake API
 // request and whether the traffic rules that were selected after the
-// handshake immediately exhaust the client.
+// handshake, or an exhausted quota, immediately exhaust the client.
 //
 // When the client is immediately exhausted it will be closed; but this
 // takes effect asynchronously. The "exhausted" return value is used to
@@ -2056,6 +2854,13 @@ func (sshClient *sshClient) getHandshaked() (bool, bool) {
 		exhausted = true
 	}
 
+	if completed &&
+		sshClient.quotaRateLimits != nil &&
+		sshClient.quotaRateLimits.CloseAfterExhausted {
+
+		exhausted = true
+	}
+
 	return completed, exhausted
 }
 
@@ -2073,19 +2878,49 @@ func (sshClient *sshClient) setTrafficRules() {
 	sshClient.Lock()
 	defer sshClient.Unlock()
 
-	sshClient.trafficRules = sshClient.sshServer.support.TrafficRulesSet.GetTrafficRules(
+	trafficRulesSet := sshClient.sshServer.support.TrafficRulesSet
+	conditions := sshClient.sshServer.getTrafficRulesConditions()
+
+	sshClient.trafficRules = trafficRulesSet.GetTrafficRules(
 		sshClient.isFirstTunnelInSession,
 		sshClient.tunnelProtocol,
 		sshClient.geoIPData,
-		sshClient.handshakeState)
+		sshClient.handshakeState,
+		conditions)
+
+	sshClient.trafficRulesConditionsSignature = trafficRulesSet.GetConditionsSignature(
+		conditions, sshClient.geoIPData.TimeZone)
 
 	if sshClient.throttledConn != nil {
 		// Any existing throttling state is reset.
-		sshClient.throttledConn.SetLimits(
-			sshClient.trafficRules.RateLimits.CommonRateLimits())
+		sshClient.throttledConn.SetLimits(sshClient.getRateLimits())
+	}
+
+	if sshClient.readBandwidthFlow != nil {
+		sshClient.readBandwidthFlow.SetWeight(*sshClient.trafficRules.BandwidthWeight)
+	}
+
+	if sshClient.writeBandwidthFlow != nil {
+		sshClient.writeBandwidthFlow.SetWeight(*sshClient.trafficRules.BandwidthWeight)
 	}
 }
 
+// trafficRulesConditionsChanged indicates whether the specified conditions
+// change the outcome of any load or time-of-day traffic rules filter for the
+// client, as compared to the conditions used to set the client's current
+// traffic rules.
+func (sshClient *sshClient) trafficRulesConditionsChanged(
+	conditions TrafficRulesConditions) bool {
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	signature := sshClient.sshServer.support.TrafficRulesSet.GetConditionsSignature(
+		conditions, sshClient.geoIPData.TimeZone)
+
+	return signature != sshClient.trafficRulesConditionsSignature
+}
+
 // setOSLConfig resets the client's OSL seed state based on the latest OSL config
 // As sshClient.oslClientSeedState may be reset by a concurrent goroutine,
 // oslClientSeedState must only be accessed within the sshClient mutex.
@@ -2148,6 +2983,109 @@ func (sshClient *sshClient) newClientSeedPortForward(ipAddress net.IP) *osl.Clie
 	return sshClient.oslClientSeedState.NewClientSeedPortForward(ipAddress)
 }
 
+// newPacketTunnelDomainBytesUpdater returns a flow activity updater which
+// records bytes transferred for the domain corresponding to the packet
+// tunnel flow hostname. As with port forward domain bytes, the domain is
+// determined by the sponsor's regexes, and no domain bytes are recorded
+// when there are no regexes.
+func (sshClient *sshClient) newPacketTunnelDomainBytesUpdater(
+	hostname string) tun.FlowActivityUpdater {
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	// Will not be initialized before handshake.
+	if !sshClient.handshakeState.expectDomainBytes {
+		return nil
+	}
+
+	domain := transferstats.RegexHostname(
+		hostname, sshClient.handshakeState.domainBytesRegexps)
+
+	if sshClient.packetTunnelDomainBytes == nil {
+		sshClient.packetTunnelDomainBytes = make(map[string]*int64)
+	}
+
+	bytes, ok := sshClient.packetTunnelDomainBytes[domain]
+	if !ok {
+		bytes = new(int64)
+		sshClient.packetTunnelDomainBytes[domain] = bytes
+	}
+
+	return &packetTunnelDomainBytesUpdater{bytes: bytes}
+}
+
+// takePacketTunnelDomainBytes returns and resets the packet tunnel domain
+// bytes counts. Domains with no bytes transferred are omitted.
+func (sshClient *sshClient) takePacketTunnelDomainBytes() map[string]int64 {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	domainBytes := make(map[string]int64)
+	for domain, bytes := range sshClient.packetTunnelDomainBytes {
+		value := atomic.SwapInt64(bytes, 0)
+		if value > 0 {
+			domainBytes[domain] = value
+		}
+	}
+
+	return domainBytes
+}
+
+// logPacketTunnelDomainBytes logs any packet tunnel domain bytes which
+// were not logged in a status request.
+func (sshClient *sshClient) logPacketTunnelDomainBytes() {
+
+	domainBytes := sshClient.takePacketTunnelDomainBytes()
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	for domain, bytes := range domainBytes {
+
+		logFields := getRequestLogFields(
+			"domain_bytes",
+			sshClient.geoIPData,
+			sshClient.handshakeState.authorizedAccessTypes,
+			sshClient.handshakeState.apiParams,
+			baseRequestParams)
+
+		logFields["domain"] = domain
+		logFields["bytes"] = bytes
+
+		log.LogRawFieldsWithTimestamp(logFields)
+	}
+}
+
+// packetTunnelDomainBytesUpdater is a tun.FlowActivityUpdater which
+// counts packet tunnel flow bytes for a domain.
+type packetTunnelDomainBytesUpdater struct {
+	bytes *int64
+}
+
+func (updater *packetTunnelDomainBytesUpdater) UpdateProgress(
+	upstreamBytes, downstreamBytes int64, _ int64) {
+
+	atomic.AddInt64(updater.bytes, upstreamBytes+downstreamBytes)
+}
+
+// clientBytesUpdater is a common.ActivityUpdater which counts bytes
+// transferred on the client connection for traffic rules quotas and for
+// admin API client summaries.
+type clientBytesUpdater struct {
+	quotaBytes *int64
+	bytesUp    *int64
+	bytesDown  *int64
+}
+
+func (updater *clientBytesUpdater) UpdateProgress(
+	bytesRead, bytesWritten int64, _ int64) {
+
+	atomic.AddInt64(updater.quotaBytes, bytesRead+bytesWritten)
+	atomic.AddInt64(updater.bytesUp, bytesRead)
+	atomic.AddInt64(updater.bytesDown, bytesWritten)
+}
+
 // getOSLSeedPayload returns a payload containing all seeded SLOKs for
 // this client's session.
 func (sshClient *sshClient) getOSLSeedPayload() *osl.SeedPayload {
@@ -2169,11 +3107,60 @@ func (sshClient *sshClient) clearOSLSeedPayload() {
 	sshClient.oslClientSeedState.ClearSeedPayload()
 }
 
+// newBandwidthFlows creates the client's flows in the server-wide
+// bandwidth schedulers, weighted by the current traffic rules. A nil flow
+// is returned for each direction without a scheduler.
+func (sshClient *sshClient) newBandwidthFlows() (*common.BandwidthFlow, *common.BandwidthFlow) {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	weight := *sshClient.trafficRules.BandwidthWeight
+
+	if sshClient.sshServer.readBandwidthScheduler != nil {
+		sshClient.readBandwidthFlow =
+			sshClient.sshServer.readBandwidthScheduler.NewFlow(weight)
+	}
+
+	if sshClient.sshServer.writeBandwidthScheduler != nil {
+		sshClient.writeBandwidthFlow =
+			sshClient.sshServer.writeBandwidthScheduler.NewFlow(weight)
+	}
+
+	return sshClient.readBandwidthFlow, sshClient.writeBandwidthFlow
+}
+
 func (sshClient *sshClient) rateLimits() common.RateLimits {
 	sshClient.Lock()
 	defer sshClient.Unlock()
 
-	return sshClient.trafficRules.RateLimits.CommonRateLimits()
+	return sshClient.getRateLimits()
+}
+
+// getRateLimits returns the traffic rules rate limits or, when a quota is
+// exhausted, the quota rate limits. Any lower traffic rules rate is
+// retained. The caller must hold the sshClient mutex.
+func (sshClient *sshClient) getRateLimits() common.RateLimits {
+
+	rateLimits := sshClient.trafficRules.RateLimits.CommonRateLimits()
+
+	if sshClient.quotaRateLimits == nil {
+		return rateLimits
+	}
+
+	quotaRateLimits := *sshClient.quotaRateLimits
+
+	if !quotaRateLimits.CloseAfterExhausted {
+		if rateLimits.ReadBytesPerSecond > 0 &&
+			rateLimits.ReadBytesPerSecond < quotaRateLimits.ReadBytesPerSecond {
+			quotaRateLimits.ReadBytesPerSecond = rateLimits.ReadBytesPerSecond
+		}
+		if rateLimits.WriteBytesPerSecond > 0 &&
+			rateLimits.WriteBytesPerSecond < quotaRateLimits.WriteBytesPerSecond {
+			quotaRateLimits.WriteBytesPerSecond = rateLimits.WriteBytesPerSecond
+		}
+	}
+
+	return quotaRateLimits
 }
 
 func (sshClient *sshClient) idleTCPPortForwardTimeout() time.Duration {
@@ -2223,6 +3210,20 @@ func (sshClient *sshClient) isPortForwardPermitted(
 		return false
 	}
 
+	// Disallow relaying to other Psiphon servers, as used by multi-hop
+	// tunnels, unless permitted by the traffic rules.
+	if !*sshClient.trafficRules.AllowPsiphonServerRelay &&
+		sshClient.sshServer.support.PsinetDatabase.IsServerIPAddress(remoteIP) {
+
+		log.WithContextFields(
+			LogFields{
+				"type": portForwardType,
+				"port": port,
+			}).Debug("port forward to Psiphon server denied by traffic rules")
+
+		return false
+	}
+
 	var allowPorts []int
 	if portForwardType == portForwardTypeTCP {
 		allowPorts = sshClient.trafficRules.AllowTCPPorts
@@ -2260,6 +3261,39 @@ func (sshClient *sshClient) isPortForwardPermitted(
 	return false
 }
 
+// isDomainPermitted checks the domain against the domain blocklists
+// selected by the client's traffic rules. Blocked domains are counted, for
+// logging, in the TCP or UDP traffic state according to portForwardType.
+func (sshClient *sshClient) isDomainPermitted(
+	portForwardType int, domain string) bool {
+
+	sshClient.Lock()
+	blocklistNames := sshClient.trafficRules.DomainBlocklists
+	sshClient.Unlock()
+
+	// Note: unlock before use is only safe as long as the traffic rules
+	// DomainBlocklists slice is read-only.
+
+	if !sshClient.sshServer.support.DomainBlocklists.IsBlocked(blocklistNames, domain) {
+		return true
+	}
+
+	sshClient.Lock()
+	if portForwardType == portForwardTypeTCP {
+		sshClient.tcpTrafficState.blockedDomainCount += 1
+	} else {
+		sshClient.udpTrafficState.blockedDomainCount += 1
+	}
+	sshClient.Unlock()
+
+	log.WithContextFields(
+		LogFields{
+			"type": portForwardType,
+		}).Debug("domain denied by traffic rules")
+
+	return false
+}
+
 func (sshClient *sshClient) isTCPDialingPortForwardLimitExceeded() bool {
 
 	sshClient.Lock()
@@ -2453,24 +3487,33 @@ func (sshClient *sshClient) updateQualityMetricsWithDialResult(
 	tcpPortForwardDialSuccess bool, dialDuration time.Duration) {
 
 	sshClient.Lock()
-	defer sshClient.Unlock()
-
-	if tcpPortForwardDialSuccess {
-		sshClient.qualityMetrics.tcpPortForwardDialedCount += 1
-		sshClient.qualityMetrics.tcpPortForwardDialedDuration += dialDuration
+	sshClient.qualityMetrics.addDialResult(tcpPortForwardDialSuccess, dialDuration)
+	tunnelProtocol := sshClient.tunnelProtocol
+	region := sshClient.geoIPData.Country
+	sshClient.Unlock()
 
-	} else {
-		sshClient.qualityMetrics.tcpPortForwardFailedCount += 1
-		sshClient.qualityMetrics.tcpPortForwardFailedDuration += dialDuration
-	}
+	sshClient.sshServer.updateQualityMetricsTotals(
+		tunnelProtocol,
+		region,
+		func(metrics *qualityMetrics) {
+			metrics.addDialResult(tcpPortForwardDialSuccess, dialDuration)
+		})
 }
 
 func (sshClient *sshClient) updateQualityMetricsWithRejectedDialingLimit() {
 
 	sshClient.Lock()
-	defer sshClient.Unlock()
+	sshClient.qualityMetrics.addRejectedDialingLimit()
+	tunnelProtocol := sshClient.tunnelProtocol
+	region := sshClient.geoIPData.Country
+	sshClient.Unlock()
 
-	sshClient.qualityMetrics.tcpPortForwardRejectedDialingLimitCount += 1
+	sshClient.sshServer.updateQualityMetricsTotals(
+		tunnelProtocol,
+		region,
+		func(metrics *qualityMetrics) {
+			metrics.addRejectedDialingLimit()
+		})
 }
 
 func (sshClient *sshClient) handleTCPChannel(
@@ -2508,6 +3551,19 @@ func (sshClient *sshClient) handleTCPChannel(
 		}
 	}
 
+	// Enforce the domain blocklists before resolving the hostname, so that
+	// blocked domains are not resolved.
+
+	if !isWebServerPortForward &&
+		net.ParseIP(hostToConnect) == nil &&
+		!sshClient.isDomainPermitted(portForwardTypeTCP, hostToConnect) {
+
+		// Note: not recording a port forward failure in this case
+
+		sshClient.rejectNewChannel(newChannel, "port forward not permitted")
+		return
+	}
+
 	// Dial the remote address.
 	//
 	// Hostname resolution is performed explicitly, as a separate step, as the target IP
@@ -2699,3 +3755,165 @@ func (sshClient *sshClient) handleTCPChannel(
 			"bytesUp":    atomic.LoadInt64(&bytesUp),
 			"bytesDown":  atomic.LoadInt64(&bytesDown)}).Debug("exiting")
 }
+
+// dialPacketTunnelFlow is the tun.FlowDialer used when the packet tunnel
+// server runs in userspace stack mode. Each packet tunnel TCP or UDP flow
+// is relayed through a port forward which is subject to the same limits,
+// LRU, idle timeouts, OSL seeding, and bytes transferred accounting as SSH
+// port forwards. Traffic rules for the flow destination are checked by the
+// packet tunnel server, via checkAllowedTCPPortFunc/checkAllowedUDPPortFunc.
+func (sshClient *sshClient) dialPacketTunnelFlow(
+	network string, upstreamIPAddress net.IP, port int) (net.Conn, error) {
+
+	remoteAddr := net.JoinHostPort(upstreamIPAddress.String(), strconv.Itoa(port))
+
+	var portForwardType int
+	var portForwardLRU *common.LRUConns
+	var idleTimeout time.Duration
+	var conn net.Conn
+	var err error
+
+	if network == "tcp" {
+
+		portForwardType = portForwardTypeTCP
+		portForwardLRU = sshClient.tcpPortForwardLRU
+		idleTimeout = sshClient.idleTCPPortForwardTimeout()
+
+		// Unlike SSH port forwards, packet tunnel flows are not queued when
+		// at the dialing limit. The flow is refused and the client may retry.
+
+		if sshClient.isTCPDialingPortForwardLimitExceeded() {
+			sshClient.updateQualityMetricsWithRejectedDialingLimit()
+			return nil, common.ContextError(errors.New("TCP dialing port forward limit exceeded"))
+		}
+
+		sshClient.dialingTCPPortForward()
+
+		log.WithContextFields(LogFields{"remoteAddr": remoteAddr}).Debug("dialing")
+
+		dialStartTime := monotime.Now()
+
+		ctx, cancelCtx := context.WithTimeout(
+			sshClient.runCtx,
+			time.Duration(sshClient.getDialTCPPortForwardTimeoutMilliseconds())*time.Millisecond)
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", remoteAddr)
+		cancelCtx() // "must be called or the new context will remain live until its parent context is cancelled"
+
+		// Record port forward success or failure
+		sshClient.updateQualityMetricsWithDialResult(err == nil, monotime.Since(dialStartTime))
+
+		if err != nil {
+			sshClient.abortedTCPPortForward()
+
+			// Monitor for low resource error conditions
+			sshClient.sshServer.monitorPortForwardDialError(err)
+
+			return nil, common.ContextError(err)
+		}
+
+	} else if network == "udp" {
+
+		portForwardType = portForwardTypeUDP
+		portForwardLRU = sshClient.packetTunnelUDPPortForwardLRU
+		idleTimeout = sshClient.idleUDPPortForwardTimeout()
+
+		log.WithContextFields(LogFields{"remoteAddr": remoteAddr}).Debug("dialing")
+
+		conn, err = net.Dial("udp", remoteAddr)
+		if err != nil {
+
+			// Monitor for low resource error conditions
+			sshClient.sshServer.monitorPortForwardDialError(err)
+
+			return nil, common.ContextError(err)
+		}
+
+	} else {
+		return nil, common.ContextError(fmt.Errorf("unsupported network: %s", network))
+	}
+
+	// establishedPortForward increments the concurrent port forward counter
+	// and closes the LRU existing port forward when already at the limit.
+	// For TCP, this releases the dialing slot.
+
+	sshClient.establishedPortForward(portForwardType, portForwardLRU)
+
+	lruEntry := portForwardLRU.Add(conn)
+
+	// Ensure nil interface if newClientSeedPortForward returns nil
+	var updater common.ActivityUpdater
+	seedUpdater := sshClient.newClientSeedPortForward(upstreamIPAddress)
+	if seedUpdater != nil {
+		updater = seedUpdater
+	}
+
+	activityConn, err := common.NewActivityMonitoredConn(
+		conn,
+		idleTimeout,
+		true,
+		updater,
+		lruEntry)
+	if err != nil {
+		lruEntry.Remove()
+		conn.Close()
+		sshClient.closedPortForward(portForwardType, 0, 0)
+		return nil, common.ContextError(err)
+	}
+
+	return &packetTunnelFlowConn{
+		Conn:            activityConn,
+		baseConn:        conn,
+		sshClient:       sshClient,
+		portForwardType: portForwardType,
+		lruEntry:        lruEntry,
+	}, nil
+}
+
+// packetTunnelFlowConn is the port forward conn for a packet tunnel flow.
+// packetTunnelFlowConn counts bytes transferred and, on Close, releases
+// the port forward.
+type packetTunnelFlowConn struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytesUp   int64
+	bytesDown int64
+	net.Conn
+	baseConn        net.Conn
+	sshClient       *sshClient
+	portForwardType int
+	lruEntry        *common.LRUConnsEntry
+	closeOnce       sync.Once
+}
+
+func (conn *packetTunnelFlowConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	atomic.AddInt64(&conn.bytesDown, int64(n))
+	return n, err
+}
+
+func (conn *packetTunnelFlowConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	atomic.AddInt64(&conn.bytesUp, int64(n))
+	return n, err
+}
+
+// CloseWrite half-closes a TCP port forward, relaying a client FIN.
+func (conn *packetTunnelFlowConn) CloseWrite() error {
+	if tcpConn, ok := conn.baseConn.(*net.TCPConn); ok {
+		return tcpConn.CloseWrite()
+	}
+	return nil
+}
+
+func (conn *packetTunnelFlowConn) Close() error {
+	err := conn.Conn.Close()
+	conn.closeOnce.Do(func() {
+		conn.lruEntry.Remove()
+		conn.sshClient.closedPortForward(
+			conn.portForwardType,
+			atomic.LoadInt64(&conn.bytesUp),
+			atomic.LoadInt64(&conn.bytesDown))
+	})
+	return err
+}
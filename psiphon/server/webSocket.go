@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/websocket"
+)
+
+// webSocketServer accepts WebSocket tunnel protocol connections. Each
+// WebSocket connection, after the HTTP/1.1 upgrade handshake, carries a
+// single client's obfuscated SSH stream in binary frames.
+//
+// The same server handles both fronted and unfronted WebSocket connections;
+// when fronted, the CDN is expected to relay the upgrade request and the
+// WebSocket stream.
+type webSocketServer struct {
+	support       *SupportServices
+	listener      net.Listener
+	clientHandler func(clientTunnelProtocol string, clientConn net.Conn)
+	openConns     *common.Conns
+	stopBroadcast <-chan struct{}
+}
+
+func serveWebSocketTransport(serveParams *TransportServeParameters) error {
+
+	tlsConfig, err := makeMeekTLSConfig(serveParams.Support, false)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	server := &webSocketServer{
+		support:       serveParams.Support,
+		listener:      serveParams.Listener,
+		clientHandler: serveParams.HandleClient,
+		openConns:     common.NewConns(),
+		stopBroadcast: serveParams.ShutdownBroadcast,
+	}
+
+	// The http.Server timeouts apply only to the upgrade request; Upgrade
+	// clears the deadlines before the connection is handed off to the SSH
+	// layer, which applies its own timeouts.
+
+	httpServer := &http.Server{
+		ReadTimeout:  MEEK_HTTP_CLIENT_IO_TIMEOUT,
+		WriteTimeout: MEEK_HTTP_CLIENT_IO_TIMEOUT,
+		Handler:      server,
+		ConnState:    server.httpConnStateCallback,
+
+		// Disable auto HTTP/2 (https://golang.org/doc/go1.6)
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+
+	// Note: Serve() will be interrupted by listener.Close() call
+	httpsServer := HTTPSServer{Server: httpServer}
+	err = httpsServer.ServeTLS(server.listener, tlsConfig)
+
+	// See the stopBroadcast comment in MeekServer.Run.
+	select {
+	case <-server.stopBroadcast:
+		err = nil
+	default:
+	}
+
+	server.listener.Close()
+	server.openConns.CloseAll()
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// ServeHTTP handles WebSocket upgrade requests. Upgraded connections are
+// passed to the client handler, which runs the SSH layer.
+func (server *webSocketServer) ServeHTTP(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	conn, err := websocket.Upgrade(responseWriter, request)
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Debug("upgrade failed")
+		return
+	}
+
+	// When a CDN relays the connection, the original client address may be
+	// available in a header such as X-Forwarded-For. As in meek, the client
+	// address is used for geolocation and stats.
+
+	var clientConn net.Conn = conn
+
+	for _, header := range server.support.Config.MeekProxyForwardedForHeaders {
+		value := request.Header.Get(header)
+		if len(value) > 0 {
+			// The first IP in a comma-separated list is the client IP.
+			proxyClientIP := strings.Split(value, ",")[0]
+			if net.ParseIP(proxyClientIP) != nil &&
+				server.support.GeoIPService.Lookup(proxyClientIP).Country != GEOIP_UNKNOWN_VALUE {
+
+				// The port value is a stub and is expected to be ignored.
+				clientConn = &webSocketProxiedConn{
+					Conn: conn,
+					remoteAddr: &net.TCPAddr{
+						IP:   net.ParseIP(proxyClientIP),
+						Port: 0,
+					},
+				}
+				break
+			}
+		}
+	}
+
+	server.clientHandler("", clientConn)
+}
+
+// httpConnStateCallback tracks open HTTPS connections which have not yet
+// been upgraded to WebSocket connections.
+func (server *webSocketServer) httpConnStateCallback(
+	conn net.Conn, connState http.ConnState) {
+
+	switch connState {
+	case http.StateNew:
+		server.openConns.Add(conn)
+	case http.StateHijacked, http.StateClosed:
+		server.openConns.Remove(conn)
+	}
+}
+
+// webSocketProxiedConn is a WebSocket connection relayed by a proxy or CDN.
+// RemoteAddr returns the original client address, as reported by the
+// proxy.
+type webSocketProxiedConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+func (conn *webSocketProxiedConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
@@ -200,8 +200,15 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return common.ContextError(err)
 	}
 
+	// The handshake response notices report the client region, home pages,
+	// and so on for the active tunnel. A multi-hop entry tunnel never becomes
+	// the active tunnel, and the exit tunnel handshake emits these notices.
+	emitNotices := !serverContext.tunnel.isMultiHopEntry
+
 	serverContext.clientRegion = handshakeResponse.ClientRegion
-	NoticeClientRegion(serverContext.clientRegion)
+	if emitNotices {
+		NoticeClientRegion(serverContext.clientRegion)
+	}
 
 	var serverEntries []protocol.ServerEntryFields
 
@@ -239,13 +246,16 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return common.ContextError(err)
 	}
 
-	NoticeHomepages(handshakeResponse.Homepages)
-
 	serverContext.clientUpgradeVersion = handshakeResponse.UpgradeClientVersion
-	if handshakeResponse.UpgradeClientVersion != "" {
-		NoticeClientUpgradeAvailable(handshakeResponse.UpgradeClientVersion)
-	} else {
-		NoticeClientIsLatestVersion("")
+
+	if emitNotices {
+		NoticeHomepages(handshakeResponse.Homepages)
+
+		if handshakeResponse.UpgradeClientVersion != "" {
+			NoticeClientUpgradeAvailable(handshakeResponse.UpgradeClientVersion)
+		} else {
+			NoticeClientIsLatestVersion("")
+		}
 	}
 
 	if !ignoreStatsRegexps {
@@ -263,7 +273,11 @@ func (serverContext *ServerContext) doHandshakeRequest(
 	serverContext.serverHandshakeTimestamp = handshakeResponse.ServerTimestamp
 	NoticeServerTimestamp(serverContext.serverHandshakeTimestamp)
 
-	NoticeActiveAuthorizationIDs(handshakeResponse.ActiveAuthorizationIDs)
+	if emitNotices {
+		NoticeActiveAuthorizationIDs(handshakeResponse.ActiveAuthorizationIDs)
+
+		NoticeQuotas(handshakeResponse.Quotas)
+	}
 
 	if doTactics && handshakeResponse.TacticsPayload != nil &&
 		networkID == serverContext.tunnel.config.networkIDGetter.GetNetworkID() {
@@ -668,12 +682,20 @@ func (serverContext *ServerContext) doPostRequest(
 }
 
 func (serverContext *ServerContext) getBaseAPIParameters() common.APIParameters {
-	return getBaseAPIParameters(
+	params := getBaseAPIParameters(
 		serverContext.tunnel.config,
 		serverContext.sessionId,
 		serverContext.tunnel.serverEntry,
 		serverContext.tunnel.protocol,
 		serverContext.tunnel.dialStats)
+
+	// For a multi-hop exit tunnel, report the entry tunnel session ID, which
+	// links the two hops in server-side stats.
+	if serverContext.tunnel.entryTunnel != nil {
+		params["multihop_entry_session_id"] = serverContext.tunnel.entryTunnel.sessionId
+	}
+
+	return params
 }
 
 // getBaseAPIParameters returns all the common API parameters that are
@@ -706,6 +728,12 @@ func getBaseAPIParameters(
 		params["device_region"] = config.DeviceRegion
 	}
 
+	isReplay := "0"
+	if dialStats.IsReplay {
+		isReplay = "1"
+	}
+	params["is_replay"] = isReplay
+
 	if dialStats.SelectedSSHClientVersion {
 		params["ssh_client_version"] = dialStats.SSHClientVersion
 	}
@@ -875,11 +903,25 @@ func HandleServerRequest(
 	switch name {
 	case protocol.PSIPHON_API_OSL_REQUEST_NAME:
 		return HandleOSLRequest(tunnelOwner, tunnel, payload)
+	case protocol.PSIPHON_API_DRAIN_REQUEST_NAME:
+		return HandleDrainRequest(tunnelOwner, tunnel)
 	}
 
 	return common.ContextError(fmt.Errorf("invalid request name: %s", name))
 }
 
+// HandleDrainRequest handles a request from a server which is draining in
+// preparation for shutting down. The tunnel owner is signaled to establish
+// a replacement tunnel to another server.
+func HandleDrainRequest(tunnelOwner TunnelOwner, tunnel *Tunnel) error {
+
+	NoticeInfo("server draining: %s", tunnel.serverEntry.IpAddress)
+
+	tunnelOwner.SignalTunnelDraining(tunnel)
+
+	return nil
+}
+
 func HandleOSLRequest(
 	tunnelOwner TunnelOwner, tunnel *Tunnel, payload []byte) error {
 
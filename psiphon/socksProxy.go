@@ -20,6 +20,8 @@
 package psiphon
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -33,12 +35,17 @@ import (
 // and, for each connection, establishes a port forward through
 // the tunnel SSH client and relays traffic through the port
 // forward.
+//
+// When Config.UdpgwServerAddress is set, SOCKS5 UDP ASSOCIATE is
+// also supported. UDP datagrams are relayed through a single udpgw
+// port forward shared by all associations.
 type SocksProxy struct {
 	tunneler               Tunneler
 	listener               *socks.SocksListener
 	serveWaitGroup         *sync.WaitGroup
 	openConns              *common.Conns
 	stopListeningBroadcast chan struct{}
+	udpgwClient            *udpgwClient
 }
 
 var _SOCKS_PROXY_TYPE = "SOCKS"
@@ -66,6 +73,9 @@ func NewSocksProxy(
 		openConns:              common.NewConns(),
 		stopListeningBroadcast: make(chan struct{}),
 	}
+	if config.UdpgwServerAddress != "" {
+		proxy.udpgwClient = newUdpgwClient(tunneler, config.UdpgwServerAddress)
+	}
 	proxy.serveWaitGroup.Add(1)
 	go proxy.serve()
 	NoticeListeningSocksProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
@@ -79,6 +89,9 @@ func (proxy *SocksProxy) Close() {
 	proxy.listener.Close()
 	proxy.serveWaitGroup.Wait()
 	proxy.openConns.CloseAll()
+	if proxy.udpgwClient != nil {
+		proxy.udpgwClient.Close()
+	}
 }
 
 func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err error) {
@@ -87,6 +100,10 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 
 	proxy.openConns.Add(localConn)
 
+	if localConn.Req.Command == socks.SocksCmdUDPAssociate {
+		return proxy.socksUDPAssociateHandler(localConn)
+	}
+
 	// Using downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
 	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
 	// open connection for data which will never arrive.
@@ -117,6 +134,199 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 	return nil
 }
 
+// socksUDPAssociateHandler handles a SOCKS5 UDP ASSOCIATE request. A local
+// UDP socket is opened to receive datagrams from the SOCKS client; each
+// datagram is relayed through the udpgw port forward. The association, and
+// all of its UDP flows, ends when the SOCKS TCP connection closes.
+//
+// Datagrams addressed to a domain name are dropped, as the udpgw protocol
+// supports only IP addresses and resolving the name locally would leak the
+// DNS request outside of the tunnel. Fragmented datagrams are also dropped;
+// fragmentation is optional for SOCKS servers.
+func (proxy *SocksProxy) socksUDPAssociateHandler(localConn *socks.SocksConn) error {
+
+	if proxy.udpgwClient == nil {
+		_ = localConn.RejectReason(socks.SocksRepCommandNotSupported)
+		return common.ContextError(errors.New("UDP ASSOCIATE is not enabled"))
+	}
+
+	// Listen on the same local IP that accepted the SOCKS TCP connection. Only
+	// datagrams from the SOCKS client's IP address are relayed.
+
+	localAddr, ok := localConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		_ = localConn.Reject()
+		return common.ContextError(errors.New("unexpected local address type"))
+	}
+
+	clientAddr, ok := localConn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		_ = localConn.Reject()
+		return common.ContextError(errors.New("unexpected remote address type"))
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP, Port: 0})
+	if err != nil {
+		_ = localConn.Reject()
+		return common.ContextError(err)
+	}
+	defer udpConn.Close()
+
+	err = localConn.GrantUDPAssociate(udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// The association lasts as long as the SOCKS TCP connection. Any data
+	// received on the TCP connection is discarded.
+
+	go func() {
+		buffer := make([]byte, 1)
+		for {
+			_, err := localConn.Read(buffer)
+			if err != nil {
+				break
+			}
+		}
+		udpConn.Close()
+	}()
+
+	var clientUDPAddrMutex sync.Mutex
+	var clientUDPAddr *net.UDPAddr
+
+	downstream := func(remoteIP net.IP, remotePort uint16, packet []byte) {
+
+		clientUDPAddrMutex.Lock()
+		addr := clientUDPAddr
+		clientUDPAddrMutex.Unlock()
+
+		if addr == nil {
+			return
+		}
+
+		datagram, err := makeSocksUDPDatagram(remoteIP, remotePort, packet)
+		if err != nil {
+			NoticeLocalProxyError(_SOCKS_PROXY_TYPE, common.ContextError(err))
+			return
+		}
+
+		_, err = udpConn.WriteToUDP(datagram, addr)
+		if err != nil {
+			// Debug since errors occur during normal operation, such as
+			// after the association is closed.
+			NoticeInfo("SOCKS UDP downstream write failed: %s", common.ContextError(err))
+		}
+	}
+
+	flows := make(map[string]*udpgwFlow)
+	defer func() {
+		for _, flow := range flows {
+			proxy.udpgwClient.closeFlow(flow)
+		}
+	}()
+
+	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+	for {
+		n, addr, err := udpConn.ReadFromUDP(buffer)
+		if err != nil {
+			// udpConn is closed when the SOCKS TCP connection closes.
+			break
+		}
+
+		if !addr.IP.Equal(clientAddr.IP) {
+			continue
+		}
+
+		clientUDPAddrMutex.Lock()
+		clientUDPAddr = addr
+		clientUDPAddrMutex.Unlock()
+
+		remoteIP, remotePort, packet, err := parseSocksUDPDatagram(buffer[:n])
+		if err != nil {
+			NoticeInfo("SOCKS UDP datagram dropped: %s", common.ContextError(err))
+			continue
+		}
+
+		flowKey := net.JoinHostPort(remoteIP.String(), fmt.Sprintf("%d", remotePort))
+		flow, ok := flows[flowKey]
+		if !ok {
+			flow, err = proxy.udpgwClient.openFlow(remoteIP, remotePort, downstream)
+			if err != nil {
+				NoticeLocalProxyError(_SOCKS_PROXY_TYPE, common.ContextError(err))
+				continue
+			}
+			flows[flowKey] = flow
+		}
+
+		err = proxy.udpgwClient.sendPacket(flow, packet)
+		if err != nil {
+			NoticeLocalProxyError(_SOCKS_PROXY_TYPE, common.ContextError(err))
+		}
+	}
+
+	return nil
+}
+
+// parseSocksUDPDatagram parses a SOCKS5 UDP request header, RFC 1928
+// section 7, and returns the destination address and payload. The returned
+// packet references memory in the input datagram.
+func parseSocksUDPDatagram(datagram []byte) (net.IP, uint16, []byte, error) {
+
+	// | 2 byte RSV | 1 byte FRAG | 1 byte ATYP | DST.ADDR | 2 byte DST.PORT | DATA |
+
+	if len(datagram) < 4 {
+		return nil, 0, nil, common.ContextError(errors.New("invalid datagram size"))
+	}
+
+	if datagram[2] != 0 {
+		return nil, 0, nil, common.ContextError(errors.New("unsupported fragment"))
+	}
+
+	var addressSize int
+	switch datagram[3] {
+	case 0x01:
+		addressSize = net.IPv4len
+	case 0x04:
+		addressSize = net.IPv6len
+	default:
+		return nil, 0, nil, common.ContextError(
+			fmt.Errorf("unsupported address type: 0x%02x", datagram[3]))
+	}
+
+	if len(datagram) < 4+addressSize+2 {
+		return nil, 0, nil, common.ContextError(errors.New("invalid datagram size"))
+	}
+
+	remoteIP := make(net.IP, addressSize)
+	copy(remoteIP, datagram[4:4+addressSize])
+	remotePort := binary.BigEndian.Uint16(datagram[4+addressSize : 6+addressSize])
+
+	return remoteIP, remotePort, datagram[6+addressSize:], nil
+}
+
+// makeSocksUDPDatagram prepends a SOCKS5 UDP request header, with the
+// specified source address, to the packet.
+func makeSocksUDPDatagram(remoteIP net.IP, remotePort uint16, packet []byte) ([]byte, error) {
+
+	addressType := byte(0x01)
+	address := remoteIP.To4()
+	if address == nil {
+		addressType = 0x04
+		address = remoteIP.To16()
+		if address == nil {
+			return nil, common.ContextError(errors.New("invalid remote IP"))
+		}
+	}
+
+	datagram := make([]byte, 4+len(address)+2+len(packet))
+	datagram[3] = addressType
+	copy(datagram[4:], address)
+	binary.BigEndian.PutUint16(datagram[4+len(address):], remotePort)
+	copy(datagram[6+len(address):], packet)
+
+	return datagram, nil
+}
+
 func (proxy *SocksProxy) serve() {
 	defer proxy.listener.Close()
 	defer proxy.serveWaitGroup.Done()
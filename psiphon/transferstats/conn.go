@@ -33,6 +33,8 @@ Assumption: Enough of the first HTTP will be present in the first Write() call
 import (
 	"net"
 	"sync/atomic"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
 
 // Conn is to be used as an intermediate link in a chain of net.Conn objects.
@@ -85,11 +87,11 @@ func (conn *Conn) Write(buffer []byte) (n int, err error) {
 
 		if conn.isRecordingHostBytes() && atomic.CompareAndSwapInt32(&conn.firstWrite, 1, 0) {
 
-			hostname, ok := getHostname(buffer)
-			if ok {
+			hostname := common.ExtractHostnameFromTCPFlow(buffer)
+			if hostname != "" {
 				// Get the hostname value that will be stored in stats by
 				// regexing the real hostname.
-				conn.hostname = regexHostname(hostname, conn.regexps)
+				conn.hostname = RegexHostname(hostname, conn.regexps)
 				atomic.StoreInt32(&conn.hostnameParsed, 1)
 			}
 		}
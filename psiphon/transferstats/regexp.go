@@ -67,9 +67,9 @@ func MakeRegexps(pageViewRegexes, httpsRequestRegexes []map[string]string) (rege
 	return
 }
 
-// regexHostname processes hostname through the given regexps and returns the
+// RegexHostname processes hostname through the given regexps and returns the
 // string that should be used for stats.
-func regexHostname(hostname string, regexps *Regexps) (statsHostname string) {
+func RegexHostname(hostname string, regexps *Regexps) (statsHostname string) {
 	statsHostname = "(OTHER)"
 	if regexps != nil {
 		for _, rr := range *regexps {
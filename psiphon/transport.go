@@ -0,0 +1,356 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
+)
+
+// ClientTransport is the client side of a tunnel protocol transport. A
+// ClientTransport establishes the base network connection, to a Psiphon
+// server, over which the (obfuscated) SSH layer runs.
+//
+// Dialing is split into two phases. MakeDialParameters selects the dial
+// parameters for the specified server entry; the resulting DialStats are
+// reported in a ConnectingServer notice before the dial begins. Dial then
+// establishes the connection.
+type ClientTransport struct {
+
+	// MakeDialParameters selects the dial parameters for a connection to
+	// the server.
+	MakeDialParameters func(
+		config *Config,
+		serverEntry *protocol.ServerEntry,
+		tunnelProtocol string,
+		sessionId string) (*TransportDialParameters, error)
+
+	// Dial establishes a connection to the server using the selected dial
+	// parameters. dialConfig is initialized by the caller, and includes
+	// any upstream proxy and device binding configuration.
+	Dial func(
+		ctx context.Context,
+		config *Config,
+		dialParams *TransportDialParameters,
+		dialConfig *DialConfig) (net.Conn, error)
+}
+
+// TransportDialParameters are the dial parameters selected by
+// ClientTransport.MakeDialParameters.
+type TransportDialParameters struct {
+	ServerEntry    *protocol.ServerEntry
+	TunnelProtocol string
+
+	// DialAddress is the host:port, or host, to dial.
+	DialAddress string
+
+	// MeekConfig is set for meek transports. When set, the dial config
+	// and dial stats are initialized with the meek parameters.
+	MeekConfig *MeekConfig
+
+	// SSHClientVersion, when not "", is the SSH client version string to
+	// send. It is reported in the dial stats.
+	SSHClientVersion string
+
+	// FragmentorCoinFlip is the FragmentorProbability coin flip outcome,
+	// which determines whether TCP transports use a FragmentorConn. It is
+	// selected by the caller, not by MakeDialParameters.
+	FragmentorCoinFlip bool
+
+	// Custom holds any additional, transport-specific, dial parameters.
+	Custom interface{}
+}
+
+var clientTransports = make(map[string]*ClientTransport)
+
+// RegisterClientTransport registers the client transport for the specified
+// tunnel protocol, which must already be registered with
+// protocol.RegisterTransport. RegisterClientTransport is not safe for
+// concurrent use and must be called from an init function.
+//
+// RegisterClientTransport panics if the tunnel protocol is not registered
+// or if a client transport is already registered for the tunnel protocol.
+func RegisterClientTransport(tunnelProtocol string, transport *ClientTransport) {
+
+	if protocol.GetTransport(tunnelProtocol) == nil {
+		panic(fmt.Sprintf("unregistered tunnel protocol: %s", tunnelProtocol))
+	}
+	if _, ok := clientTransports[tunnelProtocol]; ok {
+		panic(fmt.Sprintf("duplicate client transport: %s", tunnelProtocol))
+	}
+
+	clientTransports[tunnelProtocol] = transport
+}
+
+// GetClientTransport returns the client transport registered for the
+// specified tunnel protocol, or nil when there is none.
+func GetClientTransport(tunnelProtocol string) *ClientTransport {
+	return clientTransports[tunnelProtocol]
+}
+
+func init() {
+
+	RegisterClientTransport(
+		protocol.TUNNEL_PROTOCOL_SSH,
+		&ClientTransport{
+			MakeDialParameters: func(
+				config *Config,
+				serverEntry *protocol.ServerEntry,
+				tunnelProtocol string,
+				_ string) (*TransportDialParameters, error) {
+
+				return &TransportDialParameters{
+					ServerEntry:    serverEntry,
+					TunnelProtocol: tunnelProtocol,
+					DialAddress: net.JoinHostPort(
+						selectDialIPAddress(config, serverEntry),
+						strconv.Itoa(serverEntry.SshPort)),
+					SSHClientVersion: pickSSHClientVersion(),
+				}, nil
+			},
+			Dial: dialTCPTransport,
+		})
+
+	RegisterClientTransport(
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		&ClientTransport{
+			MakeDialParameters: makeObfuscatedSSHDialParameters,
+			Dial:               dialTCPTransport,
+		})
+
+	for _, tunnelProtocol := range []string{
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET,
+		protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+		protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP} {
+
+		RegisterClientTransport(
+			tunnelProtocol,
+			&ClientTransport{
+				MakeDialParameters: func(
+					config *Config,
+					serverEntry *protocol.ServerEntry,
+					tunnelProtocol string,
+					sessionId string) (*TransportDialParameters, error) {
+
+					meekConfig, err := initMeekConfig(
+						config, serverEntry, tunnelProtocol, sessionId)
+					if err != nil {
+						return nil, common.ContextError(err)
+					}
+
+					return &TransportDialParameters{
+						ServerEntry:    serverEntry,
+						TunnelProtocol: tunnelProtocol,
+						MeekConfig:     meekConfig,
+					}, nil
+				},
+				Dial: func(
+					ctx context.Context,
+					_ *Config,
+					dialParams *TransportDialParameters,
+					dialConfig *DialConfig) (net.Conn, error) {
+
+					return DialMeek(ctx, dialParams.MeekConfig, dialConfig)
+				},
+			})
+	}
+
+	for _, tunnelProtocol := range []string{
+		protocol.TUNNEL_PROTOCOL_FRONTED_WEBSOCKET,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_WEBSOCKET} {
+
+		RegisterClientTransport(
+			tunnelProtocol,
+			&ClientTransport{
+				MakeDialParameters: func(
+					config *Config,
+					serverEntry *protocol.ServerEntry,
+					tunnelProtocol string,
+					sessionId string) (*TransportDialParameters, error) {
+
+					meekConfig, err := initMeekConfig(
+						config, serverEntry, tunnelProtocol, sessionId)
+					if err != nil {
+						return nil, common.ContextError(err)
+					}
+
+					return &TransportDialParameters{
+						ServerEntry:    serverEntry,
+						TunnelProtocol: tunnelProtocol,
+						MeekConfig:     meekConfig,
+					}, nil
+				},
+				Dial: func(
+					ctx context.Context,
+					_ *Config,
+					dialParams *TransportDialParameters,
+					dialConfig *DialConfig) (net.Conn, error) {
+
+					return DialWebSocket(ctx, dialParams.MeekConfig, dialConfig)
+				},
+			})
+	}
+
+	RegisterClientTransport(
+		protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
+		&ClientTransport{
+			MakeDialParameters: func(
+				config *Config,
+				serverEntry *protocol.ServerEntry,
+				tunnelProtocol string,
+				_ string) (*TransportDialParameters, error) {
+
+				return &TransportDialParameters{
+					ServerEntry:    serverEntry,
+					TunnelProtocol: tunnelProtocol,
+					DialAddress: net.JoinHostPort(
+						selectDialIPAddress(config, serverEntry),
+						strconv.Itoa(serverEntry.SshObfuscatedQUICPort)),
+					Custom: fmt.Sprintf(
+						"%s:%d", common.GenerateHostName(), serverEntry.SshObfuscatedQUICPort),
+				}, nil
+			},
+			Dial: func(
+				ctx context.Context,
+				_ *Config,
+				dialParams *TransportDialParameters,
+				dialConfig *DialConfig) (net.Conn, error) {
+
+				packetConn, remoteAddr, err := NewUDPConn(
+					ctx,
+					dialParams.DialAddress,
+					dialConfig)
+				if err != nil {
+					return nil, common.ContextError(err)
+				}
+
+				// The Custom dial parameter is the QUIC SNI address.
+				return quic.Dial(
+					ctx,
+					packetConn,
+					remoteAddr,
+					dialParams.Custom.(string))
+			},
+		})
+
+	RegisterClientTransport(
+		protocol.TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH,
+		&ClientTransport{
+			MakeDialParameters: func(
+				_ *Config,
+				serverEntry *protocol.ServerEntry,
+				tunnelProtocol string,
+				_ string) (*TransportDialParameters, error) {
+
+				// Marionette servers listen only on the server entry IpAddress.
+				return &TransportDialParameters{
+					ServerEntry:    serverEntry,
+					TunnelProtocol: tunnelProtocol,
+					DialAddress:    serverEntry.IpAddress,
+				}, nil
+			},
+			Dial: func(
+				ctx context.Context,
+				_ *Config,
+				dialParams *TransportDialParameters,
+				dialConfig *DialConfig) (net.Conn, error) {
+
+				return marionette.Dial(
+					ctx,
+					NewNetDialer(dialConfig),
+					dialParams.ServerEntry.MarionetteFormat,
+					dialParams.DialAddress)
+			},
+		})
+
+	RegisterClientTransport(
+		protocol.TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH,
+		&ClientTransport{
+			MakeDialParameters: func(
+				_ *Config,
+				serverEntry *protocol.ServerEntry,
+				tunnelProtocol string,
+				_ string) (*TransportDialParameters, error) {
+
+				// TapDance servers listen only on the server entry IpAddress,
+				// so selectDialIPAddress, which may select the IPv6 address,
+				// isn't used.
+				return &TransportDialParameters{
+					ServerEntry:    serverEntry,
+					TunnelProtocol: tunnelProtocol,
+					DialAddress: net.JoinHostPort(
+						serverEntry.IpAddress,
+						strconv.Itoa(serverEntry.SshObfuscatedPort)),
+				}, nil
+			},
+			Dial: func(
+				ctx context.Context,
+				config *Config,
+				dialParams *TransportDialParameters,
+				dialConfig *DialConfig) (net.Conn, error) {
+
+				return tapdance.Dial(
+					ctx,
+					config.DataStoreDirectory,
+					NewNetDialer(dialConfig),
+					dialParams.DialAddress)
+			},
+		})
+}
+
+func makeObfuscatedSSHDialParameters(
+	config *Config,
+	serverEntry *protocol.ServerEntry,
+	tunnelProtocol string,
+	_ string) (*TransportDialParameters, error) {
+
+	return &TransportDialParameters{
+		ServerEntry:    serverEntry,
+		TunnelProtocol: tunnelProtocol,
+		DialAddress: net.JoinHostPort(
+			selectDialIPAddress(config, serverEntry),
+			strconv.Itoa(serverEntry.SshObfuscatedPort)),
+	}, nil
+}
+
+func dialTCPTransport(
+	ctx context.Context,
+	config *Config,
+	dialParams *TransportDialParameters,
+	dialConfig *DialConfig) (net.Conn, error) {
+
+	return DialTCPFragmentor(
+		ctx,
+		dialParams.DialAddress,
+		dialConfig,
+		dialParams.TunnelProtocol,
+		config.clientParameters,
+		&dialParams.FragmentorCoinFlip)
+}
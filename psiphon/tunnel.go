@@ -29,6 +29,7 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -36,13 +37,10 @@ import (
 	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 	regen "github.com/zach-klippenstein/goregen"
 )
@@ -72,16 +70,26 @@ type Tunneler interface {
 
 // TunnelOwner specifies the interface required by Tunnel to notify its
 // owner when it has failed. The owner may, as in the case of the Controller,
-// remove the tunnel from its list of active tunnels.
+// remove the tunnel from its list of active tunnels. The owner is also
+// notified when the tunnel's server is draining and the tunnel should be
+// replaced.
 type TunnelOwner interface {
 	SignalSeededNewSLOK()
 	SignalTunnelFailure(tunnel *Tunnel)
+	SignalTunnelDraining(tunnel *Tunnel)
 }
 
 // Tunnel is a connection to a Psiphon server. An established
 // tunnel includes a network connection to the specified server
 // and an SSH session built on top of that transport.
 type Tunnel struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	totalBytesSent             int64
+	totalBytesReceived         int64
+	activePortForwards         int64
+	totalPortForwards          int64
 	mutex                      *sync.Mutex
 	config                     *Config
 	isActivated                bool
@@ -101,8 +109,15 @@ type Tunnel struct {
 	totalPortForwardFailures   int
 	adjustedEstablishStartTime monotime.Time
 	establishDuration          time.Duration
+	connectDuration            time.Duration
 	establishedTime            monotime.Time
 	dialStats                  *DialStats
+	dialParams                 *DialParameters
+	entryTunnel                *Tunnel
+	isMultiHopEntry            bool
+	entryTunnelFailure         chan struct{}
+	entryTunnelDraining        chan struct{}
+	health                     *tunnelHealth
 }
 
 // DialStats records additional dial config that is sent to the server for
@@ -117,7 +132,10 @@ type Tunnel struct {
 // dial process has begun. The atomic.Value will contain a string, initialized
 // to "", and set to the resolved IP address once that part of the dial
 // process has completed.
+//
+// IsReplay indicates that stored DialParameters were replayed.
 type DialStats struct {
+	IsReplay                       bool
 	SelectedSSHClientVersion       bool
 	SSHClientVersion               string
 	UpstreamProxyType              string
@@ -143,6 +161,9 @@ type DialStats struct {
 // When requiredProtocol is not blank, that protocol is used. Otherwise,
 // the a random supported protocol is used.
 //
+// When replayDialParams is not nil, the stored dial parameters are replayed,
+// and are invalidated if the connection or activation fails.
+//
 // Call Activate on a connected tunnel to complete its establishment
 // before using.
 //
@@ -159,6 +180,7 @@ func ConnectTunnel(
 	sessionId string,
 	serverEntry *protocol.ServerEntry,
 	selectedProtocol string,
+	replayDialParams *DialParameters,
 	adjustedEstablishStartTime monotime.Time) (*Tunnel, error) {
 
 	if !serverEntry.SupportsProtocol(selectedProtocol) {
@@ -169,11 +191,21 @@ func ConnectTunnel(
 	// Build transport layers and establish SSH connection. Note that
 	// dialConn and monitoredConn are the same network connection.
 	dialResult, err := dialSsh(
-		ctx, config, serverEntry, selectedProtocol, sessionId)
+		ctx, config, serverEntry, selectedProtocol, sessionId, replayDialParams, nil)
 	if err != nil {
+
+		// Don't invalidate replayed dial parameters when the dial is
+		// interrupted, as when establishment stops.
+		if replayDialParams != nil && ctx.Err() == nil {
+			replayDialParams.Failed()
+		}
+
 		return nil, common.ContextError(err)
 	}
 
+	failureRateHalfLife := config.clientParameters.Get().Duration(
+		parameters.TunnelPoolFailureRateHalfLife)
+
 	// The tunnel is now connected
 	return &Tunnel{
 		mutex:             new(sync.Mutex),
@@ -189,9 +221,143 @@ func ConnectTunnel(
 		signalPortForwardFailure:   make(chan struct{}, 1),
 		adjustedEstablishStartTime: adjustedEstablishStartTime,
 		dialStats:                  dialResult.dialStats,
+		dialParams:                 dialResult.dialParams,
+		health:                     newTunnelHealth(failureRateHalfLife),
+	}, nil
+}
+
+// ConnectMultiHopTunnel extends a connected tunnel, to an entry server, into
+// a multi-hop tunnel. The entry tunnel is activated, performing a handshake
+// with the entry server, and an exit server is selected. A port forward to
+// the exit server's OSSH port is established through the entry tunnel, and
+// a second SSH session, to the exit server, is established over that port
+// forward.
+//
+// The returned tunnel is the exit tunnel, which is activated, and used for
+// port forwards, in the same way as any other connected tunnel. The exit
+// tunnel owns the entry tunnel: closing the exit tunnel closes the entry
+// tunnel, and entry tunnel failure is reported as exit tunnel failure.
+//
+// Unlike Activate, ConnectMultiHopTunnel is run concurrently by establish
+// workers, as the entry handshake is required to connect to the exit server.
+// As the entry tunnel never becomes an active tunnel, the entry handshake
+// doesn't emit the notices, such as ClientRegion and Homepages, that report
+// the handshake response for an active tunnel; the exit tunnel handshake
+// emits these notices.
+//
+// The exit tunnel has its own session ID, distinct from the entry tunnel
+// session ID, so that the exit server doesn't receive the session ID the
+// client presents to the entry server. The link between the two hops is
+// reported to the exit server in the separate multihop_entry_session_id API
+// parameter, for stats.
+//
+// On failure, the entry tunnel is closed.
+func ConnectMultiHopTunnel(
+	ctx context.Context,
+	entryTunnel *Tunnel,
+	tunnelOwner TunnelOwner) (exitTunnel *Tunnel, err error) {
+
+	defer func() {
+		if err != nil {
+			entryTunnel.Close(true)
+		}
+	}()
+
+	config := entryTunnel.config
+
+	if !entryTunnel.serverEntry.SupportsMultiHopRelay() {
+		return nil, common.ContextError(
+			errors.New("entry server does not support multi-hop relay"))
+	}
+
+	exitServerEntry, err := GetMultiHopExitServerEntry(config, entryTunnel.serverEntry)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if exitServerEntry == nil {
+		return nil, common.ContextError(errors.New("no multi-hop exit server"))
+	}
+
+	entryTunnelOwner := &multiHopEntryTunnelOwner{
+		tunnelOwner:    tunnelOwner,
+		signalFailure:  make(chan struct{}, 1),
+		signalDraining: make(chan struct{}, 1),
+	}
+
+	entryTunnel.isMultiHopEntry = true
+
+	err = entryTunnel.Activate(ctx, entryTunnelOwner)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	exitSessionId, err := MakeSessionId()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	selectedProtocol := protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH
+
+	dialResult, err := dialSsh(
+		ctx, config, exitServerEntry, selectedProtocol, exitSessionId, nil, entryTunnel)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	NoticeMultiHopTunnel(entryTunnel.serverEntry.IpAddress, exitServerEntry.IpAddress)
+
+	failureRateHalfLife := config.clientParameters.Get().Duration(
+		parameters.TunnelPoolFailureRateHalfLife)
+
+	return &Tunnel{
+		mutex:             new(sync.Mutex),
+		config:            config,
+		sessionId:         exitSessionId,
+		serverEntry:       exitServerEntry,
+		protocol:          selectedProtocol,
+		conn:              dialResult.monitoredConn,
+		sshClient:         dialResult.sshClient,
+		sshServerRequests: dialResult.sshRequests,
+		// A buffer allows at least one signal to be sent even when the receiver is
+		// not listening. Senders should not block.
+		signalPortForwardFailure:   make(chan struct{}, 1),
+		adjustedEstablishStartTime: entryTunnel.adjustedEstablishStartTime,
+		dialStats:                  dialResult.dialStats,
+		health:                     newTunnelHealth(failureRateHalfLife),
+		entryTunnel:                entryTunnel,
+		entryTunnelFailure:         entryTunnelOwner.signalFailure,
+		entryTunnelDraining:        entryTunnelOwner.signalDraining,
 	}, nil
 }
 
+// multiHopEntryTunnelOwner is the TunnelOwner for a multi-hop entry tunnel.
+// Entry tunnel failure is signaled to the exit tunnel, which then reports
+// its own failure to its owner. Entry server draining is likewise reported
+// as exit tunnel draining.
+type multiHopEntryTunnelOwner struct {
+	tunnelOwner    TunnelOwner
+	signalFailure  chan struct{}
+	signalDraining chan struct{}
+}
+
+func (owner *multiHopEntryTunnelOwner) SignalSeededNewSLOK() {
+	owner.tunnelOwner.SignalSeededNewSLOK()
+}
+
+func (owner *multiHopEntryTunnelOwner) SignalTunnelFailure(_ *Tunnel) {
+	select {
+	case owner.signalFailure <- *new(struct{}):
+	default:
+	}
+}
+
+func (owner *multiHopEntryTunnelOwner) SignalTunnelDraining(_ *Tunnel) {
+	select {
+	case owner.signalDraining <- *new(struct{}):
+	default:
+	}
+}
+
 // Activate completes the tunnel establishment, performing the handshake
 // request and starting operateTunnel, the worker that monitors the tunnel
 // and handles periodic management.
@@ -219,9 +385,10 @@ func (tunnel *Tunnel) Activate(
 		timeout := tunnel.config.clientParameters.Get().Duration(
 			parameters.PsiphonAPIRequestTimeout)
 
+		requestCtx := ctx
 		if timeout > 0 {
 			var cancelFunc context.CancelFunc
-			ctx, cancelFunc = context.WithTimeout(ctx, timeout)
+			requestCtx, cancelFunc = context.WithTimeout(ctx, timeout)
 			defer cancelFunc()
 		}
 
@@ -244,14 +411,21 @@ func (tunnel *Tunnel) Activate(
 
 		select {
 		case result = <-resultChannel:
-		case <-ctx.Done():
-			result.err = ctx.Err()
+		case <-requestCtx.Done():
+			result.err = requestCtx.Err()
 			// Interrupt the goroutine
 			tunnel.Close(true)
 			<-resultChannel
 		}
 
 		if result.err != nil {
+
+			// A handshake failure, including a timeout, invalidates replayed
+			// dial parameters, but an interruption by the caller does not.
+			if tunnel.dialParams != nil && ctx.Err() == nil {
+				tunnel.dialParams.Failed()
+			}
+
 			return common.ContextError(
 				fmt.Errorf("error starting server context for %s: %s",
 					tunnel.serverEntry.IpAddress, result.err))
@@ -295,6 +469,10 @@ func (tunnel *Tunnel) Activate(
 
 	tunnel.mutex.Unlock()
 
+	if tunnel.dialParams != nil {
+		tunnel.dialParams.Succeeded()
+	}
+
 	return nil
 }
 
@@ -338,6 +516,10 @@ func (tunnel *Tunnel) Close(isDiscarded bool) {
 		if err != nil {
 			NoticeAlert("close tunnel ssh error: %s", err)
 		}
+
+		if tunnel.entryTunnel != nil {
+			tunnel.entryTunnel.Close(isDiscarded)
+		}
 	}
 }
 
@@ -355,6 +537,14 @@ func (tunnel *Tunnel) IsDiscarded() bool {
 	return tunnel.isDiscarded
 }
 
+// GetTotalBytesTransferred returns the total bytes sent and received through
+// the tunnel. The totals are updated periodically, not on every read and
+// write.
+func (tunnel *Tunnel) GetTotalBytesTransferred() (int64, int64) {
+	return atomic.LoadInt64(&tunnel.totalBytesSent),
+		atomic.LoadInt64(&tunnel.totalBytesReceived)
+}
+
 // SendAPIRequest sends an API request as an SSH request through the tunnel.
 // This function blocks awaiting a response. Only one request may be in-flight
 // at once; a concurrent SendAPIRequest will block until an active request
@@ -416,6 +606,8 @@ func (tunnel *Tunnel) Dial(
 
 	result := <-resultChannel
 
+	tunnel.health.addPortForwardResult(result.err != nil)
+
 	if result.err != nil {
 		// TODO: conditional on type of error or error message?
 		select {
@@ -425,6 +617,9 @@ func (tunnel *Tunnel) Dial(
 		return nil, common.ContextError(result.err)
 	}
 
+	atomic.AddInt64(&tunnel.activePortForwards, 1)
+	atomic.AddInt64(&tunnel.totalPortForwards, 1)
+
 	conn = &TunneledConn{
 		Conn:           result.sshPortForwardConn,
 		tunnel:         tunnel,
@@ -494,6 +689,7 @@ type TunneledConn struct {
 	net.Conn
 	tunnel         *Tunnel
 	downstreamConn net.Conn
+	isClosed       int32
 }
 
 func (conn *TunneledConn) Read(buffer []byte) (n int, err error) {
@@ -523,6 +719,9 @@ func (conn *TunneledConn) Write(buffer []byte) (n int, err error) {
 }
 
 func (conn *TunneledConn) Close() error {
+	if atomic.CompareAndSwapInt32(&conn.isClosed, 0, 1) {
+		atomic.AddInt64(&conn.tunnel.activePortForwards, -1)
+	}
 	if conn.downstreamConn != nil {
 		conn.downstreamConn.Close()
 	}
@@ -571,8 +770,44 @@ func selectFrontingParameters(
 	return
 }
 
+// selectDialIPAddress selects which server entry IP address to dial. When
+// the server entry has an IPv6 address and the host has an IPv6 route, the
+// IPv6 address is selected when the host has no IPv4 route or, otherwise,
+// with IPv6DialProbability. When the IPv4 address is selected on an IPv6-only
+// network, the dial may still succeed via IPv6Synthesizer on NAT64 networks.
+func selectDialIPAddress(config *Config, serverEntry *protocol.ServerEntry) string {
+
+	if serverEntry.IpAddressV6 == "" {
+		return serverEntry.IpAddress
+	}
+
+	hasIPv4Route, hasIPv6Route := config.hasIPRoutes()
+
+	if !hasIPv6Route {
+		return serverEntry.IpAddress
+	}
+
+	if !hasIPv4Route ||
+		config.clientParameters.Get().WeightedCoinFlip(parameters.IPv6DialProbability) {
+
+		return serverEntry.IpAddressV6
+	}
+
+	return serverEntry.IpAddress
+}
+
+// formatHostHeaderIPAddress returns the IP address in the form used in a
+// HTTP Host header, which requires brackets around IPv6 addresses.
+func formatHostHeaderIPAddress(IPAddress string) string {
+	IP := net.ParseIP(IPAddress)
+	if IP != nil && IP.To4() == nil {
+		return "[" + IPAddress + "]"
+	}
+	return IPAddress
+}
+
 // initMeekConfig is a helper that creates a MeekConfig suitable for the
-// selected meek tunnel protocol.
+// selected meek or WebSocket tunnel protocol.
 func initMeekConfig(
 	config *Config,
 	serverEntry *protocol.ServerEntry,
@@ -619,8 +854,9 @@ func initMeekConfig(
 
 	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK:
 
-		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
-		hostname := serverEntry.IpAddress
+		dialIPAddress := selectDialIPAddress(config, serverEntry)
+		dialAddress = net.JoinHostPort(dialIPAddress, strconv.Itoa(serverEntry.MeekServerPort))
+		hostname := formatHostHeaderIPAddress(dialIPAddress)
 		if doMeekTransformHostName() {
 			hostname = common.GenerateHostName()
 			transformedHostName = true
@@ -634,20 +870,54 @@ func initMeekConfig(
 	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
 		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET:
 
-		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		dialIPAddress := selectDialIPAddress(config, serverEntry)
+		dialAddress = net.JoinHostPort(dialIPAddress, strconv.Itoa(serverEntry.MeekServerPort))
 		useHTTPS = true
 		if selectedProtocol == protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET {
 			useObfuscatedSessionTickets = true
 		}
-		SNIServerName = serverEntry.IpAddress
+		SNIServerName = dialIPAddress
 		if doMeekTransformHostName() {
 			SNIServerName = common.GenerateHostName()
 			transformedHostName = true
 		}
 		if serverEntry.MeekServerPort == 443 {
-			hostHeader = serverEntry.IpAddress
+			hostHeader = formatHostHeaderIPAddress(dialIPAddress)
+		} else {
+			hostHeader = dialAddress
+		}
+
+	case protocol.TUNNEL_PROTOCOL_FRONTED_WEBSOCKET:
+
+		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		dialAddress = fmt.Sprintf("%s:443", frontingAddress)
+		useHTTPS = true
+		if !serverEntry.MeekFrontingDisableSNI {
+			SNIServerName = frontingAddress
+			if doMeekTransformHostName() {
+				SNIServerName = common.GenerateHostName()
+				transformedHostName = true
+			}
+		}
+		hostHeader = frontingHost
+
+	case protocol.TUNNEL_PROTOCOL_UNFRONTED_WEBSOCKET:
+
+		dialIPAddress := selectDialIPAddress(config, serverEntry)
+		dialAddress = net.JoinHostPort(dialIPAddress, strconv.Itoa(serverEntry.WebSocketServerPort))
+		useHTTPS = true
+		SNIServerName = dialIPAddress
+		if doMeekTransformHostName() {
+			SNIServerName = common.GenerateHostName()
+			transformedHostName = true
+		}
+		if serverEntry.WebSocketServerPort == 443 {
+			hostHeader = formatHostHeaderIPAddress(dialIPAddress)
 		} else {
-			hostHeader = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+			hostHeader = dialAddress
 		}
 
 	default:
@@ -670,7 +940,8 @@ func initMeekConfig(
 
 	// Pin the TLS profile for the entire meek connection.
 	selectedTLSProfile := ""
-	if protocol.TunnelProtocolUsesMeekHTTPS(selectedProtocol) {
+	if protocol.TunnelProtocolUsesMeekHTTPS(selectedProtocol) ||
+		protocol.TunnelProtocolUsesWebSocket(selectedProtocol) {
 		selectedTLSProfile = SelectTLSProfile(
 			selectedProtocol,
 			config.clientParameters)
@@ -792,11 +1063,21 @@ type dialResult struct {
 	sshClient     *ssh.Client
 	sshRequests   <-chan *ssh.Request
 	dialStats     *DialStats
+	dialParams    *DialParameters
 }
 
 // dialSsh is a helper that builds the transport layers and establishes the SSH connection.
 // When additional dial configuration is used, DialStats are recorded and returned.
 //
+// When replayDialParams is not nil, the replayed dial parameters override
+// the newly selected dial parameters. The dial parameters that are used are
+// returned in the dialResult, to be stored on success; dial parameters are
+// not recorded when a NetworkIDGetter is not configured.
+//
+// When entryTunnel is not nil, the base transport is a port forward through
+// entryTunnel to the server entry's IP address; only OSSH is supported in
+// this case.
+//
 // The net.Conn return value is the value to be removed from pendingConns; additional
 // layering (ThrottledConn, ActivityMonitoredConn) is applied, but this return value is the
 // base dial conn. The *ActivityMonitoredConn return value is the layered conn passed into
@@ -806,13 +1087,16 @@ func dialSsh(
 	config *Config,
 	serverEntry *protocol.ServerEntry,
 	selectedProtocol,
-	sessionId string) (*dialResult, error) {
+	sessionId string,
+	replayDialParams *DialParameters,
+	entryTunnel *Tunnel) (*dialResult, error) {
 
 	p := config.clientParameters.Get()
 	timeout := p.Duration(parameters.TunnelConnectTimeout)
 	rateLimits := p.RateLimits(parameters.TunnelRateLimits)
 	obfuscatedSSHMinPadding := p.Int(parameters.ObfuscatedSSHMinPadding)
 	obfuscatedSSHMaxPadding := p.Int(parameters.ObfuscatedSSHMaxPadding)
+	fragmentorCoinFlip := p.WeightedCoinFlip(parameters.FragmentorProbability)
 	p = nil
 
 	var cancelFunc context.CancelFunc
@@ -824,48 +1108,64 @@ func dialSsh(
 
 	// Note: when SSHClientVersion is "", a default is supplied by the ssh package:
 	// https://godoc.org/golang.org/x/crypto/ssh#ClientConfig
-	var selectedSSHClientVersion bool
-	SSHClientVersion := ""
-	useObfuscatedSsh := false
-	var directDialAddress string
-	var quicDialSNIAddress string
-	var meekConfig *MeekConfig
+
+	clientTransport := GetClientTransport(selectedProtocol)
+	if clientTransport == nil {
+		return nil, common.ContextError(
+			fmt.Errorf("unsupported tunnel protocol: %s", selectedProtocol))
+	}
+
+	var dialParams *TransportDialParameters
 	var err error
 
-	switch selectedProtocol {
-	case protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, protocol.TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH:
-		useObfuscatedSsh = true
-		directDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedPort)
+	if entryTunnel != nil {
 
-	case protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH:
-		useObfuscatedSsh = true
-		directDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedQUICPort)
-		quicDialSNIAddress = fmt.Sprintf("%s:%d", common.GenerateHostName(), serverEntry.SshObfuscatedQUICPort)
+		if selectedProtocol != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+			return nil, common.ContextError(
+				fmt.Errorf("unsupported multi-hop tunnel protocol: %s", selectedProtocol))
+		}
 
-	case protocol.TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH:
-		useObfuscatedSsh = true
-		directDialAddress = serverEntry.IpAddress
+		// The entry server dials the exit server, so the local IPv6 route is
+		// not relevant.
+		dialParams = &TransportDialParameters{
+			ServerEntry:    serverEntry,
+			TunnelProtocol: selectedProtocol,
+			DialAddress: net.JoinHostPort(
+				serverEntry.IpAddress, strconv.Itoa(serverEntry.SshObfuscatedPort)),
+		}
 
-	case protocol.TUNNEL_PROTOCOL_SSH:
-		selectedSSHClientVersion = true
-		SSHClientVersion = pickSSHClientVersion()
-		directDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshPort)
+	} else {
 
-	default:
-		useObfuscatedSsh = true
-		meekConfig, err = initMeekConfig(config, serverEntry, selectedProtocol, sessionId)
+		dialParams, err = clientTransport.MakeDialParameters(
+			config, serverEntry, selectedProtocol, sessionId)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
+
+		dialParams.FragmentorCoinFlip = fragmentorCoinFlip
 	}
 
-	dialConfig, dialStats := initDialConfig(config, meekConfig)
+	if replayDialParams != nil {
+		replayDialParams.applyTransportDialParameters(dialParams)
+	}
+
+	// The meek transports dial their own TCP conns, and apply the selected,
+	// or replayed, fragmentor coin flip via the meek config.
+	if dialParams.MeekConfig != nil {
+		dialParams.MeekConfig.FragmentorCoinFlip = &dialParams.FragmentorCoinFlip
+	}
+
+	dialConfig, dialStats := initDialConfig(config, dialParams.MeekConfig)
+
+	if replayDialParams != nil {
+		replayDialParams.applyDialConfig(dialConfig, dialStats)
+	}
 
 	// Add dial stats specific to SSH dialing
 
-	if selectedSSHClientVersion {
+	if dialParams.SSHClientVersion != "" {
 		dialStats.SelectedSSHClientVersion = true
-		dialStats.SSHClientVersion = SSHClientVersion
+		dialStats.SSHClientVersion = dialParams.SSHClientVersion
 	}
 
 	// Note: dialStats.MeekResolvedIPAddress isn't set until the dial begins,
@@ -877,72 +1177,17 @@ func dialSsh(
 		selectedProtocol,
 		dialStats)
 
-	// Create the base transport: meek or direct connection
+	// Create the base transport: a port forward through the multi-hop entry
+	// tunnel, or a connection established by the protocol transport.
 
 	var dialConn net.Conn
-	if meekConfig != nil {
-
-		dialConn, err = DialMeek(
-			ctx,
-			meekConfig,
-			dialConfig)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
-
-	} else if protocol.TunnelProtocolUsesQUIC(selectedProtocol) {
-
-		packetConn, remoteAddr, err := NewUDPConn(
-			ctx,
-			directDialAddress,
-			dialConfig)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
-
-		dialConn, err = quic.Dial(
-			ctx,
-			packetConn,
-			remoteAddr,
-			quicDialSNIAddress)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
-
-	} else if protocol.TunnelProtocolUsesMarionette(selectedProtocol) {
-
-		dialConn, err = marionette.Dial(
-			ctx,
-			NewNetDialer(dialConfig),
-			serverEntry.MarionetteFormat,
-			directDialAddress)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
-
-	} else if protocol.TunnelProtocolUsesTapdance(selectedProtocol) {
-
-		dialConn, err = tapdance.Dial(
-			ctx,
-			config.DataStoreDirectory,
-			NewNetDialer(dialConfig),
-			directDialAddress)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
-
+	if entryTunnel != nil {
+		dialConn, err = entryTunnel.Dial(dialParams.DialAddress, true, nil)
 	} else {
-
-		dialConn, err = DialTCPFragmentor(
-			ctx,
-			directDialAddress,
-			dialConfig,
-			selectedProtocol,
-			config.clientParameters,
-			nil)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
+		dialConn, err = clientTransport.Dial(ctx, config, dialParams, dialConfig)
+	}
+	if err != nil {
+		return nil, common.ContextError(err)
 	}
 
 	// If dialConn is not a Closer, tunnel failure detection may be slower
@@ -972,7 +1217,7 @@ func dialSsh(
 
 	// Add obfuscated SSH layer
 	var sshConn net.Conn = throttledConn
-	if useObfuscatedSsh {
+	if protocol.TunnelProtocolUsesObfuscatedSSH(selectedProtocol) {
 		sshConn, err = obfuscator.NewObfuscatedSshConn(
 			obfuscator.OBFUSCATION_CONN_MODE_CLIENT,
 			throttledConn,
@@ -1015,7 +1260,7 @@ func dialSsh(
 			ssh.Password(string(payload)),
 		},
 		HostKeyCallback: sshCertChecker.CheckHostKey,
-		ClientVersion:   SSHClientVersion,
+		ClientVersion:   dialParams.SSHClientVersion,
 	}
 
 	if protocol.TunnelProtocolUsesObfuscatedSSH(selectedProtocol) {
@@ -1106,6 +1351,15 @@ func dialSsh(
 
 	cleanupConn = nil
 
+	// Multi-hop exit dial parameters are not recorded, as they are not
+	// selected by this client.
+	var resultDialParams *DialParameters
+	if replayDialParams != nil {
+		resultDialParams = replayDialParams
+	} else if entryTunnel == nil {
+		resultDialParams = makeDialParameters(config, dialParams, dialStats)
+	}
+
 	// Note: dialConn may be used to close the underlying network connection
 	// but should not be used to perform I/O as that would interfere with SSH
 	// (and also bypasses throttling).
@@ -1115,7 +1369,8 @@ func dialSsh(
 			monitoredConn: monitoredConn,
 			sshClient:     result.sshClient,
 			sshRequests:   result.sshRequests,
-			dialStats:     dialStats},
+			dialStats:     dialStats,
+			dialParams:    resultDialParams},
 		nil
 }
 
@@ -1274,6 +1529,8 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 			totalSent += sent
 			totalReceived += received
+			atomic.StoreInt64(&tunnel.totalBytesSent, totalSent)
+			atomic.StoreInt64(&tunnel.totalBytesReceived, totalReceived)
 
 			noticePeriod := clientParameters.Get().Duration(parameters.TotalBytesTransferredNoticePeriod)
 
@@ -1334,6 +1591,12 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 		case err = <-sshKeepAliveError:
 
+		case <-tunnel.entryTunnelFailure:
+			err = errors.New("multi-hop entry tunnel failed")
+
+		case <-tunnel.entryTunnelDraining:
+			tunnelOwner.SignalTunnelDraining(tunnel)
+
 		case serverRequest := <-tunnel.sshServerRequests:
 			if serverRequest != nil {
 				err := HandleServerRequest(tunnelOwner, tunnel, serverRequest.Type, serverRequest.Payload)
@@ -1359,6 +1622,8 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	sent, received := transferstats.ReportRecentBytesTransferredForServer(tunnel.serverEntry.IpAddress)
 	totalSent += sent
 	totalReceived += received
+	atomic.StoreInt64(&tunnel.totalBytesSent, totalSent)
+	atomic.StoreInt64(&tunnel.totalBytesReceived, totalReceived)
 
 	// Always emit a final NoticeTotalBytesTransferred
 	NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
@@ -1423,6 +1688,12 @@ func (tunnel *Tunnel) sendSshKeepAlive(isFirstKeepAlive bool, timeout time.Durat
 
 		errChannel <- err
 
+		// Record the keep alive round trip for the tunnel pool scheduler.
+		// Unlike speed test samples, all successful round trips are recorded.
+		if err == nil && requestOk {
+			tunnel.health.addRTTSample(elapsedTime)
+		}
+
 		// Record the keep alive round trip as a speed test sample. The first
 		// keep alive is always recorded, as many tunnels are short-lived and
 		// we want to ensure that some data is gathered. Subsequent keep
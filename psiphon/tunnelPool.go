@@ -0,0 +1,290 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+const (
+	// TUNNEL_HEALTH_SAMPLE_WEIGHT is the weight given to each new sample in
+	// the exponentially weighted moving averages of tunnel RTT and port
+	// forward failure rate.
+	TUNNEL_HEALTH_SAMPLE_WEIGHT = 0.25
+
+	// TUNNEL_POOL_MIN_WEIGHT_FACTOR ensures every selectable tunnel retains
+	// some small share of new flows, so that its health continues to be
+	// measured.
+	TUNNEL_POOL_MIN_WEIGHT_FACTOR = 0.01
+)
+
+// tunnelHealth records recent health measurements for a tunnel: the round
+// trip time of SSH keep alives, which are also the source of speed test
+// samples, and the failure rate of port forward dials. Both measurements
+// are exponentially weighted moving averages, so that the tunnel pool
+// scheduler responds to recent degradation.
+//
+// The failure rate also decays over time, halving every
+// failureRateHalfLife. Once a tunnel is degraded, the scheduler directs
+// few or no new port forwards to it, so port forward results alone would
+// rarely, if ever, restore the tunnel; with decay, the tunnel is retried
+// once its failures are no longer recent.
+//
+// now is the clock used to measure decay, and may be replaced for testing.
+type tunnelHealth struct {
+	mutex               sync.Mutex
+	hasRTT              bool
+	rtt                 time.Duration
+	failureRate         float64
+	failureRateTime     monotime.Time
+	failureRateHalfLife time.Duration
+	now                 func() monotime.Time
+}
+
+func newTunnelHealth(failureRateHalfLife time.Duration) *tunnelHealth {
+	return &tunnelHealth{
+		failureRateHalfLife: failureRateHalfLife,
+		now:                 monotime.Now,
+	}
+}
+
+// addRTTSample records an SSH keep alive round trip time.
+func (health *tunnelHealth) addRTTSample(rtt time.Duration) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	if !health.hasRTT {
+		health.hasRTT = true
+		health.rtt = rtt
+		return
+	}
+	health.rtt = time.Duration(
+		TUNNEL_HEALTH_SAMPLE_WEIGHT*float64(rtt) +
+			(1.0-TUNNEL_HEALTH_SAMPLE_WEIGHT)*float64(health.rtt))
+}
+
+// addPortForwardResult records the outcome of a port forward dial.
+func (health *tunnelHealth) addPortForwardResult(failed bool) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	health.decayFailureRate()
+	sample := 0.0
+	if failed {
+		sample = 1.0
+	}
+	health.failureRate =
+		TUNNEL_HEALTH_SAMPLE_WEIGHT*sample +
+			(1.0-TUNNEL_HEALTH_SAMPLE_WEIGHT)*health.failureRate
+}
+
+// get returns the current RTT and failure rate. hasRTT is false when no
+// keep alive has yet completed.
+func (health *tunnelHealth) get() (hasRTT bool, rtt time.Duration, failureRate float64) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	health.decayFailureRate()
+	return health.hasRTT, health.rtt, health.failureRate
+}
+
+// decayFailureRate applies the decay, since the previous call, to the
+// failure rate. The caller must hold the mutex.
+func (health *tunnelHealth) decayFailureRate() {
+	now := health.now()
+	if health.failureRate > 0 && health.failureRateHalfLife > 0 {
+		elapsed := now.Sub(health.failureRateTime)
+		health.failureRate *= math.Pow(
+			0.5, float64(elapsed)/float64(health.failureRateHalfLife))
+	}
+	health.failureRateTime = now
+}
+
+// TunnelUtilization is the per-tunnel utilization reported in the Tunnels
+// notice.
+type TunnelUtilization struct {
+	ServerIPAddress    string  `json:"serverIPAddress"`
+	Protocol           string  `json:"protocol"`
+	RTTMilliseconds    int64   `json:"rttMilliseconds"`
+	FailureRate        float64 `json:"failureRate"`
+	ActivePortForwards int64   `json:"activePortForwards"`
+	TotalPortForwards  int64   `json:"totalPortForwards"`
+	IsDegraded         bool    `json:"isDegraded"`
+}
+
+// tunnelPoolScheduler selects the tunnel to use for each new flow. Tunnels
+// are weighted by measured RTT and recent port forward failure rate, and
+// selected using smooth weighted round-robin, which spreads flows across
+// tunnels in proportion to their weights without bursts to any one tunnel.
+//
+// A tunnel is degraded when its failure rate exceeds
+// TunnelPoolDegradedFailureRate or when its RTT exceeds the best RTT in the
+// pool by a factor of TunnelPoolDegradedRTTMultiplier. New flows are not
+// assigned to degraded tunnels unless all tunnels are degraded. Existing
+// flows are not interrupted.
+//
+// tunnelPoolScheduler is not safe for concurrent use; the Controller calls
+// it while holding tunnelMutex.
+type tunnelPoolScheduler struct {
+	currentWeights map[*Tunnel]float64
+	degraded       map[*Tunnel]bool
+}
+
+func newTunnelPoolScheduler() *tunnelPoolScheduler {
+	return &tunnelPoolScheduler{
+		currentWeights: make(map[*Tunnel]float64),
+		degraded:       make(map[*Tunnel]bool),
+	}
+}
+
+// selectTunnel returns the tunnel to use for a new flow, or nil when there
+// are no tunnels. degradedChanged indicates that the set of degraded
+// tunnels has changed since the previous call.
+func (scheduler *tunnelPoolScheduler) selectTunnel(
+	tunnels []*Tunnel,
+	degradedFailureRate float64,
+	degradedRTTMultiplier float64) (selectedTunnel *Tunnel, degradedChanged bool) {
+
+	if len(tunnels) == 0 {
+		return nil, false
+	}
+
+	weights, degraded := scheduler.getWeights(
+		tunnels, degradedFailureRate, degradedRTTMultiplier)
+
+	for _, tunnel := range tunnels {
+		if degraded[tunnel] != scheduler.degraded[tunnel] {
+			degradedChanged = true
+		}
+	}
+	scheduler.degraded = degraded
+
+	allDegraded := true
+	for _, tunnel := range tunnels {
+		if !degraded[tunnel] {
+			allDegraded = false
+			break
+		}
+	}
+
+	totalWeight := 0.0
+	for _, tunnel := range tunnels {
+		if degraded[tunnel] && !allDegraded {
+			continue
+		}
+		weight := weights[tunnel]
+		totalWeight += weight
+		scheduler.currentWeights[tunnel] += weight
+		if selectedTunnel == nil ||
+			scheduler.currentWeights[tunnel] > scheduler.currentWeights[selectedTunnel] {
+			selectedTunnel = tunnel
+		}
+	}
+
+	scheduler.currentWeights[selectedTunnel] -= totalWeight
+
+	return selectedTunnel, degradedChanged
+}
+
+// getWeights calculates the selection weight and degraded state of each
+// tunnel. A tunnel's weight is inversely proportional to its RTT and is
+// scaled down by its failure rate. Tunnels with no RTT measurement yet are
+// assigned the best RTT in the pool, so that new tunnels receive flows and
+// are measured.
+func (scheduler *tunnelPoolScheduler) getWeights(
+	tunnels []*Tunnel,
+	degradedFailureRate float64,
+	degradedRTTMultiplier float64) (map[*Tunnel]float64, map[*Tunnel]bool) {
+
+	rtts := make(map[*Tunnel]time.Duration)
+	failureRates := make(map[*Tunnel]float64)
+
+	bestRTT := time.Duration(0)
+	for _, tunnel := range tunnels {
+		hasRTT, rtt, failureRate := tunnel.health.get()
+		if hasRTT {
+			if rtt < time.Millisecond {
+				rtt = time.Millisecond
+			}
+			rtts[tunnel] = rtt
+			if bestRTT == 0 || rtt < bestRTT {
+				bestRTT = rtt
+			}
+		}
+		failureRates[tunnel] = failureRate
+	}
+	if bestRTT == 0 {
+		bestRTT = time.Second
+	}
+
+	weights := make(map[*Tunnel]float64)
+	degraded := make(map[*Tunnel]bool)
+
+	for _, tunnel := range tunnels {
+
+		rtt, ok := rtts[tunnel]
+		if !ok {
+			rtt = bestRTT
+		}
+		failureRate := failureRates[tunnel]
+
+		weightFactor := 1.0 - failureRate
+		if weightFactor < TUNNEL_POOL_MIN_WEIGHT_FACTOR {
+			weightFactor = TUNNEL_POOL_MIN_WEIGHT_FACTOR
+		}
+
+		weights[tunnel] = weightFactor * float64(bestRTT) / float64(rtt)
+
+		degraded[tunnel] = failureRate > degradedFailureRate ||
+			float64(rtt) > degradedRTTMultiplier*float64(bestRTT)
+	}
+
+	return weights, degraded
+}
+
+// removeTunnel clears the scheduler state for a tunnel that has been
+// removed from the pool.
+func (scheduler *tunnelPoolScheduler) removeTunnel(tunnel *Tunnel) {
+	delete(scheduler.currentWeights, tunnel)
+	delete(scheduler.degraded, tunnel)
+}
+
+// getUtilization returns the utilization of each tunnel in the pool, for
+// reporting in the Tunnels notice.
+func (scheduler *tunnelPoolScheduler) getUtilization(
+	tunnels []*Tunnel) []*TunnelUtilization {
+
+	utilization := make([]*TunnelUtilization, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		_, rtt, failureRate := tunnel.health.get()
+		utilization = append(utilization, &TunnelUtilization{
+			ServerIPAddress:    tunnel.serverEntry.IpAddress,
+			Protocol:           tunnel.protocol,
+			RTTMilliseconds:    int64(rtt / time.Millisecond),
+			FailureRate:        failureRate,
+			ActivePortForwards: atomic.LoadInt64(&tunnel.activePortForwards),
+			TotalPortForwards:  atomic.LoadInt64(&tunnel.totalPortForwards),
+			IsDegraded:         scheduler.degraded[tunnel],
+		})
+	}
+	return utilization
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestTunnelPoolScheduler(t *testing.T) {
+
+	failureRateHalfLife := 1 * time.Minute
+
+	// The failure rate decay uses this fixed clock, which the test advances,
+	// so that failure rates are deterministic.
+	now := monotime.Time(0)
+	clock := func() monotime.Time { return now }
+
+	makeTunnel := func(index int, rtt time.Duration) *Tunnel {
+		tunnel := &Tunnel{
+			serverEntry: &protocol.ServerEntry{
+				IpAddress: fmt.Sprintf("192.168.0.%d", index),
+			},
+			health: newTunnelHealth(failureRateHalfLife),
+		}
+		tunnel.health.now = clock
+		if rtt > 0 {
+			tunnel.health.addRTTSample(rtt)
+		}
+		return tunnel
+	}
+
+	degradedFailureRate := 0.5
+	degradedRTTMultiplier := 3.0
+
+	selectTunnels := func(
+		scheduler *tunnelPoolScheduler,
+		tunnels []*Tunnel,
+		count int) (map[*Tunnel]int, bool) {
+
+		selections := make(map[*Tunnel]int)
+		anyDegradedChanged := false
+		for i := 0; i < count; i++ {
+			tunnel, degradedChanged := scheduler.selectTunnel(
+				tunnels, degradedFailureRate, degradedRTTMultiplier)
+			selections[tunnel] += 1
+			if degradedChanged {
+				anyDegradedChanged = true
+			}
+		}
+		return selections, anyDegradedChanged
+	}
+
+	scheduler := newTunnelPoolScheduler()
+
+	tunnel, _ := scheduler.selectTunnel(nil, degradedFailureRate, degradedRTTMultiplier)
+	if tunnel != nil {
+		t.Fatalf("unexpected tunnel selected from empty pool")
+	}
+
+	// Tunnels with equal health are selected round-robin.
+
+	tunnels := []*Tunnel{
+		makeTunnel(1, 100*time.Millisecond),
+		makeTunnel(2, 100*time.Millisecond),
+		makeTunnel(3, 0),
+	}
+
+	selections, degradedChanged := selectTunnels(scheduler, tunnels, 300)
+	for _, tunnel := range tunnels {
+		if selections[tunnel] != 100 {
+			t.Fatalf("unexpected selections for equal tunnels: %d", selections[tunnel])
+		}
+	}
+	if degradedChanged {
+		t.Fatalf("unexpected degraded change")
+	}
+
+	// Flows are distributed in inverse proportion to RTT.
+
+	scheduler = newTunnelPoolScheduler()
+	tunnels = []*Tunnel{
+		makeTunnel(1, 100*time.Millisecond),
+		makeTunnel(2, 200*time.Millisecond),
+	}
+
+	selections, _ = selectTunnels(scheduler, tunnels, 300)
+	if selections[tunnels[0]] != 200 || selections[tunnels[1]] != 100 {
+		t.Fatalf("unexpected selections for weighted tunnels: %d, %d",
+			selections[tunnels[0]], selections[tunnels[1]])
+	}
+
+	// New flows are migrated off tunnels degraded by high RTT.
+
+	for i := 0; i < 20; i++ {
+		tunnels[1].health.addRTTSample(time.Second)
+	}
+
+	selections, degradedChanged = selectTunnels(scheduler, tunnels, 100)
+	if selections[tunnels[0]] != 100 || !degradedChanged {
+		t.Fatalf("unexpected selections for degraded RTT tunnel: %d", selections[tunnels[0]])
+	}
+
+	utilization := scheduler.getUtilization(tunnels)
+	if utilization[0].IsDegraded || !utilization[1].IsDegraded {
+		t.Fatalf("unexpected utilization: %+v, %+v", utilization[0], utilization[1])
+	}
+
+	// New flows are migrated off tunnels degraded by port forward failures,
+	// and return once the failures decay, without any new port forward
+	// results for the degraded tunnel.
+
+	scheduler = newTunnelPoolScheduler()
+	tunnels = []*Tunnel{
+		makeTunnel(1, 100*time.Millisecond),
+		makeTunnel(2, 100*time.Millisecond),
+	}
+
+	expectedFailureRate := 0.0
+	for i := 0; i < 5; i++ {
+		tunnels[0].health.addPortForwardResult(true)
+		expectedFailureRate =
+			TUNNEL_HEALTH_SAMPLE_WEIGHT +
+				(1.0-TUNNEL_HEALTH_SAMPLE_WEIGHT)*expectedFailureRate
+	}
+
+	_, _, failureRate := tunnels[0].health.get()
+	if failureRate != expectedFailureRate {
+		t.Fatalf("unexpected failure rate: %f", failureRate)
+	}
+
+	selections, _ = selectTunnels(scheduler, tunnels, 100)
+	if selections[tunnels[1]] != 100 {
+		t.Fatalf("unexpected selections for failing tunnel: %d", selections[tunnels[1]])
+	}
+
+	// The failure rate halves every failureRateHalfLife.
+
+	now = now.Add(failureRateHalfLife)
+
+	_, _, failureRate = tunnels[0].health.get()
+	if failureRate != expectedFailureRate/2 {
+		t.Fatalf("unexpected decayed failure rate: %f", failureRate)
+	}
+
+	now = now.Add(3 * failureRateHalfLife)
+
+	_, _, failureRate = tunnels[0].health.get()
+	if failureRate != expectedFailureRate/16 {
+		t.Fatalf("unexpected decayed failure rate: %f", failureRate)
+	}
+
+	selections, degradedChanged = selectTunnels(scheduler, tunnels, 100)
+	if selections[tunnels[0]] == 0 || !degradedChanged {
+		t.Fatalf("unexpected selections for recovered tunnel: %d", selections[tunnels[0]])
+	}
+
+	// When all tunnels are degraded, all remain selectable.
+
+	for _, tunnel := range tunnels {
+		for i := 0; i < 5; i++ {
+			tunnel.health.addPortForwardResult(true)
+		}
+	}
+
+	selections, _ = selectTunnels(scheduler, tunnels, 100)
+	if selections[tunnels[0]] == 0 || selections[tunnels[1]] == 0 {
+		t.Fatalf("unexpected selections for all degraded tunnels: %d, %d",
+			selections[tunnels[0]], selections[tunnels[1]])
+	}
+}
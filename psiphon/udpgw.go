@@ -0,0 +1,374 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// udpgwClient is the client side of the udpgw protocol, which multiplexes
+// many UDP flows over a single port forward to the server's udpgw address.
+// The server intercepts port forwards to that address and handles the
+// protocol directly; see udpPortForwardMultiplexer in server/udp.go.
+//
+// The server retains only one udpgw port forward per client, so all UDP
+// flows, across all local consumers, must share a single udpgwClient.
+//
+// The port forward is dialed on demand, when the first packet is sent, and
+// redialed after a failure, such as when the tunnel is reestablished. Flow
+// state is retained across redials; the server will create new UDP port
+// forwards for existing flows as packets are sent.
+//
+// The server enforces traffic rules, including AllowUDPPorts and the UDP
+// port forward idle timeout, on each flow. The udpgw protocol has no error
+// response, so packets rejected by the server are silently dropped.
+type udpgwClient struct {
+	tunneler      Tunneler
+	serverAddress string
+	writeMutex    sync.Mutex
+	mutex         sync.Mutex
+	isClosed      bool
+	conn          net.Conn
+	nextConnID    uint16
+	flows         map[uint16]*udpgwFlow
+	workers       *sync.WaitGroup
+}
+
+// udpgwFlow is a single UDP flow, identified by a udpgw connection ID.
+// Downstream packets for the flow are delivered to the downstream callback.
+type udpgwFlow struct {
+	connID       uint16
+	remoteIP     net.IP
+	remotePort   uint16
+	downstream   func(remoteIP net.IP, remotePort uint16, packet []byte)
+	isNew        bool
+	lastActivity monotime.Time
+}
+
+const (
+	udpgwProtocolFlagKeepalive = 1 << 0
+	udpgwProtocolFlagRebind    = 1 << 1
+	udpgwProtocolFlagDNS       = 1 << 2
+	udpgwProtocolFlagIPv6      = 1 << 3
+
+	udpgwProtocolMaxPreambleSize = 23
+	udpgwProtocolMaxPayloadSize  = 32768
+	udpgwProtocolMaxMessageSize  = udpgwProtocolMaxPreambleSize + udpgwProtocolMaxPayloadSize
+
+	udpgwMaxFlows = 1 << 16
+)
+
+func newUdpgwClient(tunneler Tunneler, serverAddress string) *udpgwClient {
+	return &udpgwClient{
+		tunneler:      tunneler,
+		serverAddress: serverAddress,
+		flows:         make(map[uint16]*udpgwFlow),
+		workers:       new(sync.WaitGroup),
+	}
+}
+
+// Close closes the current udpgw port forward, if any, and waits for the
+// downstream relay to stop. All flows are discarded.
+func (client *udpgwClient) Close() {
+	client.mutex.Lock()
+	client.isClosed = true
+	if client.conn != nil {
+		client.conn.Close()
+		client.conn = nil
+	}
+	client.flows = make(map[uint16]*udpgwFlow)
+	client.mutex.Unlock()
+
+	client.workers.Wait()
+}
+
+// openFlow allocates a new flow to the specified remote address. When all
+// connection IDs are in use, the least recently active flow is evicted.
+func (client *udpgwClient) openFlow(
+	remoteIP net.IP,
+	remotePort uint16,
+	downstream func(remoteIP net.IP, remotePort uint16, packet []byte)) (*udpgwFlow, error) {
+
+	if remoteIP.To4() != nil {
+		remoteIP = remoteIP.To4()
+	} else if remoteIP.To16() == nil {
+		return nil, common.ContextError(errors.New("invalid remote IP"))
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.isClosed {
+		return nil, common.ContextError(errors.New("udpgw client is closed"))
+	}
+
+	if len(client.flows) >= udpgwMaxFlows {
+		var evict *udpgwFlow
+		for _, flow := range client.flows {
+			if evict == nil || flow.lastActivity.Before(evict.lastActivity) {
+				evict = flow
+			}
+		}
+		delete(client.flows, evict.connID)
+	}
+
+	for {
+		connID := client.nextConnID
+		client.nextConnID++
+		if _, ok := client.flows[connID]; ok {
+			continue
+		}
+
+		// isNew indicates that the first message for this flow should set
+		// the udpgw rebind flag. A connection ID may be reused after a flow
+		// is closed, while the server still retains a UDP port forward for
+		// the previous flow; the rebind flag instructs the server to discard
+		// that port forward.
+
+		flow := &udpgwFlow{
+			connID:       connID,
+			remoteIP:     remoteIP,
+			remotePort:   remotePort,
+			downstream:   downstream,
+			isNew:        true,
+			lastActivity: monotime.Now(),
+		}
+		client.flows[connID] = flow
+		return flow, nil
+	}
+}
+
+// closeFlow discards a flow. No message is sent to the server, as the
+// udpgw protocol has no close message; the server will close its UDP port
+// forward after an idle timeout.
+func (client *udpgwClient) closeFlow(flow *udpgwFlow) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.flows[flow.connID] == flow {
+		delete(client.flows, flow.connID)
+	}
+}
+
+// sendPacket sends an upstream UDP packet for the specified flow, dialing
+// the udpgw port forward when necessary.
+func (client *udpgwClient) sendPacket(flow *udpgwFlow, packet []byte) error {
+
+	if len(packet) > udpgwProtocolMaxPayloadSize {
+		return common.ContextError(errors.New("packet too large"))
+	}
+
+	conn, err := client.getConn()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	client.mutex.Lock()
+	flags := uint8(0)
+	if flow.isNew {
+		flags |= udpgwProtocolFlagRebind
+		flow.isNew = false
+	}
+	flow.lastActivity = monotime.Now()
+	client.mutex.Unlock()
+
+	message := make([]byte, 7+len(flow.remoteIP)+len(packet))
+
+	err = writeUdpgwPreamble(flags, flow.connID, flow.remoteIP, flow.remotePort, len(packet), message)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	copy(message[7+len(flow.remoteIP):], packet)
+
+	client.writeMutex.Lock()
+	_, err = conn.Write(message)
+	client.writeMutex.Unlock()
+
+	if err != nil {
+		// The downstream relay will complete cleanup.
+		conn.Close()
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// getConn returns the current udpgw port forward, dialing a new port forward
+// when there is none.
+func (client *udpgwClient) getConn() (net.Conn, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.isClosed {
+		return nil, common.ContextError(errors.New("udpgw client is closed"))
+	}
+
+	if client.conn != nil {
+		return client.conn, nil
+	}
+
+	// Always tunnel the udpgw port forward; the udpgw server address is
+	// only meaningful to the Psiphon server.
+
+	conn, err := client.tunneler.Dial(client.serverAddress, true, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	client.conn = conn
+
+	client.workers.Add(1)
+	go client.relayDownstream(conn)
+
+	return conn, nil
+}
+
+func (client *udpgwClient) relayDownstream(conn net.Conn) {
+	defer client.workers.Done()
+
+	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+	for {
+		connID, remoteIP, remotePort, packet, err := readUdpgwMessage(conn, buffer)
+		if err != nil {
+			if err != io.EOF {
+				NoticeAlert("udpgw downstream relay failed: %s", common.ContextError(err))
+			}
+			break
+		}
+
+		client.mutex.Lock()
+		flow := client.flows[connID]
+		if flow != nil {
+			flow.lastActivity = monotime.Now()
+		}
+		client.mutex.Unlock()
+
+		if flow == nil ||
+			!flow.remoteIP.Equal(remoteIP) ||
+			flow.remotePort != remotePort {
+
+			// The flow may have been closed or evicted, and the
+			// connection ID reused.
+			continue
+		}
+
+		flow.downstream(remoteIP, remotePort, packet)
+	}
+
+	conn.Close()
+
+	client.mutex.Lock()
+	if client.conn == conn {
+		client.conn = nil
+	}
+	client.mutex.Unlock()
+}
+
+// readUdpgwMessage reads the next non-keepalive udpgw message. The returned
+// packet references memory in the input buffer, which will be overwritten by
+// the next readUdpgwMessage call.
+func readUdpgwMessage(
+	reader io.Reader,
+	buffer []byte) (uint16, net.IP, uint16, []byte, error) {
+
+	// udpgw message layout:
+	//
+	// | 2 byte size | 3 byte header | 6 or 18 byte address | variable length packet |
+
+	for {
+		_, err := io.ReadFull(reader, buffer[0:2])
+		if err != nil {
+			if err != io.EOF {
+				err = common.ContextError(err)
+			}
+			return 0, nil, 0, nil, err
+		}
+
+		size := int(binary.LittleEndian.Uint16(buffer[0:2]))
+
+		if size < 3 || size > len(buffer)-2 {
+			return 0, nil, 0, nil, common.ContextError(errors.New("invalid udpgw message size"))
+		}
+
+		_, err = io.ReadFull(reader, buffer[2:2+size])
+		if err != nil {
+			return 0, nil, 0, nil, common.ContextError(err)
+		}
+
+		flags := buffer[2]
+		connID := binary.LittleEndian.Uint16(buffer[3:5])
+
+		if flags&udpgwProtocolFlagKeepalive == udpgwProtocolFlagKeepalive {
+			continue
+		}
+
+		addressSize := net.IPv4len
+		if flags&udpgwProtocolFlagIPv6 == udpgwProtocolFlagIPv6 {
+			addressSize = net.IPv6len
+		}
+
+		if size < 3+addressSize+2 {
+			return 0, nil, 0, nil, common.ContextError(errors.New("invalid udpgw message size"))
+		}
+
+		remoteIP := make(net.IP, addressSize)
+		copy(remoteIP, buffer[5:5+addressSize])
+		remotePort := binary.BigEndian.Uint16(buffer[5+addressSize : 7+addressSize])
+
+		return connID, remoteIP, remotePort, buffer[7+addressSize : 2+size], nil
+	}
+}
+
+// writeUdpgwPreamble writes a udpgw message header and address into buffer,
+// which must have room for the preamble, 7 bytes plus the address length.
+func writeUdpgwPreamble(
+	flags uint8,
+	connID uint16,
+	remoteIP net.IP,
+	remotePort uint16,
+	packetSize int,
+	buffer []byte) error {
+
+	if len(remoteIP) == net.IPv6len {
+		flags |= udpgwProtocolFlagIPv6
+	} else if len(remoteIP) != net.IPv4len {
+		return common.ContextError(errors.New("invalid remote IP"))
+	}
+
+	preambleSize := 7 + len(remoteIP)
+
+	if len(buffer) < preambleSize {
+		return common.ContextError(errors.New("invalid buffer size"))
+	}
+
+	binary.LittleEndian.PutUint16(buffer[0:2], uint16(preambleSize-2+packetSize))
+	buffer[2] = flags
+	binary.LittleEndian.PutUint16(buffer[3:5], connID)
+	copy(buffer[5:5+len(remoteIP)], remoteIP)
+	binary.BigEndian.PutUint16(buffer[5+len(remoteIP):preambleSize], remotePort)
+
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testUdpgwTunneler is a Tunneler which serves udpgw port forwards with an
+// in-process echo server: each upstream packet is returned downstream.
+type testUdpgwTunneler struct {
+	udpgwServerAddress string
+}
+
+func (t *testUdpgwTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	if remoteAddr != t.udpgwServerAddress {
+		return nil, errors.New("unexpected remote address")
+	}
+
+	clientConn, serverConn := net.Pipe()
+
+	go func() {
+		defer serverConn.Close()
+		buffer := make([]byte, udpgwProtocolMaxMessageSize)
+		for {
+			connID, remoteIP, remotePort, packet, err := readUdpgwMessage(serverConn, buffer)
+			if err != nil {
+				return
+			}
+			message := make([]byte, 7+len(remoteIP)+len(packet))
+			err = writeUdpgwPreamble(0, connID, remoteIP, remotePort, len(packet), message)
+			if err != nil {
+				return
+			}
+			copy(message[7+len(remoteIP):], packet)
+			_, err = serverConn.Write(message)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return clientConn, nil
+}
+
+func (t *testUdpgwTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return nil, errors.New("unsupported")
+}
+
+func (t *testUdpgwTunneler) SignalComponentFailure() {
+}
+
+func TestUdpgwMessages(t *testing.T) {
+
+	for _, remoteIP := range []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("2001:db8::1")} {
+
+		packet := []byte("udpgw test packet")
+		message := make([]byte, 7+len(remoteIP)+len(packet))
+		err := writeUdpgwPreamble(0, 1234, remoteIP, 53, len(packet), message)
+		if err != nil {
+			t.Fatalf("writeUdpgwPreamble failed: %s", err)
+		}
+		copy(message[7+len(remoteIP):], packet)
+
+		buffer := make([]byte, udpgwProtocolMaxMessageSize)
+		connID, readRemoteIP, readRemotePort, readPacket, err := readUdpgwMessage(
+			bytes.NewReader(message), buffer)
+		if err != nil {
+			t.Fatalf("readUdpgwMessage failed: %s", err)
+		}
+
+		if connID != 1234 ||
+			!readRemoteIP.Equal(remoteIP) ||
+			readRemotePort != 53 ||
+			!bytes.Equal(readPacket, packet) {
+
+			t.Fatalf("unexpected message: %d %s %d %x", connID, readRemoteIP, readRemotePort, readPacket)
+		}
+	}
+}
+
+func TestSocksUDPAssociate(t *testing.T) {
+
+	udpgwServerAddress := "127.0.0.1:7300"
+
+	config := &Config{
+		UdpgwServerAddress: udpgwServerAddress,
+	}
+
+	proxy, err := NewSocksProxy(
+		config, &testUdpgwTunneler{udpgwServerAddress: udpgwServerAddress}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// No authentication method
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	response := make([]byte, 2)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || response[1] != 0x00 {
+		t.Fatalf("unexpected method response: %x %v", response, err)
+	}
+
+	// UDP ASSOCIATE 0.0.0.0:0
+	_, err = conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	response = make([]byte, 10)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || response[1] != 0x00 || response[3] != 0x01 {
+		t.Fatalf("unexpected UDP ASSOCIATE response: %x %v", response, err)
+	}
+
+	relayAddr := &net.UDPAddr{
+		IP:   net.IP(response[4:8]),
+		Port: int(response[8])<<8 | int(response[9]),
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %s", err)
+	}
+	defer udpConn.Close()
+
+	udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	remoteIP := net.ParseIP("192.0.2.1")
+	packet := []byte("SOCKS UDP test packet")
+
+	datagram, err := makeSocksUDPDatagram(remoteIP, 53, packet)
+	if err != nil {
+		t.Fatalf("makeSocksUDPDatagram failed: %s", err)
+	}
+
+	_, err = udpConn.Write(datagram)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	buffer := make([]byte, 1024)
+	n, err := udpConn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	readRemoteIP, readRemotePort, readPacket, err := parseSocksUDPDatagram(buffer[:n])
+	if err != nil {
+		t.Fatalf("parseSocksUDPDatagram failed: %s", err)
+	}
+
+	if !readRemoteIP.Equal(remoteIP) ||
+		readRemotePort != 53 ||
+		!bytes.Equal(readPacket, packet) {
+
+		t.Fatalf("unexpected datagram: %s %d %x", readRemoteIP, readRemotePort, readPacket)
+	}
+}
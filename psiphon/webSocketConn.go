@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/websocket"
+	utls "github.com/Psiphon-Labs/utls"
+)
+
+// DialWebSocket establishes a WebSocket connection to a Psiphon server,
+// either directly or through a fronting CDN which relays WebSockets. The
+// returned net.Conn carries the obfuscated SSH stream in binary frames.
+//
+// DialWebSocket uses the TLS, SNI, and Host header parameters in the
+// MeekConfig initialized by initMeekConfig. Unlike meek, there are no
+// HTTP round trips after the handshake, and the meek cookie and
+// obfuscation keys are not used.
+func DialWebSocket(
+	ctx context.Context,
+	meekConfig *MeekConfig,
+	dialConfig *DialConfig) (net.Conn, error) {
+
+	tcpDialer := NewTCPFragmentorDialer(
+		dialConfig,
+		meekConfig.ClientTunnelProtocol,
+		meekConfig.ClientParameters,
+		meekConfig.FragmentorCoinFlip)
+
+	// As with meek, the server certificate is not verified; the tunneled
+	// SSH provides confidentiality and integrity. See the comment in
+	// DialMeek.
+
+	tlsConfig := &CustomTLSConfig{
+		ClientParameters:              meekConfig.ClientParameters,
+		DialAddr:                      meekConfig.DialAddress,
+		Dial:                          tcpDialer,
+		SNIServerName:                 meekConfig.SNIServerName,
+		SkipVerify:                    true,
+		TLSProfile:                    meekConfig.TLSProfile,
+		TrustedCACertificatesFilename: dialConfig.TrustedCACertificatesFilename,
+	}
+
+	// As DialAddr is set in the CustomTLSConfig, no address is required here.
+	conn, err := CustomTLSDial(ctx, "tcp", "", tlsConfig)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// The WebSocket upgrade is an HTTP/1.1 mechanism. The Psiphon server
+	// negotiates only "http/1.1", but a fronting CDN may select "h2" from
+	// the TLS profile's ALPN list.
+	if tlsConn, ok := conn.(*utls.UConn); ok {
+		state := tlsConn.ConnectionState()
+		if state.NegotiatedProtocolIsMutual &&
+			state.NegotiatedProtocol == "h2" {
+			conn.Close()
+			return nil, common.ContextError(errors.New("negotiated HTTP/2"))
+		}
+	}
+
+	host, _, err := net.SplitHostPort(meekConfig.DialAddress)
+	if err != nil {
+		conn.Close()
+		return nil, common.ContextError(err)
+	}
+
+	headers := http.Header{
+		"X-Psiphon-Fronting-Address": {host},
+	}
+	userAgent := dialConfig.CustomHeaders.Get("User-Agent")
+	if userAgent != "" {
+		headers.Set("User-Agent", userAgent)
+	}
+
+	// The handshake is interrupted when ctx is done.
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	handshakeDone := make(chan struct{})
+	interruptDone := make(chan struct{})
+	go func() {
+		defer close(interruptDone)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	webSocketConn, err := websocket.Client(
+		conn, meekConfig.HostHeader, "/", headers)
+
+	close(handshakeDone)
+	<-interruptDone
+
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, common.ContextError(err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return webSocketConn, nil
+}